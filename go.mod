@@ -7,11 +7,15 @@ require (
 	github.com/hashicorp/go-multierror v1.0.0
 	github.com/imdario/mergo v0.3.5
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/prometheus/client_golang v0.9.2
 	github.com/sacloud/libsacloud v1.27.1
+	github.com/spf13/cobra v0.0.0-20180319062004-c439c4fa0937
 	github.com/stretchr/testify v1.2.2
+	golang.org/x/time v0.0.0-20161028155119-f51c12702a4d
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
 	k8s.io/apiserver v0.0.0
+	k8s.io/client-go v0.0.0
 	k8s.io/cloud-provider v0.0.0
 	k8s.io/component-base v0.0.0
 	k8s.io/klog v0.3.1
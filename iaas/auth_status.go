@@ -1,7 +1,11 @@
 package iaas
 
-import "github.com/sacloud/libsacloud/sacloud"
+import (
+	"context"
 
-func (c *client) AuthStatus() (*sacloud.AuthStatus, error) {
-	return c.apiClient.ReadAuthStatus()
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+func (c *client) AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error) {
+	return c.apiClient.ReadAuthStatus(ctx)
 }
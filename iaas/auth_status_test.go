@@ -1,13 +1,15 @@
 package iaas
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestE2EAuthStatus(t *testing.T) {
-	res, err := testClient.AuthStatus()
+	skipIfNoAPIKey(t)
+	res, err := testClient.AuthStatus(context.Background())
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 }
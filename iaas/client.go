@@ -1,8 +1,11 @@
 package iaas
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/sacloud/libsacloud/api"
@@ -30,6 +33,7 @@ type LoadBalancerParam struct {
 	Name                 string
 	Description          string
 	Tags                 []string
+	RemoveTags           []string
 	RouterTags           []string
 	UseHA                bool
 	UseHighSpecPlan      bool
@@ -38,12 +42,32 @@ type LoadBalancerParam struct {
 	AssignIPAddressRange string
 	DefaultGateway       string
 	Type                 string
+	Adopted              bool
+	// ReservedVRIDRange is range of VRID which must not be used by LoadBalancer
+	ReservedVRIDRange *VRIDRange
+	// ExcludeIPAddresses is list of IP addresses or CIDR blocks which must not be assigned
+	ExcludeIPAddresses []string
+	// NetworkRecorded is true if type and selector of the network recorded to the LoadBalancer are same as this param,
+	// then LoadBalancerDrift doesn't look up the switch again
+	NetworkRecorded bool
 }
 
 func (l *LoadBalancerParam) hasVIP() bool {
 	return l.VIP == ""
 }
 
+// requiredIPs returns count of IP addresses required for creating LoadBalancer
+func (l *LoadBalancerParam) requiredIPs() int {
+	n := 2 // LoadBalancer + VIP
+	if l.UseHA {
+		n++
+	}
+	if l.VIP != "" {
+		n--
+	}
+	return n
+}
+
 func (l *LoadBalancerParam) assignAddresses() (net.IP, int, error) {
 	ip, assignNet, err := net.ParseCIDR(l.AssignIPAddressRange)
 	if err != nil {
@@ -55,21 +79,18 @@ func (l *LoadBalancerParam) assignAddresses() (net.IP, int, error) {
 	return ip, maskLen, nil
 }
 
-func (l *LoadBalancerParam) nwMaskLen() (int, error) {
-	_, lbNet, err := net.ParseCIDR(l.IPAddressRange)
-	if err != nil {
-		return -1, err
-	}
-	maskLen, _ := lbNet.Mask.Size()
-	return maskLen, nil
-}
-
 // VIPParam represents LoadBalancer VIP parameter for IaaS API
 type VIPParam struct {
 	Ports   []*VIPPorts
 	NodeIPs []string
-	VIP     string
-	Type    string
+	// DisabledNodeIPs are nodes being drained, their real servers are disabled instead of removed
+	DisabledNodeIPs []string
+	// SorryServer is IP address of server which responds when all real servers are down
+	SorryServer string
+	VIP         string
+	Type        string
+	// Owner is marker of VIP settings owned by the service when LoadBalancer is shared or adopted
+	Owner string
 }
 
 // VIPPorts represents LoadBalancer VIP port parameter for IaaS API
@@ -89,19 +110,39 @@ type HealthCheck struct {
 
 // Client IaaS API Client interface
 type Client interface {
-	AuthStatus() (*sacloud.AuthStatus, error)
-	LoadBalancers(tags ...string) ([]sacloud.LoadBalancer, error)
-	WaitForLBActive(id int64, waitTimeout time.Duration) error
-	CreateLoadBalancer(*LoadBalancerParam, *VIPParam, time.Duration) ([]string, error)
-	UpdateLoadBalancer(*sacloud.LoadBalancer, *LoadBalancerParam, *VIPParam) ([]string, error)
-	DeleteLoadBalancer(id int64, waitTimeout time.Duration) error
-	Servers() ([]sacloud.Server, error)
-	ShutdownServerByID(id int64, shutdownWait time.Duration) error
+	AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error)
+	LoadBalancers(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error)
+	LoadBalancer(ctx context.Context, id int64) (*sacloud.LoadBalancer, error)
+	WaitForLBActive(ctx context.Context, id int64, waitTimeout time.Duration) error
+	CreateLoadBalancer(ctx context.Context, lbParam *LoadBalancerParam, vipParam *VIPParam) (*sacloud.LoadBalancer, error)
+	UpdateLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, vipParam *VIPParam) ([]string, error)
+	DeleteLoadBalancer(ctx context.Context, id int64, waitTimeout time.Duration) error
+	RemoveLoadBalancerSettings(ctx context.Context, lb *sacloud.LoadBalancer, owner string) error
+	ReleaseLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, owner string, tags []string) error
+	RetainLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, tags []string) error
+	LoadBalancerDrift(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam) ([]string, error)
+	Servers(ctx context.Context) ([]sacloud.Server, error)
+	ShutdownServerByID(ctx context.Context, id int64, shutdownWait time.Duration) error
+	ExpandRouterSubnet(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, nwMaskLen int) (*sacloud.Subnet, error)
+	ReleaseRouterSubnets(ctx context.Context, lbParam *LoadBalancerParam) ([]*sacloud.Subnet, error)
+	MarkedSubnets(ctx context.Context, usedIPs []string, tags ...string) ([]*MarkedSubnet, error)
+	DeleteMarkedSubnet(ctx context.Context, subnet *MarkedSubnet, usedIPs []string) (bool, error)
+	AssignRoutedIP(ctx context.Context, lbParam *LoadBalancerParam, param *RoutedIPParam) (*RoutedIP, error)
+	ReleaseRoutedIP(ctx context.Context, lbParam *LoadBalancerParam, owner string) error
+	EnsureVPCRouterPortForwarding(ctx context.Context, lbParam *LoadBalancerParam, param *PortForwardingParam) (string, error)
+	RemoveVPCRouterPortForwarding(ctx context.Context, lbParam *LoadBalancerParam, owner string) error
+	PortForwardings(ctx context.Context, tags ...string) ([]*PortForwarding, error)
+	DeletePortForwarding(ctx context.Context, forwarding *PortForwarding) error
 	CurrentZone() string
+	SetReserver(reserver Reserver)
 }
 
 type client struct {
-	apiClient apiClient
+	apiClient   apiClient
+	reserver    Reserver
+	switchLocks sync.Map
+	// appliedStates are states of LoadBalancers whose config is applied by this process, by LoadBalancer ID
+	appliedStates sync.Map
 }
 
 // Config represents Iaas API Client configuration
@@ -114,6 +155,14 @@ type Config struct {
 	RetryIntervalSec  int
 	APIRootURL        string
 	TraceMode         bool
+
+	// RateLimit is number of requests per second, RateBurst is size of the token bucket
+	RateLimit float64
+	RateBurst int
+	// CircuitBreakerThreshold is number of consecutive 5xx or 429 responses to open the circuit breaker,
+	// CircuitBreakerCooldownSec is seconds to fail requests fast after it is opened
+	CircuitBreakerThreshold   int
+	CircuitBreakerCooldownSec int
 }
 
 // NewClient returns Iaas API Client instance
@@ -136,7 +185,14 @@ func NewClient(c *Config) (Client, error) {
 		api.SakuraCloudAPIRoot = c.APIRootURL
 	}
 
-	return &client{apiClient: newDefaultAPIClient(rawClient)}, nil
+	// shared by all clones of rawClient
+	rawClient.HTTPClient = &http.Client{Transport: newThrottledTransport(http.DefaultTransport, c)}
+
+	registerMetrics()
+	return &client{
+		apiClient: newInstrumentedAPIClient(rawClient),
+		reserver:  NewMemoryReserver(),
+	}, nil
 }
 
 func (c *client) getAPIClient() apiClient {
@@ -151,21 +207,31 @@ func (c *client) CurrentZone() string {
 type apiClient interface {
 	Clone() apiClient
 	Zone() string
-	ReadAuthStatus() (*sacloud.AuthStatus, error)
-	ReadSwitch(id int64) (*sacloud.Switch, error)
-	FindServers() ([]sacloud.Server, error)
-	FindLoadBalancers() ([]sacloud.LoadBalancer, error)
-	FindLoadBalancersByTags(tags ...string) ([]sacloud.LoadBalancer, error)
-	FindRoutersByTags(tags ...string) ([]sacloud.Internet, error)
-	FindSwitchesByTags(tags ...string) ([]sacloud.Switch, error)
-	FindVPCRouters() ([]sacloud.VPCRouter, error)
-	FindDatabases() ([]sacloud.Database, error)
-	ShutdownServer(id int64, shutdownWait time.Duration) error
-	WaitForLBActive(id int64, wait time.Duration) error
-	CreateLoadBalancer(value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error)
-	ApplyLoadBalancerConfig(id int64) error
-	UpdateLoadBalancer(id int64, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error)
-	DeleteLoadBalancer(id int64, waitTimeout time.Duration) error
+	ReadAuthStatus(ctx context.Context) (*sacloud.AuthStatus, error)
+	ReadSwitch(ctx context.Context, id int64) (*sacloud.Switch, error)
+	FindServers(ctx context.Context) ([]sacloud.Server, error)
+	ReadLoadBalancer(ctx context.Context, id int64) (*sacloud.LoadBalancer, error)
+	FindLoadBalancers(ctx context.Context) ([]sacloud.LoadBalancer, error)
+	FindLoadBalancersByTags(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error)
+	FindRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.Internet, error)
+	ReadRouter(ctx context.Context, id int64) (*sacloud.Internet, error)
+	UpdateRouter(ctx context.Context, id int64, value *sacloud.Internet) (*sacloud.Internet, error)
+	AddRouterSubnet(ctx context.Context, id int64, nwMaskLen int, nextHop string) (*sacloud.Subnet, error)
+	DeleteRouterSubnet(ctx context.Context, id int64, subnetID int64) error
+	UpdateRouterSubnet(ctx context.Context, id int64, subnetID int64, nextHop string) (*sacloud.Subnet, error)
+	FindSwitchesByTags(ctx context.Context, tags ...string) ([]sacloud.Switch, error)
+	FindVPCRouters(ctx context.Context) ([]sacloud.VPCRouter, error)
+	FindVPCRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.VPCRouter, error)
+	ReadVPCRouter(ctx context.Context, id int64) (*sacloud.VPCRouter, error)
+	UpdateVPCRouterSetting(ctx context.Context, id int64, value *sacloud.VPCRouter) (*sacloud.VPCRouter, error)
+	ApplyVPCRouterConfig(ctx context.Context, id int64) error
+	FindDatabases(ctx context.Context) ([]sacloud.Database, error)
+	ShutdownServer(ctx context.Context, id int64, shutdownWait time.Duration) error
+	WaitForLBActive(ctx context.Context, id int64, wait time.Duration) error
+	CreateLoadBalancer(ctx context.Context, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error)
+	ApplyLoadBalancerConfig(ctx context.Context, id int64) error
+	UpdateLoadBalancer(ctx context.Context, id int64, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error)
+	DeleteLoadBalancer(ctx context.Context, id int64, waitTimeout time.Duration) error
 }
 
 type defaultAPIClient struct {
@@ -176,6 +242,27 @@ func newDefaultAPIClient(rawClient *api.Client) *defaultAPIClient {
 	return &defaultAPIClient{rawClient: rawClient}
 }
 
+// contextTransport binds requests to ctx, since libsacloud doesn't accept context
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// withContext returns a clone of rawClient whose requests are canceled when ctx is done
+func (d *defaultAPIClient) withContext(ctx context.Context) *api.Client {
+	transport := http.DefaultTransport
+	if d.rawClient.HTTPClient != nil && d.rawClient.HTTPClient.Transport != nil {
+		transport = d.rawClient.HTTPClient.Transport
+	}
+	rawClient := d.rawClient.Clone()
+	rawClient.HTTPClient = &http.Client{Transport: &contextTransport{ctx: ctx, base: transport}}
+	return rawClient
+}
+
 func (d *defaultAPIClient) Clone() apiClient {
 	return newDefaultAPIClient(d.rawClient.Clone())
 }
@@ -184,32 +271,36 @@ func (d *defaultAPIClient) Zone() string {
 	return d.rawClient.Zone
 }
 
-func (d *defaultAPIClient) ReadAuthStatus() (*sacloud.AuthStatus, error) {
-	return d.rawClient.AuthStatus.Read()
+func (d *defaultAPIClient) ReadAuthStatus(ctx context.Context) (*sacloud.AuthStatus, error) {
+	return d.withContext(ctx).AuthStatus.Read()
 }
 
-func (d *defaultAPIClient) ReadSwitch(id int64) (*sacloud.Switch, error) {
-	return d.rawClient.Switch.Read(id)
+func (d *defaultAPIClient) ReadSwitch(ctx context.Context, id int64) (*sacloud.Switch, error) {
+	return d.withContext(ctx).Switch.Read(id)
 }
 
-func (d *defaultAPIClient) FindServers() ([]sacloud.Server, error) {
-	res, err := d.rawClient.Server.Reset().Limit(apiFindLimit).Find()
+func (d *defaultAPIClient) FindServers(ctx context.Context) ([]sacloud.Server, error) {
+	res, err := d.withContext(ctx).Server.Reset().Limit(apiFindLimit).Find()
 	if err != nil {
 		return nil, err
 	}
 	return res.Servers, nil
 }
 
-func (d *defaultAPIClient) FindLoadBalancers() ([]sacloud.LoadBalancer, error) {
-	res, err := d.rawClient.LoadBalancer.Reset().Limit(apiFindLimit).Find()
+func (d *defaultAPIClient) ReadLoadBalancer(ctx context.Context, id int64) (*sacloud.LoadBalancer, error) {
+	return d.withContext(ctx).LoadBalancer.Read(id)
+}
+
+func (d *defaultAPIClient) FindLoadBalancers(ctx context.Context) ([]sacloud.LoadBalancer, error) {
+	res, err := d.withContext(ctx).LoadBalancer.Reset().Limit(apiFindLimit).Find()
 	if err != nil {
 		return nil, err
 	}
 	return res.LoadBalancers, nil
 }
 
-func (d *defaultAPIClient) FindLoadBalancersByTags(tags ...string) ([]sacloud.LoadBalancer, error) {
-	finder := d.rawClient.LoadBalancer.Reset().Limit(apiFindLimit)
+func (d *defaultAPIClient) FindLoadBalancersByTags(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error) {
+	finder := d.withContext(ctx).LoadBalancer.Reset().Limit(apiFindLimit)
 	if len(tags) > 0 {
 		finder.WithTags(tags)
 	}
@@ -220,8 +311,8 @@ func (d *defaultAPIClient) FindLoadBalancersByTags(tags ...string) ([]sacloud.Lo
 	return res.LoadBalancers, nil
 }
 
-func (d *defaultAPIClient) FindRoutersByTags(tags ...string) ([]sacloud.Internet, error) {
-	finder := d.rawClient.Internet.Reset().Limit(apiFindLimit)
+func (d *defaultAPIClient) FindRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.Internet, error) {
+	finder := d.withContext(ctx).Internet.Reset().Limit(apiFindLimit)
 	if len(tags) > 0 {
 		finder.WithTags(tags)
 	}
@@ -232,8 +323,29 @@ func (d *defaultAPIClient) FindRoutersByTags(tags ...string) ([]sacloud.Internet
 	return res.Internet, nil
 }
 
-func (d *defaultAPIClient) FindSwitchesByTags(tags ...string) ([]sacloud.Switch, error) {
-	finder := d.rawClient.Switch.Reset().Limit(apiFindLimit)
+func (d *defaultAPIClient) ReadRouter(ctx context.Context, id int64) (*sacloud.Internet, error) {
+	return d.withContext(ctx).Internet.Read(id)
+}
+
+func (d *defaultAPIClient) UpdateRouter(ctx context.Context, id int64, value *sacloud.Internet) (*sacloud.Internet, error) {
+	return d.withContext(ctx).Internet.Update(id, value)
+}
+
+func (d *defaultAPIClient) AddRouterSubnet(ctx context.Context, id int64, nwMaskLen int, nextHop string) (*sacloud.Subnet, error) {
+	return d.withContext(ctx).Internet.AddSubnet(id, nwMaskLen, nextHop)
+}
+
+func (d *defaultAPIClient) DeleteRouterSubnet(ctx context.Context, id int64, subnetID int64) error {
+	_, err := d.withContext(ctx).Internet.DeleteSubnet(id, subnetID)
+	return err
+}
+
+func (d *defaultAPIClient) UpdateRouterSubnet(ctx context.Context, id int64, subnetID int64, nextHop string) (*sacloud.Subnet, error) {
+	return d.withContext(ctx).Internet.UpdateSubnet(id, subnetID, nextHop)
+}
+
+func (d *defaultAPIClient) FindSwitchesByTags(ctx context.Context, tags ...string) ([]sacloud.Switch, error) {
+	finder := d.withContext(ctx).Switch.Reset().Limit(apiFindLimit)
 	if len(tags) > 0 {
 		finder.WithTags(tags)
 	}
@@ -244,68 +356,142 @@ func (d *defaultAPIClient) FindSwitchesByTags(tags ...string) ([]sacloud.Switch,
 	return res.Switches, nil
 }
 
-func (d *defaultAPIClient) FindVPCRouters() ([]sacloud.VPCRouter, error) {
-	res, err := d.rawClient.VPCRouter.Reset().Limit(apiFindLimit).Find()
+func (d *defaultAPIClient) FindVPCRouters(ctx context.Context) ([]sacloud.VPCRouter, error) {
+	res, err := d.withContext(ctx).VPCRouter.Reset().Limit(apiFindLimit).Find()
+	if err != nil {
+		return nil, err
+	}
+	return res.VPCRouters, nil
+}
+
+func (d *defaultAPIClient) FindVPCRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.VPCRouter, error) {
+	finder := d.withContext(ctx).VPCRouter.Reset().Limit(apiFindLimit)
+	if len(tags) > 0 {
+		finder.WithTags(tags)
+	}
+	res, err := finder.Find()
 	if err != nil {
 		return nil, err
 	}
 	return res.VPCRouters, nil
 }
 
-func (d *defaultAPIClient) FindDatabases() ([]sacloud.Database, error) {
-	res, err := d.rawClient.Database.Reset().Limit(apiFindLimit).Find()
+func (d *defaultAPIClient) ReadVPCRouter(ctx context.Context, id int64) (*sacloud.VPCRouter, error) {
+	return d.withContext(ctx).VPCRouter.Read(id)
+}
+
+func (d *defaultAPIClient) UpdateVPCRouterSetting(ctx context.Context, id int64, value *sacloud.VPCRouter) (*sacloud.VPCRouter, error) {
+	return d.withContext(ctx).VPCRouter.UpdateSetting(id, value)
+}
+
+func (d *defaultAPIClient) ApplyVPCRouterConfig(ctx context.Context, id int64) error {
+	_, err := d.withContext(ctx).VPCRouter.Config(id)
+	return err
+}
+
+func (d *defaultAPIClient) FindDatabases(ctx context.Context) ([]sacloud.Database, error) {
+	res, err := d.withContext(ctx).Database.Reset().Limit(apiFindLimit).Find()
 	if err != nil {
 		return nil, err
 	}
 	return res.Databases, nil
 }
 
-func (d *defaultAPIClient) ShutdownServer(id int64, shutdownWait time.Duration) error {
-	if _, err := d.rawClient.Server.Shutdown(id); err != nil {
-		return err
+func (d *defaultAPIClient) ShutdownServer(ctx context.Context, id int64, shutdownWait time.Duration) error {
+	rawClient := d.withContext(ctx)
+	isDown := func() (bool, error) {
+		server, err := rawClient.Server.Read(id)
+		if err != nil {
+			return false, err
+		}
+		return server.IsDown(), nil
 	}
-	if err := d.rawClient.Server.SleepUntilDown(id, shutdownWait); err == nil {
-		return nil
+
+	if _, err := rawClient.Server.Shutdown(id); err != nil {
+		return err
 	}
-	if _, err := d.rawClient.Server.Stop(id); err != nil {
+	err := poll(ctx, shutdownWait, isDown)
+	if err == nil || ctx.Err() != nil {
 		return err
 	}
-	return d.rawClient.Server.SleepUntilDown(id, shutdownWait)
-}
-
-func (d *defaultAPIClient) WaitForLBActive(id int64, wait time.Duration) error {
-	if err := d.rawClient.LoadBalancer.SleepWhileCopying(id, wait, 20); err != nil {
+	if _, err := rawClient.Server.Stop(id); err != nil {
 		return err
 	}
-	if err := d.rawClient.LoadBalancer.SleepUntilUp(id, wait); err != nil {
+	return poll(ctx, shutdownWait, isDown)
+}
+
+// maxReadErrorsWhileCopying is number of errors tolerated while reading LoadBalancer just after it is created
+const maxReadErrorsWhileCopying = 20
+
+func (d *defaultAPIClient) WaitForLBActive(ctx context.Context, id int64, wait time.Duration) error {
+	rawClient := d.withContext(ctx)
+
+	readErrors := 0
+	err := poll(ctx, wait, func() (bool, error) {
+		lb, err := rawClient.LoadBalancer.Read(id)
+		if err != nil {
+			readErrors++
+			if readErrors < maxReadErrorsWhileCopying {
+				return false, nil
+			}
+			return false, err
+		}
+		if lb.IsFailed() {
+			return false, fmt.Errorf("LoadBalancer %d is failed", id)
+		}
+		return lb.IsAvailable(), nil
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+
+	return poll(ctx, wait, func() (bool, error) {
+		lb, err := rawClient.LoadBalancer.Read(id)
+		if err != nil {
+			return false, err
+		}
+		return lb.IsUp(), nil
+	})
 }
 
-func (d *defaultAPIClient) CreateLoadBalancer(value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
-	return d.rawClient.LoadBalancer.Create(value)
+func (d *defaultAPIClient) CreateLoadBalancer(ctx context.Context, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
+	return d.withContext(ctx).LoadBalancer.Create(value)
 }
 
-func (d *defaultAPIClient) ApplyLoadBalancerConfig(id int64) error {
-	_, err := d.rawClient.LoadBalancer.Config(id)
+func (d *defaultAPIClient) ApplyLoadBalancerConfig(ctx context.Context, id int64) error {
+	_, err := d.withContext(ctx).LoadBalancer.Config(id)
 	return err
 }
 
-func (d *defaultAPIClient) UpdateLoadBalancer(id int64, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
-	return d.rawClient.LoadBalancer.Update(id, value)
+func (d *defaultAPIClient) UpdateLoadBalancer(ctx context.Context, id int64, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
+	return d.withContext(ctx).LoadBalancer.Update(id, value)
 }
 
-func (d *defaultAPIClient) DeleteLoadBalancer(id int64, waitTimeout time.Duration) error {
-	_, err := d.rawClient.LoadBalancer.Stop(id)
+func (d *defaultAPIClient) DeleteLoadBalancer(ctx context.Context, id int64, waitTimeout time.Duration) error {
+	rawClient := d.withContext(ctx)
+	lb, err := rawClient.LoadBalancer.Read(id)
 	if err != nil {
 		return err
 	}
-	err = d.rawClient.LoadBalancer.SleepUntilDown(id, waitTimeout)
-	if err != nil {
-		return err
+
+	// failed or half-booted LoadBalancer can't be stopped
+	if lb.IsUp() {
+		_, err = rawClient.LoadBalancer.Stop(id)
+		if err != nil {
+			return err
+		}
+		err = poll(ctx, waitTimeout, func() (bool, error) {
+			lb, err := rawClient.LoadBalancer.Read(id)
+			if err != nil {
+				return false, err
+			}
+			return lb.IsDown(), nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = d.rawClient.LoadBalancer.Delete(id)
+	_, err = rawClient.LoadBalancer.Delete(id)
 	return err
 }
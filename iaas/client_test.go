@@ -0,0 +1,203 @@
+package iaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+// testAPIClient is in-memory fake of SAKURA Cloud API.
+// It sleeps while creating LoadBalancer to widen race windows.
+type testAPIClient struct {
+	apiClient
+	mu            sync.Mutex
+	sw            *sacloud.Switch
+	loadBalancers []sacloud.LoadBalancer
+	vpcRouters    []sacloud.VPCRouter
+	// loadBalancerUpdates and loadBalancerApplies are count of updating LoadBalancer and applying its config
+	loadBalancerUpdates int
+	loadBalancerApplies int
+	// applyLoadBalancerConfigError is returned by applying LoadBalancer config
+	applyLoadBalancerConfigError error
+	// vpcRouterUpdates is count of updating VPC router settings
+	vpcRouterUpdates int
+	databases        []sacloud.Database
+	router           *sacloud.Internet
+	// routedSubnets are networks of subnets added to the router in order
+	routedSubnets        []string
+	deletedSubnetIDs     []int64
+	addRouterSubnetError error
+	nextID               int64
+}
+
+func newTestAPIClient(switchID int64) *testAPIClient {
+	return &testAPIClient{
+		sw:     &sacloud.Switch{Resource: sacloud.NewResource(switchID)},
+		nextID: 100000000000,
+	}
+}
+
+func (t *testAPIClient) Clone() apiClient {
+	return t
+}
+
+func (t *testAPIClient) FindSwitchesByTags(ctx context.Context, tags ...string) ([]sacloud.Switch, error) {
+	return []sacloud.Switch{*t.sw}, nil
+}
+
+func (t *testAPIClient) ReadSwitch(ctx context.Context, id int64) (*sacloud.Switch, error) {
+	return t.sw, nil
+}
+
+func (t *testAPIClient) FindServers(ctx context.Context) ([]sacloud.Server, error) {
+	return nil, nil
+}
+
+func (t *testAPIClient) FindRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.Internet, error) {
+	if t.router == nil {
+		return nil, nil
+	}
+	return []sacloud.Internet{*t.router}, nil
+}
+
+func (t *testAPIClient) ReadRouter(ctx context.Context, id int64) (*sacloud.Internet, error) {
+	if t.router == nil || t.router.ID != id {
+		return nil, fmt.Errorf("router %d is not found", id)
+	}
+	router := *t.router
+	return &router, nil
+}
+
+func (t *testAPIClient) UpdateRouter(ctx context.Context, id int64, value *sacloud.Internet) (*sacloud.Internet, error) {
+	t.router = value
+	return value, nil
+}
+
+func (t *testAPIClient) AddRouterSubnet(ctx context.Context, id int64, nwMaskLen int, nextHop string) (*sacloud.Subnet, error) {
+	if t.addRouterSubnetError != nil {
+		return nil, t.addRouterSubnetError
+	}
+	t.nextID++
+	subnet := &sacloud.Subnet{
+		Resource:       sacloud.NewResource(t.nextID),
+		NetworkAddress: t.routedSubnets[0],
+		NetworkMaskLen: nwMaskLen,
+		NextHop:        nextHop,
+	}
+	t.routedSubnets = t.routedSubnets[1:]
+	t.sw.Subnets = append(t.sw.Subnets, sacloud.SwitchSubnet{Subnet: subnet})
+	return subnet, nil
+}
+
+func (t *testAPIClient) DeleteRouterSubnet(ctx context.Context, id int64, subnetID int64) error {
+	var subnets []sacloud.SwitchSubnet
+	for _, s := range t.sw.Subnets {
+		if s.ID != subnetID {
+			subnets = append(subnets, s)
+		}
+	}
+	t.sw.Subnets = subnets
+	t.deletedSubnetIDs = append(t.deletedSubnetIDs, subnetID)
+	return nil
+}
+
+func (t *testAPIClient) UpdateRouterSubnet(ctx context.Context, id int64, subnetID int64, nextHop string) (*sacloud.Subnet, error) {
+	for _, s := range t.sw.Subnets {
+		if s.ID == subnetID {
+			s.NextHop = nextHop
+			return s.Subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("subnet %d is not found", subnetID)
+}
+
+func (t *testAPIClient) FindLoadBalancersByTags(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]sacloud.LoadBalancer{}, t.loadBalancers...), nil
+}
+
+func (t *testAPIClient) FindLoadBalancers(ctx context.Context) ([]sacloud.LoadBalancer, error) {
+	return t.FindLoadBalancersByTags(context.Background())
+}
+
+func (t *testAPIClient) FindVPCRouters(ctx context.Context) ([]sacloud.VPCRouter, error) {
+	return t.vpcRouters, nil
+}
+
+func (t *testAPIClient) FindVPCRoutersByTags(ctx context.Context, tags ...string) ([]sacloud.VPCRouter, error) {
+	return t.vpcRouters, nil
+}
+
+func (t *testAPIClient) ReadVPCRouter(ctx context.Context, id int64) (*sacloud.VPCRouter, error) {
+	for i := range t.vpcRouters {
+		if t.vpcRouters[i].ID == id {
+			// return a copy of settings like API does
+			router := t.vpcRouters[i]
+			data, _ := json.Marshal(router.Settings)
+			router.Settings = nil
+			json.Unmarshal(data, &router.Settings) // nolint: errcheck
+			return &router, nil
+		}
+	}
+	return nil, fmt.Errorf("VPC router %d is not found", id)
+}
+
+func (t *testAPIClient) UpdateVPCRouterSetting(ctx context.Context, id int64, value *sacloud.VPCRouter) (*sacloud.VPCRouter, error) {
+	for i := range t.vpcRouters {
+		if t.vpcRouters[i].ID == id {
+			t.vpcRouters[i].Settings = value.Settings
+			t.vpcRouterUpdates++
+			return &t.vpcRouters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("VPC router %d is not found", id)
+}
+
+func (t *testAPIClient) ApplyVPCRouterConfig(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (t *testAPIClient) FindDatabases(ctx context.Context) ([]sacloud.Database, error) {
+	return t.databases, nil
+}
+
+func (t *testAPIClient) CreateLoadBalancer(ctx context.Context, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
+	time.Sleep(10 * time.Millisecond)
+
+	// round trip via JSON as same as API response(e.g. Remark.Servers is decoded as map[string]interface{})
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	lb := sacloud.LoadBalancer{}
+	if err := json.Unmarshal(data, &lb); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	lb.Resource = sacloud.NewResource(t.nextID)
+	lb.Switch = t.sw
+	t.loadBalancers = append(t.loadBalancers, lb)
+	return &lb, nil
+}
+
+func (t *testAPIClient) UpdateLoadBalancer(ctx context.Context, id int64, value *sacloud.LoadBalancer) (*sacloud.LoadBalancer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loadBalancerUpdates++
+	return value, nil
+}
+
+func (t *testAPIClient) ApplyLoadBalancerConfig(ctx context.Context, id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loadBalancerApplies++
+	return t.applyLoadBalancerConfigError
+}
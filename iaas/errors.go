@@ -0,0 +1,115 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/sacloud/libsacloud/api"
+)
+
+// Kinds of errors returned by Client. Kind of an error can be checked by errors.Is.
+var (
+	// ErrNotFound is returned when router, switch or other resource for LoadBalancer is not found
+	ErrNotFound = errors.New("resource not found")
+	// ErrIPExhausted is returned when no IP address is usable for LoadBalancer
+	ErrIPExhausted = errors.New("usable ip-address not found")
+	// ErrVRIDExhausted is returned when no VRID is usable on the switch for LoadBalancer
+	ErrVRIDExhausted = errors.New("usable VRID not found")
+	// ErrInvalidVIP is returned when specified VIP can't be used
+	ErrInvalidVIP = errors.New("invalid VIP")
+	// ErrVIPConflict is returned when specified VIP or its port is already used by others
+	ErrVIPConflict = errors.New("VIP conflict")
+	// ErrInvalidConfig is returned when parameters of LoadBalancer are invalid, or API rejects the request as bad request
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrThrottled is returned when SAKURA Cloud API is busy and libsacloud gave up retrying
+	ErrThrottled = errors.New("SAKURA Cloud API is throttled")
+	// ErrUnavailable is returned when SAKURA Cloud API is down or unreachable.
+	// It is also returned without calling API while SAKURA Cloud API is considered to be down.
+	ErrUnavailable = errors.New("SAKURA Cloud API is unavailable")
+)
+
+// kindError is an error which has kind and own message
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Is(target error) bool {
+	return e.kind == target
+}
+
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// APIError is an error of SAKURA Cloud API call.
+// Kind of the error can be checked by errors.Is, and libsacloud api.Error can be retrieved by errors.As.
+type APIError struct {
+	// Operation is name of the API call, same as operation label of metrics
+	Operation string
+	// StatusCode is HTTP status code of the last response, 0 if no response is received
+	StatusCode int
+	// Kind is one of ErrNotFound, ErrInvalidConfig, ErrThrottled or ErrUnavailable, nil if the error isn't classified
+	Kind error
+	// Err is the error returned by libsacloud, such as api.Error
+	Err error
+}
+
+func (e *APIError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func (e *APIError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newAPIError classifies err returned by the API call.
+// lastStatus is status code of the last response, which is used when libsacloud gave up retrying.
+// Canceled calls and errors not caused by API are returned as is.
+func newAPIError(operation string, err error, lastStatus int) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+
+	var apiErr api.Error
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &apiErr):
+		code := apiErr.ResponseCode()
+		return &APIError{Operation: operation, StatusCode: code, Kind: statusKind(code), Err: err}
+	case isRetryableStatus(lastStatus):
+		// libsacloud gave up retrying
+		return &APIError{Operation: operation, StatusCode: lastStatus, Kind: ErrThrottled, Err: err}
+	case errors.As(err, &urlErr):
+		return &APIError{Operation: operation, Kind: ErrUnavailable, Err: err}
+	default:
+		return err
+	}
+}
+
+// statusKind returns kind of the error response, nil if the status code has no corresponding kind
+func statusKind(code int) error {
+	switch {
+	case code == http.StatusNotFound:
+		return ErrNotFound
+	case code == http.StatusBadRequest:
+		return ErrInvalidConfig
+	case code == http.StatusTooManyRequests || isRetryableStatus(code):
+		return ErrThrottled
+	case code >= http.StatusInternalServerError:
+		return ErrUnavailable
+	default:
+		return nil
+	}
+}
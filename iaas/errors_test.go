@@ -0,0 +1,66 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIError(t *testing.T) {
+	newError := func(code int) error {
+		return api.NewError(code, &sacloud.ResultErrorValue{ErrorCode: "error", ErrorMessage: "error"})
+	}
+	gaveUp := errors.New("giving up after 3 attempts")
+	urlErr := &url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("connection refused")}
+	canceled := &url.Error{Op: "Get", URL: "https://example.com", Err: context.Canceled}
+	breakerErr := &url.Error{Op: "Get", URL: "https://example.com", Err: errorf(ErrUnavailable, "circuit breaker is open")}
+	other := errors.New("LoadBalancer 1 is failed")
+
+	expects := []struct {
+		caseName   string
+		err        error
+		lastStatus int
+		kind       error
+		statusCode int
+		passed     bool
+	}{
+		{caseName: "not found", err: newError(http.StatusNotFound), lastStatus: 404, kind: ErrNotFound, statusCode: 404},
+		{caseName: "bad request", err: newError(http.StatusBadRequest), lastStatus: 400, kind: ErrInvalidConfig, statusCode: 400},
+		{caseName: "too many requests", err: newError(http.StatusTooManyRequests), lastStatus: 429, kind: ErrThrottled, statusCode: 429},
+		{caseName: "server error", err: newError(http.StatusInternalServerError), lastStatus: 500, kind: ErrUnavailable, statusCode: 500},
+		{caseName: "conflict", err: newError(http.StatusConflict), lastStatus: 409, statusCode: 409},
+		{caseName: "gave up retrying", err: gaveUp, lastStatus: 503, kind: ErrThrottled, statusCode: 503},
+		{caseName: "unreachable", err: urlErr, kind: ErrUnavailable},
+		{caseName: "canceled", err: canceled, passed: true},
+		{caseName: "circuit breaker", err: breakerErr, passed: true},
+		{caseName: "other", err: other, lastStatus: 200, passed: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			err := newAPIError("ReadAuthStatus", expect.err, expect.lastStatus)
+			if expect.passed {
+				assert.Equal(t, expect.err, err)
+				return
+			}
+
+			var apiErr *APIError
+			if !assert.True(t, errors.As(err, &apiErr), "unexpected error: %v", err) {
+				return
+			}
+			assert.Equal(t, "ReadAuthStatus", apiErr.Operation)
+			assert.Equal(t, expect.statusCode, apiErr.StatusCode)
+			assert.Equal(t, expect.err.Error(), err.Error())
+			assert.True(t, errors.Is(err, expect.err))
+			for _, kind := range []error{ErrNotFound, ErrInvalidConfig, ErrThrottled, ErrUnavailable, ErrVIPConflict} {
+				assert.Equal(t, kind == expect.kind, errors.Is(err, kind), "kind %q", kind)
+			}
+		})
+	}
+}
@@ -16,8 +16,8 @@ func TestMain(m *testing.M) {
 	accessTokenSecret := os.Getenv("SAKURACLOUD_ACCESS_TOKEN_SECRET")
 
 	if accessToken == "" || accessTokenSecret == "" {
-		log.Println("Please Set ENV 'SAKURACLOUD_ACCESS_TOKEN' and 'SAKURACLOUD_ACCESS_TOKEN_SECRET'")
-		os.Exit(0) // exit normal
+		log.Println("Please Set ENV 'SAKURACLOUD_ACCESS_TOKEN' and 'SAKURACLOUD_ACCESS_TOKEN_SECRET' to run E2E tests")
+		os.Exit(m.Run()) // run unit tests only
 	}
 
 	zone := os.Getenv("SAKURACLOUD_ZONE")
@@ -68,3 +68,9 @@ func TestMain(m *testing.M) {
 	ret := m.Run()
 	os.Exit(ret)
 }
+
+func skipIfNoAPIKey(t *testing.T) {
+	if testClient == nil {
+		t.Skip("SAKURACLOUD_ACCESS_TOKEN and SAKURACLOUD_ACCESS_TOKEN_SECRET are not set")
+	}
+}
@@ -0,0 +1,251 @@
+package iaas
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipamSubnet represents IPv4 subnet managed by ipam
+type ipamSubnet struct {
+	network *net.IPNet
+	gateway string
+	// nextHop is not empty if the subnet is routed subnet of Internet router
+	nextHop string
+	// first and last are range of assignable addresses
+	first uint32
+	last  uint32
+}
+
+// newIPAMSubnet returns subnet which assignable range is all host addresses of the network
+func newIPAMSubnet(cidr string) (*ipamSubnet, error) {
+	network, err := parseIPv4CIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	first, last := ipv4NetworkRange(network)
+	if ones, bits := network.Mask.Size(); bits-ones >= 2 {
+		// exclude network address and broadcast address
+		first++
+		last--
+	}
+	return &ipamSubnet{
+		network: network,
+		first:   first,
+		last:    last,
+	}, nil
+}
+
+// restrict restricts assignable addresses of the subnet to from-to
+func (s *ipamSubnet) restrict(from, to string) error {
+	first, err := parseIPv4(from)
+	if err != nil {
+		return err
+	}
+	last, err := parseIPv4(to)
+	if err != nil {
+		return err
+	}
+	if first > last {
+		return fmt.Errorf("invalid ip-address range %s-%s", from, to)
+	}
+	return s.restrictRange(first, last)
+}
+
+// restrictToCIDR restricts assignable addresses of the subnet to the CIDR block
+func (s *ipamSubnet) restrictToCIDR(cidr string) error {
+	network, err := parseIPv4CIDR(cidr)
+	if err != nil {
+		return err
+	}
+	first, last := ipv4NetworkRange(network)
+	return s.restrictRange(first, last)
+}
+
+func (s *ipamSubnet) restrictRange(first, last uint32) error {
+	if first > s.last || last < s.first {
+		return fmt.Errorf("ip-address range %s-%s is out of network %q", uint32ToIPv4(first), uint32ToIPv4(last), s.network)
+	}
+	if first > s.first {
+		s.first = first
+	}
+	if last < s.last {
+		s.last = last
+	}
+	return nil
+}
+
+func (s *ipamSubnet) maskLen() int {
+	ones, _ := s.network.Mask.Size()
+	return ones
+}
+
+func (s *ipamSubnet) isRouted() bool {
+	return s.nextHop != ""
+}
+
+// contains returns true if ip is in assignable range of the subnet
+func (s *ipamSubnet) contains(ip string) bool {
+	v, err := parseIPv4(ip)
+	if err != nil {
+		return false
+	}
+	return s.first <= v && v <= s.last
+}
+
+type ipv4Range struct {
+	first uint32
+	last  uint32
+}
+
+// ipam manages assignable IPv4 addresses in subnets.
+// Addresses are assigned in order of subnets, and in ascending order in the subnet.
+type ipam struct {
+	subnets       []*ipamSubnet
+	excluded      map[uint32]bool
+	excludeRanges []*ipv4Range
+}
+
+func newIPAM(subnets ...*ipamSubnet) *ipam {
+	p := &ipam{
+		subnets:  subnets,
+		excluded: map[uint32]bool{},
+	}
+	for _, subnet := range subnets {
+		// gateway and next-hop are never assigned
+		p.excludeIPs(subnet.gateway, subnet.nextHop)
+	}
+	return p
+}
+
+// excludeIPs excludes used addresses. Invalid or empty addresses are ignored.
+func (p *ipam) excludeIPs(ips ...string) {
+	for _, ip := range ips {
+		if v, err := parseIPv4(ip); err == nil {
+			p.excluded[v] = true
+		}
+	}
+}
+
+// exclude excludes addresses specified by IPv4 address or CIDR block
+func (p *ipam) exclude(addresses ...string) error {
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		switch {
+		case address == "":
+			continue
+		case strings.Contains(address, "/"):
+			network, err := parseIPv4CIDR(address)
+			if err != nil {
+				return err
+			}
+			first, last := ipv4NetworkRange(network)
+			p.excludeRanges = append(p.excludeRanges, &ipv4Range{first: first, last: last})
+		default:
+			v, err := parseIPv4(address)
+			if err != nil {
+				return err
+			}
+			p.excluded[v] = true
+		}
+	}
+	return nil
+}
+
+func (p *ipam) isExcluded(v uint32) bool {
+	if p.excluded[v] {
+		return true
+	}
+	for _, r := range p.excludeRanges {
+		if r.first <= v && v <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// isUsed returns true if ip is used or excluded
+func (p *ipam) isUsed(ip string) bool {
+	v, err := parseIPv4(ip)
+	if err != nil {
+		return false
+	}
+	return p.isExcluded(v)
+}
+
+// isAvailable returns true if ip is assignable in the subnet
+func (p *ipam) isAvailable(subnet *ipamSubnet, ip string) bool {
+	return subnet.contains(ip) && !p.isUsed(ip)
+}
+
+// available returns at most n assignable addresses in the subnet in ascending order
+func (p *ipam) available(subnet *ipamSubnet, n int) []string {
+	var ips []string
+	for v := uint64(subnet.first); v <= uint64(subnet.last) && len(ips) < n; v++ {
+		if !p.isExcluded(uint32(v)) {
+			ips = append(ips, uint32ToIPv4(uint32(v)))
+		}
+	}
+	return ips
+}
+
+// countAvailable returns number of assignable addresses in all subnets
+func (p *ipam) countAvailable() int {
+	n := 0
+	for _, subnet := range p.subnets {
+		for v := uint64(subnet.first); v <= uint64(subnet.last); v++ {
+			if !p.isExcluded(uint32(v)) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// subnetFor returns first subnet which has n assignable addresses.
+// Routed subnets are used only if includeRouted is true.
+func (p *ipam) subnetFor(n int, includeRouted bool) *ipamSubnet {
+	for _, subnet := range p.subnets {
+		if subnet.isRouted() && !includeRouted {
+			continue
+		}
+		if len(p.available(subnet, n)) == n {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func parseIPv4CIDR(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, err
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("%q is not IPv4 CIDR", cidr)
+	}
+	network.IP = network.IP.To4()
+	return network, nil
+}
+
+func parseIPv4(ip string) (uint32, error) {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil || parsed.To4() == nil {
+		return 0, fmt.Errorf("%q is not IPv4 address", ip)
+	}
+	return binary.BigEndian.Uint32(parsed.To4()), nil
+}
+
+func ipv4NetworkRange(network *net.IPNet) (uint32, uint32) {
+	first := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	last := first | uint32(uint64(1)<<uint(bits-ones)-1)
+	return first, last
+}
+
+func uint32ToIPv4(v uint32) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip.String()
+}
@@ -0,0 +1,132 @@
+package iaas
+
+import (
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPAMSubnet(t *testing.T) {
+	expects := []struct {
+		cidr      string
+		restrict  string
+		first     string
+		last      string
+		maskLen   int
+		hasError  bool
+		restrictE bool
+	}{
+		{cidr: "192.2.0.0/24", first: "192.2.0.1", last: "192.2.0.254", maskLen: 24},
+		{cidr: "192.2.0.10/24", first: "192.2.0.1", last: "192.2.0.254", maskLen: 24},
+		{cidr: "10.0.0.0/16", restrict: "10.0.2.0/23", first: "10.0.2.0", last: "10.0.3.255", maskLen: 16},
+		{cidr: "10.0.0.0/16", restrict: "10.0.0.0/22", first: "10.0.0.1", last: "10.0.3.255", maskLen: 16},
+		{cidr: "192.2.0.0/24", restrict: "192.2.0.128/25", first: "192.2.0.128", last: "192.2.0.254", maskLen: 24},
+		{cidr: "192.2.0.0/24", restrict: "192.2.1.0/24", restrictE: true},
+		{cidr: "192.2.0.8/31", first: "192.2.0.8", last: "192.2.0.9", maskLen: 31},
+		{cidr: "192.2.0.0", hasError: true},
+		{cidr: "2001:db8::/64", hasError: true},
+	}
+
+	for _, expect := range expects {
+		subnet, err := newIPAMSubnet(expect.cidr)
+		assert.Equal(t, expect.hasError, err != nil, "newIPAMSubnet(%q): unexpected error", expect.cidr)
+		if err != nil {
+			continue
+		}
+		if expect.restrict != "" {
+			err := subnet.restrictToCIDR(expect.restrict)
+			assert.Equal(t, expect.restrictE, err != nil, "restrictToCIDR(%q): unexpected error", expect.restrict)
+			if err != nil {
+				continue
+			}
+		}
+		assert.Equal(t, expect.first, uint32ToIPv4(subnet.first), "%s(%s): unexpected first address", expect.cidr, expect.restrict)
+		assert.Equal(t, expect.last, uint32ToIPv4(subnet.last), "%s(%s): unexpected last address", expect.cidr, expect.restrict)
+		assert.Equal(t, expect.maskLen, subnet.maskLen(), "%s: unexpected mask length", expect.cidr)
+	}
+}
+
+func TestIPAM_available(t *testing.T) {
+	t.Run("larger than /24", func(t *testing.T) {
+		subnet, _ := newIPAMSubnet("10.0.0.0/16")
+		assert.NoError(t, subnet.restrictToCIDR("10.0.0.252/30"))
+		assert.NoError(t, subnet.restrict("10.0.0.252", "10.0.1.2"))
+		p := newIPAM(subnet)
+		// restricted range is intersection
+		assert.Equal(t, []string{"10.0.0.252", "10.0.0.253", "10.0.0.254", "10.0.0.255"}, p.available(subnet, 10))
+
+		subnet, _ = newIPAMSubnet("10.0.0.0/16")
+		assert.NoError(t, subnet.restrict("10.0.0.253", "10.0.1.2"))
+		p = newIPAM(subnet)
+		assert.Equal(t, []string{"10.0.0.253", "10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}, p.available(subnet, 5),
+			"addresses must not wrap in last octet")
+	})
+
+	t.Run("exclusions", func(t *testing.T) {
+		subnet, _ := newIPAMSubnet("192.2.0.0/24")
+		subnet.gateway = "192.2.0.1"
+		p := newIPAM(subnet)
+		p.excludeIPs("192.2.0.2", "", "invalid")
+		assert.NoError(t, p.exclude("192.2.0.4", " 192.2.0.8/30"))
+		assert.Error(t, p.exclude("192.2.0.300"))
+
+		assert.Equal(t, []string{"192.2.0.3", "192.2.0.5", "192.2.0.6", "192.2.0.7", "192.2.0.12"}, p.available(subnet, 5))
+		assert.True(t, p.isUsed("192.2.0.1"), "gateway must be used")
+		assert.True(t, p.isUsed("192.2.0.9"))
+		assert.False(t, p.isAvailable(subnet, "192.2.0.10"))
+		assert.True(t, p.isAvailable(subnet, "192.2.0.13"))
+		assert.False(t, p.isAvailable(subnet, "192.2.1.13"), "out of subnet")
+		assert.Equal(t, 254-7, p.countAvailable())
+	})
+
+	t.Run("deterministic order over subnets", func(t *testing.T) {
+		connected, _ := newIPAMSubnet("192.2.0.0/28")
+		assert.NoError(t, connected.restrict("192.2.0.4", "192.2.0.6"))
+		routed, _ := newIPAMSubnet("198.51.100.0/28")
+		routed.nextHop = "192.2.0.4"
+		second, _ := newIPAMSubnet("203.0.113.0/28")
+		p := newIPAM(connected, routed, second)
+
+		assert.Equal(t, connected, p.subnetFor(2, false))
+		assert.Equal(t, second, p.subnetFor(3, false), "routed subnet must be skipped")
+		assert.Equal(t, routed, p.subnetFor(3, true))
+		assert.Nil(t, p.subnetFor(20, true))
+		assert.True(t, p.isUsed("192.2.0.4"), "next-hop must be used")
+	})
+}
+
+func TestSwitchIPAMSubnets(t *testing.T) {
+	connected := sacloud.SwitchSubnet{Subnet: &sacloud.Subnet{
+		NetworkAddress: "192.2.0.0",
+		NetworkMaskLen: 28,
+		DefaultRoute:   "192.2.0.1",
+	}}
+	connected.IPAddresses.Min = "192.2.0.4"
+	connected.IPAddresses.Max = "192.2.0.14"
+	routed := sacloud.SwitchSubnet{Subnet: &sacloud.Subnet{
+		NetworkAddress: "198.51.100.0",
+		NetworkMaskLen: 28,
+		NextHop:        "192.2.0.4",
+	}}
+	sw := &sacloud.Switch{Resource: sacloud.NewResource(1), Subnets: []sacloud.SwitchSubnet{connected, routed}}
+
+	subnets, err := switchIPAMSubnets(sw)
+	assert.NoError(t, err)
+	assert.Len(t, subnets, 2)
+	assert.Equal(t, "192.2.0.4", uint32ToIPv4(subnets[0].first))
+	assert.Equal(t, "192.2.0.14", uint32ToIPv4(subnets[0].last))
+	assert.Equal(t, "192.2.0.1", subnets[0].gateway)
+	assert.False(t, subnets[0].isRouted())
+	assert.True(t, subnets[1].isRouted())
+
+	_, err = switchIPAMSubnets(&sacloud.Switch{Resource: sacloud.NewResource(2)})
+	assert.Error(t, err)
+}
+
+func TestLoadBalancerParam_requiredIPs(t *testing.T) {
+	assert.Equal(t, 2, (&LoadBalancerParam{}).requiredIPs())
+	assert.Equal(t, 3, (&LoadBalancerParam{UseHA: true}).requiredIPs())
+	assert.Equal(t, 1, (&LoadBalancerParam{VIP: "192.2.0.10"}).requiredIPs())
+	assert.Equal(t, 2, (&LoadBalancerParam{UseHA: true, VIP: "192.2.0.10"}).requiredIPs())
+}
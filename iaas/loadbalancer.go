@@ -1,13 +1,15 @@
 package iaas
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/klog"
 )
 
 const (
@@ -17,13 +19,6 @@ const (
 	LoadBalancerTypesSwitch = "switch"
 )
 
-type globalIPList struct {
-	gateway        string
-	addresses      []string
-	networkAddress string
-	nwMaskLen      int
-}
-
 type loadBalancerIPs struct {
 	switchID  int64
 	vrid      int
@@ -34,23 +29,59 @@ type loadBalancerIPs struct {
 	gateway   string
 }
 
-func (c *client) LoadBalancers(tags ...string) ([]sacloud.LoadBalancer, error) {
-	return c.getAPIClient().FindLoadBalancersByTags()
+func (l *loadBalancerIPs) addresses() []string {
+	var addresses []string
+	for _, ip := range []string{l.vip, l.ip1, l.ip2} {
+		if ip != "" {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
 }
 
-func (c *client) WaitForLBActive(id int64, waitTimeout time.Duration) error {
-	return c.getAPIClient().WaitForLBActive(id, waitTimeout)
+func (c *client) LoadBalancers(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error) {
+	return c.getAPIClient().FindLoadBalancersByTags(ctx)
 }
 
-func (c *client) CreateLoadBalancer(lbParam *LoadBalancerParam, vipParam *VIPParam, waitTimeout time.Duration) ([]string, error) {
+func (c *client) LoadBalancer(ctx context.Context, id int64) (*sacloud.LoadBalancer, error) {
+	return c.getAPIClient().ReadLoadBalancer(ctx, id)
+}
 
-	lock := sync.Mutex{}
-	lock.Lock()
-	var once sync.Once
-	defer once.Do(lock.Unlock)
+func (c *client) WaitForLBActive(ctx context.Context, id int64, waitTimeout time.Duration) error {
+	return c.getAPIClient().WaitForLBActive(ctx, id, waitTimeout)
+}
 
+func (c *client) CreateLoadBalancer(ctx context.Context, lbParam *LoadBalancerParam, vipParam *VIPParam) (*sacloud.LoadBalancer, error) {
 	client := c.getAPIClient()
-	lbIPs, err := c.extractLoadBalancerIPSettings(lbParam)
+	sw, err := c.findLBSwitch(ctx, lbParam, lbParam.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocating IPs and VRID on the switch must be serialized until LoadBalancer is created,
+	// and allocation is reserved so that other CCM process(e.g. new leader) doesn't allocate it
+	unlock := c.lockSwitch(sw.ID)
+	defer unlock()
+
+	var lbIPs *loadBalancerIPs
+	err = c.reserve(sw.ID, func(reservations []*Reservation) (*Reservation, error) {
+		for _, r := range reservations {
+			// LoadBalancer requested by other process(or not listed yet) must not be replaced by duplicated one
+			if r.ID == lbParam.Name && r.VRID > 0 {
+				return nil, fmt.Errorf("LoadBalancer %q is already requested to be created", lbParam.Name)
+			}
+		}
+		lbIPs, err = c.extractLoadBalancerIPSettings(ctx, lbParam, sw, reservations)
+		if err != nil {
+			return nil, err
+		}
+		return &Reservation{
+			ID:          lbParam.Name,
+			IPAddresses: lbIPs.addresses(),
+			VRID:        lbIPs.vrid,
+			ExpiresAt:   time.Now().Add(reservationTTL),
+		}, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -70,33 +101,7 @@ func (c *client) CreateLoadBalancer(lbParam *LoadBalancerParam, vipParam *VIPPar
 		p.Plan = sacloud.LoadBalancerPlanPremium
 	}
 
-	settings := []*sacloud.LoadBalancerSetting{}
-	for _, port := range vipParam.Ports {
-		v := &sacloud.LoadBalancerSetting{
-			VirtualIPAddress: lbIPs.vip,
-			Port:             fmt.Sprintf("%d", port.Port),
-			DelayLoop:        fmt.Sprintf("%d", port.HealthCheck.DelayLoop),
-		}
-		hc := &sacloud.LoadBalancerHealthCheck{
-			Protocol: port.HealthCheck.Protocol,
-		}
-
-		// we don't use this(for future)
-		if port.HealthCheck.Protocol == "http" || port.HealthCheck.Protocol == "https" {
-			hc.Path = port.HealthCheck.Path
-			hc.Status = fmt.Sprintf("%d", port.HealthCheck.StatusCode)
-		}
-
-		for _, nodeIP := range vipParam.NodeIPs {
-			v.AddServer(&sacloud.LoadBalancerServer{
-				IPAddress:   nodeIP,
-				Port:        fmt.Sprintf("%d", port.HealthCheck.Port),
-				HealthCheck: hc,
-				Enabled:     "True",
-			})
-		}
-		settings = append(settings, v)
-	}
+	settings := buildLoadBalancerSettings(lbIPs.vip, vipParam)
 
 	var createParam *sacloud.LoadBalancer
 	if lbParam.UseHA {
@@ -110,86 +115,194 @@ func (c *client) CreateLoadBalancer(lbParam *LoadBalancerParam, vipParam *VIPPar
 	if err != nil {
 		return nil, err
 	}
-	lb, err := client.CreateLoadBalancer(createParam)
+	// Note: booting LoadBalancer takes several minutes, so we don't wait for it here.
+	// Caller should check its status and apply config when it is active.
+	lb, err := client.CreateLoadBalancer(ctx, createParam)
 	if err != nil {
+		// reservation is kept until it expires when created
+		c.releaseReservation(sw.ID, lbParam.Name)
 		return nil, err
 	}
+	return lb, nil
+}
 
-	once.Do(lock.Unlock)
+func (c *client) UpdateLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, vipParam *VIPParam) (_ []string, err error) {
+	var settings []*sacloud.LoadBalancerSetting
 
-	err = client.WaitForLBActive(lb.ID, waitTimeout)
-	if err != nil {
-		return nil, err
-	}
-	if err = client.ApplyLoadBalancerConfig(lb.ID); err != nil {
-		return nil, err
+	// keep settings owned by others(for shared or adopted LoadBalancer)
+	vip := ""
+	if lb.Settings != nil {
+		for _, s := range lb.Settings.LoadBalancer {
+			if !isOwnSetting(s, vipParam.Owner, lbParam.Adopted) {
+				settings = append(settings, s)
+				continue
+			}
+			if vip == "" {
+				vip = s.VirtualIPAddress
+			}
+		}
 	}
-	return []string{lbIPs.vip}, nil
-}
 
-func (c *client) UpdateLoadBalancer(lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, vipParam *VIPParam) ([]string, error) {
-	var settings []*sacloud.LoadBalancerSetting
+	needAllocation := false
+	switch {
+	case lbParam.Adopted && vipParam.VIP != "" && vipParam.VIP != vip:
+		// addressing of adopted LoadBalancer is owned by its creator, so only check the VIP is reachable
+		if err := validateVIPInLoadBalancerNetwork(lb, vipParam.VIP); err != nil {
+			return nil, err
+		}
+		vip = vipParam.VIP
+	case vipParam.VIP != "" && vipParam.VIP != vip:
+		// VIP used by other member of shared LoadBalancer can be shared
+		needAllocation = !hasVIP(settings, vipParam.VIP)
+		vip = vipParam.VIP
+	case vip == "" && vipParam.Owner != "" && !lbParam.Adopted:
+		// new member of shared LoadBalancer
+		needAllocation = true
+	}
 
-	vip := lb.Settings.LoadBalancer[0].VirtualIPAddress
-	// Check VIP duplication if specified
-	if vipParam.VIP != "" && vipParam.VIP != lb.Settings.LoadBalancer[0].VirtualIPAddress {
+	if needAllocation {
 		var sw *sacloud.Switch
-		var err error
-		var assignableIPInfo *assignableIPInfo
+		sw, err = c.findLBSwitch(ctx, lbParam, vipParam.Type)
+		if err != nil {
+			return nil, err
+		}
 
-		switch vipParam.Type {
-		case LoadBalancerTypesInternet:
-			sw, err = c.findLBConnectedRouterSwitch(lbParam)
-			if err != nil {
-				return nil, err
-			}
-			if sw == nil {
-				return nil, fmt.Errorf("switch resource (with tag[%s]) is not found", lbParam.RouterTags)
+		unlock := c.lockSwitch(sw.ID)
+		defer unlock()
+
+		reservationID := fmt.Sprintf("%s/%s", lb.GetStrID(), vipParam.Owner)
+		specifiedVIP := vip
+		err = c.reserve(sw.ID, func(reservations []*Reservation) (*Reservation, error) {
+			var assignableIPInfo *assignableIPInfo
+			if vipParam.Type == LoadBalancerTypesInternet {
+				assignableIPInfo, err = c.extractAssignableExternalVIPs(ctx, lb, lbParam, sw, reservedIPs(reservations), specifiedVIP)
+			} else {
+				assignableIPInfo, err = c.extractAssignableIPs(ctx, lbParam, vipParam.Type, sw, reservedIPs(reservations), 1)
 			}
-			assignableIPInfo, err = c.extractAssignableExternalIPs(lbParam, sw)
 			if err != nil {
 				return nil, err
 			}
 
-		case LoadBalancerTypesSwitch:
-			sw, err = c.findLBConnectedSwitch(lbParam)
-			if err != nil {
-				return nil, err
-			}
-			if sw == nil {
-				return nil, fmt.Errorf("switch resource (with tag[%s]) is not found", lbParam.RouterTags)
+			if specifiedVIP != "" {
+				// Check VIP duplication if specified
+				if !assignableIPInfo.isAssignable(specifiedVIP) {
+					return nil, errorf(ErrVIPConflict, "can't use specified VIP %q", specifiedVIP)
+				}
+			} else {
+				ips := assignableIPInfo.assignableIPs(1)
+				if len(ips) == 0 {
+					return nil, ErrIPExhausted
+				}
+				vip = ips[0]
 			}
-			assignableIPInfo, err = c.extractAssignableInternalIPs(lbParam, sw)
+
+			return &Reservation{
+				ID:          reservationID,
+				IPAddresses: []string{vip},
+				ExpiresAt:   time.Now().Add(reservationTTL),
+			}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			// reservation is kept until it expires when updated
 			if err != nil {
-				return nil, err
+				c.releaseReservation(sw.ID, reservationID)
 			}
-		default:
-			return nil, fmt.Errorf("invalid LoadBalancerType %q is specified", vipParam.Type)
-		}
+		}()
+	}
+	if vip == "" {
+		return nil, fmt.Errorf("LoadBalancer %q has no VIP, loadBalancerIP is required", lb.Name)
+	}
 
-		found := false
-		for _, addr := range assignableIPInfo.assignableIPs {
-			if addr == vipParam.VIP {
-				found = true
-				break
+	for _, port := range vipParam.Ports {
+		strPort := fmt.Sprintf("%d", port.Port)
+		for _, s := range settings {
+			if s.VirtualIPAddress == vip && s.Port == strPort {
+				return nil, errorf(ErrVIPConflict, "port %s of VIP %q is already used by another service", strPort, vip)
 			}
 		}
-		if !found {
-			return nil, fmt.Errorf("can't use specified VIP %q", vipParam.VIP)
+	}
+
+	settings = append(settings, buildLoadBalancerSettings(vip, vipParam)...)
+
+	current := currentLoadBalancerState(lb)
+	if lb.Settings == nil {
+		lb.Settings = &sacloud.LoadBalancerSettings{}
+	}
+	lb.Settings.LoadBalancer = settings
+	if !lbParam.Adopted && lbParam.Name != "" {
+		lb.Name = lbParam.Name
+	}
+	if !lbParam.Adopted && lbParam.Description != "" {
+		lb.Description = lbParam.Description
+	}
+	for _, tag := range lbParam.RemoveTags {
+		lb.RemoveTag(tag)
+	}
+	for _, tag := range lbParam.Tags {
+		lb.AppendTag(tag)
+	}
+
+	desired := currentLoadBalancerState(lb)
+	diff := diffLoadBalancerState(current, desired)
+	applied := c.isConfigApplied(lb.ID, desired)
+	if len(diff) == 0 && applied {
+		klog.V(4).Infof("LoadBalancer %q(id:%s) is up to date", lb.Name, lb.GetStrID())
+		return []string{vip}, nil
+	}
+
+	if len(diff) > 0 {
+		klog.V(4).Infof("updating LoadBalancer %q(id:%s):\n  %s", lb.Name, lb.GetStrID(), strings.Join(diff, "\n  "))
+		if _, err := c.apiClient.UpdateLoadBalancer(ctx, lb.ID, lb); err != nil {
+			return nil, err
 		}
+	} else {
+		// settings are written at creation, or previous apply is failed
+		klog.V(4).Infof("applying config of LoadBalancer %q(id:%s)", lb.Name, lb.GetStrID())
+	}
+	if err := c.applyLoadBalancerConfig(ctx, c.apiClient, lb); err != nil {
+		return nil, err
+	}
 
-		vip = vipParam.VIP
+	return []string{vip}, nil
+}
+
+// isConfigApplied returns true if config of LoadBalancer id is applied with desired state by this process.
+// Config of LoadBalancer created with settings is not applied until its first update.
+func (c *client) isConfigApplied(id int64, desired *loadBalancerState) bool {
+	v, ok := c.appliedStates.Load(id)
+	return ok && len(diffLoadBalancerState(v.(*loadBalancerState), desired)) == 0
+}
+
+// applyLoadBalancerConfig applies config of lb, and records its state when applied
+func (c *client) applyLoadBalancerConfig(ctx context.Context, client apiClient, lb *sacloud.LoadBalancer) error {
+	c.appliedStates.Delete(lb.ID)
+	if err := client.ApplyLoadBalancerConfig(ctx, lb.ID); err != nil {
+		return err
 	}
+	c.appliedStates.Store(lb.ID, currentLoadBalancerState(lb).snapshot())
+	return nil
+}
 
+// buildLoadBalancerSettings returns VIP settings for vipParam.
+// Settings are marked with vipParam.Owner in description.
+func buildLoadBalancerSettings(vip string, vipParam *VIPParam) []*sacloud.LoadBalancerSetting {
+	settings := []*sacloud.LoadBalancerSetting{}
 	for _, port := range vipParam.Ports {
 		v := &sacloud.LoadBalancerSetting{
 			VirtualIPAddress: vip,
 			Port:             fmt.Sprintf("%d", port.Port),
 			DelayLoop:        fmt.Sprintf("%d", port.HealthCheck.DelayLoop),
+			Description:      vipParam.Owner,
+			SorryServer:      vipParam.SorryServer,
 		}
 		hc := &sacloud.LoadBalancerHealthCheck{
 			Protocol: port.HealthCheck.Protocol,
 		}
+
+		// we don't use this(for future)
 		if port.HealthCheck.Protocol == "http" || port.HealthCheck.Protocol == "https" {
 			hc.Path = port.HealthCheck.Path
 			hc.Status = fmt.Sprintf("%d", port.HealthCheck.StatusCode)
@@ -203,92 +316,200 @@ func (c *client) UpdateLoadBalancer(lb *sacloud.LoadBalancer, lbParam *LoadBalan
 				Enabled:     "True",
 			})
 		}
+		for _, nodeIP := range vipParam.DisabledNodeIPs {
+			v.AddServer(&sacloud.LoadBalancerServer{
+				IPAddress:   nodeIP,
+				Port:        fmt.Sprintf("%d", port.HealthCheck.Port),
+				HealthCheck: hc,
+				Enabled:     "False",
+			})
+		}
 		settings = append(settings, v)
 	}
+	return settings
+}
 
-	lb.Settings.LoadBalancer = settings
-	if _, err := c.apiClient.UpdateLoadBalancer(lb.ID, lb); err != nil {
-		return nil, err
+// isOwnSetting returns true if setting is owned by owner.
+// Settings that have no owner(created before sharing, or retained) are claimable by anyone,
+// except ones of adopted LoadBalancer which belong to its creator.
+func isOwnSetting(setting *sacloud.LoadBalancerSetting, owner string, adopted bool) bool {
+	if adopted {
+		return setting.Description == owner
 	}
-	if err := c.apiClient.ApplyLoadBalancerConfig(lb.ID); err != nil {
-		return nil, err
-	}
-
-	return []string{vip}, nil
+	return setting.Description == "" || setting.Description == owner
 }
 
-func (c *client) DeleteLoadBalancer(id int64, waitTimeout time.Duration) error {
-	return c.getAPIClient().DeleteLoadBalancer(id, waitTimeout)
+func hasVIP(settings []*sacloud.LoadBalancerSetting, vip string) bool {
+	for _, s := range settings {
+		if s.VirtualIPAddress == vip {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *client) extractLoadBalancerIPSettings(lbParam *LoadBalancerParam) (*loadBalancerIPs, error) {
+func (c *client) findLBSwitch(ctx context.Context, lbParam *LoadBalancerParam, lbType string) (*sacloud.Switch, error) {
 	var sw *sacloud.Switch
-	var vrid int
-	var assignableIPInfo *assignableIPInfo
 	var err error
 
-	switch lbParam.Type {
+	switch lbType {
 	case LoadBalancerTypesInternet:
-		sw, err = c.findLBConnectedRouterSwitch(lbParam)
-		if err != nil {
-			return nil, err
-		}
-		if sw == nil {
-			return nil, fmt.Errorf("switch resource (with tag[%s]) is not found", lbParam.RouterTags)
-		}
+		sw, err = c.findLBConnectedRouterSwitch(ctx, lbParam)
+	case LoadBalancerTypesSwitch:
+		sw, err = c.findLBConnectedSwitch(ctx, lbParam)
+	default:
+		return nil, errorf(ErrInvalidConfig, "invalid LoadBalancerType %q is specified", lbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sw == nil {
+		return nil, errorf(ErrNotFound, "switch resource (with tag[%s]) is not found", lbParam.RouterTags)
+	}
+	return sw, nil
+}
 
-		// VRID scope = clusterID
-		vrid, err = c.selectUniqVRID(lbParam, sw.ID)
-		if err != nil {
-			return nil, err
-		}
+// extractAssignableIPs returns subnet which has at least required assignable IPs
+func (c *client) extractAssignableIPs(ctx context.Context, lbParam *LoadBalancerParam, lbType string, sw *sacloud.Switch, reservedIPs []string, required int) (*assignableIPInfo, error) {
+	switch lbType {
+	case LoadBalancerTypesInternet:
+		return c.extractAssignableExternalIPs(ctx, lbParam, sw, reservedIPs, required)
+	case LoadBalancerTypesSwitch:
+		return c.extractAssignableInternalIPs(ctx, lbParam, sw, reservedIPs)
+	default:
+		return nil, errorf(ErrInvalidConfig, "invalid LoadBalancerType %q is specified", lbType)
+	}
+}
 
-		// get assignable IPs
-		assignableIPInfo, err = c.extractAssignableExternalIPs(lbParam, sw)
-		if err != nil {
-			return nil, err
+func (c *client) DeleteLoadBalancer(ctx context.Context, id int64, waitTimeout time.Duration) error {
+	start := time.Now()
+	err := c.getAPIClient().DeleteLoadBalancer(ctx, id, waitTimeout)
+	if err == nil {
+		c.appliedStates.Delete(id)
+	}
+	loadBalancerDeleteDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (c *client) RemoveLoadBalancerSettings(ctx context.Context, lb *sacloud.LoadBalancer, owner string) error {
+	client := c.getAPIClient()
+
+	var settings []*sacloud.LoadBalancerSetting
+	if lb.Settings != nil {
+		for _, s := range lb.Settings.LoadBalancer {
+			if s.Description != owner {
+				settings = append(settings, s)
+			}
 		}
+	}
+	lb.Settings = &sacloud.LoadBalancerSettings{LoadBalancer: settings}
+	if _, err := client.UpdateLoadBalancer(ctx, lb.ID, lb); err != nil {
+		return err
+	}
+	return c.applyLoadBalancerConfig(ctx, client, lb)
+}
 
-	case LoadBalancerTypesSwitch:
-		sw, err = c.findLBConnectedSwitch(lbParam)
-		if err != nil {
-			return nil, err
+func (c *client) ReleaseLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, owner string, tags []string) error {
+	client := c.getAPIClient()
+
+	// settings made by creator of the LoadBalancer are kept
+	settings := []*sacloud.LoadBalancerSetting{}
+	if lb.Settings != nil {
+		for _, s := range lb.Settings.LoadBalancer {
+			if s.Description != owner {
+				settings = append(settings, s)
+			}
 		}
-		if sw == nil {
-			return nil, fmt.Errorf("switch resource (with tag[%s]) is not found", lbParam.RouterTags)
+	}
+	lb.Settings = &sacloud.LoadBalancerSettings{LoadBalancer: settings}
+	for _, tag := range tags {
+		lb.RemoveTag(tag)
+	}
+	if _, err := client.UpdateLoadBalancer(ctx, lb.ID, lb); err != nil {
+		return err
+	}
+	return c.applyLoadBalancerConfig(ctx, client, lb)
+}
+
+func (c *client) RetainLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, tags []string) error {
+	client := c.getAPIClient()
+
+	// keep VIPs, but stop forwarding to real servers.
+	// VIPs are released from its owner so that they can be reclaimed.
+	if lb.Settings != nil {
+		for _, setting := range lb.Settings.LoadBalancer {
+			setting.Servers = []*sacloud.LoadBalancerServer{}
+			setting.Description = ""
 		}
+	}
+	for _, tag := range tags {
+		lb.AppendTag(tag)
+	}
+	if _, err := client.UpdateLoadBalancer(ctx, lb.ID, lb); err != nil {
+		return err
+	}
+	return c.applyLoadBalancerConfig(ctx, client, lb)
+}
 
-		// VRID scope = clusterID
-		vrid, err = c.selectUniqVRID(lbParam, sw.ID)
-		if err != nil {
-			return nil, err
+func validateVIPInLoadBalancerNetwork(lb *sacloud.LoadBalancer, vip string) error {
+	if lb.Remark == nil || lb.Remark.Network == nil {
+		return fmt.Errorf("LoadBalancer %q has no network settings", lb.Name)
+	}
+	lbIP := ""
+	if len(lb.Remark.Servers) > 0 {
+		if ip, ok := lb.Remark.Servers[0].(map[string]interface{})["IPAddress"]; ok {
+			lbIP, _ = ip.(string)
 		}
+	}
+	_, lbIPNet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", lbIP, lb.Remark.Network.NetworkMaskLen))
+	if err != nil {
+		return err
+	}
+	parsedVIP := net.ParseIP(vip)
+	if parsedVIP == nil {
+		return errorf(ErrInvalidVIP, "VIP %q is invalid", vip)
+	}
+	if !lbIPNet.Contains(parsedVIP) {
+		return errorf(ErrInvalidVIP, "VIP %q must be in same LB network %q", vip, lbIPNet.String())
+	}
+	return nil
+}
 
-		// get assignable IPs
-		assignableIPInfo, err = c.extractAssignableInternalIPs(lbParam, sw)
-		if err != nil {
-			return nil, err
+func (c *client) extractLoadBalancerIPSettings(ctx context.Context, lbParam *LoadBalancerParam, sw *sacloud.Switch, reservations []*Reservation) (*loadBalancerIPs, error) {
+	// VRID scope = switch
+	vrid, err := c.selectUniqVRID(ctx, lbParam, sw.ID, reservedVRIDs(reservations))
+	if err != nil {
+		return nil, err
+	}
+
+	// get assignable IPs
+	assignableIPInfo, err := c.extractAssignableIPs(ctx, lbParam, lbParam.Type, sw, reservedIPs(reservations), lbParam.requiredIPs())
+	if errors.Is(err, ErrGlobalIPExhausted) {
+		if ips, routedErr := c.routedLoadBalancerIPs(ctx, lbParam, sw, reservations); routedErr == nil && ips != nil {
+			ips.vrid = vrid
+			return ips, nil
 		}
-	default:
-		return nil, fmt.Errorf("Invalid LoadBalancer type %q is specidied", lbParam.Type)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	vip, lbIP1, lbIP2, err := c.choiceLoadBalancerIPs(lbParam, assignableIPInfo.assignableIPs, assignableIPInfo.usedIPs)
+	vip, lbIP1, lbIP2, err := c.choiceLoadBalancerIPs(lbParam, assignableIPInfo)
 	if err != nil {
 		return nil, err
 	}
 
 	// check VIP
-	_, lbIPNet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", lbIP1, assignableIPInfo.maskLen))
+	_, lbIPNet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", lbIP1, assignableIPInfo.maskLen()))
 	if err != nil {
 		return nil, err
 	}
-	parsedVIP, _, err := net.ParseCIDR(fmt.Sprintf("%s/%d", vip, assignableIPInfo.maskLen))
+	parsedVIP, _, err := net.ParseCIDR(fmt.Sprintf("%s/%d", vip, assignableIPInfo.maskLen()))
 	if err != nil {
 		return nil, err
 	}
 	if !lbIPNet.Contains(parsedVIP) {
-		return nil, fmt.Errorf("VIP %q must be in same LB network %q", vip, lbIPNet.String())
+		return nil, errorf(ErrInvalidVIP, "VIP %q must be in same LB network %q", vip, lbIPNet.String())
 	}
 
 	return &loadBalancerIPs{
@@ -297,146 +518,200 @@ func (c *client) extractLoadBalancerIPSettings(lbParam *LoadBalancerParam) (*loa
 		vip:       vip,
 		ip1:       lbIP1,
 		ip2:       lbIP2,
-		nwMaskLen: assignableIPInfo.maskLen,
-		gateway:   assignableIPInfo.gateway,
+		nwMaskLen: assignableIPInfo.maskLen(),
+		gateway:   assignableIPInfo.subnet.gateway,
 	}, nil
 
 }
 
-func (c *client) choiceLoadBalancerIPs(lbParam *LoadBalancerParam, assignableIPs []string, usedIPs []string) (string, string, string, error) {
-	lbAllocatable := false
+// routedLoadBalancerIPs returns IPs of the LoadBalancer whose VIP is in routed subnet added by ExpandRouterSubnet.
+// IP address of the LoadBalancer is the next-hop reserved for it, and nil is returned if it isn't reserved.
+func (c *client) routedLoadBalancerIPs(ctx context.Context, lbParam *LoadBalancerParam, sw *sacloud.Switch, reservations []*Reservation) (*loadBalancerIPs, error) {
+	if lbParam.UseHA || lbParam.VIP != "" {
+		return nil, nil
+	}
+	nextHop := ""
+	var others []*Reservation
+	for _, r := range reservations {
+		if r.ID == lbParam.Name && r.VRID == 0 && len(r.IPAddresses) == 1 {
+			nextHop = r.IPAddresses[0]
+			continue
+		}
+		others = append(others, r)
+	}
+	if nextHop == "" {
+		return nil, nil
+	}
+
+	p, err := c.externalIPAM(ctx, lbParam, sw, reservedIPs(others))
+	if err != nil {
+		return nil, err
+	}
+	var connected *ipamSubnet
+	for _, subnet := range p.subnets {
+		if !subnet.isRouted() && subnet.network.Contains(net.ParseIP(nextHop)) {
+			connected = subnet
+		}
+	}
+	if connected == nil {
+		return nil, nil
+	}
+	for _, subnet := range p.subnets {
+		if subnet.nextHop != nextHop {
+			continue
+		}
+		if vips := p.available(subnet, 1); len(vips) > 0 {
+			return &loadBalancerIPs{
+				switchID:  sw.ID,
+				vip:       vips[0],
+				ip1:       nextHop,
+				nwMaskLen: connected.maskLen(),
+				gateway:   connected.gateway,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *client) choiceLoadBalancerIPs(lbParam *LoadBalancerParam, assignableIPInfo *assignableIPInfo) (string, string, string, error) {
 	var lbIP1, lbIP2, vip string
 	if lbParam.VIP != "" {
 		// validate vip
-		for _, used := range usedIPs {
-			if used == lbParam.VIP {
-				return "", "", "", fmt.Errorf("VIP %q is already used", lbParam.VIP)
-			}
+		if assignableIPInfo.ipam.isUsed(lbParam.VIP) {
+			return "", "", "", errorf(ErrVIPConflict, "VIP %q is already used", lbParam.VIP)
 		}
 		vip = lbParam.VIP
 	}
 
+	reqIPNum := lbParam.requiredIPs()
+	assignableIPs := assignableIPInfo.assignableIPs(reqIPNum)
+	if len(assignableIPs) < reqIPNum {
+		return "", "", "", ErrIPExhausted
+	}
+
+	lbIP1 = assignableIPs[0]
 	if lbParam.UseHA {
-		reqIPNum := 3
-		if lbParam.VIP != "" {
-			reqIPNum = 2
-		}
-		if len(assignableIPs) >= reqIPNum { // for LB HA
-			lbAllocatable = true
-			lbIP1 = assignableIPs[0]
-			lbIP2 = assignableIPs[1]
-			if vip == "" {
-				vip = assignableIPs[2]
-			}
-		}
-	} else {
-		reqIPNum := 2
-		if lbParam.VIP != "" {
-			reqIPNum = 1
-		}
-		if len(assignableIPs) >= reqIPNum { // for LB single
-			lbAllocatable = true
-			lbIP1 = assignableIPs[0]
-			if vip == "" {
-				vip = assignableIPs[1]
-			}
-		}
+		lbIP2 = assignableIPs[1]
 	}
-	if !lbAllocatable {
-		return "", "", "", errors.New("usable ip-address not found")
+	if vip == "" {
+		vip = assignableIPs[reqIPNum-1]
 	}
 
 	return vip, lbIP1, lbIP2, nil
 }
 
+// assignableIPInfo represents subnet for LoadBalancer and assignable IPs in it
 type assignableIPInfo struct {
-	assignableIPs []string
-	usedIPs       []string
-	maskLen       int
-	gateway       string
+	ipam   *ipam
+	subnet *ipamSubnet
 }
 
-func (c *client) extractAssignableInternalIPs(lbParam *LoadBalancerParam, sw *sacloud.Switch) (*assignableIPInfo, error) {
+// assignableIPs returns at most n assignable IPs in ascending order
+func (a *assignableIPInfo) assignableIPs(n int) []string {
+	return a.ipam.available(a.subnet, n)
+}
+
+func (a *assignableIPInfo) isAssignable(ip string) bool {
+	return a.ipam.isAvailable(a.subnet, ip)
+}
+
+func (a *assignableIPInfo) maskLen() int {
+	return a.subnet.maskLen()
+}
+
+func (c *client) extractAssignableInternalIPs(ctx context.Context, lbParam *LoadBalancerParam, sw *sacloud.Switch, reservedIPs []string) (*assignableIPInfo, error) {
 	// IPAddress scope = clusterID
-	usedIPs, err := c.extractConsumedIPsFromLoadBalancerWithSwitch(lbParam, sw.ID)
+	usedIPs, err := c.extractConsumedIPsFromLoadBalancerWithSwitch(ctx, lbParam, sw.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	// parse LoadBalancer network options
-	assignIP, poolSize, err := lbParam.assignAddresses()
+	subnet, err := newIPAMSubnet(lbParam.IPAddressRange)
 	if err != nil {
-		return nil, err
+		return nil, errorf(ErrInvalidConfig, "invalid ip-address range %q: %s", lbParam.IPAddressRange, err)
 	}
-
-	// search assignable IPAddress
-	var assignableIPs []string
-	baseIPPart := assignIP[3]
-	for i := 1; len(assignableIPs) < 3 && i < poolSize; i++ {
-		// Note: current implementation is not support lager than /24 subnet for assign IP
-		assignIP[3] = baseIPPart + byte(i)
-		found := false
-		for _, used := range usedIPs {
-			if used == assignIP.String() {
-				found = true
-				break
-			}
-		}
-		if !found {
-			assignableIPs = append(assignableIPs, assignIP.String())
+	if lbParam.AssignIPAddressRange != "" {
+		if err := subnet.restrictToCIDR(lbParam.AssignIPAddressRange); err != nil {
+			return nil, errorf(ErrInvalidConfig, "invalid assign ip-address range %q: %s", lbParam.AssignIPAddressRange, err)
 		}
 	}
+	subnet.gateway = lbParam.DefaultGateway
+
+	p := newIPAM(subnet)
+	p.excludeIPs(usedIPs...)
+	p.excludeIPs(reservedIPs...)
+	if err := p.exclude(lbParam.ExcludeIPAddresses...); err != nil {
+		return nil, errorf(ErrInvalidConfig, "invalid exclude ip-addresses: %s", err)
+	}
+	switchFreeIPAddresses.WithLabelValues(switchIDLabel(sw.ID)).Set(float64(p.countAvailable()))
+
+	return &assignableIPInfo{ipam: p, subnet: subnet}, nil
+}
 
-	maskLen, err := lbParam.nwMaskLen()
+func (c *client) extractAssignableExternalIPs(ctx context.Context, lbParam *LoadBalancerParam, routerConnectedSwitch *sacloud.Switch, reservedIPs []string, required int) (*assignableIPInfo, error) {
+	p, err := c.externalIPAM(ctx, lbParam, routerConnectedSwitch, reservedIPs)
 	if err != nil {
 		return nil, err
 	}
 
-	return &assignableIPInfo{
-		assignableIPs: assignableIPs,
-		usedIPs:       usedIPs,
-		maskLen:       maskLen,
-		gateway:       lbParam.DefaultGateway,
-	}, nil
+	// LoadBalancer must be connected to the subnet directly
+	subnet := p.subnetFor(required, false)
+	if subnet == nil {
+		return nil, ErrGlobalIPExhausted
+	}
+	return &assignableIPInfo{ipam: p, subnet: subnet}, nil
 }
 
-func (c *client) extractAssignableExternalIPs(_ *LoadBalancerParam, routerConnectedSwitch *sacloud.Switch) (*assignableIPInfo, error) {
-	var globalIPs []*globalIPList
-	ips, err := routerConnectedSwitch.GetIPAddressList()
+func (c *client) externalIPAM(ctx context.Context, lbParam *LoadBalancerParam, routerConnectedSwitch *sacloud.Switch, reservedIPs []string) (*ipam, error) {
+	subnets, err := switchIPAMSubnets(routerConnectedSwitch)
 	if err != nil {
 		return nil, err
 	}
-	globalIPs = append(globalIPs, &globalIPList{
-		gateway:        routerConnectedSwitch.Subnets[0].DefaultRoute,
-		networkAddress: routerConnectedSwitch.Subnets[0].NetworkAddress,
-		addresses:      ips,
-		nwMaskLen:      routerConnectedSwitch.Subnets[0].NetworkMaskLen,
-	})
-	usedIPs, err := c.extractConsumedGlobalIPs(routerConnectedSwitch.ID)
+	usedIPs, err := c.extractConsumedGlobalIPs(ctx, routerConnectedSwitch.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	usableIPSubnets := c.usableGlobalIPs(globalIPs, usedIPs)
-	if len(usableIPSubnets) == 0 {
-		return nil, errors.New("usable global-ip-address not found")
+	p := newIPAM(subnets...)
+	p.excludeIPs(usedIPs...)
+	p.excludeIPs(reservedIPs...)
+	if err := p.exclude(lbParam.ExcludeIPAddresses...); err != nil {
+		return nil, errorf(ErrInvalidConfig, "invalid exclude ip-addresses: %s", err)
 	}
-	lbSubnet := usableIPSubnets[0]
-	var assignableIPs []string
-	for _, addr := range lbSubnet.addresses {
-		assignableIPs = append(assignableIPs, addr)
+	switchFreeIPAddresses.WithLabelValues(switchIDLabel(routerConnectedSwitch.ID)).Set(float64(p.countAvailable()))
+	return p, nil
+}
+
+// switchIPAMSubnets returns IPv4 subnets of the switch includes routed subnets of Internet router
+func switchIPAMSubnets(sw *sacloud.Switch) ([]*ipamSubnet, error) {
+	if len(sw.Subnets) == 0 {
+		return nil, fmt.Errorf("switch[%d].Subnets is nil", sw.ID)
 	}
-	return &assignableIPInfo{
-		assignableIPs: assignableIPs,
-		usedIPs:       usedIPs,
-		maskLen:       lbSubnet.nwMaskLen,
-		gateway:       lbSubnet.gateway,
-	}, nil
+
+	var subnets []*ipamSubnet
+	for _, s := range sw.Subnets {
+		if s.Subnet == nil || s.NetworkAddress == "" {
+			continue
+		}
+		subnet, err := newIPAMSubnet(fmt.Sprintf("%s/%d", s.NetworkAddress, s.NetworkMaskLen))
+		if err != nil {
+			return nil, err
+		}
+		if s.IPAddresses.Min != "" && s.IPAddresses.Max != "" {
+			if err := subnet.restrict(s.IPAddresses.Min, s.IPAddresses.Max); err != nil {
+				return nil, err
+			}
+		}
+		subnet.gateway = s.DefaultRoute
+		subnet.nextHop = s.NextHop
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
 }
 
-func (c *client) findLBConnectedSwitch(lbParam *LoadBalancerParam) (*sacloud.Switch, error) {
+func (c *client) findLBConnectedSwitch(ctx context.Context, lbParam *LoadBalancerParam) (*sacloud.Switch, error) {
 
-	switches, err := c.apiClient.FindSwitchesByTags(lbParam.RouterTags...)
+	switches, err := c.apiClient.FindSwitchesByTags(ctx, lbParam.RouterTags...)
 	if err != nil {
 		return nil, err
 	}
@@ -447,23 +722,23 @@ func (c *client) findLBConnectedSwitch(lbParam *LoadBalancerParam) (*sacloud.Swi
 	return nil, nil
 }
 
-func (c *client) findLBConnectedRouterSwitch(lbParam *LoadBalancerParam) (*sacloud.Switch, error) {
+func (c *client) findLBConnectedRouterSwitch(ctx context.Context, lbParam *LoadBalancerParam) (*sacloud.Switch, error) {
 
-	routers, err := c.apiClient.FindRoutersByTags(lbParam.RouterTags...)
+	routers, err := c.apiClient.FindRoutersByTags(ctx, lbParam.RouterTags...)
 	if err != nil {
 		return nil, err
 	}
 	if len(routers) > 0 {
 		router := routers[0]
 		var sw *sacloud.Switch
-		sw, err = c.apiClient.ReadSwitch(router.Switch.ID)
+		sw, err = c.apiClient.ReadSwitch(ctx, router.Switch.ID)
 		if err != nil {
 			return nil, err
 		}
 		return sw, nil
 	}
 
-	switches, err := c.apiClient.FindSwitchesByTags(lbParam.RouterTags...)
+	switches, err := c.apiClient.FindSwitchesByTags(ctx, lbParam.RouterTags...)
 	if err != nil {
 		return nil, err
 	}
@@ -474,61 +749,59 @@ func (c *client) findLBConnectedRouterSwitch(lbParam *LoadBalancerParam) (*saclo
 	return nil, nil
 }
 
-func (c *client) extractConsumedGlobalIPs(routerSwitchID int64) ([]string, error) {
+// extractConsumedGlobalIPsTimeout is timeout of listing resources connected to router switch
+var extractConsumedGlobalIPsTimeout = time.Minute
+
+func (c *client) extractConsumedGlobalIPs(ctx context.Context, routerSwitchID int64) ([]string, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, extractConsumedGlobalIPsTimeout)
+	// stops remaining collectors on return
+	defer cancel()
 
-	var wg = sync.WaitGroup{}
-	collectors := []func(apiClient, int64) ([]string, error){
+	collectors := []func(context.Context, apiClient, int64) ([]string, error){
 		c.extractConsumedIPsFromServer,
 		c.extractConsumedIPsFromRouter,
 		c.extractConsumedIPsFromLoadBalancer,
 		c.extractConsumedIPsFromVPCRouter,
 		c.extractConsumedIPsFromDB,
 	}
-	wg.Add(len(collectors))
-	var resultChan = make(chan []string)
-	var errChan = make(chan error)
-	var done = make(chan bool)
-	results := []string{}
+	type result struct {
+		ips []string
+		err error
+	}
+	// buffered, so that collectors never block after returning early
+	resultChan := make(chan result, len(collectors))
 
 	for _, v := range collectors {
 		collector := v
 		go func() {
-			client := c.getAPIClient()
-			ips, err := collector(client, routerSwitchID)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			resultChan <- ips
+			ips, err := collector(ctx, c.getAPIClient(), routerSwitchID)
+			resultChan <- result{ips: ips, err: err}
 		}()
 	}
 
-	// wait for extract complete
-	go func() {
-		wg.Wait()
-		done <- true
-	}()
-
-	lock := sync.Mutex{}
-	for {
+	results := []string{}
+	for range collectors {
+		var err error
 		select {
-		case ips := <-resultChan:
-			lock.Lock()
-			results = append(results, ips...)
-			lock.Unlock()
-			wg.Done()
-		case err := <-errChan:
+		case r := <-resultChan:
+			results = append(results, r.ips...)
+			err = r.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			if parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("Extracting consumed GlobalIPs timed out")
+			}
 			return nil, err
-		case <-done:
-			return results, nil
-		case <-time.After(time.Minute):
-			return nil, fmt.Errorf("Extracting consumed GlobalIPs timed out")
 		}
 	}
+	return results, nil
 }
 
-func (c *client) extractConsumedIPsFromServer(client apiClient, routerSwitchID int64) (ips []string, err error) {
-	servers, err := client.FindServers()
+func (c *client) extractConsumedIPsFromServer(ctx context.Context, client apiClient, routerSwitchID int64) (ips []string, err error) {
+	servers, err := client.FindServers(ctx)
 	if err != nil {
 		return
 	}
@@ -543,9 +816,9 @@ func (c *client) extractConsumedIPsFromServer(client apiClient, routerSwitchID i
 	return
 }
 
-func (c *client) extractConsumedIPsFromRouter(client apiClient, routerSwitchID int64) (ips []string, err error) {
+func (c *client) extractConsumedIPsFromRouter(ctx context.Context, client apiClient, routerSwitchID int64) (ips []string, err error) {
 	var sw *sacloud.Switch
-	sw, err = client.ReadSwitch(routerSwitchID)
+	sw, err = client.ReadSwitch(ctx, routerSwitchID)
 	if err != nil {
 		return
 	}
@@ -557,8 +830,8 @@ func (c *client) extractConsumedIPsFromRouter(client apiClient, routerSwitchID i
 	return
 }
 
-func (c *client) extractConsumedIPsFromLoadBalancer(client apiClient, routerSwitchID int64) (ips []string, err error) {
-	lbs, err := client.FindLoadBalancers()
+func (c *client) extractConsumedIPsFromLoadBalancer(ctx context.Context, client apiClient, routerSwitchID int64) (ips []string, err error) {
+	lbs, err := client.FindLoadBalancers(ctx)
 	if err != nil {
 		return
 	}
@@ -583,34 +856,8 @@ func (c *client) extractConsumedIPsFromLoadBalancer(client apiClient, routerSwit
 	return
 }
 
-func (c *client) selectUniqVRID(lbParam *LoadBalancerParam, switchID int64) (int, error) {
-	lbs, err := c.apiClient.FindLoadBalancersByTags(lbParam.ClusterSelector...)
-	if err != nil {
-		return -1, err
-	}
-	var vrids []int
-	for _, lb := range lbs {
-		if lb.Switch.ID == switchID {
-			vrids = append(vrids, lb.Remark.VRRP.VRID)
-		}
-	}
-
-	for vrid := 1; ; vrid++ {
-		found := false
-		for _, used := range vrids {
-			if used == vrid {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return vrid, nil
-		}
-	}
-}
-
-func (c *client) extractConsumedIPsFromLoadBalancerWithSwitch(lbParam *LoadBalancerParam, switchID int64) (ips []string, err error) {
-	lbs, err := c.apiClient.FindLoadBalancersByTags(lbParam.ClusterSelector...)
+func (c *client) extractConsumedIPsFromLoadBalancerWithSwitch(ctx context.Context, lbParam *LoadBalancerParam, switchID int64) (ips []string, err error) {
+	lbs, err := c.apiClient.FindLoadBalancersByTags(ctx, lbParam.ClusterSelector...)
 	if err != nil {
 		return
 	}
@@ -635,8 +882,8 @@ func (c *client) extractConsumedIPsFromLoadBalancerWithSwitch(lbParam *LoadBalan
 	return
 }
 
-func (c *client) extractConsumedIPsFromVPCRouter(client apiClient, routerSwitchID int64) (ips []string, err error) {
-	vpcRouters, err := client.FindVPCRouters()
+func (c *client) extractConsumedIPsFromVPCRouter(ctx context.Context, client apiClient, routerSwitchID int64) (ips []string, err error) {
+	vpcRouters, err := client.FindVPCRouters(ctx)
 	if err != nil {
 		return
 	}
@@ -652,8 +899,8 @@ func (c *client) extractConsumedIPsFromVPCRouter(client apiClient, routerSwitchI
 	return
 }
 
-func (c *client) extractConsumedIPsFromDB(client apiClient, routerSwitchID int64) (ips []string, err error) {
-	dbs, err := client.FindDatabases()
+func (c *client) extractConsumedIPsFromDB(ctx context.Context, client apiClient, routerSwitchID int64) (ips []string, err error) {
+	dbs, err := client.FindDatabases(ctx)
 	if err != nil {
 		return
 	}
@@ -671,31 +918,3 @@ func (c *client) extractConsumedIPsFromDB(client apiClient, routerSwitchID int64
 	}
 	return
 }
-
-func (c *client) usableGlobalIPs(subnets []*globalIPList, usedIPs []string) []*globalIPList {
-	var res []*globalIPList
-	for _, subnet := range subnets {
-		var ips []string
-		for _, ip := range subnet.addresses {
-			exists := false
-			for _, v := range usedIPs {
-				if v == ip {
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				ips = append(ips, ip)
-			}
-		}
-		if len(ips) > 0 {
-			res = append(res, &globalIPList{
-				gateway:        subnet.gateway,
-				addresses:      ips,
-				networkAddress: subnet.networkAddress,
-				nwMaskLen:      subnet.nwMaskLen,
-			})
-		}
-	}
-	return res
-}
@@ -0,0 +1,173 @@
+package iaas
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+// loadBalancerState represents attributes of LoadBalancer managed by UpdateLoadBalancer
+type loadBalancerState struct {
+	name        string
+	description string
+	tags        []string
+	settings    []*sacloud.LoadBalancerSetting
+}
+
+func currentLoadBalancerState(lb *sacloud.LoadBalancer) *loadBalancerState {
+	state := &loadBalancerState{
+		name:        lb.Name,
+		description: lb.Description,
+		tags:        append([]string{}, lb.Tags...),
+	}
+	if lb.Settings != nil {
+		state.settings = append(state.settings, lb.Settings.LoadBalancer...)
+	}
+	return state
+}
+
+// snapshot returns a copy of state which isn't affected by changes of the LoadBalancer
+func (s *loadBalancerState) snapshot() *loadBalancerState {
+	copied := &loadBalancerState{name: s.name, description: s.description, tags: s.tags}
+	for _, setting := range s.settings {
+		c := *setting
+		c.Servers = nil
+		for _, server := range setting.Servers {
+			server := *server
+			c.Servers = append(c.Servers, &server)
+		}
+		copied.settings = append(copied.settings, &c)
+	}
+	return copied
+}
+
+// diffLoadBalancerState returns human readable differences from current to desired.
+// Order of settings, servers and tags is ignored.
+func diffLoadBalancerState(current, desired *loadBalancerState) []string {
+	var diff []string
+	if current.name != desired.name {
+		diff = append(diff, fmt.Sprintf("name: %q -> %q", current.name, desired.name))
+	}
+	if current.description != desired.description {
+		diff = append(diff, fmt.Sprintf("description: %q -> %q", current.description, desired.description))
+	}
+	diff = append(diff, diffStrings("tag", current.tags, desired.tags)...)
+
+	currentSettings := map[string]*sacloud.LoadBalancerSetting{}
+	for _, s := range current.settings {
+		currentSettings[settingKey(s)] = s
+	}
+	desiredSettings := map[string]*sacloud.LoadBalancerSetting{}
+	for _, s := range desired.settings {
+		desiredSettings[settingKey(s)] = s
+	}
+
+	for _, key := range sortedSettingKeys(currentSettings) {
+		if _, ok := desiredSettings[key]; !ok {
+			diff = append(diff, fmt.Sprintf("- VIP %s", key))
+		}
+	}
+	for _, key := range sortedSettingKeys(desiredSettings) {
+		d := desiredSettings[key]
+		c, ok := currentSettings[key]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("+ VIP %s (servers: %d)", key, len(d.Servers)))
+			continue
+		}
+		diff = append(diff, diffSetting(key, c, d)...)
+	}
+	return diff
+}
+
+func diffSetting(key string, current, desired *sacloud.LoadBalancerSetting) []string {
+	var diff []string
+	if current.DelayLoop != desired.DelayLoop {
+		diff = append(diff, fmt.Sprintf("VIP %s delay loop: %q -> %q", key, current.DelayLoop, desired.DelayLoop))
+	}
+	if current.SorryServer != desired.SorryServer {
+		diff = append(diff, fmt.Sprintf("VIP %s sorry server: %q -> %q", key, current.SorryServer, desired.SorryServer))
+	}
+	if current.Description != desired.Description {
+		diff = append(diff, fmt.Sprintf("VIP %s description: %q -> %q", key, current.Description, desired.Description))
+	}
+
+	currentServers := map[string]string{}
+	for _, s := range current.Servers {
+		currentServers[s.IPAddress] = serverSpec(s)
+	}
+	desiredServers := map[string]string{}
+	for _, s := range desired.Servers {
+		desiredServers[s.IPAddress] = serverSpec(s)
+	}
+	for _, ip := range sortedKeys(currentServers) {
+		if _, ok := desiredServers[ip]; !ok {
+			diff = append(diff, fmt.Sprintf("VIP %s - server %s", key, ip))
+		}
+	}
+	for _, ip := range sortedKeys(desiredServers) {
+		c, ok := currentServers[ip]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("VIP %s + server %s %s", key, ip, desiredServers[ip]))
+		case c != desiredServers[ip]:
+			diff = append(diff, fmt.Sprintf("VIP %s server %s: %s -> %s", key, ip, c, desiredServers[ip]))
+		}
+	}
+	return diff
+}
+
+func diffStrings(name string, current, desired []string) []string {
+	var diff []string
+	for _, v := range sortedStrings(current) {
+		if !containsString(desired, v) {
+			diff = append(diff, fmt.Sprintf("- %s %s", name, v))
+		}
+	}
+	for _, v := range sortedStrings(desired) {
+		if !containsString(current, v) {
+			diff = append(diff, fmt.Sprintf("+ %s %s", name, v))
+		}
+	}
+	return diff
+}
+
+func settingKey(s *sacloud.LoadBalancerSetting) string {
+	return fmt.Sprintf("%s:%s", s.VirtualIPAddress, s.Port)
+}
+
+// serverSpec returns configurable attributes of real server, status fields reported by API are ignored
+func serverSpec(s *sacloud.LoadBalancerServer) string {
+	spec := fmt.Sprintf("port=%s enabled=%s", s.Port, s.Enabled)
+	if s.HealthCheck != nil {
+		spec += fmt.Sprintf(" healthcheck=%s", s.HealthCheck.Protocol)
+		if s.HealthCheck.Path != "" || s.HealthCheck.Status != "" {
+			spec += fmt.Sprintf("(%s %s)", s.HealthCheck.Path, s.HealthCheck.Status)
+		}
+	}
+	return spec
+}
+
+func sortedSettingKeys(m map[string]*sacloud.LoadBalancerSetting) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedStrings(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,134 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_UpdateLoadBalancer_Diff(t *testing.T) {
+	api := newTestAPIClient(1)
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	lb := testLoadBalancerWithVIPs("test", "192.2.0.10")
+	lbParam := &LoadBalancerParam{Name: "test", Tags: []string{"@k8s"}}
+	vipParam := &VIPParam{
+		Ports: []*VIPPorts{
+			{Port: 80, HealthCheck: &HealthCheck{Protocol: "ping", DelayLoop: 10, Port: 80}},
+		},
+		NodeIPs: []string{"192.2.0.11", "192.2.0.12"},
+		Type:    LoadBalancerTypesInternet,
+	}
+
+	_, err := c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, api.loadBalancerUpdates)
+	assert.Equal(t, 1, api.loadBalancerApplies)
+
+	// status fields reported by API and order of servers are ignored
+	lb.Settings.LoadBalancer[0].Servers[0].Status = "UP"
+	lb.Settings.LoadBalancer[0].Servers[0], lb.Settings.LoadBalancer[0].Servers[1] =
+		lb.Settings.LoadBalancer[0].Servers[1], lb.Settings.LoadBalancer[0].Servers[0]
+	_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, api.loadBalancerUpdates, "API must not be called without changes")
+	assert.Equal(t, 1, api.loadBalancerApplies)
+
+	vipParam.NodeIPs = []string{"192.2.0.11"}
+	vipParam.DisabledNodeIPs = []string{"192.2.0.12"}
+	_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, api.loadBalancerUpdates)
+	assert.Equal(t, 2, api.loadBalancerApplies)
+
+	// description of adopted LoadBalancer is owned by its creator
+	lbParam.Description = `{"name":"test","uid":"uid1"}`
+	lbParam.Adopted = true
+	_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, api.loadBalancerUpdates)
+
+	lbParam.Adopted = false
+	_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, api.loadBalancerUpdates)
+	assert.Equal(t, lbParam.Description, lb.Description)
+}
+
+func TestClient_UpdateLoadBalancer_Apply(t *testing.T) {
+	lbParam := &LoadBalancerParam{Name: "test"}
+	vipParam := &VIPParam{
+		Ports: []*VIPPorts{
+			{Port: 80, HealthCheck: &HealthCheck{Protocol: "ping", DelayLoop: 10, Port: 80}},
+		},
+		NodeIPs: []string{"192.2.0.11"},
+		Type:    LoadBalancerTypesInternet,
+	}
+	// LoadBalancer created with desired settings
+	newCreatedLoadBalancer := func() *sacloud.LoadBalancer {
+		lb := testLoadBalancerWithVIPs("test")
+		lb.Settings.LoadBalancer = buildLoadBalancerSettings("192.2.0.10", vipParam)
+		return lb
+	}
+
+	t.Run("first sync after boot", func(t *testing.T) {
+		api := newTestAPIClient(1)
+		c := &client{apiClient: api, reserver: NewMemoryReserver()}
+		lb := newCreatedLoadBalancer()
+
+		_, err := c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, api.loadBalancerUpdates, "settings are already written at creation")
+		assert.Equal(t, 1, api.loadBalancerApplies, "config must be applied without changes")
+
+		_, err = c.UpdateLoadBalancer(context.Background(), newCreatedLoadBalancer(), lbParam, vipParam)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, api.loadBalancerUpdates)
+		assert.Equal(t, 1, api.loadBalancerApplies, "applied config must not be applied again")
+	})
+
+	t.Run("retry failed apply", func(t *testing.T) {
+		api := newTestAPIClient(1)
+		c := &client{apiClient: api, reserver: NewMemoryReserver()}
+		lb := testLoadBalancerWithVIPs("test", "192.2.0.10")
+		api.applyLoadBalancerConfigError = errors.New("dummy")
+
+		_, err := c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+		assert.Error(t, err)
+		assert.Equal(t, 1, api.loadBalancerUpdates)
+		assert.Equal(t, 1, api.loadBalancerApplies)
+
+		// settings are updated, but config is not applied
+		api.applyLoadBalancerConfigError = nil
+		_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, api.loadBalancerUpdates)
+		assert.Equal(t, 2, api.loadBalancerApplies, "failed apply must be retried")
+
+		_, err = c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, api.loadBalancerUpdates)
+		assert.Equal(t, 2, api.loadBalancerApplies)
+	})
+}
+
+func TestDiffLoadBalancerState(t *testing.T) {
+	current := currentLoadBalancerState(testLoadBalancerWithVIPs("old", "192.2.0.10"))
+	current.tags = []string{"@k8s", "@k8s.Orphaned"}
+	desiredLB := testLoadBalancerWithVIPs("new", "192.2.0.20")
+	desiredLB.Settings.LoadBalancer[0].SorryServer = "192.2.0.100"
+	desired := currentLoadBalancerState(desiredLB)
+	desired.tags = []string{"@k8s"}
+
+	assert.Equal(t, []string{
+		`name: "old" -> "new"`,
+		"- tag @k8s.Orphaned",
+		"- VIP 192.2.0.10:80",
+		"+ VIP 192.2.0.20:80 (servers: 0)",
+	}, diffLoadBalancerState(current, desired))
+
+	assert.Empty(t, diffLoadBalancerState(desired, desired))
+}
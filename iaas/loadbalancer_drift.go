@@ -0,0 +1,42 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+// LoadBalancerDrift returns immutable attributes of the LoadBalancer which differ from lbParam.
+// They can't be changed by UpdateLoadBalancer, so the LoadBalancer must be replaced to apply them.
+// Switch is looked up only when the network isn't recorded to the LoadBalancer as same as lbParam.
+func (c *client) LoadBalancerDrift(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam) ([]string, error) {
+	var drift []string
+
+	premium := lb.GetPlanID() == int64(sacloud.LoadBalancerPlanPremium)
+	if premium != lbParam.UseHighSpecPlan {
+		drift = append(drift, fmt.Sprintf("plan: %s -> %s", loadBalancerPlanName(premium), loadBalancerPlanName(lbParam.UseHighSpecPlan)))
+	}
+	ha := lb.Remark != nil && len(lb.Remark.Servers) > 1
+	if ha != lbParam.UseHA {
+		drift = append(drift, fmt.Sprintf("ha: %t -> %t", ha, lbParam.UseHA))
+	}
+
+	if lb.Switch != nil && !lbParam.NetworkRecorded {
+		sw, err := c.findLBSwitch(ctx, lbParam, lbParam.Type)
+		if err != nil {
+			return nil, err
+		}
+		if sw.ID != lb.Switch.ID {
+			drift = append(drift, fmt.Sprintf("switch: %s -> %s", lb.Switch.GetStrID(), sw.GetStrID()))
+		}
+	}
+	return drift, nil
+}
+
+func loadBalancerPlanName(premium bool) string {
+	if premium {
+		return "premium"
+	}
+	return "standard"
+}
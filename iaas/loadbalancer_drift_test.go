@@ -0,0 +1,36 @@
+package iaas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_LoadBalancerDrift(t *testing.T) {
+	api := newTestRouterAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	lb := testLoadBalancerWithVIPs("test", "192.2.0.4")
+	lb.Plan = sacloud.NewResource(int64(sacloud.LoadBalancerPlanStandard))
+
+	drift, err := c.LoadBalancerDrift(context.Background(), lb, &LoadBalancerParam{Type: LoadBalancerTypesInternet})
+	assert.NoError(t, err)
+	assert.Empty(t, drift)
+
+	drift, err = c.LoadBalancerDrift(context.Background(), lb, &LoadBalancerParam{Type: LoadBalancerTypesInternet, UseHighSpecPlan: true, UseHA: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plan: standard -> premium", "ha: false -> true"}, drift)
+
+	lb.Switch = &sacloud.Switch{Resource: sacloud.NewResource(2)}
+	drift, err = c.LoadBalancerDrift(context.Background(), lb, &LoadBalancerParam{Type: LoadBalancerTypesInternet})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"switch: 2 -> 1"}, drift)
+
+	// switch isn't looked up while recorded network is same
+	api.router = nil
+	drift, err = c.LoadBalancerDrift(context.Background(), lb, &LoadBalancerParam{Type: LoadBalancerTypesInternet, NetworkRecorded: true})
+	assert.NoError(t, err)
+	assert.Empty(t, drift)
+}
@@ -1,8 +1,12 @@
 package iaas
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/sacloud/libsacloud/sacloud"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -37,3 +41,152 @@ func TestLoadBalancerParam_assignAddressed(t *testing.T) {
 		assert.Equal(t, expect.hasError, err != nil, "assignAddresses: unexpected error")
 	}
 }
+
+func TestBuildLoadBalancerSettings(t *testing.T) {
+	vipParam := &VIPParam{
+		Ports: []*VIPPorts{
+			{Port: 80, HealthCheck: &HealthCheck{Protocol: "ping", DelayLoop: 10, Port: 80}},
+		},
+		NodeIPs:         []string{"192.2.0.11"},
+		DisabledNodeIPs: []string{"192.2.0.12"},
+		SorryServer:     "192.2.0.100",
+	}
+
+	settings := buildLoadBalancerSettings("192.2.0.10", vipParam)
+	assert.Len(t, settings, 1)
+	assert.Equal(t, "192.2.0.100", settings[0].SorryServer)
+	assert.Len(t, settings[0].Servers, 2)
+	assert.Equal(t, "192.2.0.11", settings[0].Servers[0].IPAddress)
+	assert.Equal(t, "True", settings[0].Servers[0].Enabled)
+	assert.Equal(t, "192.2.0.12", settings[0].Servers[1].IPAddress)
+	assert.Equal(t, "False", settings[0].Servers[1].Enabled, "real server on draining node must be disabled")
+}
+
+// blockingAPIClient blocks listing resources until ctx is done, except FindDatabases returning err
+type blockingAPIClient struct {
+	apiClient
+	err error
+}
+
+func (b *blockingAPIClient) Clone() apiClient {
+	return b
+}
+
+func (b *blockingAPIClient) FindServers(ctx context.Context) ([]sacloud.Server, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingAPIClient) ReadSwitch(ctx context.Context, id int64) (*sacloud.Switch, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingAPIClient) FindLoadBalancers(ctx context.Context) ([]sacloud.LoadBalancer, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingAPIClient) FindVPCRouters(ctx context.Context) ([]sacloud.VPCRouter, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingAPIClient) FindDatabases(ctx context.Context) ([]sacloud.Database, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClient_extractConsumedGlobalIPs_Cancel(t *testing.T) {
+	defaultTimeout := extractConsumedGlobalIPsTimeout
+	defer func() { extractConsumedGlobalIPsTimeout = defaultTimeout }()
+	collectorErr := errors.New("error")
+
+	expects := []struct {
+		caseName string
+		err      error
+		timeout  time.Duration
+		cancel   bool
+		expect   string
+	}{
+		{caseName: "collector failed", err: collectorErr, timeout: time.Minute, expect: "error"},
+		{caseName: "timed out", timeout: 10 * time.Millisecond, expect: "Extracting consumed GlobalIPs timed out"},
+		{caseName: "canceled", timeout: time.Minute, cancel: true, expect: context.Canceled.Error()},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			defer checkGoroutineLeak(t)()
+			extractConsumedGlobalIPsTimeout = expect.timeout
+			c := &client{apiClient: &blockingAPIClient{err: expect.err}}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if expect.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			_, err := c.extractConsumedGlobalIPs(ctx, 1)
+			assert.EqualError(t, err, expect.expect)
+		})
+	}
+}
+
+func TestClient_AdoptedLoadBalancerSettings(t *testing.T) {
+	newAdoptedLoadBalancer := func() *sacloud.LoadBalancer {
+		// 192.2.0.10:80 is set by creator of the LoadBalancer without description
+		lb := testLoadBalancerWithVIPs("adopted", "192.2.0.10")
+		lb.Remark.Network = &sacloud.ApplianceRemarkNetwork{NetworkMaskLen: 24}
+		lb.Remark.Servers = []interface{}{map[string]interface{}{"IPAddress": "192.2.0.4"}}
+		return lb
+	}
+	lbParam := &LoadBalancerParam{Name: "test", Adopted: true}
+	vipParam := &VIPParam{
+		Ports: []*VIPPorts{
+			{Port: 80, HealthCheck: &HealthCheck{Protocol: "ping", DelayLoop: 10, Port: 80}},
+		},
+		NodeIPs: []string{"192.2.0.11"},
+		VIP:     "192.2.0.20",
+		Type:    LoadBalancerTypesInternet,
+		Owner:   "uid1",
+	}
+
+	t.Run("update", func(t *testing.T) {
+		api := newTestAPIClient(1)
+		c := &client{apiClient: api, reserver: NewMemoryReserver()}
+		lb := newAdoptedLoadBalancer()
+
+		vips, err := c.UpdateLoadBalancer(context.Background(), lb, lbParam, vipParam)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.2.0.20"}, vips)
+		if assert.Len(t, lb.Settings.LoadBalancer, 2) {
+			assert.Equal(t, "192.2.0.10", lb.Settings.LoadBalancer[0].VirtualIPAddress, "setting of creator must be kept")
+			assert.Empty(t, lb.Settings.LoadBalancer[0].Servers)
+			assert.Equal(t, "192.2.0.20", lb.Settings.LoadBalancer[1].VirtualIPAddress)
+			assert.Equal(t, "uid1", lb.Settings.LoadBalancer[1].Description)
+		}
+
+		// VIP of creator can't be taken over
+		conflict := *vipParam
+		conflict.VIP = "192.2.0.10"
+		_, err = c.UpdateLoadBalancer(context.Background(), newAdoptedLoadBalancer(), lbParam, &conflict)
+		assert.True(t, errors.Is(err, ErrVIPConflict), "unexpected error: %v", err)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		api := newTestAPIClient(1)
+		c := &client{apiClient: api, reserver: NewMemoryReserver()}
+		lb := newAdoptedLoadBalancer()
+		lb.Settings.LoadBalancer = append(lb.Settings.LoadBalancer, buildLoadBalancerSettings("192.2.0.20", vipParam)...)
+		lb.Tags = []string{"@k8s.Adopted"}
+
+		assert.NoError(t, c.ReleaseLoadBalancer(context.Background(), lb, "uid1", []string{"@k8s.Adopted"}))
+		if assert.Len(t, lb.Settings.LoadBalancer, 1) {
+			assert.Equal(t, "192.2.0.10", lb.Settings.LoadBalancer[0].VirtualIPAddress, "setting of creator must be kept")
+		}
+		assert.Empty(t, lb.Tags)
+		assert.Equal(t, 1, api.loadBalancerApplies)
+	})
+}
@@ -0,0 +1,403 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sacloud/libsacloud/api"
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+const metricsNamespace = "sakuracloud"
+
+var (
+	apiCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "calls_total",
+			Help:      "Number of SAKURA Cloud API operations, partitioned by operation.",
+		},
+		[]string{"operation"},
+	)
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "errors_total",
+			Help:      "Number of failed SAKURA Cloud API operations, partitioned by operation and HTTP status code(`unavailable` if failed fast by the circuit breaker, `unknown` if it isn't an API error).",
+		},
+		[]string{"operation", "code"},
+	)
+	apiRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "retries_total",
+			Help:      "Number of requests retried on 503 or 423 response of SAKURA Cloud API, partitioned by operation.",
+		},
+		[]string{"operation"},
+	)
+	apiDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "call_duration_seconds",
+			Help:      "Latency of SAKURA Cloud API operations including retries and waits, partitioned by operation.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"operation"},
+	)
+
+	switchFreeIPAddresses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "switch",
+			Name:      "free_ip_addresses",
+			Help:      "Number of IP addresses assignable to LoadBalancers on the switch, at the last allocation.",
+		},
+		[]string{"switch_id"},
+	)
+	switchUsedVRIDs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "switch",
+			Name:      "used_vrids",
+			Help:      "Number of VRIDs used or reserved on the switch, at the last allocation.",
+		},
+		[]string{"switch_id"},
+	)
+
+	loadBalancerDeleteDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "loadbalancer",
+			Name:      "delete_duration_seconds",
+			Help:      "Time to shut down and delete LoadBalancer, partitioned by result.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"result"},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers metrics of SAKURA Cloud API and resources to the default registry
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(apiCalls, apiErrors, apiRetries, apiDuration,
+			apiCircuitBreakerOpen,
+			switchFreeIPAddresses, switchUsedVRIDs, loadBalancerDeleteDuration)
+	})
+}
+
+func switchIDLabel(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// responseRecorder records HTTP responses of an operation.
+// libsacloud retries requests on 503 and 423 inside its HTTP client, so they are observed only here.
+type responseRecorder struct {
+	base http.RoundTripper
+
+	mu         sync.Mutex
+	retryable  int
+	lastStatus int
+}
+
+func (r *responseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.base.RoundTrip(req)
+	if res != nil {
+		r.mu.Lock()
+		r.lastStatus = res.StatusCode
+		if isRetryableStatus(res.StatusCode) {
+			r.retryable++
+		}
+		r.mu.Unlock()
+	}
+	return res, err
+}
+
+// retries returns number of retried requests.
+// Last retryable response means libsacloud gave up, so it isn't retried.
+func (r *responseRecorder) retries() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if isRetryableStatus(r.lastStatus) {
+		return r.retryable - 1
+	}
+	return r.retryable
+}
+
+// status returns status code of the last response
+func (r *responseRecorder) status() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastStatus
+}
+
+// errorCode returns HTTP status code of err for metrics label
+func (r *responseRecorder) errorCode(err error) string {
+	var apiErr api.Error
+	if errors.As(err, &apiErr) {
+		return strconv.Itoa(apiErr.ResponseCode())
+	}
+	if errors.Is(err, ErrUnavailable) {
+		return "unavailable"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if isRetryableStatus(r.lastStatus) {
+		// libsacloud gave up retrying
+		return strconv.Itoa(r.lastStatus)
+	}
+	return "unknown"
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusServiceUnavailable || code == http.StatusLocked
+}
+
+// instrumentedAPIClient is apiClient which records metrics of each operation.
+// Each operation is called on a clone of rawClient, so that responses are recorded per operation
+// even when the client is shared across goroutines.
+type instrumentedAPIClient struct {
+	rawClient *api.Client
+	transport http.RoundTripper
+}
+
+func newInstrumentedAPIClient(rawClient *api.Client) *instrumentedAPIClient {
+	transport := http.DefaultTransport
+	if rawClient.HTTPClient != nil && rawClient.HTTPClient.Transport != nil {
+		transport = rawClient.HTTPClient.Transport
+	}
+	return &instrumentedAPIClient{rawClient: rawClient, transport: transport}
+}
+
+// call calls fn with apiClient for an operation, and records its metrics
+func (c *instrumentedAPIClient) call(operation string, fn func(client apiClient) error) error {
+	recorder := &responseRecorder{base: c.transport}
+	rawClient := c.rawClient.Clone()
+	rawClient.HTTPClient = &http.Client{Transport: recorder}
+
+	start := time.Now()
+	err := fn(newDefaultAPIClient(rawClient))
+
+	apiCalls.WithLabelValues(operation).Inc()
+	apiDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if n := recorder.retries(); n > 0 {
+		apiRetries.WithLabelValues(operation).Add(float64(n))
+	}
+	if err != nil {
+		apiErrors.WithLabelValues(operation, recorder.errorCode(err)).Inc()
+	}
+	return newAPIError(operation, err, recorder.status())
+}
+
+func (c *instrumentedAPIClient) Clone() apiClient {
+	return &instrumentedAPIClient{rawClient: c.rawClient.Clone(), transport: c.transport}
+}
+
+func (c *instrumentedAPIClient) Zone() string {
+	return c.rawClient.Zone
+}
+
+func (c *instrumentedAPIClient) ReadAuthStatus(ctx context.Context) (res *sacloud.AuthStatus, err error) {
+	err = c.call("ReadAuthStatus", func(client apiClient) error {
+		res, err = client.ReadAuthStatus(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ReadSwitch(ctx context.Context, id int64) (res *sacloud.Switch, err error) {
+	err = c.call("ReadSwitch", func(client apiClient) error {
+		res, err = client.ReadSwitch(ctx, id)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindServers(ctx context.Context) (res []sacloud.Server, err error) {
+	err = c.call("FindServers", func(client apiClient) error {
+		res, err = client.FindServers(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ReadLoadBalancer(ctx context.Context, id int64) (res *sacloud.LoadBalancer, err error) {
+	err = c.call("ReadLoadBalancer", func(client apiClient) error {
+		res, err = client.ReadLoadBalancer(ctx, id)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindLoadBalancers(ctx context.Context) (res []sacloud.LoadBalancer, err error) {
+	err = c.call("FindLoadBalancers", func(client apiClient) error {
+		res, err = client.FindLoadBalancers(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindLoadBalancersByTags(ctx context.Context, tags ...string) (res []sacloud.LoadBalancer, err error) {
+	err = c.call("FindLoadBalancersByTags", func(client apiClient) error {
+		res, err = client.FindLoadBalancersByTags(ctx, tags...)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindRoutersByTags(ctx context.Context, tags ...string) (res []sacloud.Internet, err error) {
+	err = c.call("FindRoutersByTags", func(client apiClient) error {
+		res, err = client.FindRoutersByTags(ctx, tags...)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ReadRouter(ctx context.Context, id int64) (res *sacloud.Internet, err error) {
+	err = c.call("ReadRouter", func(client apiClient) error {
+		res, err = client.ReadRouter(ctx, id)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) UpdateRouter(ctx context.Context, id int64, value *sacloud.Internet) (res *sacloud.Internet, err error) {
+	err = c.call("UpdateRouter", func(client apiClient) error {
+		res, err = client.UpdateRouter(ctx, id, value)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) AddRouterSubnet(ctx context.Context, id int64, nwMaskLen int, nextHop string) (res *sacloud.Subnet, err error) {
+	err = c.call("AddRouterSubnet", func(client apiClient) error {
+		res, err = client.AddRouterSubnet(ctx, id, nwMaskLen, nextHop)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) DeleteRouterSubnet(ctx context.Context, id int64, subnetID int64) error {
+	return c.call("DeleteRouterSubnet", func(client apiClient) error {
+		return client.DeleteRouterSubnet(ctx, id, subnetID)
+	})
+}
+
+func (c *instrumentedAPIClient) UpdateRouterSubnet(ctx context.Context, id int64, subnetID int64, nextHop string) (res *sacloud.Subnet, err error) {
+	err = c.call("UpdateRouterSubnet", func(client apiClient) error {
+		res, err = client.UpdateRouterSubnet(ctx, id, subnetID, nextHop)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindSwitchesByTags(ctx context.Context, tags ...string) (res []sacloud.Switch, err error) {
+	err = c.call("FindSwitchesByTags", func(client apiClient) error {
+		res, err = client.FindSwitchesByTags(ctx, tags...)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindVPCRouters(ctx context.Context) (res []sacloud.VPCRouter, err error) {
+	err = c.call("FindVPCRouters", func(client apiClient) error {
+		res, err = client.FindVPCRouters(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) FindVPCRoutersByTags(ctx context.Context, tags ...string) (res []sacloud.VPCRouter, err error) {
+	err = c.call("FindVPCRoutersByTags", func(client apiClient) error {
+		res, err = client.FindVPCRoutersByTags(ctx, tags...)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ReadVPCRouter(ctx context.Context, id int64) (res *sacloud.VPCRouter, err error) {
+	err = c.call("ReadVPCRouter", func(client apiClient) error {
+		res, err = client.ReadVPCRouter(ctx, id)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) UpdateVPCRouterSetting(ctx context.Context, id int64, value *sacloud.VPCRouter) (res *sacloud.VPCRouter, err error) {
+	err = c.call("UpdateVPCRouterSetting", func(client apiClient) error {
+		res, err = client.UpdateVPCRouterSetting(ctx, id, value)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ApplyVPCRouterConfig(ctx context.Context, id int64) error {
+	return c.call("ApplyVPCRouterConfig", func(client apiClient) error {
+		return client.ApplyVPCRouterConfig(ctx, id)
+	})
+}
+
+func (c *instrumentedAPIClient) FindDatabases(ctx context.Context) (res []sacloud.Database, err error) {
+	err = c.call("FindDatabases", func(client apiClient) error {
+		res, err = client.FindDatabases(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ShutdownServer(ctx context.Context, id int64, shutdownWait time.Duration) error {
+	return c.call("ShutdownServer", func(client apiClient) error {
+		return client.ShutdownServer(ctx, id, shutdownWait)
+	})
+}
+
+func (c *instrumentedAPIClient) WaitForLBActive(ctx context.Context, id int64, wait time.Duration) error {
+	return c.call("WaitForLBActive", func(client apiClient) error {
+		return client.WaitForLBActive(ctx, id, wait)
+	})
+}
+
+func (c *instrumentedAPIClient) CreateLoadBalancer(ctx context.Context, value *sacloud.LoadBalancer) (res *sacloud.LoadBalancer, err error) {
+	err = c.call("CreateLoadBalancer", func(client apiClient) error {
+		res, err = client.CreateLoadBalancer(ctx, value)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) ApplyLoadBalancerConfig(ctx context.Context, id int64) error {
+	return c.call("ApplyLoadBalancerConfig", func(client apiClient) error {
+		return client.ApplyLoadBalancerConfig(ctx, id)
+	})
+}
+
+func (c *instrumentedAPIClient) UpdateLoadBalancer(ctx context.Context, id int64, value *sacloud.LoadBalancer) (res *sacloud.LoadBalancer, err error) {
+	err = c.call("UpdateLoadBalancer", func(client apiClient) error {
+		res, err = client.UpdateLoadBalancer(ctx, id, value)
+		return err
+	})
+	return res, err
+}
+
+func (c *instrumentedAPIClient) DeleteLoadBalancer(ctx context.Context, id int64, waitTimeout time.Duration) error {
+	return c.call("DeleteLoadBalancer", func(client apiClient) error {
+		return client.DeleteLoadBalancer(ctx, id, waitTimeout)
+	})
+}
@@ -0,0 +1,102 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sacloud/libsacloud/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// metricValue returns value of counter, or sample count of histogram
+func metricValue(t *testing.T, collector prometheus.Collector) float64 {
+	registry := prometheus.NewRegistry()
+	if !assert.NoError(t, registry.Register(collector)) {
+		t.FailNow()
+	}
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if len(families) == 0 {
+		return 0
+	}
+	metric := families[0].GetMetric()[0]
+	if metric.GetHistogram() != nil {
+		return float64(metric.GetHistogram().GetSampleCount())
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestInstrumentedAPIClient(t *testing.T) {
+	// responses returns statuses in order, then 200
+	var statuses []int
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&requests, 1)) - 1
+		if i < len(statuses) {
+			w.WriteHeader(statuses[i])
+			w.Write([]byte(`{"is_fatal":true,"error_code":"error","error_msg":"error"}`)) // nolint
+			return
+		}
+		w.Write([]byte(`{"AuthClass":"account"}`)) // nolint
+	}))
+	defer server.Close()
+
+	defaultAPIRoot := api.SakuraCloudAPIRoot
+	api.SakuraCloudAPIRoot = server.URL
+	defer func() { api.SakuraCloudAPIRoot = defaultAPIRoot }()
+
+	rawClient := api.NewClient("token", "secret", "is1a")
+	rawClient.RetryMax = 2
+	rawClient.RetryInterval = time.Millisecond
+	client := newInstrumentedAPIClient(rawClient)
+
+	expects := []struct {
+		caseName  string
+		statuses  []int
+		retries   float64
+		errorCode string
+		kind      error
+	}{
+		{caseName: "success"},
+		{caseName: "success after retries", statuses: []int{503, 423}, retries: 2},
+		{caseName: "gave up retrying", statuses: []int{503, 503, 503}, retries: 2, errorCode: "503", kind: ErrThrottled},
+		{caseName: "API error", statuses: []int{404}, errorCode: "404", kind: ErrNotFound},
+		{caseName: "server error", statuses: []int{500}, errorCode: "500", kind: ErrUnavailable},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			statuses = expect.statuses
+			atomic.StoreInt32(&requests, 0)
+
+			calls := metricValue(t, apiCalls.WithLabelValues("ReadAuthStatus"))
+			durations := metricValue(t, apiDuration.WithLabelValues("ReadAuthStatus").(prometheus.Histogram))
+			retries := metricValue(t, apiRetries.WithLabelValues("ReadAuthStatus"))
+			var errorCount float64
+			if expect.errorCode != "" {
+				errorCount = metricValue(t, apiErrors.WithLabelValues("ReadAuthStatus", expect.errorCode))
+			}
+
+			_, err := client.Clone().ReadAuthStatus(context.Background())
+			assert.Equal(t, expect.errorCode != "", err != nil)
+			if expect.kind != nil {
+				assert.True(t, errors.Is(err, expect.kind), "unexpected error: %v", err)
+			}
+
+			assert.Equal(t, calls+1, metricValue(t, apiCalls.WithLabelValues("ReadAuthStatus")))
+			assert.Equal(t, durations+1, metricValue(t, apiDuration.WithLabelValues("ReadAuthStatus").(prometheus.Histogram)))
+			assert.Equal(t, retries+expect.retries, metricValue(t, apiRetries.WithLabelValues("ReadAuthStatus")))
+			if expect.errorCode != "" {
+				assert.Equal(t, errorCount+1, metricValue(t, apiErrors.WithLabelValues("ReadAuthStatus", expect.errorCode)))
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package iaas
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// reservationTTL is lifetime of Reservation.
+	// Reservation is kept after LoadBalancer is created until the LoadBalancer is surely visible via API.
+	reservationTTL = 5 * time.Minute
+	// maxReserveAttempts is max count of allocation attempts when reservation is conflicted
+	maxReserveAttempts = 5
+)
+
+// ErrReservationConflict is returned by Reserver when IP addresses or VRID are already reserved by others
+var ErrReservationConflict = errors.New("IP addresses or VRID are already reserved")
+
+// Reservation represents in-flight allocation of IP addresses and VRID on a switch
+type Reservation struct {
+	ID          string    `json:"id"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	VRID        int       `json:"vrid,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// IsExpired returns true if reservation is expired
+func (r *Reservation) IsExpired() bool {
+	return time.Now().After(r.ExpiresAt)
+}
+
+// Reserver records in-flight allocations, so that they are never allocated twice
+// even by another CCM process such as a new leader after failover.
+type Reserver interface {
+	// Reservations returns unexpired reservations on the switch
+	Reservations(switchID int64) ([]*Reservation, error)
+	// Reserve records reservation on the switch atomically.
+	// It returns ErrReservationConflict if its IP addresses or VRID are reserved by others.
+	Reserve(switchID int64, reservation *Reservation) error
+	// Release removes reservation from the switch
+	Release(switchID int64, id string) error
+}
+
+type memoryReserver struct {
+	mu           sync.Mutex
+	reservations map[int64][]*Reservation
+}
+
+// NewMemoryReserver returns Reserver which records reservations in memory.
+// It is effective only within the process.
+func NewMemoryReserver() Reserver {
+	return &memoryReserver{reservations: map[int64][]*Reservation{}}
+}
+
+func (m *memoryReserver) Reservations(switchID int64) ([]*Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reservations []*Reservation
+	for _, r := range m.reservations[switchID] {
+		if !r.IsExpired() {
+			reservations = append(reservations, r)
+		}
+	}
+	m.reservations[switchID] = reservations
+	return reservations, nil
+}
+
+func (m *memoryReserver) Reserve(switchID int64, reservation *Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reservations, err := MergeReservation(m.reservations[switchID], reservation)
+	if err != nil {
+		return err
+	}
+	m.reservations[switchID] = reservations
+	return nil
+}
+
+func (m *memoryReserver) Release(switchID int64, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reservations []*Reservation
+	for _, r := range m.reservations[switchID] {
+		if r.ID != id {
+			reservations = append(reservations, r)
+		}
+	}
+	m.reservations[switchID] = reservations
+	return nil
+}
+
+// MergeReservation returns unexpired reservations with the reservation added.
+// Reservation with same ID is replaced, and ErrReservationConflict is returned if it conflicts with others.
+func MergeReservation(reservations []*Reservation, reservation *Reservation) ([]*Reservation, error) {
+	var res []*Reservation
+	for _, r := range reservations {
+		if r.IsExpired() || r.ID == reservation.ID {
+			continue
+		}
+		if r.conflicts(reservation) {
+			return nil, ErrReservationConflict
+		}
+		res = append(res, r)
+	}
+	return append(res, reservation), nil
+}
+
+func (r *Reservation) conflicts(other *Reservation) bool {
+	if r.VRID > 0 && r.VRID == other.VRID {
+		return true
+	}
+	for _, ip := range r.IPAddresses {
+		for _, otherIP := range other.IPAddresses {
+			if ip == otherIP {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reservedIPs(reservations []*Reservation) []string {
+	var ips []string
+	for _, r := range reservations {
+		ips = append(ips, r.IPAddresses...)
+	}
+	return ips
+}
+
+func reservedVRIDs(reservations []*Reservation) []int {
+	var vrids []int
+	for _, r := range reservations {
+		if r.VRID > 0 {
+			vrids = append(vrids, r.VRID)
+		}
+	}
+	return vrids
+}
+
+// SetReserver sets Reserver for recording in-flight allocations
+func (c *client) SetReserver(reserver Reserver) {
+	c.reserver = reserver
+}
+
+// lockSwitch serializes allocations on the switch within the process.
+// Returned func unlocks the switch.
+func (c *client) lockSwitch(switchID int64) func() {
+	v, _ := c.switchLocks.LoadOrStore(switchID, &sync.Mutex{})
+	lock := v.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// reserve allocates IP addresses and VRID by allocate func and reserves them on the switch.
+// Allocation is retried when it conflicts with reservation by other CCM process.
+func (c *client) reserve(switchID int64, allocate func(reservations []*Reservation) (*Reservation, error)) error {
+	for i := 1; ; i++ {
+		reservations, err := c.reserver.Reservations(switchID)
+		if err != nil {
+			return err
+		}
+		reservation, err := allocate(reservations)
+		if err != nil {
+			return err
+		}
+		err = c.reserver.Reserve(switchID, reservation)
+		if err == ErrReservationConflict && i < maxReserveAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+func (c *client) releaseReservation(switchID int64, id string) {
+	// if releasing is failed, reservation will be expired
+	c.reserver.Release(switchID, id) // nolint: errcheck
+}
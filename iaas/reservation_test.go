@@ -0,0 +1,135 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLoadBalancerParam(name string) *LoadBalancerParam {
+	return &LoadBalancerParam{
+		Name:                 name,
+		Type:                 LoadBalancerTypesSwitch,
+		UseHA:                true,
+		IPAddressRange:       "192.168.0.0/24",
+		AssignIPAddressRange: "192.168.0.0/24",
+		DefaultGateway:       "192.168.0.1",
+	}
+}
+
+func assertUniqueAllocations(t *testing.T, lbs []sacloud.LoadBalancer) {
+	ips := map[string]string{}
+	vrids := map[int]string{}
+	for _, lb := range lbs {
+		if owner, ok := vrids[lb.Remark.VRRP.VRID]; ok {
+			t.Errorf("VRID %d is allocated to both %s and %s", lb.Remark.VRRP.VRID, owner, lb.Name)
+		}
+		vrids[lb.Remark.VRRP.VRID] = lb.Name
+
+		addresses := []string{lb.Settings.LoadBalancer[0].VirtualIPAddress}
+		for _, server := range lb.Remark.Servers {
+			addresses = append(addresses, server.(map[string]interface{})["IPAddress"].(string))
+		}
+		for _, ip := range addresses {
+			if owner, ok := ips[ip]; ok {
+				t.Errorf("IP address %s is allocated to both %s and %s", ip, owner, lb.Name)
+			}
+			ips[ip] = lb.Name
+		}
+	}
+}
+
+func createLoadBalancersConcurrently(t *testing.T, clients []*client, count int) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := clients[i%len(clients)]
+			_, err := c.CreateLoadBalancer(context.Background(), testLoadBalancerParam(fmt.Sprintf("lb-%d", i)), &VIPParam{
+				Ports: []*VIPPorts{{Port: 80, HealthCheck: &HealthCheck{Protocol: "http", Path: "/", StatusCode: 200, DelayLoop: 10}}},
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_CreateLoadBalancer_Concurrent(t *testing.T) {
+	api := newTestAPIClient(1)
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	createLoadBalancersConcurrently(t, []*client{c}, 10)
+
+	lbs, _ := api.FindLoadBalancersByTags(context.Background())
+	assert.Len(t, lbs, 10)
+	assertUniqueAllocations(t, lbs)
+}
+
+func TestClient_CreateLoadBalancer_SharedReserver(t *testing.T) {
+	// clients with shared Reserver simulate CCM processes across leader failover
+	api := newTestAPIClient(1)
+	reserver := NewMemoryReserver()
+	clients := []*client{
+		{apiClient: api, reserver: reserver},
+		{apiClient: api, reserver: reserver},
+	}
+
+	createLoadBalancersConcurrently(t, clients, 10)
+
+	lbs, _ := api.FindLoadBalancersByTags(context.Background())
+	assert.Len(t, lbs, 10)
+	assertUniqueAllocations(t, lbs)
+}
+
+func TestClient_CreateLoadBalancer_SameName(t *testing.T) {
+	// e.g. shared LoadBalancer requested by members of the group on different CCM processes
+	api := newTestAPIClient(1)
+	reserver := NewMemoryReserver()
+	vipParam := &VIPParam{Ports: []*VIPPorts{{Port: 80, HealthCheck: &HealthCheck{Protocol: "tcp", DelayLoop: 10}}}}
+
+	first := &client{apiClient: api, reserver: reserver}
+	_, err := first.CreateLoadBalancer(context.Background(), testLoadBalancerParam("k8s-lb-group-web"), vipParam)
+	assert.NoError(t, err)
+
+	second := &client{apiClient: api, reserver: reserver}
+	_, err = second.CreateLoadBalancer(context.Background(), testLoadBalancerParam("k8s-lb-group-web"), vipParam)
+	assert.Error(t, err)
+
+	lbs, _ := api.FindLoadBalancersByTags(context.Background())
+	assert.Len(t, lbs, 1)
+	reservations, _ := reserver.Reservations(1)
+	assert.Len(t, reservations, 1, "reservation of first LoadBalancer must be kept")
+}
+
+func TestMergeReservation(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+	reservations := []*Reservation{
+		{ID: "lb1", IPAddresses: []string{"192.168.0.1", "192.168.0.2"}, VRID: 1, ExpiresAt: expiresAt},
+		{ID: "expired", IPAddresses: []string{"192.168.0.3"}, VRID: 2, ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+
+	t.Run("conflicted IP address", func(t *testing.T) {
+		_, err := MergeReservation(reservations, &Reservation{ID: "lb2", IPAddresses: []string{"192.168.0.2"}, ExpiresAt: expiresAt})
+		assert.Equal(t, ErrReservationConflict, err)
+	})
+	t.Run("conflicted VRID", func(t *testing.T) {
+		_, err := MergeReservation(reservations, &Reservation{ID: "lb2", VRID: 1, ExpiresAt: expiresAt})
+		assert.Equal(t, ErrReservationConflict, err)
+	})
+	t.Run("expired reservation is pruned", func(t *testing.T) {
+		res, err := MergeReservation(reservations, &Reservation{ID: "lb2", IPAddresses: []string{"192.168.0.3"}, VRID: 2, ExpiresAt: expiresAt})
+		assert.NoError(t, err)
+		assert.Len(t, res, 2)
+	})
+	t.Run("same ID is replaced", func(t *testing.T) {
+		res, err := MergeReservation(reservations, &Reservation{ID: "lb1", IPAddresses: []string{"192.168.0.1"}, VRID: 1, ExpiresAt: expiresAt})
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	})
+}
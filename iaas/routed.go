@@ -0,0 +1,193 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+const (
+	// LoadBalancerTypesRouted represents service IP routed to a node by routed subnet of Internet router.
+	// No LoadBalancer appliance is created for this type.
+	LoadBalancerTypesRouted = "routed"
+
+	// TagsRoutedSubnetPrefix is prefix of the tag on router for marking routed subnet used by routed type services
+	TagsRoutedSubnetPrefix = "@k8s.RoutedSubnet="
+)
+
+func routedSubnetTag(subnetID int64) string {
+	return fmt.Sprintf("%s%d", TagsRoutedSubnetPrefix, subnetID)
+}
+
+// RoutedIPParam represents parameter for assigning service IP from routed subnets
+type RoutedIPParam struct {
+	// Owner identifies the service, it is used as ID of the reservation
+	Owner string
+	// IP is requested IP address. Assigning is failed if it is not usable
+	IP string
+	// CurrentIP is IP address already assigned to the service. Other address is assigned if it is not usable
+	CurrentIP string
+	// UsedIPs are IP addresses assigned to other services
+	UsedIPs []string
+	// NodeIPs are IP addresses of healthy nodes selected by the service, next-hop is moved to one of them
+	NodeIPs []string
+	// HealthyNodeIPs are IP addresses of all healthy nodes.
+	// Current next-hop is kept if it is one of them, because services sharing the subnet may select other nodes.
+	HealthyNodeIPs []string
+}
+
+// RoutedIP represents service IP assigned from routed subnet
+type RoutedIP struct {
+	IP     string
+	Subnet *sacloud.Subnet
+	// PreviousNextHop is not empty if next-hop of the subnet is moved to other node
+	PreviousNextHop string
+}
+
+// AssignRoutedIP assigns service IP from routed subnets marked by TagsRoutedSubnetPrefix tag on the router.
+// If next-hop of the subnet is not a healthy node, it is moved to one of param.NodeIPs.
+// Healthy next-hop is kept even if the service doesn't select it, otherwise services sharing the subnet move it by turns.
+func (c *client) AssignRoutedIP(ctx context.Context, lbParam *LoadBalancerParam, param *RoutedIPParam) (_ *RoutedIP, err error) {
+	router, sw, err := c.findLBConnectedRouter(ctx, lbParam)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := c.lockSwitch(sw.ID)
+	defer unlock()
+
+	var ip string
+	var subnet *sacloud.SwitchSubnet
+	err = c.reserve(sw.ID, func(reservations []*Reservation) (*Reservation, error) {
+		var others []*Reservation
+		for _, r := range reservations {
+			if r.ID != param.Owner {
+				others = append(others, r)
+			}
+		}
+		assigned, s, err := assignRoutedIP(router, sw, lbParam, param, reservedIPs(others))
+		if err != nil {
+			return nil, err
+		}
+		ip, subnet = assigned, s
+		return &Reservation{
+			ID:          param.Owner,
+			IPAddresses: []string{ip},
+			ExpiresAt:   time.Now().Add(reservationTTL),
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// reservation is kept until the service status is updated, and released only on failure
+	defer func() {
+		if err != nil {
+			c.releaseReservation(sw.ID, param.Owner)
+		}
+	}()
+
+	routed := &RoutedIP{IP: ip, Subnet: subnet.Subnet}
+	if containsString(param.NodeIPs, subnet.NextHop) || containsString(param.HealthyNodeIPs, subnet.NextHop) {
+		return routed, nil
+	}
+
+	nextHop := selectNextHop(sw, param.NodeIPs)
+	if nextHop == "" {
+		return nil, fmt.Errorf("healthy node for next-hop of routed subnet %s/%d is not found in router connected subnet",
+			subnet.NetworkAddress, subnet.NetworkMaskLen)
+	}
+	previous := subnet.NextHop
+	updated, err := c.apiClient.UpdateRouterSubnet(ctx, router.ID, subnet.ID, nextHop)
+	if err != nil {
+		return nil, err
+	}
+	routed.Subnet = updated
+	routed.PreviousNextHop = previous
+	return routed, nil
+}
+
+// ReleaseRoutedIP releases reservation of the service IP assigned by AssignRoutedIP
+func (c *client) ReleaseRoutedIP(ctx context.Context, lbParam *LoadBalancerParam, owner string) error {
+	_, sw, err := c.findLBConnectedRouter(ctx, lbParam)
+	if err != nil {
+		return err
+	}
+	c.releaseReservation(sw.ID, owner)
+	return nil
+}
+
+// assignRoutedIP returns assignable IP address and routed subnet which contains it
+func assignRoutedIP(router *sacloud.Internet, sw *sacloud.Switch, lbParam *LoadBalancerParam, param *RoutedIPParam, reservedIPs []string) (string, *sacloud.SwitchSubnet, error) {
+	var ipamSubnets []*ipamSubnet
+	var switchSubnets []*sacloud.SwitchSubnet
+	for i := range sw.Subnets {
+		s := &sw.Subnets[i]
+		if s.Subnet == nil || s.NextHop == "" || !router.HasTag(routedSubnetTag(s.ID)) {
+			continue
+		}
+		subnet, err := newIPAMSubnet(fmt.Sprintf("%s/%d", s.NetworkAddress, s.NetworkMaskLen))
+		if err != nil {
+			return "", nil, err
+		}
+		subnet.nextHop = s.NextHop
+		ipamSubnets = append(ipamSubnets, subnet)
+		switchSubnets = append(switchSubnets, s)
+	}
+	if len(ipamSubnets) == 0 {
+		return "", nil, errorf(ErrNotFound, "routed subnet marked by %q tag is not found on router %q", TagsRoutedSubnetPrefix, router.Name)
+	}
+
+	p := newIPAM(ipamSubnets...)
+	p.excludeIPs(param.UsedIPs...)
+	p.excludeIPs(reservedIPs...)
+	if err := p.exclude(lbParam.ExcludeIPAddresses...); err != nil {
+		return "", nil, err
+	}
+
+	if param.IP != "" {
+		for i, subnet := range ipamSubnets {
+			if p.isAvailable(subnet, param.IP) {
+				return param.IP, switchSubnets[i], nil
+			}
+		}
+		return "", nil, errorf(ErrInvalidVIP, "can't use specified IP %q", param.IP)
+	}
+	if param.CurrentIP != "" {
+		for i, subnet := range ipamSubnets {
+			if p.isAvailable(subnet, param.CurrentIP) {
+				return param.CurrentIP, switchSubnets[i], nil
+			}
+		}
+	}
+	for i, subnet := range ipamSubnets {
+		if ips := p.available(subnet, 1); len(ips) > 0 {
+			return ips[0], switchSubnets[i], nil
+		}
+	}
+	return "", nil, ErrGlobalIPExhausted
+}
+
+// selectNextHop returns first node IP in router connected subnet, or empty if not found
+func selectNextHop(sw *sacloud.Switch, nodeIPs []string) string {
+	ips := append([]string{}, nodeIPs...)
+	sort.Strings(ips)
+	for _, ip := range ips {
+		for _, s := range sw.Subnets {
+			if s.Subnet == nil || s.NextHop != "" {
+				continue
+			}
+			network, err := parseIPv4CIDR(fmt.Sprintf("%s/%d", s.NetworkAddress, s.NetworkMaskLen))
+			if err != nil {
+				continue
+			}
+			if network.Contains(net.ParseIP(ip)) {
+				return ip
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package iaas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRoutedAPIClient() *testAPIClient {
+	client := newTestRouterAPIClient()
+	routed := sacloud.SwitchSubnet{Subnet: &sacloud.Subnet{
+		Resource:       sacloud.NewResource(20),
+		NetworkAddress: "198.51.100.0",
+		NetworkMaskLen: 29,
+		NextHop:        "192.2.0.10",
+	}}
+	// routed subnet which isn't marked must not be used
+	unmarked := sacloud.SwitchSubnet{Subnet: &sacloud.Subnet{
+		Resource:       sacloud.NewResource(21),
+		NetworkAddress: "203.0.113.0",
+		NetworkMaskLen: 28,
+		NextHop:        "192.2.0.10",
+	}}
+	client.sw.Subnets = append(client.sw.Subnets, unmarked, routed)
+	client.router.AppendTag(routedSubnetTag(20))
+	return client
+}
+
+func TestClient_AssignRoutedIP(t *testing.T) {
+	lbParam := &LoadBalancerParam{Type: LoadBalancerTypesRouted}
+
+	testCases := []struct {
+		caseName        string
+		param           *RoutedIPParam
+		expectIP        string
+		expectNextHop   string
+		previousNextHop string
+		hasError        bool
+	}{
+		{
+			caseName:      "assign first address",
+			param:         &RoutedIPParam{Owner: "svc", NodeIPs: []string{"192.2.0.10"}},
+			expectIP:      "198.51.100.1",
+			expectNextHop: "192.2.0.10",
+		},
+		{
+			caseName:      "skip used addresses",
+			param:         &RoutedIPParam{Owner: "svc", UsedIPs: []string{"198.51.100.1", "198.51.100.2"}, NodeIPs: []string{"192.2.0.10"}},
+			expectIP:      "198.51.100.3",
+			expectNextHop: "192.2.0.10",
+		},
+		{
+			caseName:      "keep current address",
+			param:         &RoutedIPParam{Owner: "svc", CurrentIP: "198.51.100.5", NodeIPs: []string{"192.2.0.10"}},
+			expectIP:      "198.51.100.5",
+			expectNextHop: "192.2.0.10",
+		},
+		{
+			caseName:      "reassign unusable current address",
+			param:         &RoutedIPParam{Owner: "svc", CurrentIP: "203.0.113.1", NodeIPs: []string{"192.2.0.10"}},
+			expectIP:      "198.51.100.1",
+			expectNextHop: "192.2.0.10",
+		},
+		{
+			caseName: "requested address is used",
+			param:    &RoutedIPParam{Owner: "svc", IP: "198.51.100.1", UsedIPs: []string{"198.51.100.1"}, NodeIPs: []string{"192.2.0.10"}},
+			hasError: true,
+		},
+		{
+			caseName: "all addresses are used",
+			param: &RoutedIPParam{Owner: "svc", NodeIPs: []string{"192.2.0.10"}, UsedIPs: []string{
+				"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4", "198.51.100.5", "198.51.100.6",
+			}},
+			hasError: true,
+		},
+		{
+			caseName:        "move next-hop from unhealthy node",
+			param:           &RoutedIPParam{Owner: "svc", NodeIPs: []string{"192.2.0.12", "192.2.0.11", "10.0.0.1"}},
+			expectIP:        "198.51.100.1",
+			expectNextHop:   "192.2.0.11",
+			previousNextHop: "192.2.0.10",
+		},
+		{
+			caseName:      "keep next-hop on healthy node selected by other service",
+			param:         &RoutedIPParam{Owner: "svc", NodeIPs: []string{"192.2.0.11"}, HealthyNodeIPs: []string{"192.2.0.10", "192.2.0.11"}},
+			expectIP:      "198.51.100.1",
+			expectNextHop: "192.2.0.10",
+		},
+		{
+			caseName: "no healthy node in connected subnet",
+			param:    &RoutedIPParam{Owner: "svc", NodeIPs: []string{"10.0.0.1"}},
+			hasError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.caseName, func(t *testing.T) {
+			api := newTestRoutedAPIClient()
+			c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+			routed, err := c.AssignRoutedIP(context.Background(), lbParam, testCase.param)
+			assert.Equal(t, testCase.hasError, err != nil)
+			if err != nil {
+				reservations, _ := c.reserver.Reservations(api.sw.ID)
+				assert.Empty(t, reservations, "reservation must be released on failure")
+				return
+			}
+			assert.Equal(t, testCase.expectIP, routed.IP)
+			assert.Equal(t, testCase.expectNextHop, routed.Subnet.NextHop)
+			assert.Equal(t, testCase.previousNextHop, routed.PreviousNextHop)
+		})
+	}
+}
+
+func TestClient_AssignRoutedIP_Reservation(t *testing.T) {
+	api := newTestRoutedAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+	lbParam := &LoadBalancerParam{Type: LoadBalancerTypesRouted}
+	nodeIPs := []string{"192.2.0.10"}
+
+	first, err := c.AssignRoutedIP(context.Background(), lbParam, &RoutedIPParam{Owner: "svc1", NodeIPs: nodeIPs})
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.1", first.IP)
+
+	// in-flight address isn't in service status yet, but must not be assigned twice
+	second, err := c.AssignRoutedIP(context.Background(), lbParam, &RoutedIPParam{Owner: "svc2", NodeIPs: nodeIPs})
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.2", second.IP)
+
+	// own reservation doesn't conflict
+	again, err := c.AssignRoutedIP(context.Background(), lbParam, &RoutedIPParam{Owner: "svc1", CurrentIP: first.IP, NodeIPs: nodeIPs})
+	assert.NoError(t, err)
+	assert.Equal(t, first.IP, again.IP)
+
+	assert.NoError(t, c.ReleaseRoutedIP(context.Background(), lbParam, "svc1"))
+	third, err := c.AssignRoutedIP(context.Background(), lbParam, &RoutedIPParam{Owner: "svc3", NodeIPs: nodeIPs})
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.1", third.IP)
+}
@@ -0,0 +1,358 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+// TagsRouterSubnetPrefix is prefix of the tag on router for marking routed subnet added by CCM
+const TagsRouterSubnetPrefix = "@k8s.RouterSubnet="
+
+// ErrGlobalIPExhausted is returned when no global IP address is usable on the router
+var ErrGlobalIPExhausted error = &kindError{kind: ErrIPExhausted, message: "usable global-ip-address not found"}
+
+// IsQuotaExceededError returns true if err is caused by resource quota of the account
+func IsQuotaExceededError(err error) bool {
+	var apiErr api.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ResponseCode() == http.StatusConflict && strings.Contains(apiErr.Code(), "limit")
+}
+
+func routerSubnetTag(subnetID int64) string {
+	return fmt.Sprintf("%s%d", TagsRouterSubnetPrefix, subnetID)
+}
+
+// ExpandRouterSubnet adds routed subnet to the router for VIPs of the LoadBalancer.
+// Next-hop of the subnet is a VIP of the LoadBalancer in the router connected subnet.
+// If lb is nil, the subnet is added for the LoadBalancer to be created by lbParam,
+// and its next-hop is reserved as IP address of the LoadBalancer. See routedLoadBalancerIPs.
+func (c *client) ExpandRouterSubnet(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, nwMaskLen int) (_ *sacloud.Subnet, err error) {
+	router, sw, err := c.findLBConnectedRouter(ctx, lbParam)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := c.lockSwitch(sw.ID)
+	defer unlock()
+
+	var nextHop string
+	if lb == nil {
+		nextHop, err = c.reserveNextHop(ctx, lbParam, sw)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				c.releaseReservation(sw.ID, lbParam.Name)
+			}
+		}()
+	} else {
+		nextHop, err = connectedVIP(lb, sw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	subnet, err := c.apiClient.AddRouterSubnet(ctx, router.ID, nwMaskLen, nextHop)
+	if err != nil {
+		return nil, err
+	}
+
+	router.AppendTag(routerSubnetTag(subnet.ID))
+	if _, err := c.apiClient.UpdateRouter(ctx, router.ID, router); err != nil {
+		// subnet which isn't marked is never released, so remove it here
+		c.apiClient.DeleteRouterSubnet(ctx, router.ID, subnet.ID) // nolint: errcheck
+		return nil, err
+	}
+	return subnet, nil
+}
+
+// connectedVIP returns a VIP of the LoadBalancer in the router connected subnet
+func connectedVIP(lb *sacloud.LoadBalancer, sw *sacloud.Switch) (string, error) {
+	subnets, err := switchIPAMSubnets(sw)
+	if err != nil {
+		return "", err
+	}
+	for _, vip := range loadBalancerVIPs(lb) {
+		for _, subnet := range subnets {
+			if !subnet.isRouted() && subnet.network.Contains(net.ParseIP(vip)) {
+				return vip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("LoadBalancer %q has no VIP in router connected subnet for next-hop", lb.Name)
+}
+
+// reserveNextHop reserves an IP address in the router connected subnet for the LoadBalancer to be created.
+// It is reserved by the ID of the LoadBalancer without VRID, and replaced by reservation for creating it.
+// Caller must hold the lock of the switch.
+func (c *client) reserveNextHop(ctx context.Context, lbParam *LoadBalancerParam, sw *sacloud.Switch) (string, error) {
+	if lbParam.UseHA {
+		return "", errorf(ErrIPExhausted, "HA LoadBalancer %q has no fixed IP address for next-hop of routed subnet", lbParam.Name)
+	}
+	var nextHop string
+	err := c.reserve(sw.ID, func(reservations []*Reservation) (*Reservation, error) {
+		p, err := c.externalIPAM(ctx, lbParam, sw, reservedIPs(reservations))
+		if err != nil {
+			return nil, err
+		}
+		subnet := p.subnetFor(1, false)
+		if subnet == nil {
+			return nil, ErrGlobalIPExhausted
+		}
+		nextHop = p.available(subnet, 1)[0]
+		return &Reservation{
+			ID:          lbParam.Name,
+			IPAddresses: []string{nextHop},
+			ExpiresAt:   time.Now().Add(reservationTTL),
+		}, nil
+	})
+	return nextHop, err
+}
+
+// ReleaseRouterSubnets removes routed subnets added by CCM which have no VIP
+func (c *client) ReleaseRouterSubnets(ctx context.Context, lbParam *LoadBalancerParam) ([]*sacloud.Subnet, error) {
+	router, sw, err := c.findLBConnectedRouter(ctx, lbParam)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := c.lockSwitch(sw.ID)
+	defer unlock()
+
+	vips, err := c.allLoadBalancerVIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subnets, err := c.markedSubnets(router, sw, vips)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []*sacloud.Subnet
+	for _, s := range subnets {
+		if s.Routed || s.Used {
+			continue
+		}
+		if err := c.deleteMarkedSubnet(ctx, router, s); err != nil {
+			return released, err
+		}
+		released = append(released, s.Subnet)
+	}
+	return released, nil
+}
+
+// MarkedSubnet represents a subnet of the router marked by CCM.
+// It is added by ExpandRouterSubnet, or marked by TagsRoutedSubnetPrefix tag for routed type services.
+type MarkedSubnet struct {
+	Router *sacloud.Internet
+	Subnet *sacloud.Subnet
+	// Routed is true if the subnet is marked for routed type services
+	Routed bool
+	// Used is true if the subnet contains a VIP of any LoadBalancer, a reserved IP or one of used IPs
+	Used bool
+}
+
+// MarkedSubnets returns subnets marked by CCM on the routers which have all of tags.
+// usedIPs are IP addresses used out of LoadBalancers, such as service IPs of routed type.
+func (c *client) MarkedSubnets(ctx context.Context, usedIPs []string, tags ...string) ([]*MarkedSubnet, error) {
+	routers, err := c.apiClient.FindRoutersByTags(ctx, tags...)
+	if err != nil {
+		return nil, err
+	}
+	vips, err := c.allLoadBalancerVIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var marked []*MarkedSubnet
+	for i := range routers {
+		router := &routers[i]
+		if router.Switch == nil {
+			continue
+		}
+		sw, err := c.apiClient.ReadSwitch(ctx, router.Switch.ID)
+		if err != nil {
+			return nil, err
+		}
+		subnets, err := c.markedSubnets(router, sw, append(vips, usedIPs...))
+		if err != nil {
+			return nil, err
+		}
+		marked = append(marked, subnets...)
+	}
+	return marked, nil
+}
+
+// DeleteMarkedSubnet deletes the subnet listed by MarkedSubnets and removes the mark from the router.
+// The subnet is checked again under the lock of the switch, and false is returned if it is used by then.
+func (c *client) DeleteMarkedSubnet(ctx context.Context, subnet *MarkedSubnet, usedIPs []string) (bool, error) {
+	unlock := c.lockSwitch(subnet.Router.Switch.ID)
+	defer unlock()
+
+	router, err := c.apiClient.ReadRouter(ctx, subnet.Router.ID)
+	if err != nil {
+		return false, err
+	}
+	sw, err := c.apiClient.ReadSwitch(ctx, subnet.Router.Switch.ID)
+	if err != nil {
+		return false, err
+	}
+	vips, err := c.allLoadBalancerVIPs(ctx)
+	if err != nil {
+		return false, err
+	}
+	subnets, err := c.markedSubnets(router, sw, append(vips, usedIPs...))
+	if err != nil {
+		return false, err
+	}
+	for _, s := range subnets {
+		if s.Subnet.ID != subnet.Subnet.ID {
+			continue
+		}
+		if s.Used {
+			return false, nil
+		}
+		return true, c.deleteMarkedSubnet(ctx, router, s)
+	}
+	// already deleted or unmarked
+	return false, nil
+}
+
+// markedSubnets returns subnets of the switch marked on the router.
+// Caller must hold the lock of the switch for deleting them.
+func (c *client) markedSubnets(router *sacloud.Internet, sw *sacloud.Switch, usedIPs []string) ([]*MarkedSubnet, error) {
+	reservations, err := c.reserver.Reservations(sw.ID)
+	if err != nil {
+		return nil, err
+	}
+	reserved := reservedIPs(reservations)
+	usedIPs = append(append([]string{}, usedIPs...), reserved...)
+
+	var marked []*MarkedSubnet
+	for _, s := range sw.Subnets {
+		if s.Subnet == nil || s.NextHop == "" || s.ID == 0 {
+			continue
+		}
+		routed := router.HasTag(routedSubnetTag(s.ID))
+		if !routed && !router.HasTag(routerSubnetTag(s.ID)) {
+			continue
+		}
+		network, err := parseIPv4CIDR(fmt.Sprintf("%s/%d", s.NetworkAddress, s.NetworkMaskLen))
+		if err != nil {
+			return nil, err
+		}
+		// next-hop is reserved by LoadBalancer being created
+		used := containsString(reserved, s.NextHop)
+		for _, ip := range usedIPs {
+			if network.Contains(net.ParseIP(ip)) {
+				used = true
+				break
+			}
+		}
+		marked = append(marked, &MarkedSubnet{Router: router, Subnet: s.Subnet, Routed: routed, Used: used})
+	}
+	return marked, nil
+}
+
+func (c *client) deleteMarkedSubnet(ctx context.Context, router *sacloud.Internet, subnet *MarkedSubnet) error {
+	if err := c.apiClient.DeleteRouterSubnet(ctx, router.ID, subnet.Subnet.ID); err != nil {
+		return err
+	}
+	if subnet.Routed {
+		router.RemoveTag(routedSubnetTag(subnet.Subnet.ID))
+	} else {
+		router.RemoveTag(routerSubnetTag(subnet.Subnet.ID))
+	}
+	_, err := c.apiClient.UpdateRouter(ctx, router.ID, router)
+	return err
+}
+
+// allLoadBalancerVIPs returns VIPs of all LoadBalancers in the zone, including ones of other clusters
+func (c *client) allLoadBalancerVIPs(ctx context.Context) ([]string, error) {
+	lbs, err := c.apiClient.FindLoadBalancers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var vips []string
+	for i := range lbs {
+		vips = append(vips, loadBalancerVIPs(&lbs[i])...)
+	}
+	return vips, nil
+}
+
+func (c *client) findLBConnectedRouter(ctx context.Context, lbParam *LoadBalancerParam) (*sacloud.Internet, *sacloud.Switch, error) {
+	routers, err := c.apiClient.FindRoutersByTags(ctx, lbParam.RouterTags...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(routers) == 0 {
+		return nil, nil, errorf(ErrNotFound, "router resource (with tag[%s]) is not found", lbParam.RouterTags)
+	}
+	router := routers[0]
+	sw, err := c.apiClient.ReadSwitch(ctx, router.Switch.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &router, sw, nil
+}
+
+// extractAssignableExternalVIPs returns subnet for additional VIP of the LoadBalancer.
+// Routed subnets which next-hop is a VIP of the LoadBalancer can be used in addition to router connected subnet.
+func (c *client) extractAssignableExternalVIPs(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *LoadBalancerParam, sw *sacloud.Switch, reservedIPs []string, vip string) (*assignableIPInfo, error) {
+	p, err := c.externalIPAM(ctx, lbParam, sw, reservedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	vips := loadBalancerVIPs(lb)
+	for _, subnet := range p.subnets {
+		if subnet.isRouted() && !containsString(vips, subnet.nextHop) {
+			continue
+		}
+		if vip != "" {
+			if subnet.contains(vip) {
+				return &assignableIPInfo{ipam: p, subnet: subnet}, nil
+			}
+			continue
+		}
+		if len(p.available(subnet, 1)) > 0 {
+			return &assignableIPInfo{ipam: p, subnet: subnet}, nil
+		}
+	}
+	if vip != "" {
+		return nil, errorf(ErrInvalidVIP, "can't use specified VIP %q", vip)
+	}
+	return nil, ErrGlobalIPExhausted
+}
+
+func loadBalancerVIPs(lb *sacloud.LoadBalancer) []string {
+	var vips []string
+	if lb.Settings != nil {
+		for _, s := range lb.Settings.LoadBalancer {
+			if s.VirtualIPAddress != "" && !containsString(vips, s.VirtualIPAddress) {
+				vips = append(vips, s.VirtualIPAddress)
+			}
+		}
+	}
+	return vips
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package iaas
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRouterAPIClient() *testAPIClient {
+	client := newTestAPIClient(1)
+	connected := sacloud.SwitchSubnet{Subnet: &sacloud.Subnet{
+		Resource:       sacloud.NewResource(10),
+		NetworkAddress: "192.2.0.0",
+		NetworkMaskLen: 28,
+		DefaultRoute:   "192.2.0.1",
+	}}
+	connected.IPAddresses.Min = "192.2.0.4"
+	connected.IPAddresses.Max = "192.2.0.6"
+	client.sw.Subnets = []sacloud.SwitchSubnet{connected}
+
+	client.router = &sacloud.Internet{Resource: sacloud.NewResource(2)}
+	client.router.Switch = client.sw
+	client.routedSubnets = []string{"198.51.100.0", "203.0.113.0"}
+	return client
+}
+
+func testLoadBalancerWithVIPs(name string, vips ...string) *sacloud.LoadBalancer {
+	lb := &sacloud.LoadBalancer{
+		Appliance: &sacloud.Appliance{Resource: sacloud.NewResource(100)},
+		Settings:  &sacloud.LoadBalancerSettings{},
+	}
+	lb.Name = name
+	lb.Switch = &sacloud.Switch{Resource: sacloud.NewResource(1)}
+	lb.Remark = &sacloud.LoadBalancerRemark{ApplianceRemarkBase: &sacloud.ApplianceRemarkBase{}}
+	for _, vip := range vips {
+		lb.Settings.LoadBalancer = append(lb.Settings.LoadBalancer, &sacloud.LoadBalancerSetting{VirtualIPAddress: vip, Port: "80"})
+	}
+	return lb
+}
+
+func TestClient_RouterSubnetExpansion(t *testing.T) {
+	api := newTestRouterAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+	lbParam := &LoadBalancerParam{Type: LoadBalancerTypesInternet}
+
+	// all addresses of connected subnet are used
+	lb := testLoadBalancerWithVIPs("shared", "192.2.0.4", "192.2.0.5", "192.2.0.6")
+	api.loadBalancers = []sacloud.LoadBalancer{*lb}
+
+	_, err := c.extractAssignableExternalVIPs(context.Background(), lb, lbParam, api.sw, nil, "")
+	assert.Equal(t, ErrGlobalIPExhausted, err)
+
+	subnet, err := c.ExpandRouterSubnet(context.Background(), lb, lbParam, 28)
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.0", subnet.NetworkAddress)
+	assert.Equal(t, "192.2.0.4", subnet.NextHop, "next-hop must be VIP in connected subnet")
+	assert.True(t, api.router.HasTag(routerSubnetTag(subnet.ID)))
+
+	info, err := c.extractAssignableExternalVIPs(context.Background(), lb, lbParam, api.sw, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"198.51.100.1"}, info.assignableIPs(1))
+
+	other := testLoadBalancerWithVIPs("other", "192.2.0.4")
+	other.Settings.LoadBalancer[0].VirtualIPAddress = "192.2.0.9"
+	_, err = c.extractAssignableExternalVIPs(context.Background(), other, lbParam, api.sw, nil, "")
+	assert.Equal(t, ErrGlobalIPExhausted, err, "routed subnet for other LoadBalancer must not be used")
+
+	// routed subnet which has VIP is kept
+	lb.Settings.LoadBalancer = append(lb.Settings.LoadBalancer, &sacloud.LoadBalancerSetting{VirtualIPAddress: "198.51.100.1"})
+	api.loadBalancers = []sacloud.LoadBalancer{*lb}
+	released, err := c.ReleaseRouterSubnets(context.Background(), lbParam)
+	assert.NoError(t, err)
+	assert.Empty(t, released)
+
+	// empty routed subnet is released
+	api.loadBalancers = []sacloud.LoadBalancer{*testLoadBalancerWithVIPs("shared", "192.2.0.4")}
+	released, err = c.ReleaseRouterSubnets(context.Background(), lbParam)
+	assert.NoError(t, err)
+	assert.Len(t, released, 1)
+	assert.Equal(t, []int64{subnet.ID}, api.deletedSubnetIDs)
+	assert.False(t, api.router.HasTag(routerSubnetTag(subnet.ID)))
+}
+
+func TestClient_RouterSubnetExpansion_Create(t *testing.T) {
+	api := newTestRouterAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+	lbParam := &LoadBalancerParam{Name: "new", Type: LoadBalancerTypesInternet}
+	vipParam := &VIPParam{Ports: []*VIPPorts{{Port: 80, HealthCheck: &HealthCheck{Protocol: "tcp", DelayLoop: 10}}}}
+
+	// only one address is left in connected subnet
+	api.loadBalancers = []sacloud.LoadBalancer{*testLoadBalancerWithVIPs("shared", "192.2.0.4", "192.2.0.5")}
+
+	_, err := c.CreateLoadBalancer(context.Background(), lbParam, vipParam)
+	assert.Equal(t, ErrGlobalIPExhausted, err)
+
+	_, err = c.ExpandRouterSubnet(context.Background(), nil, &LoadBalancerParam{Name: "new", Type: LoadBalancerTypesInternet, UseHA: true}, 28)
+	assert.Error(t, err, "HA LoadBalancer has no fixed address for next-hop")
+
+	subnet, err := c.ExpandRouterSubnet(context.Background(), nil, lbParam, 28)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.2.0.6", subnet.NextHop, "next-hop must be reserved for the LoadBalancer")
+
+	// subnet is kept while next-hop is reserved
+	subnets, err := c.MarkedSubnets(context.Background(), nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, subnets, 1) {
+		t.FailNow()
+	}
+	assert.True(t, subnets[0].Used)
+
+	lb, err := c.CreateLoadBalancer(context.Background(), lbParam, vipParam)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.2.0.6", lb.Remark.Servers[0].(map[string]interface{})["IPAddress"])
+	assert.Equal(t, "198.51.100.1", lb.Settings.LoadBalancer[0].VirtualIPAddress)
+}
+
+func TestClient_ReleaseRouterSubnets_NotOwned(t *testing.T) {
+	api := newTestRouterAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	// routed subnet added by user isn't marked on router
+	_, err := api.AddRouterSubnet(context.Background(), api.router.ID, 28, "192.2.0.4")
+	assert.NoError(t, err)
+
+	released, err := c.ReleaseRouterSubnets(context.Background(), &LoadBalancerParam{Type: LoadBalancerTypesInternet})
+	assert.NoError(t, err)
+	assert.Empty(t, released)
+	assert.Empty(t, api.deletedSubnetIDs)
+}
+
+func TestClient_MarkedSubnets(t *testing.T) {
+	api := newTestRouterAPIClient()
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+	api.loadBalancers = []sacloud.LoadBalancer{*testLoadBalancerWithVIPs("shared", "192.2.0.4", "198.51.100.1")}
+
+	expanded, err := api.AddRouterSubnet(context.Background(), api.router.ID, 28, "192.2.0.4")
+	assert.NoError(t, err)
+	routed, err := api.AddRouterSubnet(context.Background(), api.router.ID, 28, "192.2.0.5")
+	assert.NoError(t, err)
+	// routed subnet added by user isn't marked on router
+	api.routedSubnets = []string{"233.252.0.0"}
+	_, err = api.AddRouterSubnet(context.Background(), api.router.ID, 28, "192.2.0.6")
+	assert.NoError(t, err)
+	api.router.AppendTag(routerSubnetTag(expanded.ID))
+	api.router.AppendTag(routedSubnetTag(routed.ID))
+
+	subnets, err := c.MarkedSubnets(context.Background(), nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, subnets, 2) {
+		t.FailNow()
+	}
+	assert.Equal(t, expanded.ID, subnets[0].Subnet.ID)
+	assert.False(t, subnets[0].Routed)
+	assert.True(t, subnets[0].Used, "subnet which has VIP is used")
+	assert.Equal(t, routed.ID, subnets[1].Subnet.ID)
+	assert.True(t, subnets[1].Routed)
+	assert.False(t, subnets[1].Used)
+
+	t.Run("used by service IP", func(t *testing.T) {
+		deleted, err := c.DeleteMarkedSubnet(context.Background(), subnets[1], []string{"203.0.113.5"})
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+		assert.Empty(t, api.deletedSubnetIDs)
+	})
+
+	t.Run("used by VIP after listing", func(t *testing.T) {
+		api.loadBalancers = append(api.loadBalancers, *testLoadBalancerWithVIPs("new", "203.0.113.1"))
+		deleted, err := c.DeleteMarkedSubnet(context.Background(), subnets[1], nil)
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+		assert.Empty(t, api.deletedSubnetIDs)
+		api.loadBalancers = api.loadBalancers[:1]
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		deleted, err := c.DeleteMarkedSubnet(context.Background(), subnets[1], nil)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+		assert.Equal(t, []int64{routed.ID}, api.deletedSubnetIDs)
+		assert.False(t, api.router.HasTag(routedSubnetTag(routed.ID)))
+		assert.True(t, api.router.HasTag(routerSubnetTag(expanded.ID)))
+	})
+}
+
+func TestIsQuotaExceededError(t *testing.T) {
+	quotaErr := api.NewError(http.StatusConflict, &sacloud.ResultErrorValue{ErrorCode: "limit_count_in_account"})
+	conflictErr := api.NewError(http.StatusConflict, &sacloud.ResultErrorValue{ErrorCode: "still_creating"})
+
+	assert.True(t, IsQuotaExceededError(quotaErr))
+	assert.False(t, IsQuotaExceededError(conflictErr))
+	assert.False(t, IsQuotaExceededError(ErrGlobalIPExhausted))
+	assert.True(t, IsQuotaExceededError(newAPIError("AddRouterSubnet", quotaErr, http.StatusConflict)))
+}
@@ -1,18 +1,19 @@
 package iaas
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/sacloud/libsacloud/sacloud"
 )
 
-func (c *client) Servers() ([]sacloud.Server, error) {
-	return c.getAPIClient().FindServers()
+func (c *client) Servers(ctx context.Context) ([]sacloud.Server, error) {
+	return c.getAPIClient().FindServers(ctx)
 }
 
-func (c *client) ShutdownServerByID(id int64, shutdownWait time.Duration) error {
-	err := c.getAPIClient().ShutdownServer(id, shutdownWait)
+func (c *client) ShutdownServerByID(ctx context.Context, id int64, shutdownWait time.Duration) error {
+	err := c.getAPIClient().ShutdownServer(ctx, id, shutdownWait)
 	if err != nil {
 		return fmt.Errorf("shutdown server %q is failed: %s", id, err)
 	}
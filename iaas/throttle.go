@@ -0,0 +1,169 @@
+package iaas
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Defaults of client-side throttling of SAKURA Cloud API
+const (
+	DefaultRateLimit               = 5.0
+	DefaultRateBurst               = 10
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+var apiCircuitBreakerOpen = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "circuit_breaker_open",
+		Help:      "1 if requests to SAKURA Cloud API are failed fast by the circuit breaker, 0 otherwise.",
+	},
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fails requests fast after consecutive 5xx or 429 responses.
+// After cooldown, a single request is let through to probe whether API is recovered.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns error of kind ErrUnavailable if the request must not be sent
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return b.unavailable()
+		}
+		// this request is the probe
+		b.setState(circuitHalfOpen)
+	case circuitHalfOpen:
+		// probe is in flight
+		return b.unavailable()
+	}
+	return nil
+}
+
+// record records result of the request allowed by allow
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// cancel releases the request allowed by allow without result, such as canceled one
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		// let next request probe immediately
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	if state == circuitClosed {
+		apiCircuitBreakerOpen.Set(0)
+	} else {
+		apiCircuitBreakerOpen.Set(1)
+	}
+}
+
+func (b *circuitBreaker) unavailable() error {
+	return errorf(ErrUnavailable, "SAKURA Cloud API is unavailable: circuit breaker is open after %d consecutive failures, retry after %s",
+		b.failures, b.openedAt.Add(b.cooldown).Format(time.RFC3339))
+}
+
+func isServerFailure(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+// throttledTransport limits rate of requests to SAKURA Cloud API, and fails them fast while API is unavailable.
+// It is shared by all clones of the client, so that the limits are applied to the whole process.
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+	breaker *circuitBreaker
+}
+
+func newThrottledTransport(base http.RoundTripper, c *Config) *throttledTransport {
+	limit, burst := c.RateLimit, c.RateBurst
+	if limit <= 0 {
+		limit = DefaultRateLimit
+	}
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	threshold, cooldown := c.CircuitBreakerThreshold, time.Duration(c.CircuitBreakerCooldownSec)*time.Second
+	if threshold <= 0 {
+		threshold = DefaultCircuitBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitBreakerCooldown
+	}
+
+	return &throttledTransport{
+		base:    base,
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+		breaker: newCircuitBreaker(threshold, cooldown),
+	}
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		t.breaker.cancel()
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		t.breaker.cancel()
+	case err != nil:
+		t.breaker.record(true)
+	default:
+		t.breaker.record(isServerFailure(res.StatusCode))
+	}
+	return res, err
+}
@@ -0,0 +1,143 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	// failures less than threshold
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, breaker.allow())
+		breaker.record(true)
+	}
+	assert.NoError(t, breaker.allow())
+	breaker.record(false)
+	assert.Equal(t, 0, breaker.failures)
+
+	// consecutive failures open the breaker
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, breaker.allow())
+		breaker.record(true)
+	}
+	err := breaker.allow()
+	assert.True(t, errors.Is(err, ErrUnavailable))
+
+	// probe after cooldown
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.allow())
+	assert.True(t, errors.Is(breaker.allow(), ErrUnavailable), "only a probe is allowed")
+	breaker.record(true)
+	assert.True(t, errors.Is(breaker.allow(), ErrUnavailable), "failed probe opens the breaker again")
+
+	// canceled probe lets next request probe
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.allow())
+	breaker.cancel()
+	assert.NoError(t, breaker.allow())
+
+	// succeeded probe closes the breaker
+	breaker.record(false)
+	assert.NoError(t, breaker.allow())
+	assert.NoError(t, breaker.allow())
+}
+
+func TestThrottledTransport(t *testing.T) {
+	var status, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if s := int(atomic.LoadInt32(&status)); s != http.StatusOK {
+			w.WriteHeader(s)
+			w.Write([]byte(`{"is_fatal":true,"error_code":"error","error_msg":"error"}`)) // nolint
+			return
+		}
+		w.Write([]byte(`{"AuthClass":"account"}`)) // nolint
+	}))
+	defer server.Close()
+
+	defaultAPIRoot := api.SakuraCloudAPIRoot
+	api.SakuraCloudAPIRoot = server.URL
+	defer func() { api.SakuraCloudAPIRoot = defaultAPIRoot }()
+
+	transport := newThrottledTransport(http.DefaultTransport, &Config{RateLimit: 1000, CircuitBreakerThreshold: 2})
+	rawClient := api.NewClient("token", "secret", "is1a")
+	rawClient.HTTPClient = &http.Client{Transport: transport}
+	client := newDefaultAPIClient(rawClient)
+
+	t.Run("sustained 5xx", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusInternalServerError)
+		for i := 0; i < 2; i++ {
+			_, err := client.Clone().ReadAuthStatus(context.Background())
+			assert.Error(t, err)
+			assert.False(t, errors.Is(err, ErrUnavailable))
+		}
+
+		// the breaker is shared by clones
+		atomic.StoreInt32(&requests, 0)
+		_, err := client.Clone().ReadAuthStatus(context.Background())
+		assert.True(t, errors.Is(err, ErrUnavailable), "unexpected error: %v", err)
+		assert.EqualValues(t, 0, atomic.LoadInt32(&requests), "API must not be called")
+
+		// recovered
+		atomic.StoreInt32(&status, http.StatusOK)
+		transport.breaker.openedAt = transport.breaker.openedAt.Add(-DefaultCircuitBreakerCooldown)
+		_, err = client.Clone().ReadAuthStatus(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("429", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusTooManyRequests)
+		for i := 0; i < 2; i++ {
+			client.ReadAuthStatus(context.Background()) // nolint
+		}
+		_, err := client.ReadAuthStatus(context.Background())
+		assert.True(t, errors.Is(err, ErrUnavailable), "unexpected error: %v", err)
+
+		atomic.StoreInt32(&status, http.StatusOK)
+		transport.breaker.openedAt = transport.breaker.openedAt.Add(-DefaultCircuitBreakerCooldown)
+		_, err = client.ReadAuthStatus(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("4xx isn't failure of API", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusNotFound)
+		for i := 0; i < 3; i++ {
+			_, err := client.ReadAuthStatus(context.Background())
+			assert.False(t, errors.Is(err, ErrUnavailable))
+		}
+	})
+}
+
+func TestThrottledTransport_RateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	transport := newThrottledTransport(http.DefaultTransport, &Config{RateLimit: 0.001, RateBurst: 1})
+	httpClient := &http.Client{Transport: transport}
+
+	res, err := httpClient.Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	// token bucket is empty
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	_, err = httpClient.Do(req.WithContext(ctx))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnavailable))
+	assert.Equal(t, circuitClosed, transport.breaker.state)
+}
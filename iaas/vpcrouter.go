@@ -0,0 +1,272 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sacloud/libsacloud/sacloud"
+)
+
+// LoadBalancerTypesVPCRouter represents port forwarding of VPC router.
+// No LoadBalancer appliance is created for this type.
+const LoadBalancerTypesVPCRouter = "vpcrouter"
+
+// PortForwardingParam represents parameter for port forwarding rules of VPC router owned by a service
+type PortForwardingParam struct {
+	// Owner identifies the service, it is recorded to description of the rules
+	Owner string
+	Ports []*PortForwardingPort
+	// NodeIPs are private IP addresses of healthy nodes
+	NodeIPs []string
+}
+
+// PortForwardingPort represents port forwarding from global port to NodePort
+type PortForwardingPort struct {
+	Protocol string
+	Port     int32
+	NodePort int32
+}
+
+// EnsureVPCRouterPortForwarding replaces port forwarding rules owned by param.Owner on the VPC router,
+// and returns global IP address of the VPC router.
+// Rules are forwarded to one of healthy nodes because port forwarding has single destination.
+func (c *client) EnsureVPCRouterPortForwarding(ctx context.Context, lbParam *LoadBalancerParam, param *PortForwardingParam) (string, error) {
+	router, err := c.findVPCRouter(ctx, lbParam)
+	if err != nil {
+		return "", err
+	}
+	// IDs are unique across resources, so VPC router settings are serialized by the same lock as switches
+	unlock := c.lockSwitch(router.ID)
+	defer unlock()
+
+	globalIP := vpcRouterGlobalIP(router)
+	if globalIP == "" {
+		return "", errorf(ErrNotFound, "global IP address of VPC router %q is not found", router.Name)
+	}
+
+	owned, others := splitPortForwarding(router, param.Owner)
+	nodeIP := currentForwardingNodeIP(owned, param.NodeIPs)
+	if nodeIP == "" {
+		nodeIP = selectPrivateNodeIP(router, param.NodeIPs)
+	}
+	if nodeIP == "" {
+		return "", fmt.Errorf("healthy node is not found in private networks of VPC router %q", router.Name)
+	}
+
+	var desired []*sacloud.VPCRouterPortForwardingConfig
+	for _, port := range param.Ports {
+		protocol := strings.ToLower(port.Protocol)
+		if protocol != "tcp" && protocol != "udp" {
+			return "", errorf(ErrInvalidConfig, "protocol %q is not supported by port forwarding of VPC router", port.Protocol)
+		}
+		globalPort := strconv.Itoa(int(port.Port))
+		for _, o := range others {
+			if o.Protocol == protocol && o.GlobalPort == globalPort {
+				return "", errorf(ErrVIPConflict, "port %s/%s of VPC router %q is already forwarded to %s", protocol, globalPort, router.Name, o.PrivateAddress)
+			}
+		}
+		desired = append(desired, &sacloud.VPCRouterPortForwardingConfig{
+			Protocol:       protocol,
+			GlobalPort:     globalPort,
+			PrivateAddress: nodeIP,
+			PrivatePort:    strconv.Itoa(int(port.NodePort)),
+			Description:    param.Owner,
+		})
+	}
+
+	if isSamePortForwarding(owned, desired) {
+		return globalIP, nil
+	}
+	if err := c.updatePortForwarding(ctx, router, append(others, desired...)); err != nil {
+		return "", err
+	}
+	return globalIP, nil
+}
+
+// RemoveVPCRouterPortForwarding removes port forwarding rules owned by owner from the VPC router
+func (c *client) RemoveVPCRouterPortForwarding(ctx context.Context, lbParam *LoadBalancerParam, owner string) error {
+	router, err := c.findVPCRouter(ctx, lbParam)
+	if err != nil {
+		return err
+	}
+	unlock := c.lockSwitch(router.ID)
+	defer unlock()
+
+	return c.removePortForwarding(ctx, router, owner)
+}
+
+// PortForwarding represents port forwarding rules of the VPC router owned by a service
+type PortForwarding struct {
+	Router *sacloud.VPCRouter
+	Owner  string
+	Rules  []*sacloud.VPCRouterPortForwardingConfig
+}
+
+// PortForwardings returns port forwarding rules on the VPC routers which have all of tags, grouped by owner.
+// Rules without description aren't returned because they are never added by CCM.
+func (c *client) PortForwardings(ctx context.Context, tags ...string) ([]*PortForwarding, error) {
+	routers, err := c.apiClient.FindVPCRoutersByTags(ctx, tags...)
+	if err != nil {
+		return nil, err
+	}
+
+	var forwardings []*PortForwarding
+	for i := range routers {
+		// settings aren't included in search results
+		router, err := c.apiClient.ReadVPCRouter(ctx, routers[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		if !router.HasPortForwarding() {
+			continue
+		}
+		owners := map[string]*PortForwarding{}
+		for _, config := range router.Settings.Router.PortForwarding.Config {
+			if config.Description == "" {
+				continue
+			}
+			f, ok := owners[config.Description]
+			if !ok {
+				f = &PortForwarding{Router: router, Owner: config.Description}
+				owners[config.Description] = f
+				forwardings = append(forwardings, f)
+			}
+			f.Rules = append(f.Rules, config)
+		}
+	}
+	return forwardings, nil
+}
+
+// DeletePortForwarding removes port forwarding rules owned by owner from the VPC router listed by PortForwardings
+func (c *client) DeletePortForwarding(ctx context.Context, forwarding *PortForwarding) error {
+	unlock := c.lockSwitch(forwarding.Router.ID)
+	defer unlock()
+
+	// rules of others may be changed after listing
+	router, err := c.apiClient.ReadVPCRouter(ctx, forwarding.Router.ID)
+	if err != nil {
+		return err
+	}
+	return c.removePortForwarding(ctx, router, forwarding.Owner)
+}
+
+func (c *client) removePortForwarding(ctx context.Context, router *sacloud.VPCRouter, owner string) error {
+	owned, others := splitPortForwarding(router, owner)
+	if len(owned) == 0 {
+		return nil
+	}
+	return c.updatePortForwarding(ctx, router, others)
+}
+
+func (c *client) findVPCRouter(ctx context.Context, lbParam *LoadBalancerParam) (*sacloud.VPCRouter, error) {
+	routers, err := c.apiClient.FindVPCRoutersByTags(ctx, lbParam.RouterTags...)
+	if err != nil {
+		return nil, err
+	}
+	if len(routers) == 0 {
+		return nil, errorf(ErrNotFound, "VPC router resource (with tag[%s]) is not found", lbParam.RouterTags)
+	}
+	// settings aren't included in search results
+	return c.apiClient.ReadVPCRouter(ctx, routers[0].ID)
+}
+
+func (c *client) updatePortForwarding(ctx context.Context, router *sacloud.VPCRouter, configs []*sacloud.VPCRouterPortForwardingConfig) error {
+	if router.Settings == nil {
+		router.InitVPCRouterSetting()
+	}
+	enabled := "True"
+	if len(configs) == 0 {
+		enabled = "False"
+		configs = nil
+	}
+	router.Settings.Router.PortForwarding = &sacloud.VPCRouterPortForwarding{
+		Config:  configs,
+		Enabled: enabled,
+	}
+	if _, err := c.apiClient.UpdateVPCRouterSetting(ctx, router.ID, router); err != nil {
+		return err
+	}
+	return c.apiClient.ApplyVPCRouterConfig(ctx, router.ID)
+}
+
+// splitPortForwarding returns port forwarding rules owned by owner and the others
+func splitPortForwarding(router *sacloud.VPCRouter, owner string) (owned, others []*sacloud.VPCRouterPortForwardingConfig) {
+	if !router.HasPortForwarding() {
+		return nil, nil
+	}
+	for _, config := range router.Settings.Router.PortForwarding.Config {
+		if config.Description == owner {
+			owned = append(owned, config)
+		} else {
+			others = append(others, config)
+		}
+	}
+	return owned, others
+}
+
+// currentForwardingNodeIP returns destination of current rules if it is still healthy,
+// so that rules aren't moved between nodes on every reconcile
+func currentForwardingNodeIP(owned []*sacloud.VPCRouterPortForwardingConfig, nodeIPs []string) string {
+	if len(owned) > 0 && containsString(nodeIPs, owned[0].PrivateAddress) {
+		return owned[0].PrivateAddress
+	}
+	return ""
+}
+
+// selectPrivateNodeIP returns first node IP in private networks of the VPC router, or empty if not found
+func selectPrivateNodeIP(router *sacloud.VPCRouter, nodeIPs []string) string {
+	if !router.HasInterfaces() {
+		return ""
+	}
+	ips := append([]string{}, nodeIPs...)
+	sort.Strings(ips)
+	for _, ip := range ips {
+		for i, nic := range router.Settings.Router.Interfaces {
+			if i == 0 || nic == nil {
+				continue
+			}
+			nicIP := nic.VirtualIPAddress
+			if nicIP == "" && len(nic.IPAddress) > 0 {
+				nicIP = nic.IPAddress[0]
+			}
+			network, err := parseIPv4CIDR(fmt.Sprintf("%s/%d", nicIP, nic.NetworkMaskLen))
+			if err != nil {
+				continue
+			}
+			if network.Contains(net.ParseIP(ip)) {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// vpcRouterGlobalIP returns IP address of the VPC router in shared segment or router+switch
+func vpcRouterGlobalIP(router *sacloud.VPCRouter) string {
+	if router.IsStandardPlan() {
+		if len(router.Interfaces) > 0 {
+			return router.Interfaces[0].IPAddress
+		}
+		return ""
+	}
+	if router.HasInterfaces() && router.Settings.Router.Interfaces[0] != nil {
+		return router.Settings.Router.Interfaces[0].VirtualIPAddress
+	}
+	return ""
+}
+
+func isSamePortForwarding(current, desired []*sacloud.VPCRouterPortForwardingConfig) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for i := range current {
+		if *current[i] != *desired[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package iaas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPortForwardingVPCRouter() sacloud.VPCRouter {
+	vpcRouter := sacloud.VPCRouter{
+		Appliance: &sacloud.Appliance{Resource: sacloud.NewResource(200)},
+		Settings: &sacloud.VPCRouterSettings{
+			Router: &sacloud.VPCRouterSetting{
+				Interfaces: []*sacloud.VPCRouterInterface{
+					nil, // shared segment
+					{IPAddress: []string{"192.168.0.1"}, NetworkMaskLen: 24},
+				},
+			},
+		},
+	}
+	vpcRouter.Name = "vpc"
+	vpcRouter.Plan = sacloud.NewResource(1) // standard
+	vpcRouter.Interfaces = []sacloud.Interface{{IPAddress: "203.0.113.10"}}
+	// rule created by hand
+	vpcRouter.Settings.Router.AddPortForwarding("tcp", "22", "192.168.0.5", "22", "ssh")
+	return vpcRouter
+}
+
+func TestClient_EnsureVPCRouterPortForwarding(t *testing.T) {
+	api := newTestAPIClient(1)
+	api.vpcRouters = []sacloud.VPCRouter{testPortForwardingVPCRouter()}
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+	lbParam := &LoadBalancerParam{Type: LoadBalancerTypesVPCRouter}
+
+	param := &PortForwardingParam{
+		Owner: "svc",
+		Ports: []*PortForwardingPort{
+			{Protocol: "TCP", Port: 80, NodePort: 30080},
+			{Protocol: "UDP", Port: 53, NodePort: 30053},
+		},
+		NodeIPs: []string{"10.0.0.1", "192.168.0.12", "192.168.0.11"},
+	}
+	globalIP, err := c.EnsureVPCRouterPortForwarding(context.Background(), lbParam, param)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.10", globalIP)
+
+	configs := api.vpcRouters[0].Settings.Router.PortForwarding.Config
+	assert.Len(t, configs, 3)
+	assert.Equal(t, "ssh", configs[0].Description, "rules of others must be kept")
+	assert.Equal(t, sacloud.VPCRouterPortForwardingConfig{
+		Protocol: "tcp", GlobalPort: "80", PrivateAddress: "192.168.0.11", PrivatePort: "30080", Description: "svc",
+	}, *configs[1])
+	assert.Equal(t, "udp", configs[2].Protocol)
+	assert.Equal(t, 1, api.vpcRouterUpdates)
+
+	t.Run("no change", func(t *testing.T) {
+		param.NodeIPs = []string{"192.168.0.12", "192.168.0.11"}
+		_, err := c.EnsureVPCRouterPortForwarding(context.Background(), lbParam, param)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, api.vpcRouterUpdates)
+	})
+
+	t.Run("move to healthy node", func(t *testing.T) {
+		param.NodeIPs = []string{"192.168.0.12"}
+		_, err := c.EnsureVPCRouterPortForwarding(context.Background(), lbParam, param)
+		assert.NoError(t, err)
+		configs := api.vpcRouters[0].Settings.Router.PortForwarding.Config
+		assert.Equal(t, "192.168.0.12", configs[1].PrivateAddress)
+		assert.Equal(t, "192.168.0.12", configs[2].PrivateAddress)
+	})
+
+	t.Run("port is used by others", func(t *testing.T) {
+		_, err := c.EnsureVPCRouterPortForwarding(context.Background(), lbParam, &PortForwardingParam{
+			Owner:   "other",
+			Ports:   []*PortForwardingPort{{Protocol: "TCP", Port: 22, NodePort: 30022}},
+			NodeIPs: []string{"192.168.0.12"},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("no node in private network", func(t *testing.T) {
+		_, err := c.EnsureVPCRouterPortForwarding(context.Background(), lbParam, &PortForwardingParam{
+			Owner:   "other",
+			Ports:   []*PortForwardingPort{{Protocol: "TCP", Port: 443, NodePort: 30443}},
+			NodeIPs: []string{"10.0.0.1"},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.NoError(t, c.RemoveVPCRouterPortForwarding(context.Background(), lbParam, "svc"))
+		configs := api.vpcRouters[0].Settings.Router.PortForwarding.Config
+		assert.Len(t, configs, 1)
+		assert.Equal(t, "ssh", configs[0].Description)
+	})
+}
+
+func TestClient_PortForwardings(t *testing.T) {
+	api := newTestAPIClient(1)
+	api.vpcRouters = []sacloud.VPCRouter{testPortForwardingVPCRouter()}
+	api.vpcRouters[0].Settings.Router.AddPortForwarding("tcp", "80", "192.168.0.11", "30080", "svc")
+	api.vpcRouters[0].Settings.Router.AddPortForwarding("udp", "53", "192.168.0.11", "30053", "svc")
+	api.vpcRouters[0].Settings.Router.AddPortForwarding("tcp", "8080", "192.168.0.12", "30081", "")
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	forwardings, err := c.PortForwardings(context.Background())
+	assert.NoError(t, err)
+	if !assert.Len(t, forwardings, 2, "rules without description must be ignored") {
+		t.FailNow()
+	}
+	assert.Equal(t, "ssh", forwardings[0].Owner)
+	assert.Equal(t, "svc", forwardings[1].Owner)
+	assert.Len(t, forwardings[1].Rules, 2)
+
+	assert.NoError(t, c.DeletePortForwarding(context.Background(), forwardings[1]))
+	configs := api.vpcRouters[0].Settings.Router.PortForwarding.Config
+	assert.Len(t, configs, 2)
+	assert.Equal(t, "ssh", configs[0].Description, "rules of others must be kept")
+	assert.Equal(t, "", configs[1].Description)
+}
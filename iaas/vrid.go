@@ -0,0 +1,119 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	minVRID = 1
+	maxVRID = 255
+)
+
+// VRIDRange represents range of VRID
+type VRIDRange struct {
+	Start int
+	End   int
+}
+
+// ParseVRIDRange parses VRID range such as "200-255" or "10"
+func ParseVRIDRange(s string) (*VRIDRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, errorf(ErrInvalidConfig, "invalid VRID range %q: %s", s, err)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, errorf(ErrInvalidConfig, "invalid VRID range %q: %s", s, err)
+	}
+	if start < minVRID || end > maxVRID || start > end {
+		return nil, errorf(ErrInvalidConfig, "invalid VRID range %q: must be in %d-%d", s, minVRID, maxVRID)
+	}
+	return &VRIDRange{Start: start, End: end}, nil
+}
+
+// Contains returns true if vrid is in the range
+func (r *VRIDRange) Contains(vrid int) bool {
+	return r != nil && r.Start <= vrid && vrid <= r.End
+}
+
+func (r *VRIDRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// selectUniqVRID returns VRID which is not used by any VRRP participant on the switch,
+// including appliances of other clusters or created by hand.
+func (c *client) selectUniqVRID(ctx context.Context, lbParam *LoadBalancerParam, switchID int64, reservedVRIDs []int) (int, error) {
+	usedVRIDs, err := c.extractConsumedVRIDs(ctx, switchID)
+	if err != nil {
+		return -1, err
+	}
+	used := map[int]bool{}
+	for _, vrid := range append(usedVRIDs, reservedVRIDs...) {
+		used[vrid] = true
+	}
+	switchUsedVRIDs.WithLabelValues(switchIDLabel(switchID)).Set(float64(len(used)))
+
+	for vrid := minVRID; vrid <= maxVRID; vrid++ {
+		if !used[vrid] && !lbParam.ReservedVRIDRange.Contains(vrid) {
+			return vrid, nil
+		}
+	}
+
+	if lbParam.ReservedVRIDRange != nil {
+		return -1, errorf(ErrVRIDExhausted, "usable VRID not found on switch %d: all of %d-%d are used or reserved(%s)",
+			switchID, minVRID, maxVRID, lbParam.ReservedVRIDRange)
+	}
+	return -1, errorf(ErrVRIDExhausted, "usable VRID not found on switch %d: all of %d-%d are used", switchID, minVRID, maxVRID)
+}
+
+// extractConsumedVRIDs returns VRIDs used by LoadBalancers, VPCRouters and Databases connected to the switch
+func (c *client) extractConsumedVRIDs(ctx context.Context, switchID int64) ([]int, error) {
+	var vrids []int
+
+	lbs, err := c.apiClient.FindLoadBalancers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, lb := range lbs {
+		if lb.Switch != nil && lb.Switch.ID == switchID && lb.Remark != nil && lb.Remark.VRRP != nil {
+			vrids = append(vrids, lb.Remark.VRRP.VRID)
+		}
+	}
+
+	vpcRouters, err := c.apiClient.FindVPCRouters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, vpcRouter := range vpcRouters {
+		vrid := vpcRouter.VRID()
+		if vrid < 0 {
+			continue
+		}
+		for _, nic := range vpcRouter.Interfaces {
+			if nic.Switch != nil && nic.Switch.ID == switchID {
+				vrids = append(vrids, vrid)
+				break
+			}
+		}
+	}
+
+	dbs, err := c.apiClient.FindDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		if db.Switch != nil && db.Switch.ID == switchID && db.Remark != nil && db.Remark.VRRP != nil {
+			vrids = append(vrids, db.Remark.VRRP.VRID)
+		}
+	}
+
+	return vrids, nil
+}
@@ -0,0 +1,101 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVRIDRange(t *testing.T) {
+	expects := []struct {
+		cond     string
+		expect   *VRIDRange
+		hasError bool
+	}{
+		{cond: "200-255", expect: &VRIDRange{Start: 200, End: 255}},
+		{cond: "10", expect: &VRIDRange{Start: 10, End: 10}},
+		{cond: "0-10", hasError: true},
+		{cond: "200-256", hasError: true},
+		{cond: "20-10", hasError: true},
+		{cond: "a-b", hasError: true},
+	}
+
+	for _, expect := range expects {
+		r, err := ParseVRIDRange(expect.cond)
+		assert.Equal(t, expect.hasError, err != nil, "ParseVRIDRange(%q): unexpected error", expect.cond)
+		if !expect.hasError {
+			assert.Equal(t, expect.expect, r, "ParseVRIDRange(%q): unexpected range", expect.cond)
+		}
+	}
+}
+
+func testVRRPLoadBalancer(switchID int64, vrid int) sacloud.LoadBalancer {
+	lb := sacloud.LoadBalancer{
+		Appliance: &sacloud.Appliance{},
+		Remark: &sacloud.LoadBalancerRemark{
+			ApplianceRemarkBase: &sacloud.ApplianceRemarkBase{VRRP: &sacloud.ApplianceRemarkVRRP{VRID: vrid}},
+		},
+	}
+	lb.Switch = &sacloud.Switch{Resource: sacloud.NewResource(switchID)}
+	return lb
+}
+
+func testVRRPVPCRouter(switchID int64, vrid int) sacloud.VPCRouter {
+	vpcRouter := sacloud.VPCRouter{
+		Appliance: &sacloud.Appliance{},
+		Settings: &sacloud.VPCRouterSettings{
+			Router: &sacloud.VPCRouterSetting{VRID: &vrid},
+		},
+	}
+	vpcRouter.Plan = sacloud.NewResource(2) // premium
+	vpcRouter.Interfaces = []sacloud.Interface{
+		{}, // shared segment
+	}
+	nic := sacloud.Interface{}
+	nic.Switch = &sacloud.Switch{Resource: sacloud.NewResource(switchID)}
+	vpcRouter.Interfaces = append(vpcRouter.Interfaces, nic)
+	return vpcRouter
+}
+
+func testVRRPDatabase(switchID int64, vrid int) sacloud.Database {
+	db := sacloud.Database{
+		Appliance: &sacloud.Appliance{},
+		Remark: &sacloud.DatabaseRemark{
+			ApplianceRemarkBase: &sacloud.ApplianceRemarkBase{VRRP: &sacloud.ApplianceRemarkVRRP{VRID: vrid}},
+		},
+	}
+	db.Switch = &sacloud.Switch{Resource: sacloud.NewResource(switchID)}
+	return db
+}
+
+func TestClient_selectUniqVRID(t *testing.T) {
+	api := newTestAPIClient(1)
+	// LoadBalancer of other cluster or created by hand
+	api.loadBalancers = []sacloud.LoadBalancer{testVRRPLoadBalancer(1, 1), testVRRPLoadBalancer(2, 2)}
+	api.vpcRouters = []sacloud.VPCRouter{testVRRPVPCRouter(1, 2)}
+	api.databases = []sacloud.Database{testVRRPDatabase(1, 3)}
+	c := &client{apiClient: api, reserver: NewMemoryReserver()}
+
+	t.Run("VRIDs used on the switch are skipped", func(t *testing.T) {
+		vrid, err := c.selectUniqVRID(context.Background(), &LoadBalancerParam{}, 1, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, vrid)
+	})
+	t.Run("reserved VRIDs are skipped", func(t *testing.T) {
+		vrid, err := c.selectUniqVRID(context.Background(), &LoadBalancerParam{ReservedVRIDRange: &VRIDRange{Start: 5, End: 10}}, 1, []int{4})
+		assert.NoError(t, err)
+		assert.Equal(t, 11, vrid)
+	})
+	t.Run("VRIDs on other switch can be used", func(t *testing.T) {
+		vrid, err := c.selectUniqVRID(context.Background(), &LoadBalancerParam{}, 2, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, vrid)
+	})
+	t.Run("no usable VRID", func(t *testing.T) {
+		_, err := c.selectUniqVRID(context.Background(), &LoadBalancerParam{ReservedVRIDRange: &VRIDRange{Start: 4, End: 255}}, 1, nil)
+		assert.True(t, errors.Is(err, ErrVRIDExhausted), "unexpected error: %v", err)
+	})
+}
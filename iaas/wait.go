@@ -0,0 +1,40 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pollInterval is interval of reading state of resource while waiting for it
+var pollInterval = 5 * time.Second
+
+// poll calls condition every pollInterval until it returns true or error.
+// It gives up when timeout elapses or ctx is done, and returns ctx.Err() for the latter.
+func poll(ctx context.Context, timeout time.Duration, condition func() (bool, error)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := condition()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("timed out after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// runningGoroutines returns stacks of goroutines running code of this package except tests, by goroutine ID
+func runningGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	goroutines := map[string]string{}
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if !strings.Contains(stack, "sakura-cloud-controller-manager/iaas.") || strings.Contains(stack, "testing.tRunner") {
+			continue
+		}
+		goroutines[strings.Fields(stack)[1]] = stack
+	}
+	return goroutines
+}
+
+// checkGoroutineLeak returns a function which fails the test if goroutines started after the call are still running
+func checkGoroutineLeak(t *testing.T) func() {
+	before := runningGoroutines()
+	return func() {
+		t.Helper()
+		var leaked []string
+		// wait for goroutines to exit
+		for i := 0; i < 100; i++ {
+			leaked = nil
+			for id, stack := range runningGoroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("%d goroutines are leaked:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
+
+// setPollInterval sets pollInterval and returns a function to restore it
+func setPollInterval(interval time.Duration) func() {
+	defaultInterval := pollInterval
+	pollInterval = interval
+	return func() { pollInterval = defaultInterval }
+}
+
+func TestPoll(t *testing.T) {
+	defer setPollInterval(time.Millisecond)()
+	conditionErr := errors.New("error")
+
+	expects := []struct {
+		caseName  string
+		condition func(calls int) (bool, error)
+		cancel    bool
+		err       error
+		timeout   bool
+	}{
+		{
+			caseName:  "done",
+			condition: func(calls int) (bool, error) { return calls == 3, nil },
+		},
+		{
+			caseName:  "error",
+			condition: func(calls int) (bool, error) { return false, conditionErr },
+			err:       conditionErr,
+		},
+		{
+			caseName:  "timeout",
+			condition: func(calls int) (bool, error) { return false, nil },
+			timeout:   true,
+		},
+		{
+			caseName:  "canceled",
+			condition: func(calls int) (bool, error) { return false, nil },
+			cancel:    true,
+			err:       context.Canceled,
+		},
+		{
+			caseName:  "error by cancel",
+			condition: func(calls int) (bool, error) { return false, conditionErr },
+			cancel:    true,
+			err:       context.Canceled,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if expect.cancel {
+				cancel()
+			}
+			timeout := time.Hour
+			if expect.timeout {
+				timeout = 10 * time.Millisecond
+			}
+
+			calls := 0
+			err := poll(ctx, timeout, func() (bool, error) {
+				calls++
+				return expect.condition(calls)
+			})
+			switch {
+			case expect.timeout:
+				assert.EqualError(t, err, "timed out after 10ms")
+			case expect.err != nil:
+				assert.Equal(t, expect.err, err)
+			default:
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDefaultAPIClient_Wait(t *testing.T) {
+	defer setPollInterval(time.Millisecond)()
+
+	// resources are never down
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			mu.Lock()
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			mu.Unlock()
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			w.Write([]byte(`{"is_ok":true,"Success":true}`)) // nolint
+		case strings.Contains(r.URL.Path, "/server/"):
+			w.Write([]byte(`{"Server":{"ID":1,"Instance":{"Status":"up"}}}`)) // nolint
+		default:
+			w.Write([]byte(`{"Appliance":{"ID":1,"Availability":"available","Instance":{"Status":"up"}}}`)) // nolint
+		}
+	}))
+	defer server.Close()
+
+	defaultAPIRoot := api.SakuraCloudAPIRoot
+	api.SakuraCloudAPIRoot = server.URL
+	defer func() { api.SakuraCloudAPIRoot = defaultAPIRoot }()
+	client := newDefaultAPIClient(api.NewClient("token", "secret", "is1a"))
+
+	expects := []struct {
+		caseName string
+		wait     func(ctx context.Context) error
+		requests []string
+	}{
+		{
+			caseName: "delete LoadBalancer",
+			wait: func(ctx context.Context) error {
+				return client.DeleteLoadBalancer(ctx, 1, time.Hour)
+			},
+			requests: []string{"DELETE /is1a/api/cloud/1.1/appliance/1/power"},
+		},
+		{
+			// must not be stopped forcibly
+			caseName: "shutdown server",
+			wait: func(ctx context.Context) error {
+				return client.ShutdownServer(ctx, 1, time.Hour)
+			},
+			requests: []string{"DELETE /is1a/api/cloud/1.1/server/1/power"},
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			defer checkGoroutineLeak(t)()
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := expect.wait(ctx)
+			assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+			assert.True(t, time.Since(start) < time.Second)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, expect.requests, requests)
+		})
+	}
+}
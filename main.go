@@ -9,6 +9,7 @@ import (
 
 	_ "github.com/sacloud/sakura-cloud-controller-manager/sakura"
 	"github.com/sacloud/sakura-cloud-controller-manager/version"
+	"github.com/sacloud/sakura-cloud-controller-manager/webhook"
 	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog"
@@ -25,6 +26,7 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	command := app.NewCloudControllerManagerCommand()
+	command.AddCommand(webhook.NewCommand())
 
 	logs.InitLogs()
 	defer logs.FlushLogs()
@@ -6,6 +6,7 @@ import (
 
 	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
 	"k8s.io/cloud-provider"
+	"k8s.io/klog"
 )
 
 const (
@@ -53,6 +54,11 @@ func newCloud(configReader io.Reader) (cloudprovider.Interface, error) {
 		RetryIntervalSec:  config.RetryIntervalSec,
 		APIRootURL:        config.APIRootURL,
 		TraceMode:         config.TraceMode,
+
+		RateLimit:                 config.APIRateLimit,
+		RateBurst:                 config.APIRateBurst,
+		CircuitBreakerThreshold:   config.APICircuitBreakerThreshold,
+		CircuitBreakerCooldownSec: config.APICircuitBreakerCooldownSec,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("initializing cloud provider %q is failed: %s", ProviderName, err)
@@ -76,7 +82,25 @@ func init() {
 // Initialize provides the cloud with a kubernetes client builder and may spawn goroutines
 // to perform housekeeping activities within the cloud provider.
 func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
-	// TODO changed k8s 1.13
+	kubeClient := clientBuilder.ClientOrDie(ControllerName)
+
+	// share in-flight allocations of IP addresses and VRIDs with other CCM processes
+	c.sacloudAPI.SetReserver(newConfigMapReserver(kubeClient, reservationNamespace, reservationConfigMapName))
+
+	if lbs, ok := c.loadBalancers.(*loadbalancers); ok {
+		lbs.kubeClient = kubeClient
+		lbs.specClasses = newSpecClassReader(kubeClient)
+		lbs.recorder = newEventRecorder(kubeClient)
+		lbs.watchNodes(kubeClient, stop)
+		if c.config.LoadBalancerProfilesConfigMap != "" {
+			if err := lbs.profiles.watch(kubeClient, c.config.LoadBalancerProfilesConfigMap, stop); err != nil {
+				klog.Errorf("watching LoadBalancer profiles is failed: %s", err)
+			}
+		}
+		if c.config.GarbageCollectorEnabled {
+			go newGarbageCollector(lbs, kubeClient).run(stop)
+		}
+	}
 }
 
 // LoadBalancer returns a balancer interface. Also returns true if the interface is supported, false otherwise.
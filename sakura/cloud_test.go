@@ -1,6 +1,7 @@
 package sakura
 
 import (
+	"context"
 	"time"
 
 	"github.com/sacloud/libsacloud/sacloud"
@@ -14,15 +15,66 @@ type testSacloudClient struct {
 	loadBalancers      []sacloud.LoadBalancer
 	loadBalancersError error
 
+	loadBalancer      *sacloud.LoadBalancer
+	loadBalancerError error
+
 	waitForLBActive error
 
-	createdVIPs             []string
-	createLoadBalancerError error
+	createdLoadBalancer      *sacloud.LoadBalancer
+	createLoadBalancerError  error
+	createLoadBalancerErrors []error
+	createLoadBalancerCalls  int
 
 	updatedVIPs             []string
 	updateLoadBalancerError error
+	// updateLoadBalancerErrors are returned in order before updateLoadBalancerError
+	updateLoadBalancerErrors []error
+	updateLoadBalancerCalls  int
+	updateLoadBalancerParams []*iaas.LoadBalancerParam
 
 	deleteLoadBalancerError error
+	deletedLoadBalancerIDs  []int64
+
+	removeLoadBalancerSettingsError error
+	removedSettingOwners            []string
+
+	releaseLoadBalancerError error
+	releasedLoadBalancerIDs  []int64
+	releasedSettingOwners    []string
+
+	retainLoadBalancerError error
+	retainedLoadBalancerIDs []int64
+
+	expandedSubnet          *sacloud.Subnet
+	expandRouterSubnetError error
+	expandedLoadBalancers   []*sacloud.LoadBalancer
+
+	releasedSubnets           []*sacloud.Subnet
+	releaseRouterSubnetsError error
+	releaseRouterSubnetsCalls int
+
+	markedSubnets          []*iaas.MarkedSubnet
+	deletedMarkedSubnetIDs []int64
+
+	portForwardings             []*iaas.PortForwarding
+	deletedPortForwardingOwners []string
+
+	assignedRoutedIP     *iaas.RoutedIP
+	assignRoutedIPError  error
+	assignRoutedIPParams []*iaas.RoutedIPParam
+
+	releasedRoutedIPOwners []string
+	releaseRoutedIPError   error
+
+	portForwardingGlobalIP      string
+	portForwardingParams        []*iaas.PortForwardingParam
+	ensurePortForwardingError   error
+	removedPortForwardingOwners []string
+	removePortForwardingError   error
+
+	drift       []string
+	driftParams []*iaas.LoadBalancerParam
+	driftError  error
 
 	servers      []sacloud.Server
 	serversError error
@@ -32,32 +84,106 @@ type testSacloudClient struct {
 	currentZone string
 }
 
-func (t *testSacloudClient) AuthStatus() (*sacloud.AuthStatus, error) {
+func (t *testSacloudClient) AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error) {
 	return t.authStatus, t.authError
 }
 
-func (t *testSacloudClient) LoadBalancers(tags ...string) ([]sacloud.LoadBalancer, error) {
+func (t *testSacloudClient) LoadBalancers(ctx context.Context, tags ...string) ([]sacloud.LoadBalancer, error) {
 	return t.loadBalancers, t.loadBalancersError
 }
 
-func (t *testSacloudClient) WaitForLBActive(id int64, wait time.Duration) error {
+func (t *testSacloudClient) LoadBalancer(ctx context.Context, id int64) (*sacloud.LoadBalancer, error) {
+	return t.loadBalancer, t.loadBalancerError
+}
+
+func (t *testSacloudClient) WaitForLBActive(ctx context.Context, id int64, wait time.Duration) error {
 	return t.waitForLBActive
 }
-func (t *testSacloudClient) CreateLoadBalancer(*iaas.LoadBalancerParam, *iaas.VIPParam, time.Duration) ([]string, error) {
-	return t.createdVIPs, t.createLoadBalancerError
+func (t *testSacloudClient) CreateLoadBalancer(context.Context, *iaas.LoadBalancerParam, *iaas.VIPParam) (*sacloud.LoadBalancer, error) {
+	t.createLoadBalancerCalls++
+	if len(t.createLoadBalancerErrors) > 0 {
+		err := t.createLoadBalancerErrors[0]
+		t.createLoadBalancerErrors = t.createLoadBalancerErrors[1:]
+		return nil, err
+	}
+	return t.createdLoadBalancer, t.createLoadBalancerError
 }
-func (t *testSacloudClient) UpdateLoadBalancer(*sacloud.LoadBalancer, *iaas.LoadBalancerParam, *iaas.VIPParam) ([]string, error) {
+func (t *testSacloudClient) UpdateLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam, vipParam *iaas.VIPParam) ([]string, error) {
+	t.updateLoadBalancerCalls++
+	t.updateLoadBalancerParams = append(t.updateLoadBalancerParams, lbParam)
+	if len(t.updateLoadBalancerErrors) > 0 {
+		err := t.updateLoadBalancerErrors[0]
+		t.updateLoadBalancerErrors = t.updateLoadBalancerErrors[1:]
+		return nil, err
+	}
 	return t.updatedVIPs, t.updateLoadBalancerError
 }
-func (t *testSacloudClient) DeleteLoadBalancer(id int64, wait time.Duration) error {
+func (t *testSacloudClient) DeleteLoadBalancer(ctx context.Context, id int64, wait time.Duration) error {
+	t.deletedLoadBalancerIDs = append(t.deletedLoadBalancerIDs, id)
 	return t.deleteLoadBalancerError
 }
-func (t *testSacloudClient) Servers() ([]sacloud.Server, error) {
+func (t *testSacloudClient) RemoveLoadBalancerSettings(ctx context.Context, lb *sacloud.LoadBalancer, owner string) error {
+	t.removedSettingOwners = append(t.removedSettingOwners, owner)
+	return t.removeLoadBalancerSettingsError
+}
+func (t *testSacloudClient) ReleaseLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, owner string, tags []string) error {
+	t.releasedLoadBalancerIDs = append(t.releasedLoadBalancerIDs, lb.ID)
+	t.releasedSettingOwners = append(t.releasedSettingOwners, owner)
+	return t.releaseLoadBalancerError
+}
+func (t *testSacloudClient) RetainLoadBalancer(ctx context.Context, lb *sacloud.LoadBalancer, tags []string) error {
+	t.retainedLoadBalancerIDs = append(t.retainedLoadBalancerIDs, lb.ID)
+	return t.retainLoadBalancerError
+}
+func (t *testSacloudClient) Servers(ctx context.Context) ([]sacloud.Server, error) {
 	return t.servers, t.serversError
 }
-func (t *testSacloudClient) ShutdownServerByID(id int64, shutdownWait time.Duration) error {
+func (t *testSacloudClient) ShutdownServerByID(ctx context.Context, id int64, shutdownWait time.Duration) error {
 	return t.shutdownServerError
 }
 func (t *testSacloudClient) CurrentZone() string {
 	return t.currentZone
 }
+func (t *testSacloudClient) SetReserver(iaas.Reserver) {}
+func (t *testSacloudClient) ExpandRouterSubnet(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam, maskLen int) (*sacloud.Subnet, error) {
+	t.expandedLoadBalancers = append(t.expandedLoadBalancers, lb)
+	return t.expandedSubnet, t.expandRouterSubnetError
+}
+func (t *testSacloudClient) ReleaseRouterSubnets(context.Context, *iaas.LoadBalancerParam) ([]*sacloud.Subnet, error) {
+	t.releaseRouterSubnetsCalls++
+	return t.releasedSubnets, t.releaseRouterSubnetsError
+}
+func (t *testSacloudClient) MarkedSubnets(ctx context.Context, usedIPs []string, tags ...string) ([]*iaas.MarkedSubnet, error) {
+	return t.markedSubnets, nil
+}
+func (t *testSacloudClient) DeleteMarkedSubnet(ctx context.Context, subnet *iaas.MarkedSubnet, usedIPs []string) (bool, error) {
+	t.deletedMarkedSubnetIDs = append(t.deletedMarkedSubnetIDs, subnet.Subnet.ID)
+	return true, nil
+}
+func (t *testSacloudClient) AssignRoutedIP(ctx context.Context, lbParam *iaas.LoadBalancerParam, param *iaas.RoutedIPParam) (*iaas.RoutedIP, error) {
+	t.assignRoutedIPParams = append(t.assignRoutedIPParams, param)
+	return t.assignedRoutedIP, t.assignRoutedIPError
+}
+func (t *testSacloudClient) ReleaseRoutedIP(ctx context.Context, lbParam *iaas.LoadBalancerParam, owner string) error {
+	t.releasedRoutedIPOwners = append(t.releasedRoutedIPOwners, owner)
+	return t.releaseRoutedIPError
+}
+func (t *testSacloudClient) EnsureVPCRouterPortForwarding(ctx context.Context, lbParam *iaas.LoadBalancerParam, param *iaas.PortForwardingParam) (string, error) {
+	t.portForwardingParams = append(t.portForwardingParams, param)
+	return t.portForwardingGlobalIP, t.ensurePortForwardingError
+}
+func (t *testSacloudClient) RemoveVPCRouterPortForwarding(ctx context.Context, lbParam *iaas.LoadBalancerParam, owner string) error {
+	t.removedPortForwardingOwners = append(t.removedPortForwardingOwners, owner)
+	return t.removePortForwardingError
+}
+func (t *testSacloudClient) PortForwardings(ctx context.Context, tags ...string) ([]*iaas.PortForwarding, error) {
+	return t.portForwardings, nil
+}
+func (t *testSacloudClient) DeletePortForwarding(ctx context.Context, forwarding *iaas.PortForwarding) error {
+	t.deletedPortForwardingOwners = append(t.deletedPortForwardingOwners, forwarding.Owner)
+	return nil
+}
+func (t *testSacloudClient) LoadBalancerDrift(ctx context.Context, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam) ([]string, error) {
+	t.driftParams = append(t.driftParams, lbParam)
+	return t.drift, t.driftError
+}
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/hashicorp/go-multierror"
 	"github.com/imdario/mergo"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/client-go/tools/cache"
 )
 
 // Config represents CCM configuration includes sacloud API client configuration
@@ -22,7 +25,29 @@ type Config struct {
 	TraceMode           bool   `json:"traceMode" yaml:"traceMode" split_words:"true"`
 	DisableLoadBalancer bool   `json:"disableLoadBalancer" yaml:"disableLoadBalancer" split_words:"true"`
 
+	APIRateLimit                 float64 `json:"apiRateLimit" yaml:"apiRateLimit" split_words:"true"`
+	APIRateBurst                 int     `json:"apiRateBurst" yaml:"apiRateBurst" split_words:"true"`
+	APICircuitBreakerThreshold   int     `json:"apiCircuitBreakerThreshold" yaml:"apiCircuitBreakerThreshold" split_words:"true"`
+	APICircuitBreakerCooldownSec int     `json:"apiCircuitBreakerCooldownSec" yaml:"apiCircuitBreakerCooldownSec" split_words:"true"`
+
+	LoadBalancerDeletePolicy      string `json:"loadBalancerDeletePolicy" yaml:"loadBalancerDeletePolicy" split_words:"true"`
+	LoadBalancerReservedVRIDRange string `json:"loadBalancerReservedVRIDRange" yaml:"loadBalancerReservedVRIDRange" split_words:"true"`
+
+	LoadBalancerExpandRouterSubnet  bool `json:"loadBalancerExpandRouterSubnet" yaml:"loadBalancerExpandRouterSubnet" split_words:"true"`
+	LoadBalancerRouterSubnetMaskLen int  `json:"loadBalancerRouterSubnetMaskLen" yaml:"loadBalancerRouterSubnetMaskLen" split_words:"true"`
+
 	ClusterID string `json:"clusterID" yaml:"clusterID" split_words:"true"`
+
+	GarbageCollectorEnabled        bool `json:"garbageCollectorEnabled" yaml:"garbageCollectorEnabled" split_words:"true"`
+	GarbageCollectorDryRun         bool `json:"garbageCollectorDryRun" yaml:"garbageCollectorDryRun" split_words:"true"`
+	GarbageCollectorIntervalSec    int  `json:"garbageCollectorIntervalSec" yaml:"garbageCollectorIntervalSec" split_words:"true"`
+	GarbageCollectorGracePeriodSec int  `json:"garbageCollectorGracePeriodSec" yaml:"garbageCollectorGracePeriodSec" split_words:"true"`
+
+	LoadBalancerClass                      string `json:"loadBalancerClass" yaml:"loadBalancerClass" split_words:"true"`
+	LoadBalancerIgnoreServicesWithoutClass bool   `json:"loadBalancerIgnoreServicesWithoutClass" yaml:"loadBalancerIgnoreServicesWithoutClass" split_words:"true"`
+
+	LoadBalancerProfiles          map[string]*LoadBalancerProfile `json:"loadBalancerProfiles" yaml:"loadBalancerProfiles" ignored:"true"`
+	LoadBalancerProfilesConfigMap string                          `json:"loadBalancerProfilesConfigMap" yaml:"loadBalancerProfilesConfigMap" split_words:"true"`
 }
 
 // parseConfig returns a parsed configuration for an SAKURA Cloud cloudprovider config file
@@ -76,5 +101,95 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for k, v := range map[string]float64{
+		"apiRateLimit":                 c.APIRateLimit,
+		"apiRateBurst":                 float64(c.APIRateBurst),
+		"apiCircuitBreakerThreshold":   float64(c.APICircuitBreakerThreshold),
+		"apiCircuitBreakerCooldownSec": float64(c.APICircuitBreakerCooldownSec),
+	} {
+		if v < 0 {
+			err = multierror.Append(err, fmt.Errorf("%q must be positive", k))
+		}
+	}
+
+	switch c.LoadBalancerDeletePolicy {
+	case "", LoadBalancerDeletePolicyDelete, LoadBalancerDeletePolicyRetain:
+	default:
+		err = multierror.Append(err, fmt.Errorf("%q must be one of [%q, %q]",
+			"loadBalancerDeletePolicy", LoadBalancerDeletePolicyDelete, LoadBalancerDeletePolicyRetain))
+	}
+
+	if c.LoadBalancerReservedVRIDRange != "" {
+		if _, e := iaas.ParseVRIDRange(c.LoadBalancerReservedVRIDRange); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%q is invalid: %s", "loadBalancerReservedVRIDRange", e))
+		}
+	}
+
+	if c.LoadBalancerRouterSubnetMaskLen != 0 {
+		if c.LoadBalancerRouterSubnetMaskLen < minRouterSubnetMaskLen || maxRouterSubnetMaskLen < c.LoadBalancerRouterSubnetMaskLen {
+			err = multierror.Append(err, fmt.Errorf("%q must be in %d-%d",
+				"loadBalancerRouterSubnetMaskLen", minRouterSubnetMaskLen, maxRouterSubnetMaskLen))
+		}
+	}
+
+	if c.GarbageCollectorEnabled && c.ClusterID == "" {
+		// without ClusterID, resources of other clusters can't be distinguished
+		err = multierror.Append(err, fmt.Errorf("%q is required when %q is enabled", "clusterID", "garbageCollectorEnabled"))
+	}
+	if c.GarbageCollectorIntervalSec < 0 {
+		err = multierror.Append(err, fmt.Errorf("%q must be positive", "garbageCollectorIntervalSec"))
+	}
+	if c.GarbageCollectorGracePeriodSec < 0 {
+		err = multierror.Append(err, fmt.Errorf("%q must be positive", "garbageCollectorGracePeriodSec"))
+	}
+
+	for name, profile := range c.LoadBalancerProfiles {
+		if profile == nil {
+			continue
+		}
+		if e := profile.validate(); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%q has invalid profile %q: %s", "loadBalancerProfiles", name, e))
+		}
+	}
+	if c.LoadBalancerProfilesConfigMap != "" {
+		if _, _, e := cache.SplitMetaNamespaceKey(c.LoadBalancerProfilesConfigMap); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%q must be \"namespace/name\" of ConfigMap", "loadBalancerProfilesConfigMap"))
+		}
+	}
+
 	return err
 }
+
+// garbageCollectorInterval returns interval of garbage collection
+func (c *Config) garbageCollectorInterval() time.Duration {
+	if c.GarbageCollectorIntervalSec == 0 {
+		return defaultGarbageCollectorInterval
+	}
+	return time.Duration(c.GarbageCollectorIntervalSec) * time.Second
+}
+
+// garbageCollectorGracePeriod returns period which unmatched resources are kept before deleted
+func (c *Config) garbageCollectorGracePeriod() time.Duration {
+	if c.GarbageCollectorGracePeriodSec == 0 {
+		return defaultGarbageCollectorGracePeriod
+	}
+	return time.Duration(c.GarbageCollectorGracePeriodSec) * time.Second
+}
+
+// routerSubnetMaskLen returns mask length of routed subnet added to router
+func (c *Config) routerSubnetMaskLen() int {
+	if c.LoadBalancerRouterSubnetMaskLen == 0 {
+		return defaultRouterSubnetMaskLen
+	}
+	return c.LoadBalancerRouterSubnetMaskLen
+}
+
+// reservedVRIDRange returns VRID range which must not be used by LoadBalancers
+func (c *Config) reservedVRIDRange() *iaas.VRIDRange {
+	if c.LoadBalancerReservedVRIDRange == "" {
+		return nil
+	}
+	// already validated
+	r, _ := iaas.ParseVRIDRange(c.LoadBalancerReservedVRIDRange)
+	return r
+}
@@ -85,3 +85,56 @@ func TestParseConfig(t *testing.T) {
 	}
 
 }
+
+func TestConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		caseName          string
+		reservedVRIDRange string
+		clusterID         string
+		gcEnabled         bool
+		profiles          map[string]*LoadBalancerProfile
+		profilesConfigMap string
+		apiRateLimit      float64
+		hasError          bool
+	}{
+		{caseName: "no reserved VRID range"},
+		{caseName: "valid reserved VRID range", reservedVRIDRange: "200-255"},
+		{caseName: "out of VRID range", reservedVRIDRange: "200-256", hasError: true},
+		{caseName: "invalid reserved VRID range", reservedVRIDRange: "200-", hasError: true},
+		{caseName: "garbage collector with cluster ID", clusterID: "id", gcEnabled: true},
+		{caseName: "garbage collector without cluster ID", gcEnabled: true, hasError: true},
+		{
+			caseName: "valid profiles",
+			profiles: map[string]*LoadBalancerProfile{
+				"private": {Type: "switch", SwitchSelector: "private", IPRange: "192.2.0.0/24"},
+			},
+			profilesConfigMap: "kube-system/lb-profiles",
+		},
+		{
+			caseName: "invalid profile",
+			profiles: map[string]*LoadBalancerProfile{"private": {Type: "switch", IPRange: "192.2.0.1"}},
+			hasError: true,
+		},
+		{caseName: "invalid profiles ConfigMap", profilesConfigMap: "a/b/c", hasError: true},
+		{caseName: "API rate limit", apiRateLimit: 2.5},
+		{caseName: "negative API rate limit", apiRateLimit: -1, hasError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.caseName, func(t *testing.T) {
+			cfg := &Config{
+				AccessToken:                   "token",
+				AccessTokenSecret:             "secret",
+				Zone:                          "zone",
+				LoadBalancerReservedVRIDRange: testCase.reservedVRIDRange,
+				ClusterID:                     testCase.clusterID,
+				GarbageCollectorEnabled:       testCase.gcEnabled,
+				LoadBalancerProfiles:          testCase.profiles,
+				APIRateLimit:                  testCase.apiRateLimit,
+				LoadBalancerProfilesConfigMap: testCase.profilesConfigMap,
+			}
+			err := cfg.Validate()
+			assert.Equal(t, testCase.hasError, err != nil)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package sakura
+
+import (
+	"errors"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// Event reasons recorded to services
+const (
+	// EventReasonRouterSubnetExpanded is reason of event when routed subnet is added to router
+	EventReasonRouterSubnetExpanded = "RouterSubnetExpanded"
+	// EventReasonRouterSubnetQuotaExceeded is reason of event when adding routed subnet is failed by quota
+	EventReasonRouterSubnetQuotaExceeded = "RouterSubnetQuotaExceeded"
+	// EventReasonRouterSubnetExpansionFailed is reason of event when adding routed subnet is failed
+	EventReasonRouterSubnetExpansionFailed = "RouterSubnetExpansionFailed"
+	// EventReasonRouterSubnetReleased is reason of event when empty routed subnet is removed from router
+	EventReasonRouterSubnetReleased = "RouterSubnetReleased"
+	// EventReasonRoutedNextHopMoved is reason of event when next-hop of routed subnet is moved to other node
+	EventReasonRoutedNextHopMoved = "RoutedNextHopMoved"
+	// EventReasonLoadBalancerDriftDetected is reason of event when immutable attributes of LoadBalancer are changed without opt-in for replacement
+	EventReasonLoadBalancerDriftDetected = "LoadBalancerDriftDetected"
+	// EventReasonLoadBalancerReplacementStarted is reason of event when LoadBalancer for replacement is created
+	EventReasonLoadBalancerReplacementStarted = "LoadBalancerReplacementStarted"
+	// EventReasonLoadBalancerVIPMoved is reason of event when VIP is moved to LoadBalancer for replacement
+	EventReasonLoadBalancerVIPMoved = "LoadBalancerVIPMoved"
+	// EventReasonLoadBalancerReplaced is reason of event when replaced LoadBalancer is deleted
+	EventReasonLoadBalancerReplaced = "LoadBalancerReplaced"
+	// EventReasonLoadBalancerReplacementFailed is reason of event when a step of replacement is failed
+	EventReasonLoadBalancerReplacementFailed = "LoadBalancerReplacementFailed"
+	// EventReasonLoadBalancerCreating is reason of event when LoadBalancer is requested to be created
+	EventReasonLoadBalancerCreating = "LoadBalancerCreating"
+	// EventReasonIPAddressExhausted is reason of event when no IP address is usable for VIP or service IP
+	EventReasonIPAddressExhausted = "IPAddressExhausted"
+	// EventReasonVRIDExhausted is reason of event when no VRID is usable on the switch for LoadBalancer
+	EventReasonVRIDExhausted = "VRIDExhausted"
+	// EventReasonNetworkNotFound is reason of event when router or switch for the service is not found
+	EventReasonNetworkNotFound = "NetworkNotFound"
+	// EventReasonInvalidVIP is reason of event when specified VIP can't be used
+	EventReasonInvalidVIP = "InvalidVIP"
+	// EventReasonVIPConflict is reason of event when specified VIP or its port is already used by others
+	EventReasonVIPConflict = "VIPConflict"
+	// EventReasonInvalidConfiguration is reason of event when parameters of LoadBalancer are rejected by CCM or API
+	EventReasonInvalidConfiguration = "InvalidConfiguration"
+	// EventReasonAPIThrottled is reason of event when SAKURA Cloud API is busy
+	EventReasonAPIThrottled = "APIThrottled"
+	// EventReasonAPIUnavailable is reason of event when SAKURA Cloud API is down or unreachable
+	EventReasonAPIUnavailable = "APIUnavailable"
+	// EventReasonLoadBalancerBootTimeout is reason of event when LoadBalancer is not active in boot wait
+	EventReasonLoadBalancerBootTimeout = "LoadBalancerBootTimeout"
+	// EventReasonInvalidService is reason of event when the service has annotations or specs which CCM can't handle
+	EventReasonInvalidService = "InvalidService"
+	// EventReasonLoadBalancerClassUnknown is reason of event when spec.loadBalancerClass of the service can't be read
+	EventReasonLoadBalancerClassUnknown = "LoadBalancerClassUnknown"
+	// EventReasonLoadBalancerSyncFailed is reason of event when ensuring LoadBalancer is failed by other errors
+	EventReasonLoadBalancerSyncFailed = "LoadBalancerSyncFailed"
+	// EventReasonLoadBalancerDeleteFailed is reason of event when deleting LoadBalancer is failed by other errors
+	EventReasonLoadBalancerDeleteFailed = "LoadBalancerDeleteFailed"
+)
+
+func newEventRecorder(kubeClient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName})
+}
+
+// recordEvent records event to the service if event recorder is initialized
+func (l *loadbalancers) recordEvent(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil {
+		return
+	}
+	l.recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
+
+// recordFailure records warning event for err returned to the service controller.
+// Reason is derived from kind of err so that users can find why the service is pending,
+// defaultReason is used for errors of other kinds.
+func (l *loadbalancers) recordFailure(service *v1.Service, defaultReason string, err error) {
+	if _, ok := err.(*loadBalancerPendingError); ok {
+		// LoadBalancerCreating event is already recorded
+		return
+	}
+	l.recordEvent(service, v1.EventTypeWarning, failureReason(err, defaultReason), "%s", err)
+}
+
+// isTemporaryAPIError returns true if err is caused by busy or down SAKURA Cloud API, which is recovered by retrying later
+func isTemporaryAPIError(err error) bool {
+	return errors.Is(err, iaas.ErrThrottled) || errors.Is(err, iaas.ErrUnavailable)
+}
+
+func failureReason(err error, defaultReason string) string {
+	var timeout *loadBalancerTimeoutError
+	var invalid *serviceValidationError
+	var apiErr *iaas.APIError
+	switch {
+	case errors.As(err, &invalid):
+		return EventReasonInvalidService
+	case errors.Is(err, iaas.ErrThrottled):
+		return EventReasonAPIThrottled
+	case errors.Is(err, iaas.ErrUnavailable):
+		return EventReasonAPIUnavailable
+	case errors.Is(err, iaas.ErrIPExhausted):
+		return EventReasonIPAddressExhausted
+	case errors.Is(err, iaas.ErrVRIDExhausted):
+		return EventReasonVRIDExhausted
+	case errors.Is(err, iaas.ErrNotFound) && !errors.As(err, &apiErr):
+		// resources read by ID are not network of the service
+		return EventReasonNetworkNotFound
+	case errors.Is(err, iaas.ErrInvalidVIP):
+		return EventReasonInvalidVIP
+	case errors.Is(err, iaas.ErrVIPConflict):
+		return EventReasonVIPConflict
+	case errors.Is(err, iaas.ErrInvalidConfig):
+		return EventReasonInvalidConfiguration
+	case errors.As(err, &timeout):
+		return EventReasonLoadBalancerBootTimeout
+	default:
+		return defaultReason
+	}
+}
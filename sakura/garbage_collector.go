@@ -0,0 +1,363 @@
+package sakura
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// TagsGarbageCollectorExcluded is a marker tag indicating that resource is never deleted by garbage collector
+var TagsGarbageCollectorExcluded = fmt.Sprintf("%s.GCExcluded", TagsKubernetesResource)
+
+// serviceUIDPattern matches UID of service recorded as owner of port forwarding rules
+var serviceUIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+const (
+	defaultGarbageCollectorInterval    = 10 * time.Minute
+	defaultGarbageCollectorGracePeriod = time.Hour
+)
+
+// Actions of garbage collector reported as metrics
+const (
+	garbageCollectorActionDetected = "detected"
+	garbageCollectorActionDeleted  = "deleted"
+	garbageCollectorActionDryRun   = "dry_run"
+	garbageCollectorActionFailed   = "failed"
+)
+
+var garbageCollectorResources = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "sakuracloud",
+		Subsystem: "garbage_collector",
+		Name:      "resources_total",
+		Help:      "Number of orphaned resources handled by garbage collector, partitioned by resource and action.",
+	},
+	[]string{"resource", "action"},
+)
+
+var registerGarbageCollectorMetrics sync.Once
+
+// garbageCollector deletes LoadBalancers, router subnets and port forwarding rules of the cluster
+// whose service no longer exists, e.g. the service was deleted while CCM was down.
+type garbageCollector struct {
+	lbs         *loadbalancers
+	kubeClient  kubernetes.Interface
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+
+	// unmatchedSince is time when each resource was found without its service.
+	// It is kept in memory, so grace period restarts when CCM is restarted.
+	unmatchedSince map[string]time.Time
+	now            func() time.Time
+}
+
+func newGarbageCollector(lbs *loadbalancers, kubeClient kubernetes.Interface) *garbageCollector {
+	registerGarbageCollectorMetrics.Do(func() {
+		prometheus.MustRegister(garbageCollectorResources)
+	})
+	return &garbageCollector{
+		lbs:            lbs,
+		kubeClient:     kubeClient,
+		interval:       lbs.config.garbageCollectorInterval(),
+		gracePeriod:    lbs.config.garbageCollectorGracePeriod(),
+		dryRun:         lbs.config.GarbageCollectorDryRun,
+		unmatchedSince: map[string]time.Time{},
+		now:            time.Now,
+	}
+}
+
+// run collects garbage every interval until stop is closed
+func (g *garbageCollector) run(stop <-chan struct{}) {
+	klog.Infof("garbage collector is started: interval=%s, grace period=%s, dry-run=%t", g.interval, g.gracePeriod, g.dryRun)
+
+	// cancels collection in progress, such as waiting for LoadBalancer to be stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	wait.Until(func() {
+		if err := g.collect(ctx); err != nil {
+			klog.Warningf("garbage collection is failed: %s", err)
+		}
+	}, g.interval, stop)
+}
+
+// collect deletes resources which are not matched to any service for grace period.
+// Nothing is deleted when services can't be listed.
+func (g *garbageCollector) collect(ctx context.Context) error {
+	services, err := g.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := g.now()
+	seen := map[string]bool{}
+	if err := g.collectLoadBalancers(ctx, services.Items, seen, now); err != nil {
+		return err
+	}
+	if err := g.collectRouterSubnets(ctx, services.Items, seen, now); err != nil {
+		return err
+	}
+	if err := g.collectPortForwardings(ctx, services.Items, seen, now); err != nil {
+		return err
+	}
+
+	// resources deleted or matched by others
+	for key := range g.unmatchedSince {
+		if !seen[key] {
+			delete(g.unmatchedSince, key)
+		}
+	}
+	return nil
+}
+
+// garbage is a resource which is not matched to any service
+type garbage struct {
+	// key identifies the resource in unmatchedSince
+	key string
+	// resource is label of metrics
+	resource string
+	// name is used in logs
+	name string
+	// delete deletes the resource, and returns false if it is kept because it is found to be used
+	delete func() (bool, error)
+}
+
+// sweep deletes the garbage after grace period.
+// Error is returned only when SAKURA Cloud API is busy or down, so that the collection backs off.
+func (g *garbageCollector) sweep(item *garbage, now time.Time) error {
+	since, ok := g.unmatchedSince[item.key]
+	if !ok {
+		klog.Infof("%s has no service, it will be deleted after %s", item.name, g.gracePeriod)
+		garbageCollectorResources.WithLabelValues(item.resource, garbageCollectorActionDetected).Inc()
+		g.unmatchedSince[item.key] = now
+		return nil
+	}
+	if now.Sub(since) < g.gracePeriod {
+		return nil
+	}
+
+	if g.dryRun {
+		klog.Infof("%s has no service for %s, skip deleting it by dry-run", item.name, now.Sub(since))
+		garbageCollectorResources.WithLabelValues(item.resource, garbageCollectorActionDryRun).Inc()
+		return nil
+	}
+	klog.Infof("%s has no service for %s, deleting it", item.name, now.Sub(since))
+	deleted, err := item.delete()
+	if err != nil {
+		garbageCollectorResources.WithLabelValues(item.resource, garbageCollectorActionFailed).Inc()
+		if isTemporaryAPIError(err) {
+			// back off until next collection, other resources would fail too
+			return fmt.Errorf("deleting %s is failed: %w", item.name, err)
+		}
+		klog.Warningf("deleting %s is failed: %s", item.name, err)
+		return nil
+	}
+	if deleted {
+		garbageCollectorResources.WithLabelValues(item.resource, garbageCollectorActionDeleted).Inc()
+	} else {
+		klog.Infof("%s is used now, skip deleting it", item.name)
+	}
+	delete(g.unmatchedSince, item.key)
+	return nil
+}
+
+// collectLoadBalancers deletes LoadBalancers of the cluster which don't belong to any service
+func (g *garbageCollector) collectLoadBalancers(ctx context.Context, services []v1.Service, seen map[string]bool, now time.Time) error {
+	clusterTags := g.lbs.clusterTags()
+	lbs, err := g.lbs.sacloudAPI.LoadBalancers(ctx, clusterTags...)
+	if err != nil {
+		return err
+	}
+	g.lbs.observeLoadBalancers(lbs)
+
+	for i := range lbs {
+		lb := &lbs[i]
+		if !hasTags(lb, clusterTags) || !g.isCollectable(lb) {
+			continue
+		}
+		key := fmt.Sprintf("loadbalancer/%d", lb.ID)
+		seen[key] = true
+		if g.isMatched(ctx, lb, services) {
+			delete(g.unmatchedSince, key)
+			continue
+		}
+
+		err := g.sweep(&garbage{
+			key:      key,
+			resource: "loadbalancer",
+			name:     fmt.Sprintf("LoadBalancer %q(id:%s)", lb.Name, lb.GetStrID()),
+			delete: func() (bool, error) {
+				return true, g.lbs.sacloudAPI.DeleteLoadBalancer(ctx, lb.ID, g.lbs.shutdownWait)
+			},
+		}, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectRouterSubnets deletes subnets marked by CCM on routers of the cluster which have no VIP or service IP.
+// Both subnets added for VIPs and routed subnets for routed type services are collected.
+func (g *garbageCollector) collectRouterSubnets(ctx context.Context, services []v1.Service, seen map[string]bool, now time.Time) error {
+	usedIPs := serviceIngressIPs(services)
+	subnets, err := g.lbs.sacloudAPI.MarkedSubnets(ctx, usedIPs, g.lbs.clusterTags()...)
+	if err != nil {
+		return err
+	}
+
+	for _, subnet := range subnets {
+		if subnet.Router.HasTag(TagsGarbageCollectorExcluded) {
+			continue
+		}
+		key := fmt.Sprintf("subnet/%d", subnet.Subnet.ID)
+		seen[key] = true
+		if subnet.Used {
+			delete(g.unmatchedSince, key)
+			continue
+		}
+
+		resource, kind := "router_subnet", "Router subnet"
+		if subnet.Routed {
+			resource, kind = "routed_subnet", "Routed subnet"
+		}
+		err := g.sweep(&garbage{
+			key:      key,
+			resource: resource,
+			name: fmt.Sprintf("%s %s/%d(id:%s) of router %q", kind,
+				subnet.Subnet.NetworkAddress, subnet.Subnet.NetworkMaskLen, subnet.Subnet.GetStrID(), subnet.Router.Name),
+			delete: func() (bool, error) {
+				return g.lbs.sacloudAPI.DeleteMarkedSubnet(ctx, subnet, usedIPs)
+			},
+		}, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectPortForwardings deletes port forwarding rules on VPC routers of the cluster whose service no longer exists
+func (g *garbageCollector) collectPortForwardings(ctx context.Context, services []v1.Service, seen map[string]bool, now time.Time) error {
+	forwardings, err := g.lbs.sacloudAPI.PortForwardings(ctx, g.lbs.clusterTags()...)
+	if err != nil {
+		return err
+	}
+
+	uids := map[string]bool{}
+	for i := range services {
+		uids[string(services[i].UID)] = true
+	}
+	for _, forwarding := range forwardings {
+		// rules added by hand have other descriptions
+		if forwarding.Router.HasTag(TagsGarbageCollectorExcluded) || !serviceUIDPattern.MatchString(forwarding.Owner) {
+			continue
+		}
+		key := fmt.Sprintf("portforwarding/%d/%s", forwarding.Router.ID, forwarding.Owner)
+		seen[key] = true
+		if uids[forwarding.Owner] {
+			delete(g.unmatchedSince, key)
+			continue
+		}
+
+		err := g.sweep(&garbage{
+			key:      key,
+			resource: "port_forwarding",
+			name:     fmt.Sprintf("Port forwarding of service(uid:%s) on VPC router %q", forwarding.Owner, forwarding.Router.Name),
+			delete: func() (bool, error) {
+				return true, g.lbs.sacloudAPI.DeletePortForwarding(ctx, forwarding)
+			},
+		}, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isCollectable returns false if lb must be kept regardless of services
+func (g *garbageCollector) isCollectable(lb *sacloud.LoadBalancer) bool {
+	// adopted LoadBalancer is owned by its creator, and orphaned one is retained by delete policy
+	return !lb.HasTag(TagsGarbageCollectorExcluded) && !isAdoptedLoadBalancer(lb) && !isOrphanedLoadBalancer(lb)
+}
+
+// isMatched returns true if lb belongs to one of services.
+// Matching is loose, LoadBalancer which may belong to a service is always kept.
+// Services which opt out of CCM or have other class are matched too,
+// their LoadBalancers are left behind and kept until the services are deleted.
+func (g *garbageCollector) isMatched(ctx context.Context, lb *sacloud.LoadBalancer, services []v1.Service) bool {
+	for i := range services {
+		service := &services[i]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if g.lbs.isOwnedLoadBalancer(ctx, "", service, lb) {
+			return true
+		}
+		if m := decodeServiceMetadata(lb.Description); m != nil {
+			// LoadBalancer of deleted service is garbage even if a service with same name is re-created
+			if m.UID == string(service.UID) {
+				return true
+			}
+		} else if g.lbs.isServiceLoadBalancer(lb, service) {
+			return true
+		}
+		if isGroupRequested(service) {
+			tags, err := g.lbs.groupTags(service)
+			if err == nil && hasTags(lb, tags) {
+				return true
+			}
+		}
+		if lb.Settings != nil {
+			for _, s := range lb.Settings.LoadBalancer {
+				if s.Description != "" && s.Description == string(service.UID) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// serviceIngressIPs returns ingress IPs of LoadBalancer type services
+func serviceIngressIPs(services []v1.Service) []string {
+	var ips []string
+	for i := range services {
+		if services[i].Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, ingress := range services[i].Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				ips = append(ips, ingress.IP)
+			}
+		}
+	}
+	return ips
+}
+
+func hasTags(lb *sacloud.LoadBalancer, tags []string) bool {
+	for _, tag := range tags {
+		if !lb.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/cloud-provider"
+)
+
+func TestGarbageCollector_collect(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alive", UID: "uid1"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	lbs := &loadbalancers{config: &Config{ClusterID: "cluster"}}
+	deleted := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "deleted", UID: "uid2"}}
+
+	alive := newLoadBalancer(&newLoadBalancerParam{
+		id: 100000000001, name: cloudprovider.DefaultLoadBalancerName(service), tags: lbs.serviceTags(service),
+	})
+	orphan := newLoadBalancer(&newLoadBalancerParam{
+		id: 100000000002, name: cloudprovider.DefaultLoadBalancerName(deleted), tags: lbs.serviceTags(deleted),
+	})
+	excluded := newLoadBalancer(&newLoadBalancerParam{
+		id: 100000000003, name: "excluded", tags: append(lbs.serviceTags(deleted), TagsGarbageCollectorExcluded),
+	})
+	retained := newLoadBalancer(&newLoadBalancerParam{
+		id: 100000000004, name: "retained", tags: append(lbs.serviceTags(deleted), TagsLoadBalancerOrphaned),
+	})
+	otherCluster := newLoadBalancer(&newLoadBalancerParam{
+		id: 100000000005, name: "other-cluster", tags: []string{TagsKubernetesResource, TagsClusterID + "=other"},
+	})
+
+	newCollector := func(dryRun bool) (*garbageCollector, *testSacloudClient, *time.Time) {
+		client := &testSacloudClient{
+			loadBalancers: []sacloud.LoadBalancer{*alive, *orphan, *excluded, *retained, *otherCluster},
+		}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{ClusterID: "cluster", GarbageCollectorDryRun: dryRun}}
+		g := newGarbageCollector(lbs, fake.NewSimpleClientset(service))
+		now := time.Now()
+		g.now = func() time.Time { return now }
+		return g, client, &now
+	}
+
+	t.Run("delete after grace period", func(t *testing.T) {
+		g, client, now := newCollector(false)
+
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Empty(t, client.deletedLoadBalancerIDs, "unmatched LoadBalancer is kept in grace period")
+
+		*now = now.Add(defaultGarbageCollectorGracePeriod)
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Equal(t, []int64{orphan.ID}, client.deletedLoadBalancerIDs)
+		assert.Empty(t, g.unmatchedSince)
+	})
+
+	t.Run("dry-run", func(t *testing.T) {
+		g, client, now := newCollector(true)
+
+		assert.NoError(t, g.collect(context.Background()))
+		*now = now.Add(defaultGarbageCollectorGracePeriod)
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Empty(t, client.deletedLoadBalancerIDs)
+	})
+
+	t.Run("service is re-created in grace period", func(t *testing.T) {
+		g, client, now := newCollector(false)
+
+		assert.NoError(t, g.collect(context.Background()))
+		recreated := deleted.DeepCopy()
+		recreated.Namespace = "default"
+		recreated.Spec.Type = v1.ServiceTypeLoadBalancer
+		g.kubeClient = fake.NewSimpleClientset(service, recreated)
+
+		*now = now.Add(defaultGarbageCollectorGracePeriod)
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Empty(t, client.deletedLoadBalancerIDs)
+		assert.Empty(t, g.unmatchedSince)
+	})
+
+	t.Run("service opts out", func(t *testing.T) {
+		g, client, now := newCollector(false)
+		optedOut := deleted.DeepCopy()
+		optedOut.Namespace = "default"
+		optedOut.Spec.Type = v1.ServiceTypeLoadBalancer
+		optedOut.Annotations = map[string]string{annLoadBalancerManaged: "false"}
+		otherClass := service.DeepCopy()
+		otherClass.Annotations = map[string]string{AnnLoadBalancerClass: "metallb.io/metallb"}
+		g.kubeClient = fake.NewSimpleClientset(otherClass, optedOut)
+
+		assert.NoError(t, g.collect(context.Background()))
+		*now = now.Add(defaultGarbageCollectorGracePeriod)
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Empty(t, client.deletedLoadBalancerIDs, "LoadBalancer left behind is kept while the service exists")
+	})
+
+	t.Run("back off when API is throttled", func(t *testing.T) {
+		g, client, now := newCollector(false)
+		another := newLoadBalancer(&newLoadBalancerParam{
+			id: 100000000006, name: "another", tags: lbs.serviceTags(deleted),
+		})
+		client.loadBalancers = append(client.loadBalancers, *another)
+
+		assert.NoError(t, g.collect(context.Background()))
+		*now = now.Add(defaultGarbageCollectorGracePeriod)
+		client.deleteLoadBalancerError = &iaas.APIError{StatusCode: 503, Kind: iaas.ErrThrottled, Err: errors.New("giving up after 3 attempts")}
+		err := g.collect(context.Background())
+		assert.True(t, errors.Is(err, iaas.ErrThrottled), "unexpected error: %v", err)
+		assert.Equal(t, []int64{orphan.ID}, client.deletedLoadBalancerIDs, "deleting others is deferred to next collection")
+
+		client.deleteLoadBalancerError = errors.New("dummy")
+		assert.NoError(t, g.collect(context.Background()))
+		assert.Equal(t, []int64{orphan.ID, orphan.ID, another.ID}, client.deletedLoadBalancerIDs)
+	})
+}
+
+func TestGarbageCollector_collectRouterResources(t *testing.T) {
+	const aliveUID = "6c0e1f3a-2b1d-4c5e-9f7a-0123456789ab"
+	const deletedUID = "0f9e8d7c-6b5a-4938-a7b6-c5d4e3f2a1b0"
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alive", UID: aliveUID},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+
+	router := &sacloud.Internet{Resource: sacloud.NewResource(2)}
+	router.Name = "router"
+	excludedRouter := &sacloud.Internet{Resource: sacloud.NewResource(3)}
+	excludedRouter.AppendTag(TagsGarbageCollectorExcluded)
+	newSubnet := func(id int64, routed, used bool, r *sacloud.Internet) *iaas.MarkedSubnet {
+		return &iaas.MarkedSubnet{Router: r, Subnet: &sacloud.Subnet{Resource: sacloud.NewResource(id)}, Routed: routed, Used: used}
+	}
+	vpcRouter := &sacloud.VPCRouter{Appliance: &sacloud.Appliance{Resource: sacloud.NewResource(4)}}
+
+	client := &testSacloudClient{
+		markedSubnets: []*iaas.MarkedSubnet{
+			newSubnet(10, false, true, router),
+			newSubnet(11, false, false, router),
+			newSubnet(12, true, false, router),
+			newSubnet(13, true, false, excludedRouter),
+		},
+		portForwardings: []*iaas.PortForwarding{
+			{Router: vpcRouter, Owner: aliveUID},
+			{Router: vpcRouter, Owner: deletedUID},
+			{Router: vpcRouter, Owner: "ssh"},
+		},
+	}
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{ClusterID: "cluster"}}
+	g := newGarbageCollector(lbs, fake.NewSimpleClientset(service))
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	assert.NoError(t, g.collect(context.Background()))
+	assert.Empty(t, client.deletedMarkedSubnetIDs, "unmatched subnet is kept in grace period")
+	assert.Empty(t, client.deletedPortForwardingOwners, "unmatched rules are kept in grace period")
+
+	now = now.Add(defaultGarbageCollectorGracePeriod)
+	assert.NoError(t, g.collect(context.Background()))
+	assert.Equal(t, []int64{11, 12}, client.deletedMarkedSubnetIDs)
+	assert.Equal(t, []string{deletedUID}, client.deletedPortForwardingOwners)
+	assert.Empty(t, g.unmatchedSince)
+}
@@ -4,11 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
 
-	"github.com/sacloud/libsacloud/api"
 	"github.com/sacloud/libsacloud/sacloud"
 	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
 	"k8s.io/api/core/v1"
@@ -32,7 +30,7 @@ func newInstances(client iaas.Client) cloudprovider.Instances {
 
 // NodeAddresses returns the addresses of the specified instance.
 func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
-	server, err := nodeByName(i.sacloudAPI, string(name))
+	server, err := nodeByName(ctx, i.sacloudAPI, string(name))
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +51,7 @@ func (i *instances) NodeAddressesByProviderID(ctx context.Context, providerID st
 		return nil, err
 	}
 
-	server, err := nodeByID(i.sacloudAPI, serverID)
+	server, err := nodeByID(ctx, i.sacloudAPI, serverID)
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +66,7 @@ func (i *instances) ExternalID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceID returns the cloud provider ID of the node with the specified NodeName.
 func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
-	server, err := nodeByName(i.sacloudAPI, string(nodeName))
+	server, err := nodeByName(ctx, i.sacloudAPI, string(nodeName))
 	if err != nil {
 		return "", err
 	}
@@ -77,7 +75,7 @@ func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceType returns the type of the specified instance.
 func (i *instances) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
-	server, err := nodeByName(i.sacloudAPI, string(name))
+	server, err := nodeByName(ctx, i.sacloudAPI, string(name))
 	if err != nil {
 		return "", err
 	}
@@ -91,7 +89,7 @@ func (i *instances) InstanceTypeByProviderID(ctx context.Context, providerID str
 		return "", err
 	}
 
-	server, err := nodeByID(i.sacloudAPI, serverID)
+	server, err := nodeByID(ctx, i.sacloudAPI, serverID)
 	if err != nil {
 		return "", err
 	}
@@ -118,7 +116,7 @@ func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID s
 		return false, err
 	}
 
-	_, err = nodeByID(i.sacloudAPI, serverID)
+	_, err = nodeByID(ctx, i.sacloudAPI, serverID)
 	if err == nil {
 		return true, nil
 	}
@@ -136,13 +134,9 @@ func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID
 		return false, err
 	}
 
-	server, err := nodeByID(i.sacloudAPI, serverID)
+	// error is cloudprovider.InstanceNotFound if the Server does not exist
+	server, err := nodeByID(ctx, i.sacloudAPI, serverID)
 	if err != nil {
-		if err, ok := err.(api.Error); ok {
-			if err.ResponseCode() == http.StatusNotFound {
-				return false, cloudprovider.InstanceNotFound
-			}
-		}
 		return false, err
 	}
 
@@ -151,8 +145,8 @@ func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID
 
 // nodeByName gets a SAKURA Cloud Server instance by name. The returned error will
 // be cloudprovider.InstanceNotFound if the Server does not exist.
-func nodeByName(client iaas.Client, name string) (*sacloud.Server, error) {
-	servers, err := client.Servers()
+func nodeByName(ctx context.Context, client iaas.Client, name string) (*sacloud.Server, error) {
+	servers, err := client.Servers(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -168,8 +162,8 @@ func nodeByName(client iaas.Client, name string) (*sacloud.Server, error) {
 
 // nodeByID gets a SAKURA Cloud Server instance by ID. The returned error will
 // be cloudprovider.InstanceNotFound if the Server does not exist.
-func nodeByID(client iaas.Client, id string) (*sacloud.Server, error) {
-	servers, err := client.Servers()
+func nodeByID(ctx context.Context, client iaas.Client, id string) (*sacloud.Server, error) {
+	servers, err := client.Servers(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,57 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/cloud-provider"
+)
+
+func TestInstances_InstanceShutdownByProviderID(t *testing.T) {
+	server := sacloud.Server{Resource: sacloud.NewResource(123456789012)}
+	i := newInstances(&testSacloudClient{servers: []sacloud.Server{server}})
+
+	_, err := i.InstanceShutdownByProviderID(context.Background(), "sakuracloud://123456789012")
+	assert.NoError(t, err)
+	_, err = i.InstanceShutdownByProviderID(context.Background(), "sakuracloud://123456789013")
+	assert.Equal(t, cloudprovider.InstanceNotFound, err)
+}
+
+func TestInstances_InstanceExistsByProviderID(t *testing.T) {
+	server := sacloud.Server{Resource: sacloud.NewResource(123456789012)}
+
+	expects := []struct {
+		caseName   string
+		servers    []sacloud.Server
+		serversErr error
+		exists     bool
+		hasError   bool
+	}{
+		{caseName: "exists", servers: []sacloud.Server{server}, exists: true},
+		{caseName: "not exists"},
+		{
+			// must not be treated as deleted instance
+			caseName:   "API is unavailable",
+			servers:    []sacloud.Server{server},
+			serversErr: fmt.Errorf("GET /server: %w", iaas.ErrUnavailable),
+			hasError:   true,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			i := newInstances(&testSacloudClient{servers: expect.servers, serversError: expect.serversErr})
+			exists, err := i.InstanceExistsByProviderID(context.Background(), "sakuracloud://123456789012")
+			assert.Equal(t, expect.exists, exists)
+			assert.Equal(t, expect.hasError, err != nil)
+			if expect.serversErr != nil {
+				assert.True(t, errors.Is(err, iaas.ErrUnavailable))
+			}
+		})
+	}
+}
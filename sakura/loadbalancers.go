@@ -5,22 +5,39 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sacloud/libsacloud/sacloud"
 	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
 	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/cloud-provider"
-	"k8s.io/utils/strings"
+	"k8s.io/klog"
+	utilstrings "k8s.io/utils/strings"
 )
 
 // TagsLoadBalancerServiceName is tag name indicating that resource is part of k8s cluster service
 var TagsLoadBalancerServiceName = fmt.Sprintf("%s.Service", TagsKubernetesResource)
 
+// TagsLoadBalancerAdopted is a marker tag indicating that LoadBalancer was created outside of CCM and adopted by a service
+var TagsLoadBalancerAdopted = fmt.Sprintf("%s.Adopted", TagsKubernetesResource)
+
+// TagsLoadBalancerGroup is tag name indicating that LoadBalancer is shared by services in the group
+var TagsLoadBalancerGroup = fmt.Sprintf("%s.Group", TagsKubernetesResource)
+
+// TagsLoadBalancerOrphaned is a marker tag indicating that LoadBalancer is retained after its service was deleted
+var TagsLoadBalancerOrphaned = fmt.Sprintf("%s.Orphaned", TagsKubernetesResource)
+
 const (
 	// annLoadBalancerExternalNetworkType is the annotation used to specify type
 	// for setting LoadBalancer's network type.
-	// Options are `internet` and `switch`.
+	// Options are `internet`, `switch`, `routed` and `vpcrouter`.
 	// default is `internet`.
 	annLoadBalancerType = "k8s.usacloud.jp/load-balancer-type"
 
@@ -64,6 +81,53 @@ const (
 	// This annotation is used only when load-balancer-type is `switch`
 	// default is `192.168.11.1`
 	annLoadBalancerAssignDefaultGateway = "k8s.usacloud.jp/load-balancer-assign-default-gateway"
+
+	// annLoadBalancerExcludeIPAddresses is the annotation used to specify IP addresses
+	// which must not be assigned to LoadBalancer's VIP and RealServer's IP address.
+	// Value is comma separated list of IP addresses or CIDR blocks.
+	// default is empty.
+	annLoadBalancerExcludeIPAddresses = "k8s.usacloud.jp/load-balancer-exclude-ip-addresses"
+
+	// annLoadBalancerID is the annotation used to specify ID of existing LoadBalancer
+	// for adopting it instead of creating new one.
+	// Adopted LoadBalancer is never deleted, only its VIP settings are managed.
+	// default is empty.
+	annLoadBalancerID = "k8s.usacloud.jp/load-balancer-id"
+
+	// annLoadBalancerDeletePolicy is the annotation used to specify the policy
+	// for LoadBalancer when the service is deleted.
+	// Options are `delete` and `retain`.
+	// default is value of loadBalancerDeletePolicy in CCM config, or `delete`.
+	annLoadBalancerDeletePolicy = "k8s.usacloud.jp/load-balancer-delete-policy"
+
+	// annLoadBalancerGroup is the annotation used to specify the group name
+	// for sharing one LoadBalancer across services.
+	// Services in same group get own VIP(or VIP/port set) on shared LoadBalancer.
+	// default is empty.
+	annLoadBalancerGroup = "k8s.usacloud.jp/load-balancer-group"
+
+	// annLoadBalancerSorryServer is the annotation used to specify IP address of sorry server
+	// which responds when all real servers of the VIP are down.
+	// default is empty.
+	annLoadBalancerSorryServer = "k8s.usacloud.jp/load-balancer-sorry-server"
+
+	// annLoadBalancerNodeSelector is the annotation used to specify label selector of nodes
+	// for selecting real servers of LoadBalancer(or next-hop/destination of routed and vpcrouter type).
+	// e.g. `node-role.kubernetes.io/ingress=true`
+	// default is empty(all nodes).
+	annLoadBalancerNodeSelector = "k8s.usacloud.jp/load-balancer-node-selector"
+
+	// annLoadBalancerReplaceOnChange is the annotation used to specify the flag
+	// for replacing LoadBalancer when its immutable attributes(type, plan, HA, router/switch selector) are changed.
+	// default is `false`.
+	annLoadBalancerReplaceOnChange = "k8s.usacloud.jp/load-balancer-replace-on-change"
+)
+
+const (
+	// LoadBalancerDeletePolicyDelete represents policy that deletes LoadBalancer with the service
+	LoadBalancerDeletePolicyDelete = "delete"
+	// LoadBalancerDeletePolicyRetain represents policy that retains LoadBalancer and its VIP after the service is deleted
+	LoadBalancerDeletePolicyRetain = "retain"
 )
 
 var (
@@ -78,15 +142,32 @@ const (
 type loadbalancers struct {
 	sacloudAPI   iaas.Client
 	config       *Config
+	kubeClient   kubernetes.Interface
+	recorder     record.EventRecorder
+	profiles     *loadBalancerProfiles
+	specClasses  serviceClassReader
 	shutdownWait time.Duration
 	bootWait     time.Duration
+
+	// creating is time when each LoadBalancer was requested, until it becomes active
+	creating sync.Map
+	// groupLocks serializes creating shared LoadBalancer by members of each group
+	groupLocks sync.Map
+
+	// nodeLister lists nodes including ones excluded by service controller(e.g. cordoned)
+	nodeLister  corelisters.NodeLister
+	nodesSynced cache.InformerSynced
 }
 
 // newLoadbalancers returns a cloudprovider.LoadBalancer whose concrete type is a *loadbalancer.
 func newLoadbalancers(client iaas.Client, config *Config) cloudprovider.LoadBalancer {
+	registerLoadBalancerMetrics.Do(func() {
+		prometheus.MustRegister(managedLoadBalancers, loadBalancerCreateDuration)
+	})
 	return &loadbalancers{
 		sacloudAPI:   client,
 		config:       config,
+		profiles:     newLoadBalancerProfiles(config.LoadBalancerProfiles),
 		shutdownWait: defaultLoadBalancerShutdownWait,
 		bootWait:     defaultLoadBalancerBootWait,
 	}
@@ -96,9 +177,23 @@ func newLoadbalancers(client iaas.Client, config *Config) cloudprovider.LoadBala
 //
 // GetLoadBalancer will not modify service.
 func (l *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	managed, err := l.isManaged(service)
+	if err != nil || !managed {
+		return nil, false, err
+	}
+	service, err = l.applyProfile(service)
+	if err != nil {
+		return nil, false, err
+	}
 
-	lbName := l.GetLoadBalancerName(ctx, clusterName, service)
-	lb, err := l.lbByName(lbName)
+	switch l.getLoadBalancerType(service) {
+	case iaas.LoadBalancerTypesRouted, iaas.LoadBalancerTypesVPCRouter:
+		// service IP is recorded only in the service status because no LoadBalancer exists
+		status, exists := serviceStatus(service)
+		return status, exists, nil
+	}
+
+	lb, err := l.lbForService(ctx, clusterName, service)
 	if err != nil {
 		if err == errLBNotFound {
 			return nil, false, nil
@@ -106,21 +201,15 @@ func (l *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 		return nil, false, err
 	}
 
-	if lb.IsMigrating() {
-		err = l.sacloudAPI.WaitForLBActive(lb.ID, l.bootWait)
-		if err != nil {
-			return nil, true, fmt.Errorf("error waiting for load balancer to be active %v", err)
-		}
-	}
-
-	if len(lb.Settings.LoadBalancer) == 0 {
+	settings := l.serviceSettings(lb, service)
+	if len(settings) == 0 {
 		// vip not found
 		return nil, false, nil
 	}
 
 	ingress := []v1.LoadBalancerIngress{}
 	ips := map[string]bool{}
-	for _, setting := range lb.Settings.LoadBalancer {
+	for _, setting := range settings {
 		vip := setting.VirtualIPAddress
 		if _, ok := ips[vip]; !ok {
 			ingress = append(ingress, v1.LoadBalancerIngress{IP: vip})
@@ -145,16 +234,59 @@ func (l *loadbalancers) GetLoadBalancerName(ctx context.Context, clusterName str
 //
 // EnsureLoadBalancer will not modify service or nodes.
 func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	_, exists, err := l.GetLoadBalancer(ctx, clusterName, service)
+	managed, err := l.isManaged(service)
 	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerClassUnknown, err)
 		return nil, err
 	}
+	if !managed {
+		// status written by other implementation is kept as is
+		klog.V(4).Infof("service %s/%s is not managed, ignored", service.Namespace, service.Name)
+		return service.Status.LoadBalancer.DeepCopy(), nil
+	}
+	status, err := l.ensureLoadBalancer(ctx, clusterName, service, nodes)
+	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerSyncFailed, err)
+	}
+	return status, err
+}
 
-	if !exists {
+func (l *loadbalancers) ensureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	service, err := l.applyProfile(service)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateService(service); err != nil {
+		return nil, err
+	}
+
+	switch l.getLoadBalancerType(service) {
+	case iaas.LoadBalancerTypesRouted:
+		return l.ensureRoutedService(ctx, clusterName, service, nodes)
+	case iaas.LoadBalancerTypesVPCRouter:
+		return l.ensureVPCRouterService(ctx, clusterName, service, nodes)
+	}
+
+	// Note: LoadBalancer which has no VIP(e.g. shared LoadBalancer, or failed to boot) also must be found here,
+	// otherwise duplicated LoadBalancer is created.
+	_, err = l.lbForService(ctx, clusterName, service)
+	if err == errLBNotFound && isGroupRequested(service) {
+		// other member of the group may be creating shared LoadBalancer, so look up again under the lock
+		unlock := l.lockGroup(service)
+		defer unlock()
+		_, err = l.lbForService(ctx, clusterName, service)
+	}
+	if err != nil {
+		if err != errLBNotFound {
+			return nil, err
+		}
+		if isAdoptionRequested(service) {
+			return nil, fmt.Errorf("LoadBalancer specified by %q is not found", annLoadBalancerID)
+		}
 		return l.createLoadBalancer(ctx, clusterName, service, nodes)
 	}
 
-	err = l.UpdateLoadBalancer(ctx, clusterName, service, nodes)
+	err = l.syncLoadBalancer(ctx, clusterName, service, nodes)
 	if err != nil {
 		return nil, err
 	}
@@ -188,43 +320,134 @@ func (l *loadbalancers) createLoadBalancerByType(ctx context.Context, clusterNam
 
 	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, lbType)
 
-	vips, err := l.sacloudAPI.CreateLoadBalancer(lbParam, vipParam, l.bootWait)
+	lb, err := l.requestLoadBalancer(ctx, service, lbParam, vipParam)
 	if err != nil {
 		return nil, err
 	}
-
-	var ingress []v1.LoadBalancerIngress
-	for _, vip := range vips {
-		ingress = append(ingress, v1.LoadBalancerIngress{IP: vip})
-	}
-
-	return &v1.LoadBalancerStatus{
-		Ingress: ingress,
-	}, nil
+	klog.V(2).Infof("LoadBalancer %q(id:%s) is requested for service %s/%s", lb.Name, lb.GetStrID(), service.Namespace, service.Name)
+	l.startCreation(lb)
+	l.updatePendingStatusAnnotations(service, lb)
+	l.recordEvent(service, v1.EventTypeNormal, EventReasonLoadBalancerCreating,
+		"Creating LoadBalancer %q(id:%s), config will be applied after it becomes active", lb.Name, lb.GetStrID())
+
+	// don't block the service controller while booting LoadBalancer,
+	// config will be applied by following reconcile after it becomes active
+	return nil, &loadBalancerPendingError{id: lb.GetStrID(), name: lb.Name}
 }
 
 // UpdateLoadBalancer updates the load balancer for service to balance across in nodes.
 //
 // UpdateLoadBalancer will not modify service or nodes.
 func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	lbName := l.GetLoadBalancerName(ctx, clusterName, service)
-	lb, err := l.lbByName(lbName)
+	managed, err := l.isManaged(service)
 	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerClassUnknown, err)
 		return err
 	}
+	if !managed {
+		return nil
+	}
+	err = l.syncLoadBalancer(ctx, clusterName, service, nodes)
+	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerSyncFailed, err)
+	}
+	return err
+}
+
+func (l *loadbalancers) syncLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	service, err := l.applyProfile(service)
+	if err != nil {
+		return err
+	}
+	// Validation blocks creating and changing config by EnsureLoadBalancer only.
+	// Existing service which became invalid(e.g. created before validation is added) still follows nodes.
+	invalid := validateService(service)
+	if invalid != nil {
+		klog.V(2).Infof("service %s/%s is invalid, only its backends are synced: %s", service.Namespace, service.Name, invalid)
+	}
+
+	switch l.getLoadBalancerType(service) {
+	case iaas.LoadBalancerTypesRouted:
+		// next-hop is moved if its node is no longer in healthy nodes
+		_, err := l.ensureRoutedService(ctx, clusterName, service, nodes)
+		return err
+	case iaas.LoadBalancerTypesVPCRouter:
+		_, err := l.ensureVPCRouterService(ctx, clusterName, service, nodes)
+		return err
+	}
+
+	lb, err := l.lbForService(ctx, clusterName, service)
+	if err != nil {
+		if err == errLBNotFound && isAdoptionRequested(service) {
+			return fmt.Errorf("LoadBalancer specified by %q is not found", annLoadBalancerID)
+		}
+		return err
+	}
+
+	if err := l.checkLoadBalancerActive(service, lb); err != nil {
+		switch err.(type) {
+		case *loadBalancerPendingError:
+			l.updatePendingStatusAnnotations(service, lb)
+			return err
+		case *loadBalancerInactiveError:
+			// LoadBalancer which was active may be in maintenance or stopped by operator
+			return err
+		}
+		l.finishCreation(lb, err)
+		return l.cleanupBrokenLoadBalancer(ctx, clusterName, service, lb, err)
+	}
+	l.finishCreation(lb, nil)
 
 	// TODO use loadBalancerIP parameter
 	lbType := l.getLoadBalancerType(service)
 
 	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, lbType)
+	switch {
+	case isOrphanedLoadBalancer(lb):
+		// reclaim LoadBalancer retained by deleted service
+		lbParam.RemoveTags = []string{TagsLoadBalancerOrphaned}
+		serviceTag, serviceHashTag := l.serviceTag(service), l.serviceHashTag(service)
+		for _, tag := range lb.Tags {
+			if (strings.HasPrefix(tag, TagsLoadBalancerServiceName+"=") && tag != serviceTag) ||
+				(strings.HasPrefix(tag, TagsLoadBalancerServiceHash+"=") && tag != serviceHashTag) {
+				lbParam.RemoveTags = append(lbParam.RemoveTags, tag)
+			}
+		}
+	case isGroupRequested(service):
+		// shared LoadBalancer is owned by the group
+	case isAdoptedLoadBalancer(lb) || (isAdoptionRequested(service) && !l.isOwnedLoadBalancer(ctx, clusterName, service, lb)):
+		if err := l.validateAdoption(lb, service); err != nil {
+			return err
+		}
+		lbParam.Adopted = true
+		lbParam.Tags = append(lbParam.Tags, TagsLoadBalancerAdopted)
+	}
+
+	if lb.HasTag(TagsLoadBalancerReplacement) {
+		// replacement whose replaced LoadBalancer is already deleted
+		lbParam.RemoveTags = append(lbParam.RemoveTags, TagsLoadBalancerReplacement)
+	}
 
 	vipParam, err := l.buildVIPParams(service, nodes, lbType)
 	if err != nil {
 		return err
 	}
+	if lbParam.Adopted {
+		// settings of adopted LoadBalancer are marked even after the annotation is removed
+		vipParam.Owner = string(service.UID)
+	}
 
-	_, err = l.sacloudAPI.UpdateLoadBalancer(lb, lbParam, vipParam)
-	return err
+	if invalid == nil && l.isOwnedLoadBalancer(ctx, clusterName, service, lb) && !lbParam.Adopted && !isGroupRequested(service) {
+		if replacing, err := l.reconcileDrift(ctx, clusterName, service, lb, lbParam, vipParam); replacing || err != nil {
+			return err
+		}
+	}
+
+	if err := l.updateLoadBalancer(ctx, service, lb, lbParam, vipParam); err != nil {
+		return err
+	}
+	l.updateStatusAnnotations(service, lb)
+	return nil
 }
 
 // EnsureLoadBalancerDeleted deletes the specified loadbalancer if it exists.
@@ -233,34 +456,336 @@ func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 //
 // EnsureLoadBalancerDeleted will not modify service.
 func (l *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
-	lbName := l.GetLoadBalancerName(ctx, clusterName, service)
-	lb, err := l.lbByName(lbName)
+	managed, err := l.isManaged(service)
+	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerClassUnknown, err)
+		return err
+	}
+	if !managed {
+		// resources of unmanaged service belong to other implementation
+		return nil
+	}
+	if s, err := l.applyProfile(service); err == nil {
+		service = s
+	} else {
+		// profile may be removed after the service was created, LoadBalancer is found without it
+		klog.Warningf("profile of service %s/%s is not applied for deleting: %s", service.Namespace, service.Name, err)
+	}
+	err = l.ensureServiceDeleted(ctx, clusterName, service)
+	if err != nil {
+		l.recordFailure(service, EventReasonLoadBalancerDeleteFailed, err)
+	}
+	return err
+}
+
+func (l *loadbalancers) ensureServiceDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	switch l.getLoadBalancerType(service) {
+	case iaas.LoadBalancerTypesRouted:
+		return l.ensureRoutedServiceDeleted(ctx, clusterName, service)
+	case iaas.LoadBalancerTypesVPCRouter:
+		return l.ensureVPCRouterServiceDeleted(ctx, clusterName, service)
+	}
+
+	if err := l.ensureLoadBalancerDeleted(ctx, clusterName, service); err != nil {
+		return err
+	}
+
+	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, l.getLoadBalancerType(service))
+	l.releaseRouterSubnets(ctx, service, lbParam)
+	return nil
+}
+
+func (l *loadbalancers) ensureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	lb, err := l.lbForService(ctx, clusterName, service)
 	if err != nil {
 		if err == errLBNotFound {
 			return nil
 		}
 		return err
 	}
-	return l.sacloudAPI.DeleteLoadBalancer(lb.ID, l.shutdownWait)
+
+	if isGroupRequested(service) {
+		return l.leaveLoadBalancerGroup(ctx, service, lb)
+	}
+	if isAdoptedLoadBalancer(lb) {
+		// adopted LoadBalancer is owned by its creator, so only release VIP settings and our tags
+		if !l.isServiceLoadBalancer(lb, service) {
+			return nil
+		}
+		tags := append(l.serviceTags(service), TagsLoadBalancerAdopted)
+		return l.sacloudAPI.ReleaseLoadBalancer(ctx, lb, string(service.UID), tags)
+	}
+	if !l.isOwnedLoadBalancer(ctx, clusterName, service, lb) {
+		// adoption was never completed, or LoadBalancer is retained for another service
+		return nil
+	}
+
+	policy, err := l.getDeletePolicy(service)
+	if err != nil {
+		return err
+	}
+	if err := l.deleteReplacement(ctx, lb); err != nil {
+		return err
+	}
+	if policy == LoadBalancerDeletePolicyRetain {
+		// keep LoadBalancer and its VIP, so that a new service with same identity can reclaim it
+		return l.sacloudAPI.RetainLoadBalancer(ctx, lb, []string{TagsLoadBalancerOrphaned})
+	}
+	return l.sacloudAPI.DeleteLoadBalancer(ctx, lb.ID, l.shutdownWait)
 }
 
-// lbByName gets a SAKURA Cloud Load Balancer by name. The returned error will
+// loadBalancerPendingError is returned while LoadBalancer is booting
+type loadBalancerPendingError struct {
+	id   string
+	name string
+}
+
+func (e *loadBalancerPendingError) Error() string {
+	return fmt.Sprintf("LoadBalancer %q(id:%s) is pending, waiting for it to be active", e.name, e.id)
+}
+
+// loadBalancerTimeoutError is returned when LoadBalancer is not active in boot wait
+type loadBalancerTimeoutError struct {
+	id     string
+	name   string
+	wait   time.Duration
+	status string
+}
+
+func (e *loadBalancerTimeoutError) Error() string {
+	return fmt.Sprintf("LoadBalancer %q(id:%s) is not active in %s, current status: %s", e.name, e.id, e.wait, e.status)
+}
+
+// loadBalancerInactiveError is returned when LoadBalancer which isn't being created is not active
+type loadBalancerInactiveError struct {
+	id     string
+	name   string
+	status string
+}
+
+func (e *loadBalancerInactiveError) Error() string {
+	return fmt.Sprintf("LoadBalancer %q(id:%s) is not active, current status: %s", e.name, e.id, e.status)
+}
+
+// checkLoadBalancerActive returns error if lb is not ready to apply config.
+// Returned error is retryable, the service controller calls us again with backoff.
+// Boot wait is applied only while creation of lb is tracked, LoadBalancer which was active is never timed out.
+func (l *loadbalancers) checkLoadBalancerActive(service *v1.Service, lb *sacloud.LoadBalancer) error {
+	status := fmt.Sprintf("%s/%s", lb.Availability, lb.GetInstanceStatus())
+	switch {
+	case lb.IsFailed():
+		// failed LoadBalancer has never been active
+		return fmt.Errorf("LoadBalancer %q(id:%s) failed to boot", lb.Name, lb.GetStrID())
+	case lb.IsAvailable() && lb.IsUp():
+		return nil
+	case !l.isCreating(service, lb):
+		return &loadBalancerInactiveError{id: lb.GetStrID(), name: lb.Name, status: status}
+	case lb.CreatedAt != nil && time.Since(*lb.CreatedAt) > l.bootWait:
+		return &loadBalancerTimeoutError{
+			id:     lb.GetStrID(),
+			name:   lb.Name,
+			wait:   l.bootWait,
+			status: status,
+		}
+	default:
+		return &loadBalancerPendingError{id: lb.GetStrID(), name: lb.Name}
+	}
+}
+
+// cleanupBrokenLoadBalancer deletes lb which is failed or stuck in booting.
+// New LoadBalancer is never created until broken one is deleted, so that IPs and VRID are not leaked.
+func (l *loadbalancers) cleanupBrokenLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, lb *sacloud.LoadBalancer, cause error) error {
+	owned := l.isOwnedLoadBalancer(ctx, clusterName, service, lb) ||
+		(isGroupRequested(service) && !isAdoptedLoadBalancer(lb) && !isOrphanedLoadBalancer(lb))
+	if !owned {
+		// LoadBalancer which is not created by CCM must be recovered by its owner
+		return cause
+	}
+
+	klog.Warningf("%s, deleting it for service %s/%s", cause, service.Namespace, service.Name)
+	if err := l.sacloudAPI.DeleteLoadBalancer(ctx, lb.ID, l.shutdownWait); err != nil {
+		return fmt.Errorf("%w, and cleaning up is failed: %s", cause, err)
+	}
+	return fmt.Errorf("%w, deleted it and will re-create in next reconcile", cause)
+}
+
+// lbForService gets a SAKURA Cloud Load Balancer for service.
+// When service has load-balancer-id annotation, the Load Balancer is looked up by ID.
+// The returned error will be lbNotFound if the Load Balancer does not exist.
+func (l *loadbalancers) lbForService(ctx context.Context, clusterName string, service *v1.Service) (*sacloud.LoadBalancer, error) {
+	if isGroupRequested(service) {
+		if isAdoptionRequested(service) {
+			return nil, fmt.Errorf("%q and %q can't be specified at the same time", annLoadBalancerGroup, annLoadBalancerID)
+		}
+		tags, err := l.groupTags(service)
+		if err != nil {
+			return nil, err
+		}
+		return l.lbByTags(ctx, tags...)
+	}
+	if isAdoptionRequested(service) {
+		id, err := adoptedLoadBalancerID(service)
+		if err != nil {
+			return nil, err
+		}
+		lb, err := l.sacloudAPI.LoadBalancer(ctx, id)
+		if err != nil {
+			if errors.Is(err, iaas.ErrNotFound) {
+				return nil, errLBNotFound
+			}
+			return nil, err
+		}
+		return lb, nil
+	}
+
+	lbName := l.GetLoadBalancerName(ctx, clusterName, service)
+	lb, err := l.lbByName(ctx, lbName)
+	if err != errLBNotFound {
+		return lb, err
+	}
+
+	// replaced LoadBalancer is deleted but replacement hasn't taken over its name yet
+	lb, err = l.lbByName(ctx, replacementName(lbName))
+	if err != errLBNotFound {
+		return lb, err
+	}
+
+	// LoadBalancer requested to be created may not be listed yet
+	lb, err = l.lbByStatusID(ctx, clusterName, service)
+	if err != errLBNotFound {
+		return lb, err
+	}
+
+	// annotation may be removed after adoption, so look up adopted Load Balancer by tags
+	isService := func(lb *sacloud.LoadBalancer) bool { return l.isServiceLoadBalancer(lb, service) }
+	lb, err = l.findLoadBalancer(ctx, append(l.clusterTags(), TagsLoadBalancerAdopted), isService)
+	if err != errLBNotFound {
+		return lb, err
+	}
+
+	// Load Balancer retained by deleted service which has same identity
+	return l.findLoadBalancer(ctx, append(l.clusterTags(), TagsLoadBalancerOrphaned), isService)
+}
+
+// lbByStatusID gets a SAKURA Cloud Load Balancer by ID recorded to status annotation of service.
+// The returned error will be lbNotFound if the Load Balancer does not exist or is not owned by service.
+func (l *loadbalancers) lbByStatusID(ctx context.Context, clusterName string, service *v1.Service) (*sacloud.LoadBalancer, error) {
+	id, err := strconv.ParseInt(service.Annotations[annStatusLoadBalancerID], 10, 64)
+	if err != nil {
+		return nil, errLBNotFound
+	}
+	lb, err := l.sacloudAPI.LoadBalancer(ctx, id)
+	if err != nil {
+		if errors.Is(err, iaas.ErrNotFound) {
+			return nil, errLBNotFound
+		}
+		return nil, err
+	}
+	if !l.isOwnedLoadBalancer(ctx, clusterName, service, lb) {
+		return nil, errLBNotFound
+	}
+	return lb, nil
+}
+
+// lbByTags gets a SAKURA Cloud Load Balancer that has all of tags. The returned error will
 // be lbNotFound if the Load Balancer does not exist.
-func (l *loadbalancers) lbByName(name string) (*sacloud.LoadBalancer, error) {
-	lbs, err := l.sacloudAPI.LoadBalancers()
+func (l *loadbalancers) lbByTags(ctx context.Context, tags ...string) (*sacloud.LoadBalancer, error) {
+	return l.findLoadBalancer(ctx, tags, nil)
+}
+
+// findLoadBalancer gets a SAKURA Cloud Load Balancer that has all of tags and is matched by match if it is not nil.
+// The returned error will be lbNotFound if the Load Balancer does not exist.
+// Failed Load Balancer is returned only if there is no other Load Balancer, so that it can be cleaned up.
+func (l *loadbalancers) findLoadBalancer(ctx context.Context, tags []string, match func(lb *sacloud.LoadBalancer) bool) (*sacloud.LoadBalancer, error) {
+	lbs, err := l.sacloudAPI.LoadBalancers(ctx, tags...)
 	if err != nil {
 		return nil, err
 	}
+	if len(tags) == 0 {
+		l.observeLoadBalancers(lbs)
+	}
 
-	for _, lb := range lbs {
-		if !lb.IsFailed() && lb.Name == name {
-			return &lb, nil
+	var failed *sacloud.LoadBalancer
+	for i := range lbs {
+		lb := &lbs[i]
+		if !hasTags(lb, tags) || (match != nil && !match(lb)) {
+			continue
+		}
+		if !lb.IsFailed() {
+			return lb, nil
+		}
+		if failed == nil {
+			failed = lb
 		}
 	}
+	if failed != nil {
+		return failed, nil
+	}
 
 	return nil, errLBNotFound
 }
 
+// validateAdoption returns error if lb is already adopted by another service
+func (l *loadbalancers) validateAdoption(lb *sacloud.LoadBalancer, service *v1.Service) error {
+	if isAdoptedLoadBalancer(lb) && !l.isServiceLoadBalancer(lb, service) {
+		return fmt.Errorf("LoadBalancer %q is already adopted by another service", lb.GetStrID())
+	}
+	if !isAdoptedLoadBalancer(lb) && lb.HasTag(TagsKubernetesResource) {
+		return fmt.Errorf("LoadBalancer %q is managed by CCM, it can't be adopted", lb.GetStrID())
+	}
+	return nil
+}
+
+func isAdoptionRequested(service *v1.Service) bool {
+	v, ok := service.Annotations[annLoadBalancerID]
+	return ok && v != ""
+}
+
+func adoptedLoadBalancerID(service *v1.Service) (int64, error) {
+	v := service.Annotations[annLoadBalancerID]
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("%q is specified invalid value %q", annLoadBalancerID, v)
+	}
+	return id, nil
+}
+
+func isAdoptedLoadBalancer(lb *sacloud.LoadBalancer) bool {
+	return lb.HasTag(TagsLoadBalancerAdopted)
+}
+
+func isOrphanedLoadBalancer(lb *sacloud.LoadBalancer) bool {
+	return lb.HasTag(TagsLoadBalancerOrphaned)
+}
+
+// isOwnedLoadBalancer returns true if lb was created(or reclaimed) by CCM for service
+func (l *loadbalancers) isOwnedLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, lb *sacloud.LoadBalancer) bool {
+	name := l.GetLoadBalancerName(ctx, clusterName, service)
+	return !isAdoptedLoadBalancer(lb) && !isOrphanedLoadBalancer(lb) &&
+		(lb.Name == name || lb.Name == replacementName(name))
+}
+
+func (l *loadbalancers) getDeletePolicy(service *v1.Service) (string, error) {
+	policy := l.config.LoadBalancerDeletePolicy
+	if v, ok := service.Annotations[annLoadBalancerDeletePolicy]; ok && v != "" {
+		policy = v
+	}
+	switch policy {
+	case "":
+		return LoadBalancerDeletePolicyDelete, nil
+	case LoadBalancerDeletePolicyDelete, LoadBalancerDeletePolicyRetain:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%q is specified invalid value %q", annLoadBalancerDeletePolicy, policy)
+	}
+}
+
+// lbByName gets a SAKURA Cloud Load Balancer by name. The returned error will
+// be lbNotFound if the Load Balancer does not exist.
+func (l *loadbalancers) lbByName(ctx context.Context, name string) (*sacloud.LoadBalancer, error) {
+	return l.findLoadBalancer(ctx, nil, func(lb *sacloud.LoadBalancer) bool { return lb.Name == name })
+}
+
 func (l *loadbalancers) getLoadBalancerType(service *v1.Service) string {
 	loadBalancerType := iaas.LoadBalancerTypesInternet
 	if v, ok := service.Annotations[annLoadBalancerType]; ok {
@@ -273,10 +798,10 @@ func (l *loadbalancers) getAllNodeIPs(nodes []*v1.Node, lbType string) ([]string
 	ips := []string{}
 	for _, node := range nodes {
 		for _, addr := range node.Status.Addresses {
-			if addr.Type == v1.NodeExternalIP && lbType == iaas.LoadBalancerTypesInternet {
+			if addr.Type == v1.NodeExternalIP && (lbType == iaas.LoadBalancerTypesInternet || lbType == iaas.LoadBalancerTypesRouted) {
 				ips = append(ips, addr.Address)
 			}
-			if addr.Type == v1.NodeInternalIP && lbType == iaas.LoadBalancerTypesSwitch {
+			if addr.Type == v1.NodeInternalIP && (lbType == iaas.LoadBalancerTypesSwitch || lbType == iaas.LoadBalancerTypesVPCRouter) {
 				ips = append(ips, addr.Address)
 			}
 		}
@@ -284,27 +809,52 @@ func (l *loadbalancers) getAllNodeIPs(nodes []*v1.Node, lbType string) ([]string
 	return ips, nil
 }
 
-func (l *loadbalancers) createLoadBalancerParam(ctx context.Context, clusterName string, service *v1.Service, lbType string) *iaas.LoadBalancerParam {
-	var clusterSelector []string
-	lbTags := []string{TagsKubernetesResource}
+func (l *loadbalancers) clusterTags() []string {
+	tags := []string{TagsKubernetesResource}
 	if l.config.ClusterID != "" {
-		clusterIDMarker := fmt.Sprintf("%s=%s", TagsClusterID, l.config.ClusterID)
-		lbTags = append(lbTags, clusterIDMarker)
-		clusterSelector = lbTags
+		tags = append(tags, fmt.Sprintf("%s=%s", TagsClusterID, l.config.ClusterID))
 	}
-	serviceTag := fmt.Sprintf("%s=%s",
+	return tags
+}
+
+func (l *loadbalancers) serviceTag(service *v1.Service) string {
+	return fmt.Sprintf("%s=%s",
 		TagsLoadBalancerServiceName,
-		strings.ShortenString(service.Name, 18),
+		utilstrings.ShortenString(service.Name, 18),
 	)
-	lbTags = append(lbTags, serviceTag)
+}
+
+// serviceTags returns tags of LoadBalancer for service.
+// Truncated name tag is kept for finding LoadBalancers by older version.
+func (l *loadbalancers) serviceTags(service *v1.Service) []string {
+	return append(l.clusterTags(), l.serviceTag(service), l.serviceHashTag(service))
+}
+
+func (l *loadbalancers) createLoadBalancerParam(ctx context.Context, clusterName string, service *v1.Service, lbType string) *iaas.LoadBalancerParam {
+	var clusterSelector []string
+	if l.config.ClusterID != "" {
+		clusterSelector = l.clusterTags()
+	}
+	lbTags := l.serviceTags(service)
 
 	lbParam := &iaas.LoadBalancerParam{
 		ClusterSelector: clusterSelector,
 		Name:            l.GetLoadBalancerName(ctx, clusterName, service),
+		Description:     l.serviceMetadata(service).encode(),
 		Tags:            lbTags,
 		RouterTags:      []string{TagsKubernetesResource},
 		VIP:             service.Spec.LoadBalancerIP,
 		Type:            lbType,
+
+		ReservedVRIDRange: l.config.reservedVRIDRange(),
+	}
+	if isGroupRequested(service) {
+		// errors are reported by lbForService
+		if tags, err := l.groupTags(service); err == nil {
+			lbParam.Name = l.groupLoadBalancerName(service)
+			lbParam.Description = ""
+			lbParam.Tags = tags
+		}
 	}
 
 	annSelector := annRouterSelector
@@ -336,6 +886,12 @@ func (l *loadbalancers) createLoadBalancerParam(ctx context.Context, clusterName
 			lbParam.RouterTags = append(lbParam.RouterTags, v)
 		}
 	}
+	if lbParam.Description != "" {
+		// network is recorded so that drift of it is detected without API calls
+		m := l.serviceMetadata(service)
+		m.Type, m.Selector = lbType, service.Annotations[annSelector]
+		lbParam.Description = m.encode()
+	}
 	if v, ok := service.Annotations[annLoadBalancerHA]; ok {
 		if v != "" {
 			lbParam.UseHA = true
@@ -346,6 +902,13 @@ func (l *loadbalancers) createLoadBalancerParam(ctx context.Context, clusterName
 			lbParam.UseHighSpecPlan = true
 		}
 	}
+	if v, ok := service.Annotations[annLoadBalancerExcludeIPAddresses]; ok {
+		for _, address := range strings.Split(v, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				lbParam.ExcludeIPAddresses = append(lbParam.ExcludeIPAddresses, address)
+			}
+		}
+	}
 
 	return lbParam
 }
@@ -387,15 +950,30 @@ func (l *loadbalancers) buildVIPParams(service *v1.Service, nodes []*v1.Node, lb
 		})
 	}
 
-	nodeIPs, err := l.getAllNodeIPs(nodes, lbType)
+	active, draining, err := l.backendNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	nodeIPs, err := l.getAllNodeIPs(active, lbType)
+	if err != nil {
+		return nil, err
+	}
+	disabledNodeIPs, err := l.getAllNodeIPs(draining, lbType)
+	if err != nil {
+		return nil, err
+	}
+	sorry, err := sorryServer(service)
 	if err != nil {
 		return nil, err
 	}
 
 	return &iaas.VIPParam{
-		Ports:   ports,
-		NodeIPs: nodeIPs,
-		VIP:     service.Spec.LoadBalancerIP,
-		Type:    lbType,
+		Ports:           ports,
+		NodeIPs:         nodeIPs,
+		DisabledNodeIPs: disabledNodeIPs,
+		SorryServer:     sorry,
+		VIP:             service.Spec.LoadBalancerIP,
+		Type:            lbType,
+		Owner:           settingOwner(service),
 	}, nil
 }
@@ -0,0 +1,106 @@
+package sakura
+
+import (
+	"fmt"
+	"net"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// taintToBeDeletedByClusterAutoscaler is the taint added by cluster-autoscaler to nodes being drained
+const taintToBeDeletedByClusterAutoscaler = "ToBeDeletedByClusterAutoscaler"
+
+// selectNodes returns nodes matched by node selector annotation of the service
+func selectNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	v, ok := service.Annotations[annLoadBalancerNodeSelector]
+	if !ok || v == "" {
+		return nodes, nil
+	}
+	selector, err := labels.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("%q is specified invalid value %q: %s", annLoadBalancerNodeSelector, v, err)
+	}
+
+	var selected []*v1.Node
+	for _, node := range nodes {
+		if selector.Matches(labels.Set(node.Labels)) {
+			selected = append(selected, node)
+		}
+	}
+	return selected, nil
+}
+
+// isDrainingNode returns true if the node is cordoned or being drained
+func isDrainingNode(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == taintToBeDeletedByClusterAutoscaler {
+			return true
+		}
+	}
+	return false
+}
+
+// watchNodes starts the node informer shared by syncs of all services
+func (l *loadbalancers) watchNodes(kubeClient kubernetes.Interface, stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	informer := factory.Core().V1().Nodes()
+	l.nodeLister = informer.Lister()
+	l.nodesSynced = informer.Informer().HasSynced
+	factory.Start(stop)
+}
+
+// backendNodes returns active and draining nodes for real servers of the service.
+// Real servers on draining nodes are disabled instead of removed, so that connections are drained gracefully.
+func (l *loadbalancers) backendNodes(service *v1.Service, nodes []*v1.Node) (active, draining []*v1.Node, err error) {
+	all := nodes
+	if l.nodeLister != nil {
+		if !l.nodesSynced() {
+			return nil, nil, fmt.Errorf("nodes are not synced yet")
+		}
+		// cordoned nodes are already excluded from nodes by service controller
+		list, err := l.nodeLister.List(labels.Everything())
+		if err != nil {
+			return nil, nil, err
+		}
+		names := map[string]bool{}
+		for _, node := range nodes {
+			names[node.Name] = true
+		}
+		all = append([]*v1.Node{}, nodes...)
+		for _, node := range list {
+			if !names[node.Name] && isDrainingNode(node) {
+				all = append(all, node)
+			}
+		}
+	}
+
+	selected, err := selectNodes(service, all)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range selected {
+		if isDrainingNode(node) {
+			draining = append(draining, node)
+		} else {
+			active = append(active, node)
+		}
+	}
+	return active, draining, nil
+}
+
+func sorryServer(service *v1.Service) (string, error) {
+	v, ok := service.Annotations[annLoadBalancerSorryServer]
+	if !ok || v == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("%q is specified invalid value %q", annLoadBalancerSorryServer, v)
+	}
+	return v, nil
+}
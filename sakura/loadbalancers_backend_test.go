@@ -0,0 +1,108 @@
+package sakura
+
+import (
+	"testing"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestNodeLister(nodes ...*v1.Node) corelisters.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		indexer.Add(node) // nolint: errcheck
+	}
+	return corelisters.NewNodeLister(indexer)
+}
+
+func newBackendNode(name, ip string, nodeLabels map[string]string) *v1.Node {
+	node := newNodeWithExternalIP(name, ip)
+	node.Labels = nodeLabels
+	return node
+}
+
+func TestLoadBalancers_buildVIPParams_Backends(t *testing.T) {
+	ready := newBackendNode("ready", "192.2.0.11", map[string]string{"role": "ingress"})
+	other := newBackendNode("other", "192.2.0.12", map[string]string{"role": "worker"})
+	autoscaled := newBackendNode("autoscaled", "192.2.0.13", map[string]string{"role": "ingress"})
+	autoscaled.Spec.Taints = []v1.Taint{{Key: taintToBeDeletedByClusterAutoscaler, Effect: v1.TaintEffectNoSchedule}}
+	// cordoned node isn't passed by service controller
+	cordoned := newBackendNode("cordoned", "192.2.0.14", map[string]string{"role": "ingress"})
+	cordoned.Spec.Unschedulable = true
+	nodes := []*v1.Node{ready, other, autoscaled}
+
+	lb := &loadbalancers{
+		config:      &Config{},
+		nodeLister:  newTestNodeLister(ready, other, autoscaled, cordoned),
+		nodesSynced: func() bool { return true },
+	}
+
+	testCases := []struct {
+		caseName        string
+		annotations     map[string]string
+		nodeIPs         []string
+		disabledNodeIPs []string
+		sorryServer     string
+		hasError        bool
+	}{
+		{
+			caseName:        "all nodes",
+			nodeIPs:         []string{"192.2.0.11", "192.2.0.12"},
+			disabledNodeIPs: []string{"192.2.0.13", "192.2.0.14"},
+		},
+		{
+			caseName:        "node selector",
+			annotations:     map[string]string{annLoadBalancerNodeSelector: "role=ingress"},
+			nodeIPs:         []string{"192.2.0.11"},
+			disabledNodeIPs: []string{"192.2.0.13", "192.2.0.14"},
+		},
+		{
+			caseName:    "invalid node selector",
+			annotations: map[string]string{annLoadBalancerNodeSelector: "role in ("},
+			hasError:    true,
+		},
+		{
+			caseName:        "sorry server",
+			annotations:     map[string]string{annLoadBalancerSorryServer: "192.2.0.100"},
+			nodeIPs:         []string{"192.2.0.11", "192.2.0.12"},
+			disabledNodeIPs: []string{"192.2.0.13", "192.2.0.14"},
+			sorryServer:     "192.2.0.100",
+		},
+		{
+			caseName:    "invalid sorry server",
+			annotations: map[string]string{annLoadBalancerSorryServer: "sorry.example.com"},
+			hasError:    true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.caseName, func(t *testing.T) {
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: testCase.annotations}}
+			vipParam, err := lb.buildVIPParams(service, nodes, iaas.LoadBalancerTypesInternet)
+			assert.Equal(t, testCase.hasError, err != nil)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, testCase.nodeIPs, vipParam.NodeIPs)
+			assert.Equal(t, testCase.disabledNodeIPs, vipParam.DisabledNodeIPs)
+			assert.Equal(t, testCase.sorryServer, vipParam.SorryServer)
+		})
+	}
+}
+
+func TestLoadBalancers_buildVIPParams_NodesNotSynced(t *testing.T) {
+	lb := &loadbalancers{
+		config:      &Config{},
+		nodeLister:  newTestNodeLister(),
+		nodesSynced: func() bool { return false },
+	}
+
+	// real servers on draining nodes would be removed if nodes are not synced
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	_, err := lb.buildVIPParams(service, []*v1.Node{newBackendNode("ready", "192.2.0.11", nil)}, iaas.LoadBalancerTypesInternet)
+	assert.Error(t, err)
+}
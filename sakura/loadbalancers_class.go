@@ -0,0 +1,154 @@
+package sakura
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// AnnLoadBalancerClass is the annotation used to specify class of load balancer implementation
+	// which handles the service. It stands for spec.loadBalancerClass, which the Kubernetes API CCM is built with doesn't have.
+	// Admission webhook copies spec.loadBalancerClass to it.
+	// default is empty.
+	AnnLoadBalancerClass = "k8s.usacloud.jp/load-balancer-class"
+
+	// annLoadBalancerManaged is the annotation used to specify the flag
+	// for handling the service by CCM. Services with `false` are ignored.
+	// default is `true`.
+	annLoadBalancerManaged = "k8s.usacloud.jp/load-balancer-managed"
+
+	// DefaultLoadBalancerClass is class of load balancer implementation handled by CCM
+	DefaultLoadBalancerClass = "k8s.usacloud.jp/sakuracloud"
+)
+
+// ServiceFilter decides whether a LoadBalancer type service is handled by CCM
+type ServiceFilter struct {
+	// Class is load balancer class handled by CCM
+	Class string
+	// IgnoreServicesWithoutClass is true if services without load balancer class are left to other implementations
+	IgnoreServicesWithoutClass bool
+}
+
+// IsManaged returns false if the service opts out of CCM, or is for other load balancer implementation.
+// specClass is spec.loadBalancerClass of the service, see LoadBalancerClass for its precedence.
+func (f *ServiceFilter) IsManaged(service *v1.Service, specClass string) bool {
+	if v, ok := service.Annotations[annLoadBalancerManaged]; ok {
+		if managed, err := strconv.ParseBool(v); err == nil && !managed {
+			return false
+		}
+	}
+	class := LoadBalancerClass(service, specClass)
+	if class == "" {
+		return !f.IgnoreServicesWithoutClass
+	}
+	if f.Class == "" {
+		return class == DefaultLoadBalancerClass
+	}
+	return class == f.Class
+}
+
+// LoadBalancerClass returns class of load balancer implementation which handles the service.
+// spec.loadBalancerClass takes precedence, because it is immutable and other implementations only read it.
+// The annotation is used only when spec.loadBalancerClass is empty, its value is ignored if it differs from spec.
+func LoadBalancerClass(service *v1.Service, specClass string) string {
+	annotated := service.Annotations[AnnLoadBalancerClass]
+	if specClass == "" {
+		return annotated
+	}
+	if annotated != "" && annotated != specClass {
+		klog.Warningf("%q of service %s/%s is ignored, it differs from spec.loadBalancerClass %q",
+			AnnLoadBalancerClass, service.Namespace, service.Name, specClass)
+	}
+	return specClass
+}
+
+// serviceFilter returns ServiceFilter configured in CCM config
+func (c *Config) serviceFilter() *ServiceFilter {
+	return &ServiceFilter{
+		Class:                      c.LoadBalancerClass,
+		IgnoreServicesWithoutClass: c.LoadBalancerIgnoreServicesWithoutClass,
+	}
+}
+
+// isManaged returns true if the service is handled by CCM.
+// Error is returned when spec.loadBalancerClass can't be read, because the service may belong to other implementation.
+func (l *loadbalancers) isManaged(service *v1.Service) (bool, error) {
+	specClass := ""
+	if l.specClasses != nil {
+		class, err := l.specClasses.read(service)
+		if err != nil {
+			if apierrors.IsForbidden(err) {
+				return false, fmt.Errorf("reading spec.loadBalancerClass of service %s/%s is forbidden, list permission of services is required: %s",
+					service.Namespace, service.Name, err)
+			}
+			return false, fmt.Errorf("reading spec.loadBalancerClass of service %s/%s is failed: %s", service.Namespace, service.Name, err)
+		}
+		specClass = class
+	}
+	filter := &ServiceFilter{}
+	if l.config != nil {
+		filter = l.config.serviceFilter()
+	}
+	return filter.IsManaged(service, specClass), nil
+}
+
+// serviceClassReader reads spec.loadBalancerClass of the service
+type serviceClassReader interface {
+	read(service *v1.Service) (string, error)
+}
+
+// specClassReader reads spec.loadBalancerClass of services from raw objects,
+// because the Kubernetes API which CCM is built with doesn't have the field.
+// The service is listed by its name, so that only list permission of services is required same as the service controller.
+// The field can't be changed once it is set, so it is cached by UID of the service.
+type specClassReader struct {
+	client  rest.Interface
+	classes sync.Map
+}
+
+func newSpecClassReader(kubeClient kubernetes.Interface) *specClassReader {
+	return &specClassReader{client: kubeClient.CoreV1().RESTClient()}
+}
+
+func (r *specClassReader) read(service *v1.Service) (string, error) {
+	if v, ok := r.classes.Load(service.UID); ok {
+		return v.(string), nil
+	}
+	raw, err := r.client.Get().Namespace(service.Namespace).Resource("services").
+		Param("fieldSelector", fields.OneTermEqualSelector("metadata.name", service.Name).String()).
+		Do().Raw()
+	if err != nil {
+		return "", err
+	}
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				UID types.UID `json:"uid"`
+			} `json:"metadata"`
+			Spec struct {
+				LoadBalancerClass string `json:"loadBalancerClass"`
+			} `json:"spec"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return "", err
+	}
+	for _, object := range list.Items {
+		if object.Metadata.UID == service.UID {
+			r.classes.Store(service.UID, object.Spec.LoadBalancerClass)
+			return object.Spec.LoadBalancerClass, nil
+		}
+	}
+	// service is deleted or re-created with same name, only the annotation is available
+	return "", nil
+}
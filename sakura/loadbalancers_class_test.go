@@ -0,0 +1,242 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/cloud-provider"
+)
+
+func TestServiceFilter_IsManaged(t *testing.T) {
+	expects := []struct {
+		caseName    string
+		filter      ServiceFilter
+		annotations map[string]string
+		specClass   string
+		managed     bool
+	}{
+		{caseName: "without class", managed: true},
+		{caseName: "ignore services without class", filter: ServiceFilter{IgnoreServicesWithoutClass: true}},
+		{
+			caseName:    "opt out",
+			annotations: map[string]string{annLoadBalancerManaged: "false"},
+		},
+		{
+			caseName:    "opt in explicitly",
+			annotations: map[string]string{annLoadBalancerManaged: "true"},
+			managed:     true,
+		},
+		{
+			caseName:    "default class",
+			filter:      ServiceFilter{IgnoreServicesWithoutClass: true},
+			annotations: map[string]string{AnnLoadBalancerClass: DefaultLoadBalancerClass},
+			managed:     true,
+		},
+		{
+			caseName:    "configured class",
+			filter:      ServiceFilter{Class: "example.com/private"},
+			annotations: map[string]string{AnnLoadBalancerClass: "example.com/private"},
+			managed:     true,
+		},
+		{
+			caseName:    "other class",
+			annotations: map[string]string{AnnLoadBalancerClass: "metallb.io/metallb"},
+		},
+		{
+			caseName:    "opt out with class",
+			annotations: map[string]string{AnnLoadBalancerClass: DefaultLoadBalancerClass, annLoadBalancerManaged: "false"},
+		},
+		{
+			caseName:  "other class in spec",
+			filter:    ServiceFilter{IgnoreServicesWithoutClass: true},
+			specClass: "metallb.io/metallb",
+		},
+		{
+			caseName:  "default class in spec",
+			filter:    ServiceFilter{IgnoreServicesWithoutClass: true},
+			specClass: DefaultLoadBalancerClass,
+			managed:   true,
+		},
+		{
+			caseName:    "spec takes precedence over annotation",
+			annotations: map[string]string{AnnLoadBalancerClass: DefaultLoadBalancerClass},
+			specClass:   "metallb.io/metallb",
+		},
+		{
+			caseName:    "annotation differs from spec is ignored",
+			annotations: map[string]string{AnnLoadBalancerClass: "metallb.io/metallb"},
+			specClass:   DefaultLoadBalancerClass,
+			managed:     true,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: expect.annotations}}
+			assert.Equal(t, expect.managed, expect.filter.IsManaged(service, expect.specClass))
+		})
+	}
+}
+
+// testClassReader returns spec.loadBalancerClass by name of the service
+type testClassReader struct {
+	classes map[string]string
+	err     error
+}
+
+func (r *testClassReader) read(service *v1.Service) (string, error) {
+	return r.classes[service.Name], r.err
+}
+
+func TestLoadBalancers_Unmanaged(t *testing.T) {
+	newService := func(annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", UID: "uid", Annotations: annotations},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+			Status: v1.ServiceStatus{
+				LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.2.0.10"}}},
+			},
+		}
+	}
+	expects := []struct {
+		caseName    string
+		service     *v1.Service
+		specClasses serviceClassReader
+	}{
+		{
+			caseName: "class in annotation",
+			service:  newService(map[string]string{AnnLoadBalancerClass: "metallb.io/metallb", annLoadBalancerType: "nlb"}),
+		},
+		{
+			// created before the webhook is installed
+			caseName:    "class in spec",
+			service:     newService(map[string]string{annLoadBalancerType: "nlb"}),
+			specClasses: &testClassReader{classes: map[string]string{"test": "metallb.io/metallb"}},
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			service := expect.service
+			lbs := &loadbalancers{config: &Config{}, specClasses: expect.specClasses}
+			// LoadBalancer with same name must not be touched
+			client := &testSacloudClient{
+				loadBalancers: []sacloud.LoadBalancer{*newLoadBalancer(&newLoadBalancerParam{
+					id: 100000000001, name: cloudprovider.DefaultLoadBalancerName(service), tags: lbs.serviceTags(service),
+				})},
+			}
+			lbs.sacloudAPI = client
+
+			status, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, &service.Status.LoadBalancer, status, "status of other implementation is kept")
+			assert.Nil(t, client.createdLoadBalancer)
+
+			assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nil))
+			assert.Equal(t, 0, client.updateLoadBalancerCalls)
+
+			_, exists, err := lbs.GetLoadBalancer(context.Background(), "", service)
+			assert.NoError(t, err)
+			assert.False(t, exists)
+
+			assert.NoError(t, lbs.EnsureLoadBalancerDeleted(context.Background(), "", service))
+			assert.Empty(t, client.deletedLoadBalancerIDs)
+		})
+	}
+
+	t.Run("class can't be read", func(t *testing.T) {
+		service := newService(nil)
+		client := &testSacloudClient{}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, specClasses: &testClassReader{err: errors.New("dummy")}}
+
+		_, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nil)
+		assert.Error(t, err)
+		assert.Nil(t, client.createdLoadBalancer)
+		assert.Error(t, lbs.EnsureLoadBalancerDeleted(context.Background(), "", service))
+		assert.Empty(t, client.deletedLoadBalancerIDs)
+	})
+
+	t.Run("reading class is forbidden", func(t *testing.T) {
+		service := newService(nil)
+		forbidden := apierrors.NewForbidden(v1.Resource("services"), "", errors.New("RBAC: access denied"))
+		recorder := record.NewFakeRecorder(10)
+		lbs := &loadbalancers{
+			sacloudAPI:  &testSacloudClient{},
+			config:      &Config{},
+			specClasses: &testClassReader{err: forbidden},
+			recorder:    recorder,
+		}
+
+		assert.Error(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nil))
+		if assert.Len(t, recorder.Events, 1) {
+			event := <-recorder.Events
+			assert.Contains(t, event, "Warning "+EventReasonLoadBalancerClassUnknown+" ")
+			assert.Contains(t, event, "list permission of services is required")
+		}
+	})
+}
+
+func TestSpecClassReader(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/api/v1/namespaces/default/services" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("fieldSelector") {
+		case "metadata.name=metallb":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"metallb","uid":"uid1"},"spec":{"loadBalancerClass":"metallb.io/metallb"}}]}`)) // nolint
+		case "metadata.name=recreated":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"recreated","uid":"uid3"},"spec":{"loadBalancerClass":"metallb.io/metallb"}}]}`)) // nolint
+		default:
+			w.Write([]byte(`{"items":[]}`)) // nolint
+		}
+	}))
+	defer server.Close()
+
+	restClient, err := rest.RESTClientFor(&rest.Config{
+		Host:    server.URL,
+		APIPath: "/api",
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &v1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &specClassReader{client: restClient}
+	newService := func(name, uid string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(uid)}}
+	}
+
+	class, err := reader.read(newService("metallb", "uid1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "metallb.io/metallb", class)
+	class, err = reader.read(newService("metallb", "uid1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "metallb.io/metallb", class)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "class must be cached")
+
+	class, err = reader.read(newService("deleted", "uid2"))
+	assert.NoError(t, err)
+	assert.Empty(t, class)
+
+	class, err = reader.read(newService("recreated", "uid2"))
+	assert.NoError(t, err)
+	assert.Empty(t, class, "class of another service with same name must not be used")
+}
@@ -0,0 +1,110 @@
+package sakura
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/api/core/v1"
+)
+
+// maxLoadBalancerGroupLen is max length of group name, it must be fit in tags
+const maxLoadBalancerGroupLen = 18
+
+func isGroupRequested(service *v1.Service) bool {
+	v, ok := service.Annotations[annLoadBalancerGroup]
+	return ok && v != ""
+}
+
+func loadBalancerGroup(service *v1.Service) (string, error) {
+	group := service.Annotations[annLoadBalancerGroup]
+	if len(group) > maxLoadBalancerGroupLen {
+		return "", fmt.Errorf("%q string length must be less equal %d", annLoadBalancerGroup, maxLoadBalancerGroupLen)
+	}
+	return group, nil
+}
+
+func (l *loadbalancers) groupTags(service *v1.Service) ([]string, error) {
+	group, err := loadBalancerGroup(service)
+	if err != nil {
+		return nil, err
+	}
+	return append(l.clusterTags(), fmt.Sprintf("%s=%s", TagsLoadBalancerGroup, group)), nil
+}
+
+func (l *loadbalancers) groupLoadBalancerName(service *v1.Service) string {
+	return fmt.Sprintf("k8s-lb-group-%s", service.Annotations[annLoadBalancerGroup])
+}
+
+// lockGroup serializes creating shared LoadBalancer of the group within the process.
+// Returned func unlocks the group.
+func (l *loadbalancers) lockGroup(service *v1.Service) func() {
+	v, _ := l.groupLocks.LoadOrStore(service.Annotations[annLoadBalancerGroup], &sync.Mutex{})
+	lock := v.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// settingOwner returns marker of VIP settings owned by service.
+// Only services in group or adopting LoadBalancer mark its settings, because settings of dedicated LoadBalancer are all its own.
+func settingOwner(service *v1.Service) string {
+	if !isGroupRequested(service) && !isAdoptionRequested(service) {
+		return ""
+	}
+	return string(service.UID)
+}
+
+// serviceSettings returns VIP settings of lb owned by service
+func (l *loadbalancers) serviceSettings(lb *sacloud.LoadBalancer, service *v1.Service) []*sacloud.LoadBalancerSetting {
+	if lb.Settings == nil {
+		return nil
+	}
+	owner := settingOwner(service)
+	if owner == "" {
+		return lb.Settings.LoadBalancer
+	}
+
+	var settings []*sacloud.LoadBalancerSetting
+	for _, s := range lb.Settings.LoadBalancer {
+		if s.Description == owner {
+			settings = append(settings, s)
+		}
+	}
+	return settings
+}
+
+// leaveLoadBalancerGroup removes VIP settings of service from shared LoadBalancer.
+// LoadBalancer is deleted(or retained) when the last member service is gone.
+func (l *loadbalancers) leaveLoadBalancerGroup(ctx context.Context, service *v1.Service, lb *sacloud.LoadBalancer) error {
+	if isOrphanedLoadBalancer(lb) {
+		return nil
+	}
+
+	owner := settingOwner(service)
+	owned, others := 0, 0
+	if lb.Settings != nil {
+		for _, s := range lb.Settings.LoadBalancer {
+			if s.Description == owner {
+				owned++
+			} else {
+				others++
+			}
+		}
+	}
+	if others > 0 {
+		if owned == 0 {
+			return nil
+		}
+		return l.sacloudAPI.RemoveLoadBalancerSettings(ctx, lb, owner)
+	}
+
+	policy, err := l.getDeletePolicy(service)
+	if err != nil {
+		return err
+	}
+	if policy == LoadBalancerDeletePolicyRetain {
+		return l.sacloudAPI.RetainLoadBalancer(ctx, lb, []string{TagsLoadBalancerOrphaned})
+	}
+	return l.sacloudAPI.DeleteLoadBalancer(ctx, lb.ID, l.shutdownWait)
+}
@@ -0,0 +1,89 @@
+package sakura
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/api/core/v1"
+)
+
+// TagsLoadBalancerServiceHash is tag name of hashed namespace and name of the service.
+// Unlike TagsLoadBalancerServiceName, it isn't truncated, so services in different namespaces are distinguished.
+var TagsLoadBalancerServiceHash = fmt.Sprintf("%s.ServiceHash", TagsKubernetesResource)
+
+// serviceHashLen is length of hash in TagsLoadBalancerServiceHash tag, it must be fit in tags
+const serviceHashLen = 12
+
+// serviceMetadata represents identity of the service recorded to description of LoadBalancer
+type serviceMetadata struct {
+	ClusterID string `json:"clusterID,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+	// Type and Selector are type and router or switch selector of the network which the LoadBalancer is in.
+	// They are empty if the LoadBalancer was created by older version.
+	Type     string `json:"type,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+func (l *loadbalancers) serviceMetadata(service *v1.Service) *serviceMetadata {
+	return &serviceMetadata{
+		ClusterID: l.config.ClusterID,
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		UID:       string(service.UID),
+	}
+}
+
+func (m *serviceMetadata) encode() string {
+	// marshaling struct of strings never fails
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// decodeServiceMetadata returns service identity recorded in description of LoadBalancer,
+// or nil if description is not written by CCM(e.g. LoadBalancer created by older version or adopted one)
+func decodeServiceMetadata(description string) *serviceMetadata {
+	if !strings.HasPrefix(description, "{") {
+		return nil
+	}
+	var m serviceMetadata
+	if err := json.Unmarshal([]byte(description), &m); err != nil {
+		return nil
+	}
+	if m.Name == "" || m.UID == "" {
+		return nil
+	}
+	return &m
+}
+
+func (l *loadbalancers) serviceHashTag(service *v1.Service) string {
+	sum := sha256.Sum256([]byte(service.Namespace + "/" + service.Name))
+	return fmt.Sprintf("%s=%s", TagsLoadBalancerServiceHash, hex.EncodeToString(sum[:])[:serviceHashLen])
+}
+
+// isServiceLoadBalancer returns true if identity of the service is recorded to lb.
+// Recorded UID isn't compared, so LoadBalancer retained by deleted service is found by new service with same namespace and name.
+func (l *loadbalancers) isServiceLoadBalancer(lb *sacloud.LoadBalancer, service *v1.Service) bool {
+	if m := decodeServiceMetadata(lb.Description); m != nil {
+		return m.Namespace == service.Namespace && m.Name == service.Name
+	}
+	if hasTagPrefix(lb, TagsLoadBalancerServiceHash+"=") {
+		return lb.HasTag(l.serviceHashTag(service))
+	}
+	// tagged by older version, truncated name may be ambiguous
+	return lb.HasTag(l.serviceTag(service))
+}
+
+func hasTagPrefix(lb *sacloud.LoadBalancer, prefix string) bool {
+	for _, tag := range lb.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
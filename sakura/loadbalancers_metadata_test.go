@@ -0,0 +1,92 @@
+package sakura
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceMetadata(t *testing.T) {
+	lbs := &loadbalancers{config: &Config{ClusterID: "cluster"}}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", UID: "uid1"}}
+
+	description := lbs.serviceMetadata(service).encode()
+	assert.Equal(t, `{"clusterID":"cluster","namespace":"default","name":"test","uid":"uid1"}`, description)
+	assert.Equal(t, lbs.serviceMetadata(service), decodeServiceMetadata(description))
+
+	assert.Nil(t, decodeServiceMetadata(""))
+	assert.Nil(t, decodeServiceMetadata("created by network team"))
+	assert.Nil(t, decodeServiceMetadata(`{"owner":"network team"}`))
+}
+
+func TestLoadBalancers_isServiceLoadBalancer(t *testing.T) {
+	lbs := &loadbalancers{config: &Config{}}
+	// truncated names are same
+	a := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "frontend-production-a", UID: "uid1"}}
+	b := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "frontend-production-b", UID: "uid2"}}
+	assert.Equal(t, lbs.serviceTag(a), lbs.serviceTag(b))
+	assert.NotEqual(t, lbs.serviceHashTag(a), lbs.serviceHashTag(b))
+	assert.True(t, len(lbs.serviceHashTag(a)) <= 32, "tag must be fit in 32 characters")
+
+	expects := []struct {
+		caseName    string
+		description string
+		tags        []string
+		isA         bool
+		isB         bool
+	}{
+		{
+			caseName:    "metadata",
+			description: lbs.serviceMetadata(a).encode(),
+			tags:        lbs.serviceTags(b),
+			isA:         true,
+		},
+		{
+			caseName: "hashed tag",
+			tags:     lbs.serviceTags(b),
+			isB:      true,
+		},
+		{
+			caseName: "tagged by older version",
+			tags:     []string{lbs.serviceTag(a)},
+			isA:      true,
+			isB:      true,
+		},
+	}
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			lb := newLoadBalancer(&newLoadBalancerParam{name: "test", tags: expect.tags})
+			lb.Description = expect.description
+			assert.Equal(t, expect.isA, lbs.isServiceLoadBalancer(lb, a))
+			assert.Equal(t, expect.isB, lbs.isServiceLoadBalancer(lb, b))
+		})
+	}
+}
+
+func TestLoadBalancers_lbForService_Orphaned(t *testing.T) {
+	lbs := &loadbalancers{config: &Config{}}
+	a := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "frontend-production-a", UID: "uid1"}}
+	b := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "frontend-production-b", UID: "uid2"}}
+
+	retained := newLoadBalancer(&newLoadBalancerParam{
+		id:           123456789012,
+		name:         "retained",
+		availability: sacloud.EAAvailable,
+		tags:         append(lbs.serviceTags(a), TagsLoadBalancerOrphaned),
+	})
+	retained.Description = lbs.serviceMetadata(a).encode()
+	lbs.sacloudAPI = &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*retained}}
+
+	recreated := a.DeepCopy()
+	recreated.UID = "uid3"
+	lb, err := lbs.lbForService(context.Background(), "", recreated)
+	assert.NoError(t, err)
+	assert.Equal(t, retained.ID, lb.ID)
+
+	_, err = lbs.lbForService(context.Background(), "", b)
+	assert.Equal(t, errLBNotFound, err, "service in other namespace must not reclaim it")
+}
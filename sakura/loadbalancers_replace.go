@@ -0,0 +1,161 @@
+package sakura
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// TagsLoadBalancerReplacement is a marker tag indicating that LoadBalancer is created for replacing the service's LoadBalancer
+var TagsLoadBalancerReplacement = fmt.Sprintf("%s.Replacement", TagsKubernetesResource)
+
+// replacementNameSuffix is suffix of the name of LoadBalancer for replacement.
+// It takes over the name of the replaced LoadBalancer after replacement.
+const replacementNameSuffix = "-next"
+
+func replacementName(name string) string {
+	return name + replacementNameSuffix
+}
+
+func isReplaceOnChangeEnabled(service *v1.Service) bool {
+	enabled, _ := strconv.ParseBool(service.Annotations[annLoadBalancerReplaceOnChange])
+	return enabled
+}
+
+// reconcileDrift replaces the LoadBalancer if its immutable attributes differ from the service.
+// It returns true if replacement is in progress or done, then VIP settings must not be updated by caller.
+func (l *loadbalancers) reconcileDrift(ctx context.Context, clusterName string, service *v1.Service, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam, vipParam *iaas.VIPParam) (bool, error) {
+	recorded := decodeServiceMetadata(lb.Description)
+	desired := decodeServiceMetadata(lbParam.Description)
+	lbParam.NetworkRecorded = recorded != nil && desired != nil && recorded.Type != "" &&
+		recorded.Type == desired.Type && recorded.Selector == desired.Selector
+
+	drift, err := l.sacloudAPI.LoadBalancerDrift(ctx, lb, lbParam)
+	if err != nil {
+		return false, err
+	}
+	if len(drift) == 0 {
+		return false, nil
+	}
+
+	if !isReplaceOnChangeEnabled(service) {
+		// LoadBalancer stays in current network, so the network recorded to it is kept
+		if desired != nil {
+			desired.Type, desired.Selector = "", ""
+			if recorded != nil {
+				desired.Type, desired.Selector = recorded.Type, recorded.Selector
+			}
+			lbParam.Description = desired.encode()
+		}
+		l.recordEvent(service, v1.EventTypeWarning, EventReasonLoadBalancerDriftDetected,
+			"Changes of LoadBalancer %q(%s) can't be applied without replacement, set %q to replace it",
+			lb.Name, strings.Join(drift, ", "), annLoadBalancerReplaceOnChange)
+		return false, nil
+	}
+	return true, l.replaceLoadBalancer(ctx, clusterName, service, lb, lbParam, vipParam, drift)
+}
+
+// replaceLoadBalancer replaces the LoadBalancer by blue/green steps across reconciles:
+// create new LoadBalancer, wait for it to be active, move VIP if both are on same switch, then delete old one.
+func (l *loadbalancers) replaceLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam, vipParam *iaas.VIPParam, drift []string) error {
+	nextParam := *lbParam
+	nextParam.Name = replacementName(lb.Name)
+	nextParam.Tags = append(append([]string{}, lbParam.Tags...), TagsLoadBalancerReplacement)
+	nextParam.VIP = ""
+	nextVIPParam := *vipParam
+	nextVIPParam.VIP = ""
+
+	next, err := l.lbByName(ctx, nextParam.Name)
+	if err == errLBNotFound {
+		created, err := l.requestLoadBalancer(ctx, service, &nextParam, &nextVIPParam)
+		if err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, EventReasonLoadBalancerReplacementFailed,
+				"Creating LoadBalancer for replacing %q is failed: %s", lb.Name, err)
+			return err
+		}
+		klog.V(2).Infof("LoadBalancer %q(id:%s) is requested for replacing %q", created.Name, created.GetStrID(), lb.Name)
+		l.startCreation(created)
+		l.recordEvent(service, v1.EventTypeNormal, EventReasonLoadBalancerReplacementStarted,
+			"Replacing LoadBalancer %q(%s) by %q", lb.Name, strings.Join(drift, ", "), created.Name)
+		return &loadBalancerPendingError{id: created.GetStrID(), name: created.Name}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := l.checkLoadBalancerActive(service, next); err != nil {
+		switch err.(type) {
+		case *loadBalancerPendingError, *loadBalancerInactiveError:
+			return err
+		}
+		l.finishCreation(next, err)
+		l.recordEvent(service, v1.EventTypeWarning, EventReasonLoadBalancerReplacementFailed,
+			"LoadBalancer %q for replacement is broken, it is re-created: %s", next.Name, err)
+		if err := l.sacloudAPI.DeleteLoadBalancer(ctx, next.ID, l.shutdownWait); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s, deleted it and will re-create in next reconcile", err)
+	}
+
+	l.finishCreation(next, nil)
+
+	// VIP can be moved only in same network
+	vip := ""
+	if lb.Switch != nil && next.Switch != nil && lb.Switch.ID == next.Switch.ID {
+		if settings := l.serviceSettings(lb, service); len(settings) > 0 {
+			vip = settings[0].VirtualIPAddress
+		}
+	}
+	if vip != "" {
+		// VIP can't be active on both LoadBalancers, so it is removed from old one first
+		if err := l.sacloudAPI.RemoveLoadBalancerSettings(ctx, lb, settingOwner(service)); err != nil {
+			return err
+		}
+		nextVIPParam.VIP = vip
+		if _, err := l.sacloudAPI.UpdateLoadBalancer(ctx, next, &nextParam, &nextVIPParam); err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, EventReasonLoadBalancerReplacementFailed,
+				"Moving VIP %s to LoadBalancer %q is failed: %s", vip, next.Name, err)
+			return err
+		}
+		l.recordEvent(service, v1.EventTypeNormal, EventReasonLoadBalancerVIPMoved,
+			"Moved VIP %s from LoadBalancer %q to %q", vip, lb.Name, next.Name)
+	}
+
+	if err := l.sacloudAPI.DeleteLoadBalancer(ctx, lb.ID, l.shutdownWait); err != nil {
+		return err
+	}
+
+	// take over the name of replaced LoadBalancer
+	finalParam := *lbParam
+	finalParam.RemoveTags = append(append([]string{}, lbParam.RemoveTags...), TagsLoadBalancerReplacement)
+	finalVIPParam := *vipParam
+	finalVIPParam.VIP = vip
+	if _, err := l.sacloudAPI.UpdateLoadBalancer(ctx, next, &finalParam, &finalVIPParam); err != nil {
+		return err
+	}
+	klog.V(2).Infof("LoadBalancer %q(id:%s) is replaced by id:%s", lb.Name, lb.GetStrID(), next.GetStrID())
+	l.recordEvent(service, v1.EventTypeNormal, EventReasonLoadBalancerReplaced,
+		"Replaced LoadBalancer %q(id:%s) by id:%s", lb.Name, lb.GetStrID(), next.GetStrID())
+	return nil
+}
+
+// deleteReplacement deletes LoadBalancer for replacing lb if replacement is in progress
+func (l *loadbalancers) deleteReplacement(ctx context.Context, lb *sacloud.LoadBalancer) error {
+	if lb.HasTag(TagsLoadBalancerReplacement) {
+		return nil
+	}
+	next, err := l.lbByName(ctx, replacementName(lb.Name))
+	if err != nil {
+		if err == errLBNotFound {
+			return nil
+		}
+		return err
+	}
+	return l.sacloudAPI.DeleteLoadBalancer(ctx, next.ID, l.shutdownWait)
+}
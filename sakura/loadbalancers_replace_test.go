@@ -0,0 +1,129 @@
+package sakura
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLoadBalancers_UpdateLoadBalancer_Replace(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", UID: "uid1", Annotations: map[string]string{annLoadBalancerPlan: "premium"}},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	nodes := []*v1.Node{newNodeWithExternalIP("node", "192.2.0.21")}
+	lbs := &loadbalancers{config: &Config{}}
+	name := lbs.GetLoadBalancerName(context.Background(), "", service)
+
+	newActiveLB := func(id int64, name string, tags ...string) *sacloud.LoadBalancer {
+		lb := newLoadBalancer(&newLoadBalancerParam{
+			id: id, name: name, availability: sacloud.EAAvailable, instanceStatus: "up", vips: []string{"192.2.0.10"}, tags: tags,
+		})
+		lb.Switch = &sacloud.Switch{Resource: sacloud.NewResource(999)}
+		return lb
+	}
+	old := newActiveLB(100000000001, name)
+
+	t.Run("drift without opt-in", func(t *testing.T) {
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*old}, drift: []string{"plan: standard -> premium"}}
+		recorder := record.NewFakeRecorder(10)
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, recorder: recorder}
+
+		assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nodes))
+		assert.Equal(t, 1, client.updateLoadBalancerCalls, "VIP settings are updated as usual")
+		assert.Contains(t, <-recorder.Events, EventReasonLoadBalancerDriftDetected)
+	})
+
+	t.Run("recorded network", func(t *testing.T) {
+		recorded := newActiveLB(100000000001, name)
+		recorded.Description = lbs.createLoadBalancerParam(context.Background(), "", service, iaas.LoadBalancerTypesInternet).Description
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*recorded}}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+		assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nodes))
+		assert.True(t, client.driftParams[0].NetworkRecorded, "switch isn't looked up while network is same")
+
+		moved := service.DeepCopy()
+		moved.Annotations[annRouterSelector] = "other"
+		client.drift = []string{"switch: 999 -> 1000"}
+		assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", moved, nodes))
+		assert.False(t, client.driftParams[1].NetworkRecorded)
+		m := decodeServiceMetadata(client.updateLoadBalancerParams[1].Description)
+		if assert.NotNil(t, m) {
+			assert.Equal(t, "", m.Selector, "network isn't changed without replacement")
+		}
+	})
+
+	replacing := service.DeepCopy()
+	replacing.Annotations[annLoadBalancerReplaceOnChange] = "true"
+
+	t.Run("create replacement", func(t *testing.T) {
+		created := newLoadBalancer(&newLoadBalancerParam{id: 100000000002, name: replacementName(name)})
+		client := &testSacloudClient{
+			loadBalancers:       []sacloud.LoadBalancer{*old},
+			drift:               []string{"plan: standard -> premium"},
+			createdLoadBalancer: created,
+		}
+		recorder := record.NewFakeRecorder(10)
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, recorder: recorder}
+
+		err := lbs.UpdateLoadBalancer(context.Background(), "", replacing, nodes)
+		assert.IsType(t, &loadBalancerPendingError{}, err)
+		assert.Equal(t, 0, client.updateLoadBalancerCalls)
+		assert.Contains(t, <-recorder.Events, EventReasonLoadBalancerReplacementStarted)
+	})
+
+	t.Run("wait for replacement", func(t *testing.T) {
+		next := newLoadBalancer(&newLoadBalancerParam{
+			id: 100000000002, name: replacementName(name), availability: sacloud.EAMigrating, tags: []string{TagsLoadBalancerReplacement},
+		})
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*old, *next}, drift: []string{"plan: standard -> premium"}}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+		lbs.startCreation(next)
+
+		err := lbs.UpdateLoadBalancer(context.Background(), "", replacing, nodes)
+		assert.IsType(t, &loadBalancerPendingError{}, err)
+		assert.Empty(t, client.deletedLoadBalancerIDs)
+	})
+
+	t.Run("move VIP and delete replaced", func(t *testing.T) {
+		next := newActiveLB(100000000002, replacementName(name), TagsLoadBalancerReplacement)
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*old, *next}, drift: []string{"plan: standard -> premium"}}
+		recorder := record.NewFakeRecorder(10)
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, recorder: recorder}
+
+		assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", replacing, nodes))
+		assert.Equal(t, []string{""}, client.removedSettingOwners, "VIP must be removed from replaced LoadBalancer")
+		assert.Equal(t, 2, client.updateLoadBalancerCalls)
+		assert.Equal(t, []int64{old.ID}, client.deletedLoadBalancerIDs)
+		assert.Contains(t, <-recorder.Events, EventReasonLoadBalancerVIPMoved)
+		assert.Contains(t, <-recorder.Events, EventReasonLoadBalancerReplaced)
+	})
+
+	t.Run("replacement is found after replaced is deleted", func(t *testing.T) {
+		next := newActiveLB(100000000002, replacementName(name), TagsLoadBalancerReplacement)
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*next}}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+		lb, err := lbs.lbForService(context.Background(), "", replacing)
+		assert.NoError(t, err)
+		assert.Equal(t, next.ID, lb.ID)
+		assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", replacing, nodes))
+		assert.Equal(t, 1, client.updateLoadBalancerCalls)
+	})
+
+	t.Run("replacement in progress is deleted with the service", func(t *testing.T) {
+		next := newActiveLB(100000000002, replacementName(name), TagsLoadBalancerReplacement)
+		client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*old, *next}}
+		lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+		assert.NoError(t, lbs.EnsureLoadBalancerDeleted(context.Background(), "", replacing))
+		assert.Equal(t, []int64{next.ID, old.ID}, client.deletedLoadBalancerIDs)
+	})
+}
@@ -0,0 +1,119 @@
+package sakura
+
+import (
+	"context"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+func (l *loadbalancers) isRoutedService(service *v1.Service) bool {
+	return l.getLoadBalancerType(service) == iaas.LoadBalancerTypesRouted
+}
+
+// ensureRoutedService assigns service IP from routed subnet of the router,
+// and keeps next-hop of the subnet on a healthy node.
+func (l *loadbalancers) ensureRoutedService(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, iaas.LoadBalancerTypesRouted)
+
+	healthyNodeIPs, err := l.getAllNodeIPs(nodes, iaas.LoadBalancerTypesRouted)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err = selectNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	nodeIPs, err := l.getAllNodeIPs(nodes, iaas.LoadBalancerTypesRouted)
+	if err != nil {
+		return nil, err
+	}
+	usedIPs, err := l.routedServiceIPs(service)
+	if err != nil {
+		return nil, err
+	}
+
+	routed, err := l.sacloudAPI.AssignRoutedIP(ctx, lbParam, &iaas.RoutedIPParam{
+		Owner:          string(service.UID),
+		IP:             service.Spec.LoadBalancerIP,
+		CurrentIP:      currentServiceIP(service),
+		UsedIPs:        usedIPs,
+		NodeIPs:        nodeIPs,
+		HealthyNodeIPs: healthyNodeIPs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if routed.PreviousNextHop != "" {
+		klog.V(2).Infof("next-hop of routed subnet %s/%d is moved from %s to %s",
+			routed.Subnet.NetworkAddress, routed.Subnet.NetworkMaskLen, routed.PreviousNextHop, routed.Subnet.NextHop)
+		l.recordEvent(service, v1.EventTypeNormal, EventReasonRoutedNextHopMoved,
+			"Moved next-hop of routed subnet %s/%d from %s to healthy node %s",
+			routed.Subnet.NetworkAddress, routed.Subnet.NetworkMaskLen, routed.PreviousNextHop, routed.Subnet.NextHop)
+	}
+
+	return &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: routed.IP}},
+	}, nil
+}
+
+func (l *loadbalancers) ensureRoutedServiceDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, iaas.LoadBalancerTypesRouted)
+	return l.sacloudAPI.ReleaseRoutedIP(ctx, lbParam, string(service.UID))
+}
+
+// routedServiceIPs returns IPs assigned to other routed type services
+func (l *loadbalancers) routedServiceIPs(service *v1.Service) ([]string, error) {
+	if l.kubeClient == nil {
+		return nil, nil
+	}
+	services, err := l.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for i := range services.Items {
+		s := &services.Items[i]
+		if profiled, err := l.applyProfile(s); err == nil {
+			// type may be provided by the profile
+			s = profiled
+		}
+		if s.UID == service.UID || s.Spec.Type != v1.ServiceTypeLoadBalancer || !l.isRoutedService(s) {
+			continue
+		}
+		if managed, err := l.isManaged(s); err == nil && !managed {
+			// IPs of the service are kept unused when its class is unknown
+			continue
+		}
+		for _, ingress := range s.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				ips = append(ips, ingress.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// serviceStatus returns current status of the service which has ingress IP
+func serviceStatus(service *v1.Service) (*v1.LoadBalancerStatus, bool) {
+	ip := currentServiceIP(service)
+	if ip == "" {
+		return nil, false
+	}
+	return &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: ip}},
+	}, true
+}
+
+func currentServiceIP(service *v1.Service) string {
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package sakura
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newRoutedService(name, uid, ip string) *v1.Service {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			UID:         k8stypes.UID(uid),
+			Annotations: map[string]string{annLoadBalancerType: iaas.LoadBalancerTypesRouted},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	if ip != "" {
+		service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ip}}
+	}
+	return service
+}
+
+func newNodeWithExternalIP(name, ip string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeExternalIP, Address: ip},
+			{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+		}},
+	}
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_Routed(t *testing.T) {
+	service := newRoutedService("test", "uid-1", "198.51.100.2")
+	other := newRoutedService("other", "uid-2", "198.51.100.1")
+	internet := newRoutedService("internet", "uid-3", "192.2.0.5")
+	internet.Annotations = nil
+
+	subnet := &sacloud.Subnet{NetworkAddress: "198.51.100.0", NetworkMaskLen: 28, NextHop: "192.2.0.11"}
+	client := &testSacloudClient{
+		assignedRoutedIP: &iaas.RoutedIP{IP: "198.51.100.2", Subnet: subnet, PreviousNextHop: "192.2.0.10"},
+	}
+	recorder := record.NewFakeRecorder(10)
+	lb := &loadbalancers{
+		sacloudAPI: client,
+		config:     &Config{},
+		kubeClient: fake.NewSimpleClientset(service, other, internet),
+		recorder:   recorder,
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "", service, []*v1.Node{newNodeWithExternalIP("node", "192.2.0.11")})
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "198.51.100.2"}}, status.Ingress)
+
+	assert.Len(t, client.assignRoutedIPParams, 1)
+	param := client.assignRoutedIPParams[0]
+	assert.Equal(t, "uid-1", param.Owner)
+	assert.Equal(t, "198.51.100.2", param.CurrentIP)
+	assert.Equal(t, []string{"198.51.100.1"}, param.UsedIPs, "IPs of other routed services must be excluded")
+	assert.Equal(t, []string{"192.2.0.11"}, param.NodeIPs)
+	assert.Equal(t, []string{"192.2.0.11"}, param.HealthyNodeIPs)
+
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, EventReasonRoutedNextHopMoved)
+
+	// no LoadBalancer is looked up for routed type
+	status, exists, err := lb.GetLoadBalancer(context.Background(), "", service)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "198.51.100.2"}}, status.Ingress)
+
+	_, exists, err = lb.GetLoadBalancer(context.Background(), "", newRoutedService("new", "uid-4", ""))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, lb.EnsureLoadBalancerDeleted(context.Background(), "", service))
+	assert.Equal(t, []string{"uid-1"}, client.releasedRoutedIPOwners)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+}
@@ -0,0 +1,94 @@
+package sakura
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// Status annotations are written to the service by CCM, so that users can find the LoadBalancer for the service.
+// They are distinct from annotations specified by users.
+const (
+	annStatusLoadBalancerID       = "status.k8s.usacloud.jp/load-balancer-id"
+	annStatusLoadBalancerVRID     = "status.k8s.usacloud.jp/load-balancer-vrid"
+	annStatusLoadBalancerSwitchID = "status.k8s.usacloud.jp/load-balancer-switch-id"
+	annStatusLoadBalancerPlan     = "status.k8s.usacloud.jp/load-balancer-plan"
+	annStatusLoadBalancerHA       = "status.k8s.usacloud.jp/load-balancer-ha"
+	annStatusLoadBalancerState    = "status.k8s.usacloud.jp/load-balancer-state"
+)
+
+// loadBalancerStatusAnnotations returns status annotations describing lb
+func loadBalancerStatusAnnotations(lb *sacloud.LoadBalancer) map[string]string {
+	annotations := map[string]string{
+		annStatusLoadBalancerID:    lb.GetStrID(),
+		annStatusLoadBalancerPlan:  "standard",
+		annStatusLoadBalancerHA:    "false",
+		annStatusLoadBalancerState: loadBalancerStateActive,
+	}
+	if lb.GetPlanID() == int64(sacloud.LoadBalancerPlanPremium) {
+		annotations[annStatusLoadBalancerPlan] = "premium"
+	}
+	switch {
+	case lb.Switch != nil:
+		annotations[annStatusLoadBalancerSwitchID] = lb.Switch.GetStrID()
+	case lb.Remark != nil && lb.Remark.Switch != nil:
+		annotations[annStatusLoadBalancerSwitchID] = lb.Remark.Switch.ID
+	}
+	if lb.Remark != nil {
+		if lb.Remark.VRRP != nil {
+			annotations[annStatusLoadBalancerVRID] = strconv.Itoa(lb.Remark.VRRP.VRID)
+		}
+		// sacloud.LoadBalancer.IsHA can't handle servers in remark
+		if len(lb.Remark.Servers) > 1 {
+			annotations[annStatusLoadBalancerHA] = "true"
+		}
+	}
+	return annotations
+}
+
+// updateStatusAnnotations patches status annotations of the service with lb which is active.
+func (l *loadbalancers) updateStatusAnnotations(service *v1.Service, lb *sacloud.LoadBalancer) {
+	l.patchStatusAnnotations(service, loadBalancerStatusAnnotations(lb))
+}
+
+// updatePendingStatusAnnotations patches ID of lb which is not active yet and pending state to the service,
+// so that users can find the LoadBalancer being created.
+func (l *loadbalancers) updatePendingStatusAnnotations(service *v1.Service, lb *sacloud.LoadBalancer) {
+	l.patchStatusAnnotations(service, map[string]string{
+		annStatusLoadBalancerID:    lb.GetStrID(),
+		annStatusLoadBalancerState: loadBalancerStatePending,
+	})
+}
+
+// patchStatusAnnotations patches annotations to the service only when they are changed.
+// Failure is only logged because it is retried on next reconcile.
+func (l *loadbalancers) patchStatusAnnotations(service *v1.Service, annotations map[string]string) {
+	if l.kubeClient == nil {
+		return
+	}
+
+	changed := map[string]string{}
+	for k, v := range annotations {
+		if service.Annotations[k] != v {
+			changed[k] = v
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": changed},
+	})
+	if err != nil {
+		klog.Warningf("building status annotations of service %s/%s is failed: %s", service.Namespace, service.Name, err)
+		return
+	}
+	if _, err := l.kubeClient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch); err != nil {
+		klog.Warningf("updating status annotations of service %s/%s is failed: %s", service.Namespace, service.Name, err)
+	}
+}
@@ -0,0 +1,174 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/cloud-provider"
+)
+
+func TestLoadBalancers_UpdateLoadBalancer_StatusAnnotations(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", UID: "uid1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		id:             123456789012,
+		name:           cloudprovider.DefaultLoadBalancerName(service),
+		availability:   sacloud.EAAvailable,
+		instanceStatus: "up",
+		vips:           []string{"192.2.0.10"},
+	})
+	kubeClient := fake.NewSimpleClientset(service)
+	lbs := &loadbalancers{
+		sacloudAPI: &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*lb}},
+		config:     &Config{},
+		kubeClient: kubeClient,
+	}
+	nodes := []*v1.Node{newNodeWithExternalIP("node", "192.2.0.21")}
+
+	assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nodes))
+	updated, err := kubeClient.CoreV1().Services("default").Get("test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		annStatusLoadBalancerID:       "123456789012",
+		annStatusLoadBalancerVRID:     "1",
+		annStatusLoadBalancerSwitchID: "999",
+		annStatusLoadBalancerPlan:     "standard",
+		annStatusLoadBalancerHA:       "false",
+		annStatusLoadBalancerState:    loadBalancerStateActive,
+	}, updated.Annotations)
+
+	// service isn't patched while annotations are up to date
+	kubeClient.ClearActions()
+	assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", updated, nodes))
+	for _, action := range kubeClient.Actions() {
+		assert.False(t, action.Matches("patch", "services"))
+	}
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_PendingStatusAnnotations(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", UID: "uid1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	created := newLoadBalancer(&newLoadBalancerParam{
+		id:           123456789012,
+		name:         cloudprovider.DefaultLoadBalancerName(service),
+		availability: sacloud.EAMigrating,
+		vips:         []string{"192.2.0.10"},
+	})
+	kubeClient := fake.NewSimpleClientset(service)
+	client := &testSacloudClient{createdLoadBalancer: created}
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, kubeClient: kubeClient}
+	nodes := []*v1.Node{newNodeWithExternalIP("node", "192.2.0.21")}
+
+	_, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nodes)
+	assert.IsType(t, &loadBalancerPendingError{}, err)
+	updated, err := kubeClient.CoreV1().Services("default").Get("test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		annStatusLoadBalancerID:    "123456789012",
+		annStatusLoadBalancerState: loadBalancerStatePending,
+	}, updated.Annotations, "ID must be recorded when creation is requested")
+
+	// created LoadBalancer is not listed yet, it must be found by recorded ID instead of creating another one
+	client.createdLoadBalancer = nil
+	client.createLoadBalancerError = errors.New("created twice")
+	client.loadBalancer = created
+	_, err = lbs.EnsureLoadBalancer(context.Background(), "", updated, nodes)
+	assert.IsType(t, &loadBalancerPendingError{}, err)
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_FailureEvents(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", UID: "uid1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		id:             123456789012,
+		name:           cloudprovider.DefaultLoadBalancerName(service),
+		availability:   sacloud.EAAvailable,
+		instanceStatus: "up",
+		vips:           []string{"192.2.0.10"},
+	})
+
+	expects := []struct {
+		caseName string
+		err      error
+		reason   string
+	}{
+		{
+			caseName: "ip exhausted",
+			err:      iaas.ErrGlobalIPExhausted,
+			reason:   EventReasonIPAddressExhausted,
+		},
+		{
+			caseName: "switch not found",
+			err:      fmt.Errorf("finding switch: %w", iaas.ErrNotFound),
+			reason:   EventReasonNetworkNotFound,
+		},
+		{
+			caseName: "invalid VIP",
+			err:      fmt.Errorf("wrapped: %w", iaas.ErrInvalidVIP),
+			reason:   EventReasonInvalidVIP,
+		},
+		{
+			caseName: "other",
+			err:      errors.New("dummy"),
+			reason:   EventReasonLoadBalancerSyncFailed,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			lbs := &loadbalancers{
+				sacloudAPI: &testSacloudClient{
+					loadBalancers:            []sacloud.LoadBalancer{*lb},
+					updateLoadBalancerErrors: []error{expect.err},
+				},
+				config:   &Config{},
+				recorder: recorder,
+			}
+
+			_, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nil)
+			assert.Equal(t, expect.err, err)
+			assert.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, "Warning "+expect.reason+" ")
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	timeout := &loadBalancerTimeoutError{id: "1", name: "test"}
+	assert.Equal(t, EventReasonLoadBalancerBootTimeout, failureReason(fmt.Errorf("%w, deleted it", timeout), EventReasonLoadBalancerSyncFailed))
+	assert.Equal(t, EventReasonLoadBalancerDeleteFailed, failureReason(errors.New("dummy"), EventReasonLoadBalancerDeleteFailed))
+
+	expects := []struct {
+		caseName string
+		err      error
+		reason   string
+	}{
+		{caseName: "throttled", err: &iaas.APIError{StatusCode: 503, Kind: iaas.ErrThrottled, Err: errors.New("giving up after 3 attempts")}, reason: EventReasonAPIThrottled},
+		{caseName: "unavailable", err: fmt.Errorf("wrapped: %w", iaas.ErrUnavailable), reason: EventReasonAPIUnavailable},
+		{caseName: "VRID exhausted", err: fmt.Errorf("wrapped: %w", iaas.ErrVRIDExhausted), reason: EventReasonVRIDExhausted},
+		{caseName: "VIP conflict", err: fmt.Errorf("wrapped: %w", iaas.ErrVIPConflict), reason: EventReasonVIPConflict},
+		{caseName: "invalid config", err: fmt.Errorf("wrapped: %w", iaas.ErrInvalidConfig), reason: EventReasonInvalidConfiguration},
+		{caseName: "API not found", err: &iaas.APIError{StatusCode: 404, Kind: iaas.ErrNotFound, Err: errors.New("not found")}, reason: EventReasonLoadBalancerSyncFailed},
+	}
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			assert.Equal(t, expect.reason, failureReason(expect.err, EventReasonLoadBalancerSyncFailed))
+		})
+	}
+}
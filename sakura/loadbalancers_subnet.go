@@ -0,0 +1,103 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	defaultRouterSubnetMaskLen = 28
+	minRouterSubnetMaskLen     = 26
+	maxRouterSubnetMaskLen     = 28
+)
+
+func (l *loadbalancers) isRouterSubnetExpansionEnabled(lbParam *iaas.LoadBalancerParam) bool {
+	return l.config.LoadBalancerExpandRouterSubnet && lbParam.Type == iaas.LoadBalancerTypesInternet
+}
+
+// requestLoadBalancer requests creating the LoadBalancer.
+// If global IPs are exhausted and router subnet expansion is enabled, routed subnet is added to the router for its VIP.
+func (l *loadbalancers) requestLoadBalancer(ctx context.Context, service *v1.Service, lbParam *iaas.LoadBalancerParam, vipParam *iaas.VIPParam) (*sacloud.LoadBalancer, error) {
+	lb, err := l.sacloudAPI.CreateLoadBalancer(ctx, lbParam, vipParam)
+	if !errors.Is(err, iaas.ErrGlobalIPExhausted) || !l.isRouterSubnetExpansionEnabled(lbParam) {
+		return lb, err
+	}
+
+	if err := l.expandRouterSubnet(ctx, service, nil, lbParam); err != nil {
+		return nil, err
+	}
+	return l.sacloudAPI.CreateLoadBalancer(ctx, lbParam, vipParam)
+}
+
+// updateLoadBalancer updates VIP settings of the LoadBalancer.
+// If global IPs are exhausted and router subnet expansion is enabled, routed subnet is added to the router.
+// Routed subnets are released only when VIP of the service is removed, others are collected by garbage collector.
+func (l *loadbalancers) updateLoadBalancer(ctx context.Context, service *v1.Service, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam, vipParam *iaas.VIPParam) error {
+	var current []string
+	for _, s := range l.serviceSettings(lb, service) {
+		current = append(current, s.VirtualIPAddress)
+	}
+
+	vips, err := l.sacloudAPI.UpdateLoadBalancer(ctx, lb, lbParam, vipParam)
+	if errors.Is(err, iaas.ErrGlobalIPExhausted) && l.isRouterSubnetExpansionEnabled(lbParam) {
+		if err := l.expandRouterSubnet(ctx, service, lb, lbParam); err != nil {
+			return err
+		}
+		vips, err = l.sacloudAPI.UpdateLoadBalancer(ctx, lb, lbParam, vipParam)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, vip := range current {
+		if !containsValue(vips, vip) {
+			l.releaseRouterSubnets(ctx, service, lbParam)
+			break
+		}
+	}
+	return nil
+}
+
+func (l *loadbalancers) expandRouterSubnet(ctx context.Context, service *v1.Service, lb *sacloud.LoadBalancer, lbParam *iaas.LoadBalancerParam) error {
+	maskLen := l.config.routerSubnetMaskLen()
+	subnet, err := l.sacloudAPI.ExpandRouterSubnet(ctx, lb, lbParam, maskLen)
+	if err != nil {
+		if iaas.IsQuotaExceededError(err) {
+			l.recordEvent(service, v1.EventTypeWarning, EventReasonRouterSubnetQuotaExceeded,
+				"Adding /%d subnet to router is failed by quota of the account: %s", maskLen, err)
+		} else {
+			l.recordEvent(service, v1.EventTypeWarning, EventReasonRouterSubnetExpansionFailed,
+				"Adding /%d subnet to router is failed: %s", maskLen, err)
+		}
+		return err
+	}
+
+	klog.V(2).Infof("routed subnet %s/%d is added to router for LoadBalancer %q", subnet.NetworkAddress, subnet.NetworkMaskLen, lbParam.Name)
+	l.recordEvent(service, v1.EventTypeNormal, EventReasonRouterSubnetExpanded,
+		"Added routed subnet %s/%d to router for VIPs, additional subnet is charged until it is released",
+		subnet.NetworkAddress, subnet.NetworkMaskLen)
+	return nil
+}
+
+// releaseRouterSubnets removes routed subnets added by CCM which have no VIP.
+// Failure is only logged because it is retried on next reconcile.
+func (l *loadbalancers) releaseRouterSubnets(ctx context.Context, service *v1.Service, lbParam *iaas.LoadBalancerParam) {
+	if !l.isRouterSubnetExpansionEnabled(lbParam) {
+		return
+	}
+
+	released, err := l.sacloudAPI.ReleaseRouterSubnets(ctx, lbParam)
+	for _, subnet := range released {
+		klog.V(2).Infof("routed subnet %s/%d is released from router", subnet.NetworkAddress, subnet.NetworkMaskLen)
+		l.recordEvent(service, v1.EventTypeNormal, EventReasonRouterSubnetReleased,
+			"Released empty routed subnet %s/%d from router", subnet.NetworkAddress, subnet.NetworkMaskLen)
+	}
+	if err != nil {
+		klog.Warningf("releasing routed subnets is failed: %s", err)
+	}
+}
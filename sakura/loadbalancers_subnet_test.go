@@ -0,0 +1,218 @@
+package sakura
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sacloud/libsacloud/api"
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLoadBalancers_updateLoadBalancer_ExpandRouterSubnet(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	lb := newLoadBalancer(&newLoadBalancerParam{id: 123456789012, name: "test", availability: sacloud.EAAvailable})
+	subnet := &sacloud.Subnet{NetworkAddress: "198.51.100.0", NetworkMaskLen: 28}
+	quotaErr := api.NewError(http.StatusConflict, &sacloud.ResultErrorValue{ErrorCode: "limit_count_in_account"})
+
+	expects := []struct {
+		caseName     string
+		enabled      bool
+		lbType       string
+		expandError  error
+		hasError     bool
+		updateCalls  int
+		eventReasons []string
+	}{
+		{
+			caseName:    "disabled",
+			lbType:      iaas.LoadBalancerTypesInternet,
+			hasError:    true,
+			updateCalls: 1,
+		},
+		{
+			caseName:    "switch type",
+			enabled:     true,
+			lbType:      iaas.LoadBalancerTypesSwitch,
+			hasError:    true,
+			updateCalls: 1,
+		},
+		{
+			caseName:     "expanded",
+			enabled:      true,
+			lbType:       iaas.LoadBalancerTypesInternet,
+			updateCalls:  2,
+			eventReasons: []string{EventReasonRouterSubnetExpanded},
+		},
+		{
+			caseName:     "quota exceeded",
+			enabled:      true,
+			lbType:       iaas.LoadBalancerTypesInternet,
+			expandError:  quotaErr,
+			hasError:     true,
+			updateCalls:  1,
+			eventReasons: []string{EventReasonRouterSubnetQuotaExceeded},
+		},
+		{
+			caseName:     "expansion failed",
+			enabled:      true,
+			lbType:       iaas.LoadBalancerTypesInternet,
+			expandError:  errors.New("dummy"),
+			hasError:     true,
+			updateCalls:  1,
+			eventReasons: []string{EventReasonRouterSubnetExpansionFailed},
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			client := &testSacloudClient{
+				updateLoadBalancerErrors: []error{iaas.ErrGlobalIPExhausted},
+				expandedSubnet:           subnet,
+				expandRouterSubnetError:  expect.expandError,
+			}
+			recorder := record.NewFakeRecorder(10)
+			lbs := &loadbalancers{
+				sacloudAPI: client,
+				config:     &Config{LoadBalancerExpandRouterSubnet: expect.enabled},
+				recorder:   recorder,
+			}
+
+			err := lbs.updateLoadBalancer(context.Background(), service, lb, &iaas.LoadBalancerParam{Type: expect.lbType}, &iaas.VIPParam{})
+			assert.Equal(t, expect.hasError, err != nil)
+			assert.Equal(t, expect.updateCalls, client.updateLoadBalancerCalls)
+
+			close(recorder.Events)
+			var reasons []string
+			for event := range recorder.Events {
+				reasons = append(reasons, strings.Fields(event)[1])
+			}
+			assert.Equal(t, expect.eventReasons, reasons)
+		})
+	}
+}
+
+func TestLoadBalancers_requestLoadBalancer_ExpandRouterSubnet(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	created := newLoadBalancer(&newLoadBalancerParam{id: 123456789012, name: "test"})
+
+	expects := []struct {
+		caseName    string
+		enabled     bool
+		expandError error
+		hasError    bool
+		createCalls int
+		expandCalls int
+	}{
+		{
+			caseName:    "disabled",
+			hasError:    true,
+			createCalls: 1,
+		},
+		{
+			caseName:    "expanded",
+			enabled:     true,
+			createCalls: 2,
+			expandCalls: 1,
+		},
+		{
+			caseName:    "expansion failed",
+			enabled:     true,
+			expandError: errors.New("dummy"),
+			hasError:    true,
+			createCalls: 1,
+			expandCalls: 1,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			client := &testSacloudClient{
+				createdLoadBalancer:      created,
+				createLoadBalancerErrors: []error{iaas.ErrGlobalIPExhausted},
+				expandedSubnet:           &sacloud.Subnet{NetworkAddress: "198.51.100.0", NetworkMaskLen: 28},
+				expandRouterSubnetError:  expect.expandError,
+			}
+			lbs := &loadbalancers{
+				sacloudAPI: client,
+				config:     &Config{LoadBalancerExpandRouterSubnet: expect.enabled},
+				recorder:   record.NewFakeRecorder(10),
+			}
+
+			lbParam := &iaas.LoadBalancerParam{Name: "test", Type: iaas.LoadBalancerTypesInternet}
+			lb, err := lbs.requestLoadBalancer(context.Background(), service, lbParam, &iaas.VIPParam{})
+			assert.Equal(t, expect.hasError, err != nil)
+			if !expect.hasError {
+				assert.Equal(t, created, lb)
+			}
+			assert.Equal(t, expect.createCalls, client.createLoadBalancerCalls)
+			assert.Len(t, client.expandedLoadBalancers, expect.expandCalls)
+			for _, expanded := range client.expandedLoadBalancers {
+				assert.Nil(t, expanded)
+			}
+		})
+	}
+}
+
+func TestLoadBalancers_updateLoadBalancer_ReleaseRouterSubnets(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+
+	expects := []struct {
+		caseName     string
+		vips         []string
+		updatedVIPs  []string
+		releaseCalls int
+	}{
+		{
+			caseName:    "VIP is kept",
+			vips:        []string{"198.51.100.4"},
+			updatedVIPs: []string{"198.51.100.4"},
+		},
+		{
+			caseName:     "VIP is removed",
+			vips:         []string{"198.51.100.4"},
+			updatedVIPs:  []string{"192.2.0.12"},
+			releaseCalls: 1,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			client := &testSacloudClient{updatedVIPs: expect.updatedVIPs}
+			lbs := &loadbalancers{
+				sacloudAPI: client,
+				config:     &Config{LoadBalancerExpandRouterSubnet: true},
+				recorder:   record.NewFakeRecorder(10),
+			}
+
+			lb := newLoadBalancer(&newLoadBalancerParam{id: 123456789012, name: "test", vips: expect.vips})
+			err := lbs.updateLoadBalancer(context.Background(), service, lb, &iaas.LoadBalancerParam{Type: iaas.LoadBalancerTypesInternet}, &iaas.VIPParam{})
+			assert.NoError(t, err)
+			assert.Equal(t, expect.releaseCalls, client.releaseRouterSubnetsCalls)
+		})
+	}
+}
+
+func TestLoadBalancers_releaseRouterSubnets(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	client := &testSacloudClient{
+		releasedSubnets: []*sacloud.Subnet{{NetworkAddress: "198.51.100.0", NetworkMaskLen: 28}},
+	}
+	recorder := record.NewFakeRecorder(10)
+	lbs := &loadbalancers{
+		sacloudAPI: client,
+		config:     &Config{LoadBalancerExpandRouterSubnet: true},
+		recorder:   recorder,
+	}
+
+	lbs.releaseRouterSubnets(context.Background(), service, &iaas.LoadBalancerParam{Type: iaas.LoadBalancerTypesInternet})
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, EventReasonRouterSubnetReleased)
+}
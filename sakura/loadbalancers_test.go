@@ -3,6 +3,7 @@ package sakura
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/sacloud/libsacloud/sacloud"
 	"github.com/stretchr/testify/assert"
@@ -43,10 +44,423 @@ func TestLoadBalancers_GetLoadBalancer(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoadBalancers_EnsureLoadBalancerDeleted_Adopted(t *testing.T) {
+	ctx := context.Background()
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:  types.UID("test"),
+			Name: "test",
+			Annotations: map[string]string{
+				annLoadBalancerID: "123456789012",
+			},
+		},
+	}
+	lbs := &loadbalancers{config: &Config{ClusterID: "cluster"}}
+
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		name:         "created-by-network-team",
+		availability: sacloud.EAAvailable,
+		vips:         []string{"192.2.0.1"},
+		tags:         append(lbs.serviceTags(service), TagsLoadBalancerAdopted),
+	})
+	client := &testSacloudClient{loadBalancer: lb}
+	lbs.sacloudAPI = client
+
+	err := lbs.EnsureLoadBalancerDeleted(ctx, "test", service)
+	assert.NoError(t, err)
+	assert.Len(t, client.releasedLoadBalancerIDs, 1)
+	assert.Equal(t, []string{"test"}, client.releasedSettingOwners, "only settings of the service are released")
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+
+	// adoption was not completed yet
+	lb.Tags = []string{}
+	client.releasedLoadBalancerIDs = nil
+	err = lbs.EnsureLoadBalancerDeleted(ctx, "test", service)
+	assert.NoError(t, err)
+	assert.Empty(t, client.releasedLoadBalancerIDs)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+}
+
+func TestLoadBalancers_validateAdoption(t *testing.T) {
+	lbs := &loadbalancers{config: &Config{}}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other"}}
+
+	expects := []struct {
+		caseName string
+		tags     []string
+		hasError bool
+	}{
+		{
+			caseName: "not managed",
+			hasError: false,
+		},
+		{
+			caseName: "adopted by same service",
+			tags:     append(lbs.serviceTags(service), TagsLoadBalancerAdopted),
+			hasError: false,
+		},
+		{
+			caseName: "adopted by other service",
+			tags:     append(lbs.serviceTags(other), TagsLoadBalancerAdopted),
+			hasError: true,
+		},
+		{
+			caseName: "created by CCM",
+			tags:     lbs.serviceTags(other),
+			hasError: true,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			lb := newLoadBalancer(&newLoadBalancerParam{name: "test", tags: expect.tags})
+			err := lbs.validateAdoption(lb, service)
+			assert.Equal(t, expect.hasError, err != nil)
+		})
+	}
+}
+
+func TestLoadBalancers_EnsureLoadBalancerDeleted_Retain(t *testing.T) {
+	ctx := context.Background()
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:  types.UID("test"),
+			Name: "test",
+			Annotations: map[string]string{
+				annLoadBalancerDeletePolicy: LoadBalancerDeletePolicyRetain,
+			},
+		},
+	}
+	lbs := &loadbalancers{config: &Config{}}
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		name:         cloudprovider.DefaultLoadBalancerName(service),
+		availability: sacloud.EAAvailable,
+		vips:         []string{"192.2.0.1"},
+		tags:         lbs.serviceTags(service),
+	})
+	client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*lb}}
+	lbs.sacloudAPI = client
+
+	err := lbs.EnsureLoadBalancerDeleted(ctx, "test", service)
+	assert.NoError(t, err)
+	assert.Len(t, client.retainedLoadBalancerIDs, 1)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+
+	// retained LoadBalancer is not deleted by another service which has same identity
+	recreated := service.DeepCopy()
+	recreated.UID = types.UID("recreated")
+	recreated.Annotations = nil
+	lb.AppendTag(TagsLoadBalancerOrphaned)
+	client.loadBalancers = []sacloud.LoadBalancer{*lb}
+
+	err = lbs.EnsureLoadBalancerDeleted(ctx, "test", recreated)
+	assert.NoError(t, err)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+}
+
+func TestLoadBalancers_getDeletePolicy(t *testing.T) {
+	expects := []struct {
+		caseName    string
+		config      string
+		annotations map[string]string
+		expect      string
+		hasError    bool
+	}{
+		{
+			caseName: "default",
+			expect:   LoadBalancerDeletePolicyDelete,
+		},
+		{
+			caseName: "config",
+			config:   LoadBalancerDeletePolicyRetain,
+			expect:   LoadBalancerDeletePolicyRetain,
+		},
+		{
+			caseName:    "annotation overrides config",
+			config:      LoadBalancerDeletePolicyRetain,
+			annotations: map[string]string{annLoadBalancerDeletePolicy: LoadBalancerDeletePolicyDelete},
+			expect:      LoadBalancerDeletePolicyDelete,
+		},
+		{
+			caseName:    "invalid",
+			annotations: map[string]string{annLoadBalancerDeletePolicy: "keep-forever"},
+			hasError:    true,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			lbs := &loadbalancers{config: &Config{LoadBalancerDeletePolicy: expect.config}}
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: expect.annotations}}
+			policy, err := lbs.getDeletePolicy(service)
+			assert.Equal(t, expect.expect, policy)
+			assert.Equal(t, expect.hasError, err != nil)
+		})
+	}
+}
+
+func TestLoadBalancers_Group(t *testing.T) {
+	ctx := context.Background()
+	newService := func(uid string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				UID:         types.UID(uid),
+				Name:        uid,
+				Annotations: map[string]string{annLoadBalancerGroup: "internal"},
+			},
+		}
+	}
+	service1 := newService("service1")
+	service2 := newService("service2")
+
+	lbs := &loadbalancers{config: &Config{ClusterID: "cluster"}}
+	tags, err := lbs.groupTags(service1)
+	assert.NoError(t, err)
+
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		name:         lbs.groupLoadBalancerName(service1),
+		availability: sacloud.EAAvailable,
+		vips:         []string{"192.2.0.1", "192.2.0.2"},
+		owners:       []string{"service1", "service2"},
+		tags:         tags,
+	})
+	client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*lb}}
+	lbs.sacloudAPI = client
+
+	t.Run("status contains only own VIPs", func(t *testing.T) {
+		status, exists, err := lbs.GetLoadBalancer(ctx, "test", service2)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Len(t, status.Ingress, 1)
+		assert.Equal(t, "192.2.0.2", status.Ingress[0].IP)
+	})
+
+	t.Run("member leaves group", func(t *testing.T) {
+		err := lbs.EnsureLoadBalancerDeleted(ctx, "test", service1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"service1"}, client.removedSettingOwners)
+		assert.Empty(t, client.deletedLoadBalancerIDs)
+	})
+
+	t.Run("last member is gone", func(t *testing.T) {
+		lb.Settings.LoadBalancer = lb.Settings.LoadBalancer[1:]
+		client.loadBalancers = []sacloud.LoadBalancer{*lb}
+
+		err := lbs.EnsureLoadBalancerDeleted(ctx, "test", service2)
+		assert.NoError(t, err)
+		assert.Len(t, client.deletedLoadBalancerIDs, 1)
+	})
+
+	t.Run("too long group name", func(t *testing.T) {
+		service := newService("service3")
+		service.Annotations[annLoadBalancerGroup] = "group-name-longer-than-tag"
+		_, _, err := lbs.GetLoadBalancer(ctx, "test", service)
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_Pending(t *testing.T) {
+	ctx := context.Background()
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:  types.UID("test"),
+			Name: "test",
+		},
+	}
+	created := newLoadBalancer(&newLoadBalancerParam{
+		id:           123456789012,
+		name:         cloudprovider.DefaultLoadBalancerName(service),
+		availability: sacloud.EAMigrating,
+		vips:         []string{"192.2.0.1"},
+	})
+	client := &testSacloudClient{createdLoadBalancer: created}
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+	status, err := lbs.EnsureLoadBalancer(ctx, "test", service, nil)
+	assert.Nil(t, status)
+	assert.IsType(t, &loadBalancerPendingError{}, err)
+
+	// still booting
+	client.loadBalancers = []sacloud.LoadBalancer{*created}
+	status, err = lbs.EnsureLoadBalancer(ctx, "test", service, nil)
+	assert.Nil(t, status)
+	assert.IsType(t, &loadBalancerPendingError{}, err)
+}
+
+func TestLoadBalancers_checkLoadBalancerActive(t *testing.T) {
+	now := time.Now()
+	before := now.Add(-time.Hour)
+	lbs := &loadbalancers{bootWait: 10 * time.Minute}
+
+	expects := []struct {
+		caseName       string
+		availability   sacloud.EAvailability
+		instanceStatus string
+		createdAt      *time.Time
+		creating       bool
+		isPending      bool
+		isInactive     bool
+		hasError       bool
+	}{
+		{
+			caseName:       "active",
+			availability:   sacloud.EAAvailable,
+			instanceStatus: "up",
+			createdAt:      &before,
+		},
+		{
+			caseName:     "copying",
+			availability: sacloud.EAMigrating,
+			createdAt:    &now,
+			creating:     true,
+			isPending:    true,
+			hasError:     true,
+		},
+		{
+			caseName:       "booting",
+			availability:   sacloud.EAAvailable,
+			instanceStatus: "down",
+			createdAt:      &now,
+			creating:       true,
+			isPending:      true,
+			hasError:       true,
+		},
+		{
+			caseName:     "timed out",
+			availability: sacloud.EAMigrating,
+			createdAt:    &before,
+			creating:     true,
+			hasError:     true,
+		},
+		{
+			caseName:     "failed",
+			availability: sacloud.EAFailed,
+			createdAt:    &now,
+			hasError:     true,
+		},
+		{
+			caseName:     "migrating after active",
+			availability: sacloud.EAMigrating,
+			createdAt:    &before,
+			isInactive:   true,
+			hasError:     true,
+		},
+		{
+			caseName:       "stopped after active",
+			availability:   sacloud.EAAvailable,
+			instanceStatus: "down",
+			createdAt:      &before,
+			isInactive:     true,
+			hasError:       true,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			lb := newLoadBalancer(&newLoadBalancerParam{
+				id:             123456789012,
+				name:           "test",
+				availability:   expect.availability,
+				instanceStatus: expect.instanceStatus,
+				createdAt:      expect.createdAt,
+			})
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+			if expect.creating {
+				service.Annotations = map[string]string{
+					annStatusLoadBalancerID:    lb.GetStrID(),
+					annStatusLoadBalancerState: loadBalancerStatePending,
+				}
+			}
+			err := lbs.checkLoadBalancerActive(service, lb)
+			assert.Equal(t, expect.hasError, err != nil)
+			_, isPending := err.(*loadBalancerPendingError)
+			assert.Equal(t, expect.isPending, isPending)
+			_, isInactive := err.(*loadBalancerInactiveError)
+			assert.Equal(t, expect.isInactive, isInactive)
+		})
+	}
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_Inactive(t *testing.T) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Hour)
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:  types.UID("test"),
+			Name: "test",
+		},
+	}
+
+	for _, availability := range []sacloud.EAvailability{sacloud.EAAvailable, sacloud.EAMigrating} {
+		t.Run(string(availability), func(t *testing.T) {
+			lb := newLoadBalancer(&newLoadBalancerParam{
+				id:             123456789012,
+				name:           cloudprovider.DefaultLoadBalancerName(service),
+				availability:   availability,
+				instanceStatus: "down",
+				vips:           []string{"192.2.0.1"},
+				createdAt:      &before,
+			})
+			client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*lb}}
+			lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, bootWait: 10 * time.Minute}
+
+			// LoadBalancer which was active must survive maintenance or stop by operator
+			_, err := lbs.EnsureLoadBalancer(ctx, "test", service, nil)
+			assert.IsType(t, &loadBalancerInactiveError{}, err)
+			assert.Empty(t, client.deletedLoadBalancerIDs)
+			assert.Nil(t, client.createdLoadBalancer)
+		})
+	}
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_Failed(t *testing.T) {
+	ctx := context.Background()
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:  types.UID("test"),
+			Name: "test",
+		},
+	}
+	failed := newLoadBalancer(&newLoadBalancerParam{
+		id:           123456789012,
+		name:         cloudprovider.DefaultLoadBalancerName(service),
+		availability: sacloud.EAFailed,
+		vips:         []string{"192.2.0.1"},
+	})
+	client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*failed}}
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+	// broken LoadBalancer is deleted instead of creating new one
+	status, err := lbs.EnsureLoadBalancer(ctx, "test", service, nil)
+	assert.Nil(t, status)
+	assert.Error(t, err)
+	assert.Equal(t, []int64{failed.ID}, client.deletedLoadBalancerIDs)
+
+	// adopted LoadBalancer is never deleted
+	client.deletedLoadBalancerIDs = nil
+	adopted := service.DeepCopy()
+	adopted.Annotations = map[string]string{annLoadBalancerID: "123456789012"}
+	client.loadBalancer = newLoadBalancer(&newLoadBalancerParam{
+		id:           123456789012,
+		name:         "created-by-network-team",
+		availability: sacloud.EAFailed,
+	})
+	status, err = lbs.EnsureLoadBalancer(ctx, "test", adopted, nil)
+	assert.Nil(t, status)
+	assert.Error(t, err)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+}
+
 type newLoadBalancerParam struct {
-	name         string
-	availability sacloud.EAvailability
-	vips         []string
+	id             int64
+	name           string
+	availability   sacloud.EAvailability
+	vips           []string
+	owners         []string
+	tags           []string
+	instanceStatus string
+	createdAt      *time.Time
 }
 
 func newLoadBalancer(p *newLoadBalancerParam) *sacloud.LoadBalancer {
@@ -58,15 +472,27 @@ func newLoadBalancer(p *newLoadBalancerParam) *sacloud.LoadBalancer {
 		IPAddress1:   "192.2.0.11",
 		MaskLen:      24,
 		DefaultRoute: "192.2.0.1",
+		Tags:         p.tags,
 	}
 	var settings []*sacloud.LoadBalancerSetting
-	for _, vip := range p.vips {
-		settings = append(settings, &sacloud.LoadBalancerSetting{
+	for i, vip := range p.vips {
+		setting := &sacloud.LoadBalancerSetting{
 			VirtualIPAddress: vip,
-		})
+		}
+		if i < len(p.owners) {
+			setting.Description = p.owners[i]
+		}
+		settings = append(settings, setting)
 	}
 
 	lb, _ := sacloud.CreateNewLoadBalancerSingle(values, settings)
+	lb.Resource = sacloud.NewResource(p.id)
 	lb.Availability = p.availability
+	lb.CreatedAt = p.createdAt
+	if p.instanceStatus != "" {
+		lb.Instance = &sacloud.Instance{
+			EServerInstanceStatus: &sacloud.EServerInstanceStatus{Status: p.instanceStatus},
+		}
+	}
 	return lb
 }
@@ -0,0 +1,47 @@
+package sakura
+
+import (
+	"context"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+)
+
+// ensureVPCRouterService forwards service ports on global IP of the VPC router to NodePorts of a healthy node
+func (l *loadbalancers) ensureVPCRouterService(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, iaas.LoadBalancerTypesVPCRouter)
+
+	nodes, err := selectNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	nodeIPs, err := l.getAllNodeIPs(nodes, iaas.LoadBalancerTypesVPCRouter)
+	if err != nil {
+		return nil, err
+	}
+	var ports []*iaas.PortForwardingPort
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, &iaas.PortForwardingPort{
+			Protocol: string(port.Protocol),
+			Port:     port.Port,
+			NodePort: port.NodePort,
+		})
+	}
+
+	globalIP, err := l.sacloudAPI.EnsureVPCRouterPortForwarding(ctx, lbParam, &iaas.PortForwardingParam{
+		Owner:   string(service.UID),
+		Ports:   ports,
+		NodeIPs: nodeIPs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: globalIP}},
+	}, nil
+}
+
+func (l *loadbalancers) ensureVPCRouterServiceDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	lbParam := l.createLoadBalancerParam(ctx, clusterName, service, iaas.LoadBalancerTypesVPCRouter)
+	return l.sacloudAPI.RemoveVPCRouterPortForwarding(ctx, lbParam, string(service.UID))
+}
@@ -0,0 +1,43 @@
+package sakura
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadBalancers_EnsureLoadBalancer_VPCRouter(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			UID:         "uid-1",
+			Annotations: map[string]string{annLoadBalancerType: iaas.LoadBalancerTypesVPCRouter},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+			},
+		},
+	}
+	client := &testSacloudClient{portForwardingGlobalIP: "203.0.113.10"}
+	lb := &loadbalancers{sacloudAPI: client, config: &Config{}}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "", service, []*v1.Node{newNodeWithExternalIP("node", "192.2.0.11")})
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}, status.Ingress)
+
+	assert.Len(t, client.portForwardingParams, 1)
+	param := client.portForwardingParams[0]
+	assert.Equal(t, "uid-1", param.Owner)
+	assert.Equal(t, []string{"10.0.0.1"}, param.NodeIPs, "private IPs of nodes must be used")
+	assert.Equal(t, []*iaas.PortForwardingPort{{Protocol: "TCP", Port: 80, NodePort: 30080}}, param.Ports)
+
+	assert.NoError(t, lb.EnsureLoadBalancerDeleted(context.Background(), "", service))
+	assert.Equal(t, []string{"uid-1"}, client.removedPortForwardingOwners)
+	assert.Empty(t, client.deletedLoadBalancerIDs)
+}
@@ -0,0 +1,98 @@
+package sakura
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sacloud/libsacloud/sacloud"
+	"k8s.io/api/core/v1"
+)
+
+// States of LoadBalancer reported as metrics and status annotation
+const (
+	loadBalancerStateActive  = "active"
+	loadBalancerStatePending = "pending"
+	loadBalancerStateFailed  = "failed"
+)
+
+var (
+	managedLoadBalancers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "sakuracloud",
+			Name:      "managed_loadbalancers",
+			Help:      "Number of LoadBalancers of the cluster, partitioned by state.",
+		},
+		[]string{"state"},
+	)
+	loadBalancerCreateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sakuracloud",
+			Subsystem: "loadbalancer",
+			Name:      "create_duration_seconds",
+			Help:      "Time from requesting LoadBalancer until it becomes active or broken, partitioned by result.",
+			Buckets:   prometheus.ExponentialBuckets(15, 2, 8),
+		},
+		[]string{"result"},
+	)
+)
+
+var registerLoadBalancerMetrics sync.Once
+
+func loadBalancerState(lb *sacloud.LoadBalancer) string {
+	switch {
+	case lb.IsFailed():
+		return loadBalancerStateFailed
+	case lb.IsAvailable() && lb.IsUp():
+		return loadBalancerStateActive
+	default:
+		return loadBalancerStatePending
+	}
+}
+
+// observeLoadBalancers updates count of LoadBalancers of the cluster in lbs, which must be all of them
+func (l *loadbalancers) observeLoadBalancers(lbs []sacloud.LoadBalancer) {
+	if l.config == nil {
+		return
+	}
+	counts := map[string]int{loadBalancerStateActive: 0, loadBalancerStatePending: 0, loadBalancerStateFailed: 0}
+	clusterTags := l.clusterTags()
+	for i := range lbs {
+		if hasTags(&lbs[i], clusterTags) {
+			counts[loadBalancerState(&lbs[i])]++
+		}
+	}
+	for state, n := range counts {
+		managedLoadBalancers.WithLabelValues(state).Set(float64(n))
+	}
+}
+
+// startCreation records that creating lb is requested
+func (l *loadbalancers) startCreation(lb *sacloud.LoadBalancer) {
+	l.creating.Store(lb.ID, time.Now())
+}
+
+// isCreating returns true if creating lb is requested by this process, or recorded to the service as pending.
+// Pending state is kept in the service across restarts of CCM.
+func (l *loadbalancers) isCreating(service *v1.Service, lb *sacloud.LoadBalancer) bool {
+	if _, ok := l.creating.Load(lb.ID); ok {
+		return true
+	}
+	return service.Annotations[annStatusLoadBalancerState] == loadBalancerStatePending &&
+		service.Annotations[annStatusLoadBalancerID] == lb.GetStrID()
+}
+
+// finishCreation observes duration of creating lb when it becomes active(err is nil) or broken.
+// Creations requested before CCM is restarted aren't observed.
+func (l *loadbalancers) finishCreation(lb *sacloud.LoadBalancer, err error) {
+	v, ok := l.creating.Load(lb.ID)
+	if !ok {
+		return
+	}
+	l.creating.Delete(lb.ID)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	loadBalancerCreateDuration.WithLabelValues(result).Observe(time.Since(v.(time.Time)).Seconds())
+}
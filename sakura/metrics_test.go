@@ -0,0 +1,63 @@
+package sakura
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	registry := prometheus.NewRegistry()
+	if !assert.NoError(t, registry.Register(gauge)) {
+		t.FailNow()
+	}
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return families[0].GetMetric()[0].GetGauge().GetValue()
+}
+
+func histogramCount(t *testing.T, histogram prometheus.Observer) uint64 {
+	registry := prometheus.NewRegistry()
+	if !assert.NoError(t, registry.Register(histogram.(prometheus.Histogram))) {
+		t.FailNow()
+	}
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return families[0].GetMetric()[0].GetHistogram().GetSampleCount()
+}
+
+func TestLoadBalancers_observeLoadBalancers(t *testing.T) {
+	lbs := &loadbalancers{config: &Config{ClusterID: "cluster"}}
+	clusterTags := lbs.clusterTags()
+
+	lbs.observeLoadBalancers([]sacloud.LoadBalancer{
+		*newLoadBalancer(&newLoadBalancerParam{id: 1, tags: clusterTags, availability: sacloud.EAAvailable, instanceStatus: "up"}),
+		*newLoadBalancer(&newLoadBalancerParam{id: 2, tags: clusterTags, availability: sacloud.EAMigrating}),
+		*newLoadBalancer(&newLoadBalancerParam{id: 3, tags: clusterTags, availability: sacloud.EAFailed}),
+		*newLoadBalancer(&newLoadBalancerParam{id: 4, tags: []string{TagsKubernetesResource, TagsClusterID + "=other"}}),
+	})
+	assert.Equal(t, float64(1), gaugeValue(t, managedLoadBalancers.WithLabelValues(loadBalancerStateActive)))
+	assert.Equal(t, float64(1), gaugeValue(t, managedLoadBalancers.WithLabelValues(loadBalancerStatePending)))
+	assert.Equal(t, float64(1), gaugeValue(t, managedLoadBalancers.WithLabelValues(loadBalancerStateFailed)))
+}
+
+func TestLoadBalancers_finishCreation(t *testing.T) {
+	lbs := &loadbalancers{}
+	lb := newLoadBalancer(&newLoadBalancerParam{id: 1})
+	before := histogramCount(t, loadBalancerCreateDuration.WithLabelValues("success"))
+
+	lbs.finishCreation(lb, nil)
+	assert.Equal(t, before, histogramCount(t, loadBalancerCreateDuration.WithLabelValues("success")),
+		"creation not requested by this process isn't observed")
+
+	lbs.startCreation(lb)
+	lbs.finishCreation(lb, nil)
+	lbs.finishCreation(lb, nil)
+	assert.Equal(t, before+1, histogramCount(t, loadBalancerCreateDuration.WithLabelValues("success")))
+}
@@ -0,0 +1,203 @@
+package sakura
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// annLoadBalancerProfile is the annotation used to specify name of LoadBalancer profile
+// which provides defaults of other annotations.
+// Annotations of the service override fields of the profile.
+// default is empty.
+const annLoadBalancerProfile = "k8s.usacloud.jp/load-balancer-profile"
+
+// LoadBalancerProfile is a named set of LoadBalancer settings shared by services.
+// Each field is a default of the corresponding annotation.
+type LoadBalancerProfile struct {
+	Type                 string   `json:"type" yaml:"type"`
+	RouterSelector       string   `json:"routerSelector" yaml:"routerSelector"`
+	SwitchSelector       string   `json:"switchSelector" yaml:"switchSelector"`
+	HA                   bool     `json:"ha" yaml:"ha"`
+	Plan                 string   `json:"plan" yaml:"plan"`
+	HealthzInterval      int      `json:"healthzInterval" yaml:"healthzInterval"`
+	IPRange              string   `json:"ipRange" yaml:"ipRange"`
+	AssignIPRange        string   `json:"assignIPRange" yaml:"assignIPRange"`
+	AssignDefaultGateway string   `json:"assignDefaultGateway" yaml:"assignDefaultGateway"`
+	ExcludeIPAddresses   []string `json:"excludeIPAddresses" yaml:"excludeIPAddresses"`
+}
+
+// annotations returns annotations which the profile provides
+func (p *LoadBalancerProfile) annotations() map[string]string {
+	annotations := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	set(annLoadBalancerType, p.Type)
+	set(annRouterSelector, p.RouterSelector)
+	set(annSwitchSelector, p.SwitchSelector)
+	if p.HA {
+		set(annLoadBalancerHA, strconv.FormatBool(p.HA))
+	}
+	set(annLoadBalancerPlan, p.Plan)
+	if p.HealthzInterval != 0 {
+		set(annHealthzInterval, strconv.Itoa(p.HealthzInterval))
+	}
+	set(annLoadBalancerIPAddressRange, p.IPRange)
+	set(annLoadBalancerAssignIPAddressRange, p.AssignIPRange)
+	set(annLoadBalancerAssignDefaultGateway, p.AssignDefaultGateway)
+	set(annLoadBalancerExcludeIPAddresses, strings.Join(p.ExcludeIPAddresses, ","))
+	return annotations
+}
+
+// validate returns error if a field of the profile has invalid value.
+// Fields required by the type may be omitted, services can specify them.
+func (p *LoadBalancerProfile) validate() error {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: p.annotations()},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	var errs field.ErrorList
+	for _, err := range validateServiceSpec(service, true) {
+		if err.Type != field.ErrorTypeRequired {
+			errs = append(errs, err)
+		}
+	}
+	return errs.ToAggregate()
+}
+
+// parseLoadBalancerProfiles returns profiles in data of ConfigMap, each key is name of profile
+func parseLoadBalancerProfiles(data map[string]string) (map[string]*LoadBalancerProfile, error) {
+	profiles := map[string]*LoadBalancerProfile{}
+	for name, v := range data {
+		profile := &LoadBalancerProfile{}
+		if err := yaml.Unmarshal([]byte(v), profile); err != nil {
+			return nil, fmt.Errorf("profile %q is invalid: %s", name, err)
+		}
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("profile %q is invalid: %s", name, err)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// loadBalancerProfiles holds profiles in CCM config, and profiles in ConfigMap if it is watched.
+// Profile in ConfigMap takes precedence over one with same name in CCM config.
+type loadBalancerProfiles struct {
+	config map[string]*LoadBalancerProfile
+
+	mu        sync.RWMutex
+	namespace string
+	name      string
+	lister    corelisters.ConfigMapLister
+	synced    cache.InformerSynced
+}
+
+func newLoadBalancerProfiles(config map[string]*LoadBalancerProfile) *loadBalancerProfiles {
+	return &loadBalancerProfiles{config: config}
+}
+
+// watch starts watching the ConfigMap specified as "namespace/name" until stop is closed
+func (p *loadBalancerProfiles) watch(kubeClient kubernetes.Interface, configMap string, stop <-chan struct{}) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(configMap)
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceSystem
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps()
+
+	p.mu.Lock()
+	p.namespace = namespace
+	p.name = name
+	p.lister = informer.Lister()
+	p.synced = informer.Informer().HasSynced
+	p.mu.Unlock()
+
+	factory.Start(stop)
+	klog.Infof("LoadBalancer profiles are watched in ConfigMap %s/%s", namespace, name)
+	return nil
+}
+
+// get returns the profile with name
+func (p *loadBalancerProfiles) get(name string) (*LoadBalancerProfile, error) {
+	p.mu.RLock()
+	lister, synced, namespace, configMap := p.lister, p.synced, p.namespace, p.name
+	p.mu.RUnlock()
+
+	if lister != nil {
+		if !synced() {
+			return nil, fmt.Errorf("LoadBalancer profiles in ConfigMap %s/%s are not synced yet", namespace, configMap)
+		}
+		cm, err := lister.ConfigMaps(namespace).Get(configMap)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			if v, ok := cm.Data[name]; ok {
+				profiles, err := parseLoadBalancerProfiles(map[string]string{name: v})
+				if err != nil {
+					return nil, fmt.Errorf("ConfigMap %s/%s has invalid profile: %s", namespace, configMap, err)
+				}
+				return profiles[name], nil
+			}
+		}
+	}
+
+	if profile, ok := p.config[name]; ok {
+		return profile, nil
+	}
+	return nil, &serviceValidationError{errs: field.ErrorList{
+		field.NotFound(field.NewPath("metadata", "annotations").Key(annLoadBalancerProfile), name),
+	}}
+}
+
+// applyProfile returns a copy of the service whose annotations are merged with its profile.
+// Annotations of the service take precedence over the profile.
+// The service is returned as is if it doesn't specify a profile.
+func (l *loadbalancers) applyProfile(service *v1.Service) (*v1.Service, error) {
+	name := service.Annotations[annLoadBalancerProfile]
+	if name == "" {
+		return service, nil
+	}
+	profiles := l.profiles
+	if profiles == nil {
+		profiles = newLoadBalancerProfiles(nil)
+	}
+	profile, err := profiles.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	service = service.DeepCopy()
+	for k, v := range profile.annotations() {
+		if _, ok := service.Annotations[k]; !ok {
+			service.Annotations[k] = v
+		}
+	}
+	return service, nil
+}
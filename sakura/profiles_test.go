@@ -0,0 +1,112 @@
+package sakura
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLoadBalancers_applyProfile(t *testing.T) {
+	lbs := &loadbalancers{
+		profiles: newLoadBalancerProfiles(map[string]*LoadBalancerProfile{
+			"private": {
+				Type:                 "switch",
+				SwitchSelector:       "private",
+				HA:                   true,
+				Plan:                 "premium",
+				HealthzInterval:      30,
+				IPRange:              "192.2.0.0/24",
+				AssignIPRange:        "192.2.0.128/25",
+				AssignDefaultGateway: "192.2.0.1",
+				ExcludeIPAddresses:   []string{"192.2.0.10", "192.2.0.16/28"},
+			},
+		}),
+	}
+
+	t.Run("without profile", func(t *testing.T) {
+		service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+		applied, err := lbs.applyProfile(service)
+		assert.NoError(t, err)
+		assert.True(t, applied == service)
+	})
+
+	t.Run("annotations override profile", func(t *testing.T) {
+		service := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: map[string]string{
+				annLoadBalancerProfile: "private",
+				annLoadBalancerPlan:    "standard",
+				annLoadBalancerHA:      "",
+			}},
+		}
+		applied, err := lbs.applyProfile(service)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			annLoadBalancerProfile:              "private",
+			annLoadBalancerType:                 "switch",
+			annSwitchSelector:                   "private",
+			annLoadBalancerHA:                   "",
+			annLoadBalancerPlan:                 "standard",
+			annHealthzInterval:                  "30",
+			annLoadBalancerIPAddressRange:       "192.2.0.0/24",
+			annLoadBalancerAssignIPAddressRange: "192.2.0.128/25",
+			annLoadBalancerAssignDefaultGateway: "192.2.0.1",
+			annLoadBalancerExcludeIPAddresses:   "192.2.0.10,192.2.0.16/28",
+		}, applied.Annotations)
+		assert.Len(t, service.Annotations, 3, "original service must not be modified")
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		service := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: map[string]string{annLoadBalancerProfile: "unknown"}},
+		}
+		_, err := lbs.applyProfile(service)
+		assert.IsType(t, &serviceValidationError{}, err)
+	})
+}
+
+func TestLoadBalancerProfiles_watch(t *testing.T) {
+	internet, err := yaml.Marshal(&LoadBalancerProfile{Type: "internet", RouterSelector: "shared"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "lb-profiles"},
+		Data: map[string]string{
+			"default": string(internet),
+			"broken":  "plan: dummy",
+		},
+	}
+	profiles := newLoadBalancerProfiles(map[string]*LoadBalancerProfile{
+		"default": {Type: "switch"},
+		"private": {Type: "switch", SwitchSelector: "private"},
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if !assert.NoError(t, profiles.watch(fake.NewSimpleClientset(cm), "kube-system/lb-profiles", stop)) {
+		t.FailNow()
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return profiles.synced(), nil
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	profile, err := profiles.get("default")
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", profile.RouterSelector, "profile in ConfigMap takes precedence")
+
+	profile, err = profiles.get("private")
+	assert.NoError(t, err)
+	assert.Equal(t, "private", profile.SwitchSelector)
+
+	_, err = profiles.get("broken")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package sakura
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// reservationNamespace is namespace of ConfigMap for recording in-flight allocations
+	reservationNamespace = "kube-system"
+	// reservationConfigMapName is name of ConfigMap for recording in-flight allocations
+	reservationConfigMapName = "sakura-cloud-controller-manager-reservations"
+)
+
+// configMapReserver records in-flight allocations of IP addresses and VRIDs in ConfigMap,
+// so that they are shared with other CCM processes such as a new leader after failover.
+type configMapReserver struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+func newConfigMapReserver(kubeClient kubernetes.Interface, namespace, name string) iaas.Reserver {
+	return &configMapReserver{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		name:       name,
+	}
+}
+
+func (r *configMapReserver) Reservations(switchID int64) ([]*iaas.Reservation, error) {
+	cm, err := r.kubeClient.CoreV1().ConfigMaps(r.namespace).Get(r.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r.unexpiredReservations(cm, switchID)
+}
+
+func (r *configMapReserver) Reserve(switchID int64, reservation *iaas.Reservation) error {
+	return r.update(switchID, func(reservations []*iaas.Reservation) ([]*iaas.Reservation, error) {
+		return iaas.MergeReservation(reservations, reservation)
+	})
+}
+
+func (r *configMapReserver) Release(switchID int64, id string) error {
+	return r.update(switchID, func(reservations []*iaas.Reservation) ([]*iaas.Reservation, error) {
+		var res []*iaas.Reservation
+		for _, reservation := range reservations {
+			if reservation.ID != id {
+				res = append(res, reservation)
+			}
+		}
+		return res, nil
+	})
+}
+
+// update updates reservations on the switch with optimistic concurrency control of ConfigMap
+func (r *configMapReserver) update(switchID int64, fn func([]*iaas.Reservation) ([]*iaas.Reservation, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMaps := r.kubeClient.CoreV1().ConfigMaps(r.namespace)
+
+		cm, err := configMaps.Get(r.name, metav1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+		if notFound {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: r.namespace,
+					Name:      r.name,
+				},
+			}
+		}
+
+		reservations, err := r.unexpiredReservations(cm, switchID)
+		if err != nil {
+			return err
+		}
+		reservations, err = fn(reservations)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(reservations)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[reservationKey(switchID)] = string(data)
+
+		if notFound {
+			_, err = configMaps.Create(cm)
+			if apierrors.IsAlreadyExists(err) {
+				// created by another process, retry with it
+				return apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, r.name, err)
+			}
+			return err
+		}
+		_, err = configMaps.Update(cm)
+		return err
+	})
+}
+
+func (r *configMapReserver) unexpiredReservations(cm *v1.ConfigMap, switchID int64) ([]*iaas.Reservation, error) {
+	data, ok := cm.Data[reservationKey(switchID)]
+	if !ok || data == "" {
+		return nil, nil
+	}
+
+	var reservations []*iaas.Reservation
+	if err := json.Unmarshal([]byte(data), &reservations); err != nil {
+		return nil, fmt.Errorf("parsing reservations in ConfigMap %s/%s is failed: %s", r.namespace, r.name, err)
+	}
+
+	var res []*iaas.Reservation
+	for _, reservation := range reservations {
+		if !reservation.IsExpired() {
+			res = append(res, reservation)
+		}
+	}
+	return res, nil
+}
+
+func reservationKey(switchID int64) string {
+	return strconv.FormatInt(switchID, 10)
+}
@@ -0,0 +1,48 @@
+package sakura
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapReserver(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	// reservers share ConfigMap as same as CCM processes across leader failover
+	reserver := newConfigMapReserver(kubeClient, reservationNamespace, reservationConfigMapName)
+	another := newConfigMapReserver(kubeClient, reservationNamespace, reservationConfigMapName)
+	expiresAt := time.Now().Add(time.Minute)
+
+	reservations, err := reserver.Reservations(1)
+	assert.NoError(t, err)
+	assert.Empty(t, reservations)
+
+	err = reserver.Reserve(1, &iaas.Reservation{ID: "lb1", IPAddresses: []string{"192.168.0.11"}, VRID: 1, ExpiresAt: expiresAt})
+	assert.NoError(t, err)
+	err = reserver.Reserve(1, &iaas.Reservation{ID: "expired", IPAddresses: []string{"192.168.0.12"}, VRID: 2, ExpiresAt: time.Now().Add(-time.Minute)})
+	assert.NoError(t, err)
+
+	err = another.Reserve(1, &iaas.Reservation{ID: "lb2", IPAddresses: []string{"192.168.0.11"}, VRID: 3, ExpiresAt: expiresAt})
+	assert.Equal(t, iaas.ErrReservationConflict, err)
+	err = another.Reserve(2, &iaas.Reservation{ID: "lb2", IPAddresses: []string{"192.168.0.11"}, VRID: 1, ExpiresAt: expiresAt})
+	assert.NoError(t, err, "reservations on other switch never conflict")
+
+	reservations, err = another.Reservations(1)
+	assert.NoError(t, err)
+	assert.Len(t, reservations, 1)
+	assert.Equal(t, "lb1", reservations[0].ID)
+
+	err = another.Release(1, "lb1")
+	assert.NoError(t, err)
+	reservations, err = reserver.Reservations(1)
+	assert.NoError(t, err)
+	assert.Empty(t, reservations)
+
+	cm, err := kubeClient.CoreV1().ConfigMaps(reservationNamespace).Get(reservationConfigMapName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, cm.Data, "2")
+}
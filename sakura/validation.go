@@ -0,0 +1,237 @@
+package sakura
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/iaas"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var supportedLoadBalancerTypes = []string{
+	iaas.LoadBalancerTypesInternet,
+	iaas.LoadBalancerTypesSwitch,
+	iaas.LoadBalancerTypesRouted,
+	iaas.LoadBalancerTypesVPCRouter,
+}
+
+// supportedProtocols is protocols of service ports which each type can handle
+var supportedProtocols = map[string][]string{
+	iaas.LoadBalancerTypesInternet:  {string(v1.ProtocolTCP)},
+	iaas.LoadBalancerTypesSwitch:    {string(v1.ProtocolTCP)},
+	iaas.LoadBalancerTypesRouted:    {string(v1.ProtocolTCP), string(v1.ProtocolUDP), string(v1.ProtocolSCTP)},
+	iaas.LoadBalancerTypesVPCRouter: {string(v1.ProtocolTCP), string(v1.ProtocolUDP)},
+}
+
+// ValidateService returns all problems of the service which CCM can't handle, with paths of their fields.
+// Services other than LoadBalancer type are always valid.
+// It doesn't call any API, so that it can be used before touching the cloud and by admission webhook.
+// When the service specifies a profile, settings which the profile may provide are not required.
+func ValidateService(service *v1.Service) field.ErrorList {
+	return validateServiceSpec(service, service.Annotations[annLoadBalancerProfile] == "")
+}
+
+// validateServiceSpec validates the service.
+// resolved must be false if annotations of the service may be completed by its profile later.
+func validateServiceSpec(service *v1.Service, resolved bool) field.ErrorList {
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	var errs field.ErrorList
+	annotations := field.NewPath("metadata", "annotations")
+	spec := field.NewPath("spec")
+
+	if v, ok := service.Annotations[annLoadBalancerManaged]; ok {
+		managed, err := strconv.ParseBool(v)
+		if err != nil {
+			return append(errs, field.Invalid(annotations.Key(annLoadBalancerManaged), v, "must be boolean"))
+		}
+		if !managed {
+			// handled by other implementation
+			return nil
+		}
+	}
+
+	lbType := iaas.LoadBalancerTypesInternet
+	v, typeKnown := service.Annotations[annLoadBalancerType]
+	if typeKnown {
+		lbType = v
+		if !containsValue(supportedLoadBalancerTypes, v) {
+			errs = append(errs, field.NotSupported(annotations.Key(annLoadBalancerType), v, supportedLoadBalancerTypes))
+			// other fields depend on type
+			return errs
+		}
+	}
+	// type may be provided by the profile
+	typeKnown = typeKnown || resolved
+	hasAppliance := lbType == iaas.LoadBalancerTypesInternet || lbType == iaas.LoadBalancerTypesSwitch
+
+	errs = append(errs, validateApplianceAnnotations(service, annotations)...)
+	errs = append(errs, validateSwitchAnnotations(service, lbType, resolved, annotations)...)
+
+	if v, ok := service.Annotations[annLoadBalancerExcludeIPAddresses]; ok {
+		for _, address := range strings.Split(v, ",") {
+			if address = strings.TrimSpace(address); address != "" && !isIPv4(address) && !isIPv4CIDR(address) {
+				errs = append(errs, field.Invalid(annotations.Key(annLoadBalancerExcludeIPAddresses), address, "must be IPv4 address or CIDR block"))
+			}
+		}
+	}
+	if v := service.Annotations[annLoadBalancerNodeSelector]; v != "" {
+		if _, err := labels.Parse(v); err != nil {
+			errs = append(errs, field.Invalid(annotations.Key(annLoadBalancerNodeSelector), v, err.Error()))
+		}
+	}
+
+	if !typeKnown {
+		if ip := service.Spec.LoadBalancerIP; ip != "" && !isIPv4(ip) {
+			errs = append(errs, field.Invalid(spec.Child("loadBalancerIP"), ip, "must be IPv4 address"))
+		}
+		return errs
+	}
+
+	for i, port := range service.Spec.Ports {
+		protocol := string(port.Protocol)
+		if protocol == "" {
+			protocol = string(v1.ProtocolTCP)
+		}
+		if !containsValue(supportedProtocols[lbType], protocol) {
+			errs = append(errs, field.NotSupported(spec.Child("ports").Index(i).Child("protocol"), protocol, supportedProtocols[lbType]))
+		}
+	}
+
+	if service.Spec.SessionAffinity == v1.ServiceAffinityClientIP && lbType != iaas.LoadBalancerTypesRouted {
+		// traffic is balanced across nodes before kube-proxy, so affinity isn't kept
+		errs = append(errs, field.NotSupported(spec.Child("sessionAffinity"), service.Spec.SessionAffinity,
+			[]string{string(v1.ServiceAffinityNone)}))
+	}
+
+	if ip := service.Spec.LoadBalancerIP; ip != "" {
+		path := spec.Child("loadBalancerIP")
+		switch {
+		case lbType == iaas.LoadBalancerTypesVPCRouter:
+			errs = append(errs, field.Forbidden(path, "global IP address of the VPC router is used"))
+		case !isIPv4(ip):
+			errs = append(errs, field.Invalid(path, ip, "must be IPv4 address"))
+		case lbType == iaas.LoadBalancerTypesSwitch:
+			if _, ipNet, err := net.ParseCIDR(service.Annotations[annLoadBalancerIPAddressRange]); err == nil && !ipNet.Contains(net.ParseIP(ip)) {
+				errs = append(errs, field.Invalid(path, ip, "must be in "+annLoadBalancerIPAddressRange))
+			}
+		}
+	}
+
+	if !hasAppliance {
+		for _, ann := range []string{annLoadBalancerID, annLoadBalancerGroup} {
+			if v := service.Annotations[ann]; v != "" {
+				errs = append(errs, field.Forbidden(annotations.Key(ann), "can't be used with "+lbType+" type"))
+			}
+		}
+	}
+	return errs
+}
+
+// validateApplianceAnnotations validates annotations for LoadBalancer appliance
+func validateApplianceAnnotations(service *v1.Service, annotations *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if v, ok := service.Annotations[annLoadBalancerPlan]; ok && v != "" {
+		plans := []string{"standard", "premium"}
+		if !containsValue(plans, v) {
+			errs = append(errs, field.NotSupported(annotations.Key(annLoadBalancerPlan), v, plans))
+		}
+	}
+	if v, ok := service.Annotations[annHealthzInterval]; ok && v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			errs = append(errs, field.Invalid(annotations.Key(annHealthzInterval), v, "must be positive integer"))
+		}
+	}
+	if v, ok := service.Annotations[annLoadBalancerID]; ok && v != "" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			errs = append(errs, field.Invalid(annotations.Key(annLoadBalancerID), v, "must be ID of LoadBalancer"))
+		}
+		if isGroupRequested(service) {
+			errs = append(errs, field.Forbidden(annotations.Key(annLoadBalancerID), "can't be used with "+annLoadBalancerGroup))
+		}
+	}
+	if v, ok := service.Annotations[annLoadBalancerGroup]; ok && len(v) > maxLoadBalancerGroupLen {
+		errs = append(errs, field.TooLong(annotations.Key(annLoadBalancerGroup), v, maxLoadBalancerGroupLen))
+	}
+	if v, ok := service.Annotations[annLoadBalancerDeletePolicy]; ok && v != "" {
+		policies := []string{LoadBalancerDeletePolicyDelete, LoadBalancerDeletePolicyRetain}
+		if !containsValue(policies, v) {
+			errs = append(errs, field.NotSupported(annotations.Key(annLoadBalancerDeletePolicy), v, policies))
+		}
+	}
+	if v, ok := service.Annotations[annLoadBalancerReplaceOnChange]; ok && v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			errs = append(errs, field.Invalid(annotations.Key(annLoadBalancerReplaceOnChange), v, "must be boolean"))
+		}
+	}
+	if v, ok := service.Annotations[annLoadBalancerSorryServer]; ok && v != "" && !isIPv4(v) {
+		errs = append(errs, field.Invalid(annotations.Key(annLoadBalancerSorryServer), v, "must be IPv4 address"))
+	}
+	return errs
+}
+
+// validateSwitchAnnotations validates network settings of switch type
+func validateSwitchAnnotations(service *v1.Service, lbType string, resolved bool, annotations *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for _, ann := range []string{annLoadBalancerIPAddressRange, annLoadBalancerAssignIPAddressRange, annLoadBalancerAssignDefaultGateway} {
+		v := service.Annotations[ann]
+		switch {
+		case lbType != iaas.LoadBalancerTypesSwitch:
+			// ignored by other types
+		case v == "":
+			if resolved {
+				errs = append(errs, field.Required(annotations.Key(ann), "required by "+lbType+" type"))
+			}
+		case ann == annLoadBalancerAssignDefaultGateway:
+			if !isIPv4(v) {
+				errs = append(errs, field.Invalid(annotations.Key(ann), v, "must be IPv4 address"))
+			}
+		default:
+			if !isIPv4CIDR(v) {
+				errs = append(errs, field.Invalid(annotations.Key(ann), v, "must be CIDR format(e.g. 192.2.0.1/24)"))
+			}
+		}
+	}
+	return errs
+}
+
+func isIPv4(v string) bool {
+	ip := net.ParseIP(v)
+	return ip != nil && ip.To4() != nil
+}
+
+func isIPv4CIDR(v string) bool {
+	ip, _, err := net.ParseCIDR(v)
+	return err == nil && ip.To4() != nil
+}
+
+func containsValue(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceValidationError is returned when the service has problems found by ValidateService
+type serviceValidationError struct {
+	errs field.ErrorList
+}
+
+func (e *serviceValidationError) Error() string {
+	return e.errs.ToAggregate().Error()
+}
+
+// validateService validates the service whose profile is already applied
+func validateService(service *v1.Service) error {
+	if errs := validateServiceSpec(service, true); len(errs) > 0 {
+		return &serviceValidationError{errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package sakura
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sacloud/libsacloud/sacloud"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/cloud-provider"
+)
+
+func TestValidateService(t *testing.T) {
+	expects := []struct {
+		caseName    string
+		annotations map[string]string
+		spec        v1.ServiceSpec
+		fields      []string
+	}{
+		{
+			caseName: "valid internet type",
+			spec:     v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}}},
+		},
+		{
+			caseName: "valid switch type",
+			annotations: map[string]string{
+				annLoadBalancerType:                 "switch",
+				annLoadBalancerIPAddressRange:       "192.2.0.0/24",
+				annLoadBalancerAssignIPAddressRange: "192.2.0.128/25",
+				annLoadBalancerAssignDefaultGateway: "192.2.0.1",
+			},
+			spec: v1.ServiceSpec{LoadBalancerIP: "192.2.0.10"},
+		},
+		{
+			caseName: "switch type completed by profile",
+			annotations: map[string]string{
+				annLoadBalancerProfile: "private",
+				annLoadBalancerType:    "switch",
+			},
+		},
+		{
+			caseName:    "type provided by profile",
+			annotations: map[string]string{annLoadBalancerProfile: "routed"},
+			spec: v1.ServiceSpec{
+				Ports:          []v1.ServicePort{{Port: 53, Protocol: v1.ProtocolUDP}},
+				LoadBalancerIP: "dummy",
+			},
+			fields: []string{"spec.loadBalancerIP"},
+		},
+		{
+			caseName:    "not managed",
+			annotations: map[string]string{annLoadBalancerManaged: "false", annLoadBalancerType: "nlb"},
+		},
+		{
+			caseName:    "invalid managed flag",
+			annotations: map[string]string{annLoadBalancerManaged: "no"},
+			fields:      []string{"metadata.annotations[k8s.usacloud.jp/load-balancer-managed]"},
+		},
+		{
+			caseName:    "invalid type",
+			annotations: map[string]string{annLoadBalancerType: "nlb", annLoadBalancerPlan: "dummy"},
+			fields:      []string{"metadata.annotations[k8s.usacloud.jp/load-balancer-type]"},
+		},
+		{
+			caseName: "all problems of switch type",
+			annotations: map[string]string{
+				annLoadBalancerType:                 "switch",
+				annLoadBalancerIPAddressRange:       "192.2.0.0",
+				annLoadBalancerAssignDefaultGateway: "192.2.0.1",
+				annLoadBalancerPlan:                 "high",
+				annLoadBalancerExcludeIPAddresses:   "192.2.0.10, 192.2.0.x",
+			},
+			spec: v1.ServiceSpec{
+				Ports:           []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}, {Port: 53, Protocol: v1.ProtocolUDP}},
+				SessionAffinity: v1.ServiceAffinityClientIP,
+				LoadBalancerIP:  "192.2.0.1000",
+			},
+			fields: []string{
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-plan]",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-ip-range]",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-assign-ip-range]",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-exclude-ip-addresses]",
+				"spec.ports[1].protocol",
+				"spec.sessionAffinity",
+				"spec.loadBalancerIP",
+			},
+		},
+		{
+			caseName: "loadBalancerIP out of ip-range",
+			annotations: map[string]string{
+				annLoadBalancerType:                 "switch",
+				annLoadBalancerIPAddressRange:       "192.2.0.0/24",
+				annLoadBalancerAssignIPAddressRange: "192.2.0.128/25",
+				annLoadBalancerAssignDefaultGateway: "192.2.0.1",
+			},
+			spec:   v1.ServiceSpec{LoadBalancerIP: "198.51.100.10"},
+			fields: []string{"spec.loadBalancerIP"},
+		},
+		{
+			caseName:    "UDP and session affinity with routed type",
+			annotations: map[string]string{annLoadBalancerType: "routed"},
+			spec: v1.ServiceSpec{
+				Ports:           []v1.ServicePort{{Port: 53, Protocol: v1.ProtocolUDP}},
+				SessionAffinity: v1.ServiceAffinityClientIP,
+			},
+		},
+		{
+			caseName:    "appliance annotations with vpcrouter type",
+			annotations: map[string]string{annLoadBalancerType: "vpcrouter", annLoadBalancerGroup: "group"},
+			spec:        v1.ServiceSpec{LoadBalancerIP: "198.51.100.10"},
+			fields: []string{
+				"spec.loadBalancerIP",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-group]",
+			},
+		},
+		{
+			caseName: "adoption and group",
+			annotations: map[string]string{
+				annLoadBalancerID:    "lb",
+				annLoadBalancerGroup: "group-name-longer-than-18",
+			},
+			fields: []string{
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-id]",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-id]",
+				"metadata.annotations[k8s.usacloud.jp/load-balancer-group]",
+			},
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			service := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: expect.annotations},
+				Spec:       expect.spec,
+			}
+			service.Spec.Type = v1.ServiceTypeLoadBalancer
+
+			var fields []string
+			for _, err := range ValidateService(service) {
+				fields = append(fields, err.Field)
+			}
+			assert.Equal(t, expect.fields, fields)
+		})
+	}
+
+	// other types are ignored by CCM
+	clusterIP := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annLoadBalancerType: "nlb"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeClusterIP},
+	}
+	assert.Empty(t, ValidateService(clusterIP))
+}
+
+func TestLoadBalancers_EnsureLoadBalancer_Invalid(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: map[string]string{annLoadBalancerType: "nlb"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	client := &testSacloudClient{}
+	recorder := record.NewFakeRecorder(10)
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{}, recorder: recorder}
+
+	_, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nil)
+	assert.IsType(t, &serviceValidationError{}, err)
+	assert.Contains(t, <-recorder.Events, EventReasonInvalidService)
+	assert.Equal(t, 0, client.updateLoadBalancerCalls)
+}
+
+func TestLoadBalancers_UpdateLoadBalancer_Invalid(t *testing.T) {
+	// created before validation is added
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", UID: "uid1"},
+		Spec: v1.ServiceSpec{
+			Type:            v1.ServiceTypeLoadBalancer,
+			Ports:           []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+			SessionAffinity: v1.ServiceAffinityClientIP,
+		},
+	}
+	lb := newLoadBalancer(&newLoadBalancerParam{
+		id:             123456789012,
+		name:           cloudprovider.DefaultLoadBalancerName(service),
+		availability:   sacloud.EAAvailable,
+		instanceStatus: "up",
+		vips:           []string{"192.2.0.10"},
+	})
+	client := &testSacloudClient{loadBalancers: []sacloud.LoadBalancer{*lb}, drift: []string{"plan"}}
+	lbs := &loadbalancers{sacloudAPI: client, config: &Config{}}
+	service.Annotations = map[string]string{annLoadBalancerReplaceOnChange: "true"}
+	nodes := []*v1.Node{newNodeWithExternalIP("node", "192.2.0.21")}
+
+	assert.NoError(t, lbs.UpdateLoadBalancer(context.Background(), "", service, nodes), "backends must follow nodes")
+	assert.Equal(t, 1, client.updateLoadBalancerCalls)
+	assert.Nil(t, client.createdLoadBalancer, "LoadBalancer must not be replaced by invalid service")
+
+	_, err := lbs.EnsureLoadBalancer(context.Background(), "", service, nodes)
+	assert.IsType(t, &serviceValidationError{}, err, "config changes must be blocked")
+	assert.Equal(t, 1, client.updateLoadBalancerCalls)
+}
@@ -33,7 +33,7 @@ func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (clo
 		return cloudprovider.Zone{}, err
 	}
 
-	server, err := nodeByID(z.sacloudAPI, id)
+	server, err := nodeByID(ctx, z.sacloudAPI, id)
 	if err != nil {
 		return cloudprovider.Zone{}, err
 	}
@@ -45,7 +45,7 @@ func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (clo
 // This method is particularly used in the context of external cloud providers where node initialization must be down
 // outside the kubelets.
 func (z *zones) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
-	server, err := nodeByName(z.sacloudAPI, string(nodeName))
+	server, err := nodeByName(ctx, z.sacloudAPI, string(nodeName))
 	if err != nil {
 		return cloudprovider.Zone{}, err
 	}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/sakura"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type options struct {
+	bindAddress        string
+	port               int
+	tlsCertFile        string
+	tlsPrivateKeyFile  string
+	defaultAnnotations []string
+
+	loadBalancerClass          string
+	ignoreServicesWithoutClass bool
+}
+
+// NewCommand returns `webhook` subcommand which serves admission webhook for services
+func NewCommand() *cobra.Command {
+	o := &options{}
+	cmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Serve admission webhook which validates SAKURA Cloud annotations of services",
+		Long: `Serve validating admission webhook on /validate, which rejects services whose k8s.usacloud.jp/* annotations
+or load balancer settings can't work, and mutating admission webhook on /mutate, which injects default annotations.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run()
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&o.bindAddress, "bind-address", "0.0.0.0", "The IP address on which to listen.")
+	flags.IntVar(&o.port, "port", 9443, "The port on which to serve HTTPS.")
+	flags.StringVar(&o.tlsCertFile, "tls-cert-file", "", "File containing x509 certificate for HTTPS.")
+	flags.StringVar(&o.tlsPrivateKeyFile, "tls-private-key-file", "", "File containing x509 private key matching --tls-cert-file.")
+	flags.StringArrayVar(&o.defaultAnnotations, "default-annotation", nil,
+		"Annotation injected to LoadBalancer type services which don't have it, in key=value format(e.g. k8s.usacloud.jp/load-balancer-plan=premium). Can be specified multiple times.")
+
+	flags.StringVar(&o.loadBalancerClass, "load-balancer-class", sakura.DefaultLoadBalancerClass,
+		"Load balancer class handled by CCM. Services of other classes are ignored. Must match loadBalancerClass in CCM config.")
+	flags.BoolVar(&o.ignoreServicesWithoutClass, "ignore-services-without-class", false,
+		"Ignore services without load balancer class. Must match loadBalancerIgnoreServicesWithoutClass in CCM config.")
+
+	// usage of cloud-controller-manager command lists its own flags, which aren't used by this command
+	cmd.SetUsageFunc(func(c *cobra.Command) error {
+		fmt.Fprintf(c.OutOrStderr(), "Usage:\n  %s\n\nFlags:\n%s", c.UseLine(), c.LocalFlags().FlagUsages())
+		return nil
+	})
+	cmd.SetHelpFunc(func(c *cobra.Command, args []string) {
+		fmt.Fprintf(c.OutOrStdout(), "%s\n\n", c.Long)
+		_ = c.Usage()
+	})
+	return cmd
+}
+
+func (o *options) run() error {
+	if o.tlsCertFile == "" || o.tlsPrivateKeyFile == "" {
+		return fmt.Errorf("--tls-cert-file and --tls-private-key-file are required, API server calls webhook only via HTTPS")
+	}
+	defaults, err := parseAnnotations(o.defaultAnnotations)
+	if err != nil {
+		return err
+	}
+	server, err := NewServer(defaults, &sakura.ServiceFilter{
+		Class:                      o.loadBalancerClass,
+		IgnoreServicesWithoutClass: o.ignoreServicesWithoutClass,
+	})
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(o.bindAddress, strconv.Itoa(o.port))
+	klog.Infof("serving admission webhook on %s", addr)
+	return http.ListenAndServeTLS(addr, o.tlsCertFile, o.tlsPrivateKeyFile, server.Handler())
+}
+
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("annotation %q must be in key=value format", v)
+		}
+		annotations[kv[0]] = kv[1]
+	}
+	return annotations, nil
+}
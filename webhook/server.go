@@ -0,0 +1,219 @@
+// Package webhook implements admission webhook which validates SAKURA Cloud annotations of services,
+// and injects cluster default annotations to them.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/sakura"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog"
+)
+
+// AnnotationPrefix is prefix of annotations which can be injected as defaults
+const AnnotationPrefix = "k8s.usacloud.jp/"
+
+// Server serves validating and mutating admission webhook for services
+type Server struct {
+	defaults map[string]string
+	filter   *sakura.ServiceFilter
+}
+
+// NewServer returns Server which injects defaults to services which don't have them.
+// Services which aren't managed by filter are neither validated nor mutated.
+func NewServer(defaults map[string]string, filter *sakura.ServiceFilter) (*Server, error) {
+	for k := range defaults {
+		if !strings.HasPrefix(k, AnnotationPrefix) {
+			return nil, fmt.Errorf("default annotation %q must have prefix %q", k, AnnotationPrefix)
+		}
+	}
+	if filter == nil {
+		filter = &sakura.ServiceFilter{}
+	}
+	return &Server{defaults: defaults, filter: filter}, nil
+}
+
+// Handler returns http.Handler which serves `/validate` and `/mutate`
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", s.serve(s.validate))
+	mux.HandleFunc("/mutate", s.serve(s.mutate))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	return mux
+}
+
+type admitFunc func(req *admissionv1beta1.AdmissionRequest, service *v1.Service) *admissionv1beta1.AdmissionResponse
+
+func (s *Server) serve(admit admitFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		var response *admissionv1beta1.AdmissionResponse
+		service := &v1.Service{}
+		if err := json.Unmarshal(review.Request.Object.Raw, service); err != nil {
+			response = &admissionv1beta1.AdmissionResponse{
+				Result: &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusBadRequest, Message: err.Error()},
+			}
+		} else {
+			response = admit(review.Request, service)
+		}
+		response.UID = review.Request.UID
+
+		data, err := json.Marshal(&admissionv1beta1.AdmissionReview{TypeMeta: review.TypeMeta, Response: response})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			klog.Warningf("writing admission response is failed: %s", err)
+		}
+	}
+}
+
+// validate rejects services which CCM can't handle.
+// On update, only problems introduced by the update are rejected, so that existing services
+// (and annotations patched by CCM to them) aren't blocked by problems they already have.
+func (s *Server) validate(req *admissionv1beta1.AdmissionRequest, service *v1.Service) *admissionv1beta1.AdmissionResponse {
+	if !s.filter.IsManaged(service, loadBalancerClass(req)) {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	errs := sakura.ValidateService(service)
+	if req.Operation == admissionv1beta1.Update && len(errs) > 0 {
+		errs = introducedErrors(errs, req.OldObject.Raw)
+	}
+	if len(errs) == 0 {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	klog.V(2).Infof("service %s/%s is rejected: %s", req.Namespace, service.Name, errs.ToAggregate())
+	status := apierrors.NewInvalid(schema.GroupKind{Kind: "Service"}, service.Name, errs).ErrStatus
+	return &admissionv1beta1.AdmissionResponse{Result: &status}
+}
+
+// introducedErrors returns errors which the old object doesn't have
+func introducedErrors(errs field.ErrorList, oldRaw []byte) field.ErrorList {
+	old := &v1.Service{}
+	if err := json.Unmarshal(oldRaw, old); err != nil {
+		return errs
+	}
+	existing := map[string]bool{}
+	for _, err := range sakura.ValidateService(old) {
+		existing[err.Error()] = true
+	}
+	var introduced field.ErrorList
+	for _, err := range errs {
+		if !existing[err.Error()] {
+			introduced = append(introduced, err)
+		}
+	}
+	return introduced
+}
+
+// mutate injects default annotations to LoadBalancer type services on creation.
+// Existing services aren't changed, because some annotations can't be changed after LoadBalancer is created.
+func (s *Server) mutate(req *admissionv1beta1.AdmissionRequest, service *v1.Service) *admissionv1beta1.AdmissionResponse {
+	response := &admissionv1beta1.AdmissionResponse{Allowed: true}
+	if req.Operation != admissionv1beta1.Create || service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return response
+	}
+
+	defaults := map[string]string{}
+	if class := loadBalancerClass(req); class != "" {
+		defaults[sakura.AnnLoadBalancerClass] = class
+	}
+	if s.filter.IsManaged(service, loadBalancerClass(req)) {
+		for k, v := range s.defaults {
+			defaults[k] = v
+		}
+	}
+	patch := defaultAnnotationsPatch(service.Annotations, defaults)
+	if len(patch) == 0 {
+		return response
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionv1beta1.AdmissionResponse{
+			Result: &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusInternalServerError, Message: err.Error()},
+		}
+	}
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	response.Patch = data
+	response.PatchType = &patchType
+	return response
+}
+
+// loadBalancerClass returns spec.loadBalancerClass of the requested object.
+// It is read from raw object, because the Kubernetes API which CCM is built with doesn't have the field.
+func loadBalancerClass(req *admissionv1beta1.AdmissionRequest) string {
+	object := struct {
+		Spec struct {
+			LoadBalancerClass string `json:"loadBalancerClass"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		return ""
+	}
+	return object.Spec.LoadBalancerClass
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// defaultAnnotationsPatch returns JSON patch which adds defaults missing in annotations
+func defaultAnnotationsPatch(annotations, defaults map[string]string) []patchOperation {
+	var keys []string
+	for k := range defaults {
+		if _, ok := annotations[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	if annotations == nil {
+		values := map[string]string{}
+		for _, k := range keys {
+			values[k] = defaults[k]
+		}
+		return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: values}}
+	}
+	var patch []patchOperation
+	for _, k := range keys {
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(k), Value: defaults[k]})
+	}
+	return patch
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sacloud/sakura-cloud-controller-manager/sakura"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func review(t *testing.T, server *Server, path string, operation admissionv1beta1.Operation, service *v1.Service) *admissionv1beta1.AdmissionResponse {
+	raw, err := json.Marshal(service)
+	assert.NoError(t, err)
+	return reviewRaw(t, server, path, operation, raw)
+}
+
+func reviewRaw(t *testing.T, server *Server, path string, operation admissionv1beta1.Operation, raw []byte) *admissionv1beta1.AdmissionResponse {
+	return send(t, server, path, &admissionv1beta1.AdmissionRequest{
+		UID:       "request-uid",
+		Operation: operation,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+}
+
+func reviewUpdate(t *testing.T, server *Server, old, service *v1.Service) *admissionv1beta1.AdmissionResponse {
+	oldRaw, err := json.Marshal(old)
+	assert.NoError(t, err)
+	raw, err := json.Marshal(service)
+	assert.NoError(t, err)
+	return send(t, server, "/validate", &admissionv1beta1.AdmissionRequest{
+		UID:       "request-uid",
+		Operation: admissionv1beta1.Update,
+		Object:    runtime.RawExtension{Raw: raw},
+		OldObject: runtime.RawExtension{Raw: oldRaw},
+	})
+}
+
+func send(t *testing.T, server *Server, path string, req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	body, err := json.Marshal(&admissionv1beta1.AdmissionReview{Request: req})
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	result := &admissionv1beta1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), result))
+	assert.Equal(t, "request-uid", string(result.Response.UID))
+	return result.Response
+}
+
+func newService(annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: annotations},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+}
+
+func TestServer_validate(t *testing.T) {
+	server, err := NewServer(nil, nil)
+	assert.NoError(t, err)
+
+	response := review(t, server, "/validate", admissionv1beta1.Create, newService(nil))
+	assert.True(t, response.Allowed)
+
+	invalid := newService(map[string]string{
+		"k8s.usacloud.jp/load-balancer-plan":         "high",
+		"k8s.usacloud.jp/load-balancer-sorry-server": "sorry",
+	})
+	response = review(t, server, "/validate", admissionv1beta1.Update, invalid)
+	assert.False(t, response.Allowed)
+	assert.Equal(t, metav1.StatusReasonInvalid, response.Result.Reason)
+	assert.Len(t, response.Result.Details.Causes, 2)
+	assert.Equal(t, "metadata.annotations[k8s.usacloud.jp/load-balancer-plan]", response.Result.Details.Causes[0].Field)
+}
+
+func TestServer_validate_Update(t *testing.T) {
+	server, err := NewServer(nil, nil)
+	assert.NoError(t, err)
+
+	// created before the webhook is deployed
+	existing := newService(map[string]string{"k8s.usacloud.jp/load-balancer-plan": "high"})
+
+	t.Run("annotations patched by CCM", func(t *testing.T) {
+		patched := existing.DeepCopy()
+		patched.Annotations["status.k8s.usacloud.jp/load-balancer-id"] = "123456789012"
+		response := reviewUpdate(t, server, existing, patched)
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("new problem", func(t *testing.T) {
+		updated := existing.DeepCopy()
+		updated.Annotations["k8s.usacloud.jp/load-balancer-sorry-server"] = "sorry"
+		response := reviewUpdate(t, server, existing, updated)
+		assert.False(t, response.Allowed)
+		if assert.Len(t, response.Result.Details.Causes, 1, "existing problems must not be reported") {
+			assert.Equal(t, "metadata.annotations[k8s.usacloud.jp/load-balancer-sorry-server]", response.Result.Details.Causes[0].Field)
+		}
+	})
+}
+
+func TestServer_mutate(t *testing.T) {
+	server, err := NewServer(map[string]string{
+		"k8s.usacloud.jp/load-balancer-plan":                 "premium",
+		"k8s.usacloud.jp/load-balancer-exclude-ip-addresses": "192.2.0.10,192.2.0.11",
+	}, nil)
+	assert.NoError(t, err)
+
+	expects := []struct {
+		caseName    string
+		operation   admissionv1beta1.Operation
+		annotations map[string]string
+		patch       string
+	}{
+		{
+			caseName:  "no annotations",
+			operation: admissionv1beta1.Create,
+			patch:     `[{"op":"add","path":"/metadata/annotations","value":{"k8s.usacloud.jp/load-balancer-exclude-ip-addresses":"192.2.0.10,192.2.0.11","k8s.usacloud.jp/load-balancer-plan":"premium"}}]`,
+		},
+		{
+			caseName:    "specified by user",
+			operation:   admissionv1beta1.Create,
+			annotations: map[string]string{"k8s.usacloud.jp/load-balancer-plan": "standard"},
+			patch:       `[{"op":"add","path":"/metadata/annotations/k8s.usacloud.jp~1load-balancer-exclude-ip-addresses","value":"192.2.0.10,192.2.0.11"}]`,
+		},
+		{
+			caseName:  "update",
+			operation: admissionv1beta1.Update,
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.caseName, func(t *testing.T) {
+			response := review(t, server, "/mutate", expect.operation, newService(expect.annotations))
+			assert.True(t, response.Allowed)
+			assert.Equal(t, expect.patch, string(response.Patch))
+		})
+	}
+}
+
+func TestServer_LoadBalancerClass(t *testing.T) {
+	server, err := NewServer(map[string]string{"k8s.usacloud.jp/load-balancer-plan": "premium"},
+		&sakura.ServiceFilter{IgnoreServicesWithoutClass: true})
+	assert.NoError(t, err)
+
+	// UDP isn't supported by internet type
+	invalid := newService(nil)
+	invalid.Spec.Ports[0].Protocol = v1.ProtocolUDP
+	withClass := func(class string) []byte {
+		object := map[string]interface{}{}
+		data, err := json.Marshal(invalid)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, &object))
+		object["spec"].(map[string]interface{})["loadBalancerClass"] = class
+		data, err = json.Marshal(object)
+		assert.NoError(t, err)
+		return data
+	}
+
+	t.Run("without class", func(t *testing.T) {
+		response := review(t, server, "/validate", admissionv1beta1.Create, invalid)
+		assert.True(t, response.Allowed)
+		response = review(t, server, "/mutate", admissionv1beta1.Create, invalid)
+		assert.Empty(t, response.Patch)
+	})
+
+	t.Run("class of CCM", func(t *testing.T) {
+		response := reviewRaw(t, server, "/validate", admissionv1beta1.Create, withClass(sakura.DefaultLoadBalancerClass))
+		assert.False(t, response.Allowed)
+		response = reviewRaw(t, server, "/mutate", admissionv1beta1.Create, withClass(sakura.DefaultLoadBalancerClass))
+		assert.Equal(t, `[{"op":"add","path":"/metadata/annotations","value":{"k8s.usacloud.jp/load-balancer-class":"k8s.usacloud.jp/sakuracloud","k8s.usacloud.jp/load-balancer-plan":"premium"}}]`,
+			string(response.Patch))
+	})
+
+	t.Run("other class", func(t *testing.T) {
+		response := reviewRaw(t, server, "/validate", admissionv1beta1.Create, withClass("metallb.io/metallb"))
+		assert.True(t, response.Allowed)
+		response = reviewRaw(t, server, "/mutate", admissionv1beta1.Create, withClass("metallb.io/metallb"))
+		assert.Equal(t, `[{"op":"add","path":"/metadata/annotations","value":{"k8s.usacloud.jp/load-balancer-class":"metallb.io/metallb"}}]`,
+			string(response.Patch))
+	})
+}
+
+func TestNewServer_InvalidDefaults(t *testing.T) {
+	_, err := NewServer(map[string]string{"example.com/annotation": "value"}, nil)
+	assert.Error(t, err)
+}
+
+func TestParseAnnotations(t *testing.T) {
+	annotations, err := parseAnnotations([]string{"k8s.usacloud.jp/load-balancer-ha=true", "k8s.usacloud.jp/router-selector=a=b"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"k8s.usacloud.jp/load-balancer-ha": "true",
+		"k8s.usacloud.jp/router-selector":  "a=b",
+	}, annotations)
+
+	_, err = parseAnnotations([]string{"k8s.usacloud.jp/load-balancer-ha"})
+	assert.Error(t, err)
+}